@@ -81,6 +81,20 @@ func main() {
 		Gemini: config.Gemini,
 		Claude: config.Claude,
 		Redis:  config.Redis,
+
+		PushQueue: config.PushQueue,
+		Quota:     config.Quota,
+		Usage:     config.Usage,
+		History:   config.History,
+		Admins:    config.Admins,
+
+		RequestQueue: config.RequestQueue,
+		Tool:         config.Tool,
+		Knowledge:    config.Knowledge,
+		Image:        config.Image,
+		Voice:        config.Voice,
+
+		DepartmentRoute: config.DepartmentRoute,
 	})
 
 	ws, err := service.NewWeComServer(&config.WeCom)
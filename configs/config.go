@@ -1,14 +1,26 @@
 package configs
 
 import (
+	"github.com/walkerdu/wecom-backend/internal/pkg/middleware"
 	"github.com/walkerdu/wecom-backend/pkg/chatbot"
 	"github.com/walkerdu/wecom-backend/pkg/wecom"
 )
 
 // 企业微信配置
 type WeComConfig struct {
-	AgentConfig wecom.AgentConfig `json:"agent_config"`
-	Addr        string            `json:"addr"`
+	AgentConfig wecom.AgentConfig      `json:"agent_config"`
+	Addr        string                 `json:"addr"`
+	WebhookBot  wecom.WebhookBotConfig `json:"webhook_bot"` // 群机器人，开启publish后聊天回复推送到群机器人所在的群
+	SmartBot    wecom.SmartBotConfig   `json:"smart_bot"`   // 智能机器人，开启后在/smartbot接收回调，流式回复
+	Auth        middleware.AuthConfig  `json:"auth"`        // 访问控制，按照用户、部门和标签的黑白名单鉴权
+	AdminToken  string                 `json:"admin_token"` // 管理接口的鉴权token，为空时不开启/admin/下的管理接口
+	Tools       WeComToolConfig        `json:"tools"`       // 企业微信的内置工具，需要同时开启tool配置
+}
+
+// 企业微信内置工具的配置，有副作用的工具需要用户在确认卡片中点击确认后才执行
+type WeComToolConfig struct {
+	Enable bool     `json:"enable"`
+	Tools  []string `json:"tools"` // 开启的工具名称，为空时开启全部
 }
 
 type Config struct {
@@ -17,4 +29,18 @@ type Config struct {
 	Claude chatbot.ClaudeConfig `json:"claude"`
 	WeCom  WeComConfig          `json:"we_com"`
 	Redis  chatbot.RedisConfig  `json:"redis"`
+
+	PushQueue chatbot.PushQueueConfig `json:"push_queue"`
+	Quota     chatbot.QuotaConfig     `json:"quota"`
+	Usage     chatbot.UsageConfig     `json:"usage"`
+	History   chatbot.HistoryConfig   `json:"history"`
+	Admins    []string                `json:"admins"` // 管理员的userid列表
+
+	RequestQueue chatbot.RequestQueueConfig `json:"request_queue"`
+	Tool         chatbot.ToolConfig         `json:"tool"`
+	Knowledge    chatbot.KnowledgeConfig    `json:"knowledge"`
+	Image        chatbot.ImageConfig        `json:"image"`
+	Voice        chatbot.VoiceConfig        `json:"voice"`
+
+	DepartmentRoute map[string]string `json:"department_route"` // 部门id或者部门名称 -> AI名称
 }
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"log"
+
+	"github.com/walkerdu/wecom-backend/pkg/chatbot"
+	"github.com/walkerdu/wecom-backend/pkg/wecom"
+)
+
+func init() {
+	handler := &EventMessageHandler{}
+
+	HandlerInst().RegisterLogicHandler(wecom.MessageTypeEvent, handler)
+}
+
+type EventMessageHandler struct {
+}
+
+func (e *EventMessageHandler) GetHandlerType() wecom.MessageType {
+	return wecom.MessageTypeEvent
+}
+
+// HandleMessage 目前只处理确认卡片的按钮点击事件，其他事件回复空包
+func (e *EventMessageHandler) HandleMessage(msg wecom.MessageIF) (wecom.MessageIF, error) {
+	eventMsg := msg.(*wecom.EventMessageReq)
+
+	rsp := &wecom.TextMessageRsp{}
+
+	switch eventMsg.Event {
+	case wecom.EventTypeTemplateCard:
+		rsp.Content = chatbot.MustChatbot().HandleConfirmEvent(eventMsg.FromUserName, eventMsg.TaskId, eventMsg.EventKey, eventMsg.ResponseCode)
+	default:
+		log.Printf("[DEBUG][HandleMessage] ignore event, event=%s, FromUserName=%s", eventMsg.Event, eventMsg.FromUserName)
+	}
+
+	return rsp, nil
+}
@@ -8,6 +8,7 @@ package handler
 import (
 	"sync"
 
+	"github.com/walkerdu/wecom-backend/internal/pkg/middleware"
 	"github.com/walkerdu/wecom-backend/pkg/wecom"
 )
 
@@ -21,7 +22,7 @@ type LogicHandler interface {
 
 // Handler 是所有HTTP处理器的基础结构体
 type Handler struct {
-	//middleware.AuthMiddleware
+	authMiddleware  *middleware.AuthMiddleware
 	logicHandlerMap map[wecom.MessageType]LogicHandler
 }
 
@@ -43,3 +44,18 @@ func (h *Handler) RegisterLogicHandler(msgType wecom.MessageType, logicHandler L
 func (h *Handler) GetLogicHandlerMap() map[wecom.MessageType]LogicHandler {
 	return h.logicHandlerMap
 }
+
+// SetAuthMiddleware 设置访问控制中间件
+func (h *Handler) SetAuthMiddleware(authMiddleware *middleware.AuthMiddleware) {
+	h.authMiddleware = authMiddleware
+}
+
+// Wrap 返回经过中间件处理的LogicHandler.HandleMessage
+func (h *Handler) Wrap(logicHandler LogicHandler) middleware.HandleFunc {
+	handleFunc := middleware.HandleFunc(logicHandler.HandleMessage)
+	if h.authMiddleware != nil {
+		handleFunc = h.authMiddleware.Wrap(handleFunc)
+	}
+
+	return handleFunc
+}
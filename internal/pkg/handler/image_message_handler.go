@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"github.com/walkerdu/wecom-backend/pkg/chatbot"
+	"github.com/walkerdu/wecom-backend/pkg/wecom"
+)
+
+func init() {
+	handler := &ImageMessageHandler{}
+
+	HandlerInst().RegisterLogicHandler(wecom.MessageTypeImage, handler)
+}
+
+type ImageMessageHandler struct {
+}
+
+func (i *ImageMessageHandler) GetHandlerType() wecom.MessageType {
+	return wecom.MessageTypeImage
+}
+
+// HandleMessage 保存用户发送的图片，用于之后通过/draw编辑图片，没有开启图片生成时回复空包
+func (i *ImageMessageHandler) HandleMessage(msg wecom.MessageIF) (wecom.MessageIF, error) {
+	imageMsg := msg.(*wecom.ImageMessageReq)
+
+	return &wecom.TextMessageRsp{
+		Content: chatbot.MustChatbot().HandleImageMessage(imageMsg.FromUserName, imageMsg.MediaId),
+	}, nil
+}
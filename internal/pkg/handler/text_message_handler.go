@@ -7,8 +7,6 @@ import (
 	"github.com/walkerdu/wecom-backend/pkg/wecom"
 )
 
-const WeChatTimeOutSecs = 5
-
 func init() {
 	handler := &TextMessageHandler{}
 
@@ -25,14 +23,16 @@ func (t *TextMessageHandler) GetHandlerType() wecom.MessageType {
 func (t *TextMessageHandler) HandleMessage(msg wecom.MessageIF) (wecom.MessageIF, error) {
 	textMsg := msg.(*wecom.TextMessageReq)
 
-	chatRsp, err := chatbot.MustChatbot().GetResponse(textMsg.FromUserName, textMsg.Content)
+	chatRsp, pending, err := chatbot.MustChatbot().GetResponse(textMsg.FromUserName, textMsg.Content)
 	if err != nil {
 		log.Printf("[ERROR][HandleMessage] chatbot.GetResponse failed, err=%s", err)
 		chatRsp = "chatbot something wrong, errMsg:" + err.Error()
 	}
 
+	// 异步生成的回包由chatbot推送，占位回复只用于被动回复
 	textMsgRsp := wecom.TextMessageRsp{
-		Content: chatRsp,
+		Content:     chatRsp,
+		Placeholder: pending,
 	}
 
 	return &textMsgRsp, nil
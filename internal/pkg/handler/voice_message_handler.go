@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"log"
+
+	"github.com/walkerdu/wecom-backend/pkg/chatbot"
+	"github.com/walkerdu/wecom-backend/pkg/wecom"
+)
+
+func init() {
+	handler := &VoiceMessageHandler{}
+
+	HandlerInst().RegisterLogicHandler(wecom.MessageTypeVoice, handler)
+}
+
+type VoiceMessageHandler struct {
+}
+
+func (v *VoiceMessageHandler) GetHandlerType() wecom.MessageType {
+	return wecom.MessageTypeVoice
+}
+
+// HandleMessage 先回复已收到，识别结果和回答之后推送，回答按照用户的语音回复模式同时推送语音
+func (v *VoiceMessageHandler) HandleMessage(msg wecom.MessageIF) (wecom.MessageIF, error) {
+	voiceMsg := msg.(*wecom.VoiceMessageReq)
+
+	chatRsp, pending, err := chatbot.MustChatbot().GetVoiceResponse(voiceMsg.FromUserName, voiceMsg.MediaId)
+	if err != nil {
+		log.Printf("[ERROR][HandleMessage] chatbot.GetVoiceResponse failed, err=%s", err)
+		chatRsp = "chatbot something wrong, errMsg:" + err.Error()
+	}
+
+	return &wecom.TextMessageRsp{
+		Content:     chatRsp,
+		Placeholder: pending,
+	}, nil
+}
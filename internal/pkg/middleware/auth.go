@@ -0,0 +1,226 @@
+// internal/middleware/auth.go
+// 访问控制中间件，在业务LogicHandler之前按照配置的用户、部门和标签的黑白名单进行鉴权
+// 部门和标签通过企业微信通讯录解析，白名单的规则可以限制可以使用的AI和模型
+
+package middleware
+
+import (
+	"log"
+	"slices"
+	"strconv"
+
+	"github.com/walkerdu/wecom-backend/pkg/wecom"
+)
+
+const defaultDenyMessage = "抱歉，你暂时没有使用智能助手的权限，如有需要请联系管理员开通~"
+
+// 访问控制的名单，部门和标签可以配置id或者名称
+type AuthList struct {
+	Users       []string `json:"users"`
+	Departments []string `json:"departments"`
+	Tags        []string `json:"tags"`
+}
+
+// 白名单规则，Models为命中规则的用户可以使用的AI名称或者模型名称，为空表示不限制
+// Contacts为命中规则的用户通过工具可以查找和发送消息的同事，为空表示不限制
+type AuthRule struct {
+	AuthList
+	Models   []string `json:"models"`
+	Contacts AuthList `json:"contacts"`
+}
+
+// 访问控制配置，命中黑名单拒绝访问，白名单为空时不限制，否则只允许命中白名单的用户访问
+type AuthConfig struct {
+	Enable      bool       `json:"enable"`
+	DenyMessage string     `json:"deny_message"` // 拒绝访问时回复的消息
+	Deny        AuthList   `json:"deny"`
+	Allow       []AuthRule `json:"allow"`
+}
+
+// 消息处理的函数，和LogicHandler.HandleMessage一致
+type HandleFunc func(wecom.MessageIF) (wecom.MessageIF, error)
+
+type AuthMiddleware struct {
+	config          AuthConfig
+	profileProvider func(string) (*wecom.UserProfile, error)
+}
+
+// NewAuthMiddleware 返回一个新的访问控制中间件，profileProvider用于获取用户的部门和标签
+func NewAuthMiddleware(config *AuthConfig, profileProvider func(string) (*wecom.UserProfile, error)) *AuthMiddleware {
+	m := &AuthMiddleware{
+		config:          *config,
+		profileProvider: profileProvider,
+	}
+
+	if m.config.DenyMessage == "" {
+		m.config.DenyMessage = defaultDenyMessage
+	}
+
+	return m
+}
+
+// 带有发送者的请求消息
+type userMessage interface {
+	GetFromUserName() string
+}
+
+// Wrap 在消息处理前鉴权，没有权限时直接回复拒绝访问的消息
+func (m *AuthMiddleware) Wrap(next HandleFunc) HandleFunc {
+	return func(msg wecom.MessageIF) (wecom.MessageIF, error) {
+		userMsg, ok := msg.(userMessage)
+		if !ok || m.Allow(userMsg.GetFromUserName()) {
+			return next(msg)
+		}
+
+		return &wecom.TextMessageRsp{
+			Content: m.config.DenyMessage,
+		}, nil
+	}
+}
+
+// WrapSmartBot 智能机器人的消息处理前鉴权
+func (m *AuthMiddleware) WrapSmartBot(next wecom.SmartBotMessageHandler) wecom.SmartBotMessageHandler {
+	return func(userID, chatID, content string) (string, bool, error) {
+		if !m.Allow(userID) {
+			return m.config.DenyMessage, true, nil
+		}
+
+		return next(userID, chatID, content)
+	}
+}
+
+// Allow 判断用户是否有访问权限
+func (m *AuthMiddleware) Allow(userID string) bool {
+	if !m.config.Enable {
+		return true
+	}
+
+	profile := m.getProfile(userID)
+
+	if m.match(&m.config.Deny, userID, profile) {
+		log.Printf("[INFO][AuthMiddleware] user denied by deny list, userID=%s", userID)
+		return false
+	}
+
+	// 获取不到用户资料时无法判断是否命中部门和标签的黑名单，拒绝访问，避免通讯录接口失败时绕过黑名单
+	if profile == nil && (len(m.config.Deny.Departments) > 0 || len(m.config.Deny.Tags) > 0) {
+		log.Printf("[WARN][AuthMiddleware] user denied since profile unknown, userID=%s", userID)
+		return false
+	}
+
+	if len(m.config.Allow) == 0 {
+		return true
+	}
+
+	for i := range m.config.Allow {
+		if m.match(&m.config.Allow[i].AuthList, userID, profile) {
+			return true
+		}
+	}
+
+	log.Printf("[INFO][AuthMiddleware] user not in allow list, userID=%s", userID)
+
+	return false
+}
+
+// AllowModel 判断用户是否可以使用该AI的模型，命中的任意一条白名单规则允许即可
+func (m *AuthMiddleware) AllowModel(userID, aiName, model string) bool {
+	if !m.config.Enable || len(m.config.Allow) == 0 {
+		return true
+	}
+
+	profile := m.getProfile(userID)
+
+	for i := range m.config.Allow {
+		rule := &m.config.Allow[i]
+		if !m.match(&rule.AuthList, userID, profile) {
+			continue
+		}
+
+		if len(rule.Models) == 0 || slices.Contains(rule.Models, aiName) || slices.Contains(rule.Models, model) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowContact 判断用户是否可以通过工具查找同事和给同事发送消息，命中的任意一条白名单规则允许即可
+func (m *AuthMiddleware) AllowContact(userID, contactID string) bool {
+	if !m.config.Enable || len(m.config.Allow) == 0 {
+		return true
+	}
+
+	profile := m.getProfile(userID)
+
+	var contactProfile *wecom.UserProfile
+	contactLoaded := false
+	for i := range m.config.Allow {
+		rule := &m.config.Allow[i]
+		if !m.match(&rule.AuthList, userID, profile) {
+			continue
+		}
+
+		contacts := &rule.Contacts
+		if len(contacts.Users) == 0 && len(contacts.Departments) == 0 && len(contacts.Tags) == 0 {
+			return true
+		}
+
+		if !contactLoaded {
+			contactProfile, contactLoaded = m.getProfile(contactID), true
+		}
+
+		if m.match(contacts, contactID, contactProfile) {
+			return true
+		}
+	}
+
+	log.Printf("[INFO][AuthMiddleware] contact not visible, userID=%s, contactID=%s", userID, contactID)
+
+	return false
+}
+
+func (m *AuthMiddleware) getProfile(userID string) *wecom.UserProfile {
+	if m.profileProvider == nil {
+		return nil
+	}
+
+	profile, err := m.profileProvider(userID)
+	if err != nil {
+		log.Printf("[WARN][AuthMiddleware] get user profile failed, userID=%s, err=%s", userID, err)
+		return nil
+	}
+
+	return profile
+}
+
+// match 判断用户是否命中名单，获取不到用户资料时只按照userid匹配，黑名单需要调用方额外处理
+func (m *AuthMiddleware) match(list *AuthList, userID string, profile *wecom.UserProfile) bool {
+	if slices.Contains(list.Users, userID) {
+		return true
+	}
+
+	if profile == nil {
+		return false
+	}
+
+	return matchAny(list.Departments, profile.DepartmentIds, profile.Departments) ||
+		matchAny(list.Tags, profile.TagIds, profile.Tags)
+}
+
+// 名单中配置的id或者名称，命中其中一个即可
+func matchAny(list []string, ids []int, names []string) bool {
+	for _, id := range ids {
+		if slices.Contains(list, strconv.Itoa(id)) {
+			return true
+		}
+	}
+
+	for _, name := range names {
+		if name != "" && slices.Contains(list, name) {
+			return true
+		}
+	}
+
+	return false
+}
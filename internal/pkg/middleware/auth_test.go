@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/walkerdu/wecom-backend/pkg/wecom"
+)
+
+var testProfiles = map[string]*wecom.UserProfile{
+	"alice": {UserId: "alice", DepartmentIds: []int{1}, Departments: []string{"平台部"}},
+	"bob":   {UserId: "bob", DepartmentIds: []int{2}, Departments: []string{"设计部"}, TagIds: []int{7}, Tags: []string{"外包"}},
+	"carol": {UserId: "carol", DepartmentIds: []int{2}, Departments: []string{"设计部"}},
+}
+
+func newTestAuthMiddleware(config *AuthConfig) *AuthMiddleware {
+	return NewAuthMiddleware(config, func(userID string) (*wecom.UserProfile, error) {
+		if profile, exist := testProfiles[userID]; exist {
+			return profile, nil
+		}
+		return nil, errors.New("user not found")
+	})
+}
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AuthConfig
+		userID string
+		want   bool
+	}{
+		{"disabled", AuthConfig{Deny: AuthList{Users: []string{"alice"}}}, "alice", true},
+		{"no rules", AuthConfig{Enable: true}, "dave", true},
+		{"deny user", AuthConfig{Enable: true, Deny: AuthList{Users: []string{"alice"}}}, "alice", false},
+		{"deny tag name", AuthConfig{Enable: true, Deny: AuthList{Tags: []string{"外包"}}}, "bob", false},
+		{"deny tag id", AuthConfig{Enable: true, Deny: AuthList{Tags: []string{"7"}}}, "bob", false},
+		{"deny tag other user", AuthConfig{Enable: true, Deny: AuthList{Tags: []string{"7"}}}, "carol", true},
+		{"deny department unknown profile", AuthConfig{Enable: true, Deny: AuthList{Departments: []string{"设计部"}}}, "dave", false},
+		{"allow department id", AuthConfig{Enable: true, Allow: []AuthRule{{AuthList: AuthList{Departments: []string{"1"}}}}}, "alice", true},
+		{"not in allow list", AuthConfig{Enable: true, Allow: []AuthRule{{AuthList: AuthList{Departments: []string{"平台部"}}}}}, "carol", false},
+		{"deny overrides allow", AuthConfig{
+			Enable: true,
+			Deny:   AuthList{Tags: []string{"外包"}},
+			Allow:  []AuthRule{{AuthList: AuthList{Departments: []string{"设计部"}}}},
+		}, "bob", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newTestAuthMiddleware(&tt.config).Allow(tt.userID); got != tt.want {
+				t.Fatalf("Allow(%s) = %v, want %v", tt.userID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowModel(t *testing.T) {
+	config := &AuthConfig{
+		Enable: true,
+		Allow: []AuthRule{
+			{AuthList: AuthList{Departments: []string{"平台部"}}},
+			{AuthList: AuthList{Departments: []string{"设计部"}}, Models: []string{"gemini", "gpt-4o-mini"}},
+		},
+	}
+	m := newTestAuthMiddleware(config)
+
+	tests := []struct {
+		name   string
+		userID string
+		aiName string
+		model  string
+		want   bool
+	}{
+		{"unrestricted rule", "alice", "openai", "gpt-4o", true},
+		{"ai name allowed", "carol", "gemini", "gemini-1.5-pro", true},
+		{"model allowed", "carol", "openai", "gpt-4o-mini", true},
+		{"model denied", "carol", "openai", "gpt-4o", false},
+		{"no matching rule", "dave", "gemini", "gemini-1.5-pro", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.AllowModel(tt.userID, tt.aiName, tt.model); got != tt.want {
+				t.Fatalf("AllowModel(%s, %s, %s) = %v, want %v", tt.userID, tt.aiName, tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	m := newTestAuthMiddleware(&AuthConfig{Enable: true, DenyMessage: "denied", Deny: AuthList{Users: []string{"bob"}}})
+
+	handler := m.Wrap(func(msg wecom.MessageIF) (wecom.MessageIF, error) {
+		return &wecom.TextMessageRsp{Content: "ok"}, nil
+	})
+
+	tests := []struct {
+		userID string
+		want   string
+	}{
+		{"alice", "ok"},
+		{"bob", "denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.userID, func(t *testing.T) {
+			msg := &wecom.TextMessageReq{}
+			msg.FromUserName = tt.userID
+
+			rsp, err := handler(msg)
+			if err != nil {
+				t.Fatalf("handler failed, err=%s", err)
+			}
+
+			if content := rsp.(*wecom.TextMessageRsp).Content; content != tt.want {
+				t.Fatalf("content = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/walkerdu/wecom-backend/pkg/chatbot"
+)
+
+// 管理接口，请求需要携带Authorization: Bearer <admin_token>
+type adminHandler struct {
+	token string
+	mux   *http.ServeMux
+}
+
+func newAdminHandler(token string) *adminHandler {
+	h := &adminHandler{
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/admin/usage.csv", h.handleUsageExport)
+	h.mux.HandleFunc("/admin/forget", h.handleForget)
+
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		http.Error(wr, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("[INFO]adminHandler|recv request URL:%s, Method:%s", req.URL, req.Method)
+
+	h.mux.ServeHTTP(wr, req)
+}
+
+// 删除用户的所有数据，包括聊天历史、用量明细和缓存，POST或者DELETE /admin/forget?userid=xxx
+func (h *adminHandler) handleForget(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		http.Error(wr, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := req.URL.Query().Get("userid")
+	if userID == "" {
+		http.Error(wr, "userid is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := chatbot.MustChatbot().ForgetUser(userID); err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Write([]byte("ok"))
+}
+
+// 导出用量报表，group_by为user、department、day或者model，days为最近的天数
+func (h *adminHandler) handleUsageExport(wr http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	groupBy := query.Get("group_by")
+	if groupBy == "" {
+		groupBy = chatbot.UsageGroupByUser
+	}
+
+	days, _ := strconv.Atoi(query.Get("days"))
+	if days <= 0 {
+		days = 30
+	}
+
+	data, err := chatbot.MustChatbot().ExportUsageCSV(groupBy, days)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	wr.Header().Set("Content-Disposition", "attachment; filename=usage-"+groupBy+".csv")
+	wr.Write(data)
+}
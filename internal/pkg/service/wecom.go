@@ -8,13 +8,17 @@ import (
 
 	"github.com/walkerdu/wecom-backend/configs"
 	"github.com/walkerdu/wecom-backend/internal/pkg/handler"
+	"github.com/walkerdu/wecom-backend/internal/pkg/middleware"
 	"github.com/walkerdu/wecom-backend/pkg/chatbot"
 	"github.com/walkerdu/wecom-backend/pkg/wecom"
 )
 
 type WeComServer struct {
-	httpSvr *http.Server
-	wc      *wecom.WeCom
+	httpSvr    *http.Server
+	wc         *wecom.WeCom
+	webhookBot *wecom.WebhookBot
+	smartBot   *wecom.SmartBot
+	auth       *middleware.AuthMiddleware
 }
 
 func NewWeComServer(config *configs.WeComConfig) (*WeComServer, error) {
@@ -25,9 +29,39 @@ func NewWeComServer(config *configs.WeComConfig) (*WeComServer, error) {
 	// 初始化微信公众号API
 	svr.wc = wecom.NewWeCom(&config.AgentConfig)
 
+	// 素材的Redis缓存复用Chatbot的Redis客户端
+	if config.AgentConfig.Media.CacheType == wecom.MediaCacheTypeRedis {
+		if rdb := chatbot.MustChatbot().RedisClient(); rdb != nil {
+			svr.wc.SetMediaCache(wecom.NewRedisMediaCache(rdb, config.AgentConfig.Media.GetCacheTTL()))
+		} else {
+			log.Printf("[WARN] media redis cache need redis enable")
+		}
+	}
+
+	// 开启Redis时回调消息排重使用Redis，保证进程重启和多实例部署时依然有效
+	if rdb := chatbot.MustChatbot().RedisClient(); rdb != nil {
+		svr.wc.SetIdempotencyStore(wecom.NewRedisIdempotencyStore(rdb, config.AgentConfig.GetDedupTTL()))
+	}
+
+	// 访问控制，部门和标签从通讯录解析
+	svr.auth = middleware.NewAuthMiddleware(&config.Auth, svr.wc.GetUserProfile)
+	handler.HandlerInst().SetAuthMiddleware(svr.auth)
+	chatbot.MustChatbot().RegisterModelAuthorizer(svr.auth.AllowModel)
+
 	mux := http.NewServeMux()
 	mux.Handle("/wecom", svr.wc)
 
+	if config.AdminToken != "" {
+		mux.Handle("/admin/", newAdminHandler(config.AdminToken))
+	}
+
+	// 智能机器人的回调，流式回复的内容从Chatbot生成中的cache拉取
+	if config.SmartBot.Enable {
+		svr.smartBot = wecom.NewSmartBot(&config.SmartBot)
+		svr.smartBot.RegisterHandler(svr.auth.WrapSmartBot(chatbot.MustChatbot().GetStreamResponse), chatbot.MustChatbot().GetStreamContent)
+		mux.Handle("/smartbot", svr.smartBot)
+	}
+
 	svr.httpSvr = &http.Server{
 		Addr:    config.Addr,
 		Handler: mux,
@@ -35,15 +69,95 @@ func NewWeComServer(config *configs.WeComConfig) (*WeComServer, error) {
 
 	svr.InitHandler()
 
-	// 注册聊天消息的异步推送回调
-	chatbot.MustChatbot().RegsiterMessagePublish(svr.wc.PushTextMessage)
+	// 注册聊天消息的异步推送回调，群机器人开启publish时推送到群机器人所在的群
+	// 群机器人消息没有msgid，/undo只删除上下文，不能撤回消息
+	if config.WebhookBot.Enable && config.WebhookBot.Publish {
+		svr.webhookBot = wecom.NewWebhookBot(&config.WebhookBot)
+		chatbot.MustChatbot().RegsiterMessagePublish(svr.webhookBot.PushTextMessage)
+	} else {
+		chatbot.MustChatbot().RegsiterMessagePublish(svr.wc.PushTextMessage)
+	}
+	chatbot.MustChatbot().RegisterMessageRecall(svr.wc.RecallMessage)
+	chatbot.MustChatbot().RegisterGroupChat(svr.wc.PushAppChatTextMessage, svr.wc.CreateAppChat, svr.wc.GetAppChatMembers)
+	chatbot.MustChatbot().RegisterUserProfile(svr.getUserProfile)
+	chatbot.MustChatbot().RegisterUserForgetter(svr.wc.ForgetUser)
+	chatbot.MustChatbot().RegisterFilePublish(svr.pushFile)
+	chatbot.MustChatbot().RegisterImagePublish(svr.pushImage)
+	chatbot.MustChatbot().RegisterImageLoader(svr.loadMedia)
+	chatbot.MustChatbot().RegisterVoicePublish(svr.pushVoice)
+	chatbot.MustChatbot().RegisterVoiceLoader(svr.loadMedia)
+	chatbot.MustChatbot().RegisterConfirmCard(svr.pushConfirmCard, svr.wc.UpdateTemplateCardButton)
+
+	// 企业微信的内置工具，需要同时开启tool配置才会被AI调用
+	svr.registerTools(&config.Tools)
 
 	return svr, nil
 }
 
+// 上传临时素材后推送文件消息给用户
+func (svr *WeComServer) pushFile(userID, fileName string, data []byte) error {
+	mediaId, err := svr.wc.UploadTemporaryMedia(wecom.MessageTypeFile, fileName, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = svr.wc.PushFileMessage(userID, mediaId)
+	return err
+}
+
+// 上传图片临时素材后推送图片消息给用户
+func (svr *WeComServer) pushImage(userID, fileName string, data []byte) error {
+	mediaId, err := svr.wc.UploadTemporaryMedia(wecom.MessageTypeImage, fileName, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = svr.wc.PushImageMessage(userID, mediaId)
+	return err
+}
+
+// 上传语音临时素材后推送语音消息给用户
+func (svr *WeComServer) pushVoice(userID, fileName string, data []byte) error {
+	mediaId, err := svr.wc.UploadTemporaryMedia(wecom.MessageTypeVoice, fileName, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = svr.wc.PushVoiceMessage(userID, mediaId)
+	return err
+}
+
+// 下载用户发送的图片和语音
+func (svr *WeComServer) loadMedia(mediaId string) ([]byte, error) {
+	media, err := svr.wc.GetTemporaryMedia(mediaId)
+	if err != nil {
+		return nil, err
+	}
+
+	return media.Data, nil
+}
+
+// 从通讯录获取用户资料，转换为Chatbot的用户资料
+func (svr *WeComServer) getUserProfile(userID string) (*chatbot.UserProfile, error) {
+	profile, err := svr.wc.GetUserProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chatbot.UserProfile{
+		Name:           profile.Name,
+		Position:       profile.Position,
+		Departments:    profile.Departments,
+		DepartmentIds:  profile.DepartmentIds,
+		MainDepartment: profile.MainDepartment,
+		Tags:           profile.Tags,
+		TagIds:         profile.TagIds,
+	}, nil
+}
+
 func (svr *WeComServer) InitHandler() error {
-	for msgType, handler := range handler.HandlerInst().GetLogicHandlerMap() {
-		svr.wc.RegisterLogicMsgHandler(msgType, handler.HandleMessage)
+	for msgType, logicHandler := range handler.HandlerInst().GetLogicHandlerMap() {
+		svr.wc.RegisterLogicMsgHandler(msgType, wecom.LogicMessageHandler(handler.HandlerInst().Wrap(logicHandler)))
 	}
 
 	return nil
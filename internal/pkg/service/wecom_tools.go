@@ -0,0 +1,399 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/walkerdu/wecom-backend/configs"
+	"github.com/walkerdu/wecom-backend/pkg/chatbot"
+	"github.com/walkerdu/wecom-backend/pkg/wecom"
+)
+
+// 企业微信的内置工具，工具以提问人的身份执行，有副作用的工具需要提问人在确认卡片中点击确认后才执行
+// 工具执行前按照访问控制的配置重新鉴权，查找和发送消息的同事限制在提问人可见的范围内
+
+const (
+	toolLookupColleague = "lookup_colleague"
+	toolSendMessage     = "send_message"
+	toolCreateSchedule  = "create_schedule"
+	toolCreateTodo      = "create_todo"
+
+	toolTimeLayout         = "2006-01-02 15:04"
+	maxLookupResults       = 5
+	defaultScheduleMinutes = 60
+	todoScheduleMinutes    = 30
+	scheduleRemindSecs     = 900 // 日程开始前15分钟提醒
+	maxCardSubTitleLen     = 160 // 卡片二级文本建议的最大长度
+)
+
+var (
+	errToolDenied        = errors.New("the user is not allowed to use the tool")
+	errContactNotVisible = errors.New("the colleague is not visible to the user")
+)
+
+// registerTools 按照配置注册企业微信的内置工具
+func (svr *WeComServer) registerTools(config *configs.WeComToolConfig) {
+	if !config.Enable {
+		return
+	}
+
+	tools := []*chatbot.Tool{
+		{
+			Name:        toolLookupColleague,
+			Description: "在企业通讯录中按照姓名或者userid查找同事，返回姓名、userid、职务和部门。发消息、创建日程前需要先用它获取同事的userid",
+			Parameters: &chatbot.ToolSchema{
+				Type: chatbot.ToolTypeObject,
+				Properties: map[string]*chatbot.ToolSchema{
+					"keyword": {Type: chatbot.ToolTypeString, Description: "同事的姓名或者userid，姓名支持部分匹配"},
+				},
+				Required: []string{"keyword"},
+			},
+			Handler: svr.authorizeTool(svr.lookupColleague),
+		},
+		{
+			Name:        toolSendMessage,
+			Description: "以用户的名义给同事或者群聊发送一条文本消息，发送前会推送确认卡片，用户确认后才会发送",
+			Parameters: &chatbot.ToolSchema{
+				Type: chatbot.ToolTypeObject,
+				Properties: map[string]*chatbot.ToolSchema{
+					"user_id": {Type: chatbot.ToolTypeString, Description: "接收消息的同事的userid，和chat_id二选一"},
+					"chat_id": {Type: chatbot.ToolTypeString, Description: "接收消息的群聊id，和user_id二选一，在群聊中提问时都不填表示发送到当前群聊"},
+					"content": {Type: chatbot.ToolTypeString, Description: "消息内容"},
+				},
+				Required: []string{"content"},
+			},
+			Handler: svr.authorizeTool(svr.sendMessage),
+		},
+		{
+			Name:        toolCreateSchedule,
+			Description: "为用户创建日程，用户为组织者，可以邀请同事参加，创建前会推送确认卡片，用户确认后才会创建",
+			Parameters: &chatbot.ToolSchema{
+				Type: chatbot.ToolTypeObject,
+				Properties: map[string]*chatbot.ToolSchema{
+					"summary":     {Type: chatbot.ToolTypeString, Description: "日程标题"},
+					"start_time":  {Type: chatbot.ToolTypeString, Description: "开始时间，格式为YYYY-MM-DD HH:MM"},
+					"end_time":    {Type: chatbot.ToolTypeString, Description: "结束时间，格式为YYYY-MM-DD HH:MM，不填时默认持续1小时"},
+					"attendees":   {Type: chatbot.ToolTypeArray, Description: "参与的同事的userid列表，不包含用户自己", Items: &chatbot.ToolSchema{Type: chatbot.ToolTypeString}},
+					"location":    {Type: chatbot.ToolTypeString, Description: "地点"},
+					"description": {Type: chatbot.ToolTypeString, Description: "日程描述"},
+				},
+				Required: []string{"summary", "start_time"},
+			},
+			Handler: svr.authorizeTool(svr.createSchedule),
+		},
+		{
+			Name:        toolCreateTodo,
+			Description: "为用户创建一条待办，到期前提醒用户，创建前会推送确认卡片，用户确认后才会创建",
+			Parameters: &chatbot.ToolSchema{
+				Type: chatbot.ToolTypeObject,
+				Properties: map[string]*chatbot.ToolSchema{
+					"content":  {Type: chatbot.ToolTypeString, Description: "待办的内容"},
+					"due_time": {Type: chatbot.ToolTypeString, Description: "截止时间，格式为YYYY-MM-DD HH:MM"},
+				},
+				Required: []string{"content", "due_time"},
+			},
+			Handler: svr.authorizeTool(svr.createTodo),
+		},
+	}
+
+	for _, tool := range tools {
+		if len(config.Tools) > 0 && !slices.Contains(config.Tools, tool.Name) {
+			continue
+		}
+
+		if err := chatbot.MustChatbot().RegisterTool(tool); err != nil {
+			log.Printf("[ERROR]registerTools|RegisterTool failed, name:%s, err:%s", tool.Name, err)
+		}
+	}
+}
+
+// authorizeTool 工具执行前检查提问人的访问权限，群聊和智能机器人中的提问同样需要鉴权
+func (svr *WeComServer) authorizeTool(handler chatbot.ToolHandler) chatbot.ToolHandler {
+	return func(ctx *chatbot.ToolContext, args json.RawMessage) (string, error) {
+		if svr.auth != nil && !svr.auth.Allow(ctx.UserID) {
+			return "", errToolDenied
+		}
+
+		return handler(ctx, args)
+	}
+}
+
+// 提问人是否可以通过工具查找同事和给同事发送消息
+func (svr *WeComServer) contactVisible(userID, contactID string) bool {
+	return svr.auth == nil || svr.auth.AllowContact(userID, contactID)
+}
+
+// 推送按钮交互型的确认卡片，按钮的key和chatbot的确认事件对应
+func (svr *WeComServer) pushConfirmCard(userID, taskID, title, content string) error {
+	if runes := []rune(content); len(runes) > maxCardSubTitleLen {
+		content = string(runes[:maxCardSubTitleLen]) + "..."
+	}
+
+	card := &wecom.TemplateCard{
+		CardType:     "button_interaction",
+		SubTitleText: content,
+		TaskId:       taskID,
+		ButtonList: []wecom.TemplateCardButton{
+			{Text: "确认", Style: 1, Key: chatbot.ConfirmKeyConfirm},
+			{Text: "取消", Style: 2, Key: chatbot.ConfirmKeyCancel},
+		},
+	}
+	card.MainTitle.Title = title
+	card.MainTitle.Desc = "智能助手将以你的身份执行，请确认"
+
+	_, err := svr.wc.PushTemplateCardMessage(userID, card)
+	return err
+}
+
+// 提问人的姓名，获取失败时使用userid
+func (svr *WeComServer) userName(userID string) string {
+	if profile, err := svr.wc.GetUserProfile(userID); err == nil && profile.Name != "" {
+		return profile.Name
+	}
+
+	return userID
+}
+
+type lookupColleagueArgs struct {
+	Keyword string `json:"keyword"`
+}
+
+func (svr *WeComServer) lookupColleague(ctx *chatbot.ToolContext, args json.RawMessage) (string, error) {
+	var req lookupColleagueArgs
+	if err := json.Unmarshal(args, &req); err != nil {
+		return "", err
+	}
+
+	users, err := svr.wc.SearchUsers(req.Keyword, maxLookupResults)
+	if err != nil {
+		return "", err
+	}
+
+	users = slices.DeleteFunc(users, func(user wecom.SimpleUser) bool {
+		return !svr.contactVisible(ctx.UserID, user.UserId)
+	})
+
+	if len(users) == 0 {
+		return fmt.Sprintf("通讯录中没有找到\"%s\"", req.Keyword), nil
+	}
+
+	lines := make([]string, 0, len(users))
+	for _, user := range users {
+		line := fmt.Sprintf("%s(userid: %s)", user.Name, user.UserId)
+		if profile, err := svr.wc.GetUserProfile(user.UserId); err == nil {
+			if profile.Position != "" {
+				line += " 职务: " + profile.Position
+			}
+			if len(profile.Departments) > 0 {
+				line += " 部门: " + strings.Join(profile.Departments, "、")
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+type sendMessageArgs struct {
+	UserId  string `json:"user_id"`
+	ChatId  string `json:"chat_id"`
+	Content string `json:"content"`
+}
+
+// 发送到群聊时提问人需要是群成员，发送给同事时同事需要在通讯录和提问人的可见范围内
+func (svr *WeComServer) sendMessage(ctx *chatbot.ToolContext, args json.RawMessage) (string, error) {
+	var req sendMessageArgs
+	if err := json.Unmarshal(args, &req); err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(req.Content) == "" {
+		return "", errors.New("content is empty")
+	}
+
+	if req.UserId == "" && req.ChatId == "" {
+		req.ChatId = ctx.ChatID
+	}
+
+	var target string
+	var send func(text string) error
+
+	if req.UserId != "" {
+		if !svr.contactVisible(ctx.UserID, req.UserId) {
+			return "", errContactNotVisible
+		}
+
+		user, err := svr.wc.GetUser(req.UserId)
+		if err != nil {
+			return "", fmt.Errorf("user %s not found, use %s to get the userid", req.UserId, toolLookupColleague)
+		}
+
+		target = user.Name
+		send = func(text string) error {
+			_, err := svr.wc.PushTextMessage(user.UserId, text)
+			return err
+		}
+	} else if req.ChatId != "" {
+		members, err := svr.wc.GetAppChatMembers(req.ChatId)
+		if err != nil {
+			return "", err
+		}
+
+		if !slices.Contains(members, ctx.UserID) {
+			return "", errors.New("the user is not a member of the group chat")
+		}
+
+		target = "群聊"
+		send = func(text string) error {
+			_, err := svr.wc.PushAppChatTextMessage(req.ChatId, text)
+			return err
+		}
+	} else {
+		return "", errors.New("user_id or chat_id is required")
+	}
+
+	text := fmt.Sprintf("%s\n\n—— 由%s通过智能助手发送", req.Content, svr.userName(ctx.UserID))
+
+	return chatbot.MustChatbot().RequestConfirmation(ctx.UserID, "发送消息给"+target, req.Content, func() (string, error) {
+		if err := send(text); err != nil {
+			return "", err
+		}
+
+		return "消息已发送给" + target, nil
+	})
+}
+
+type createScheduleArgs struct {
+	Summary     string   `json:"summary"`
+	StartTime   string   `json:"start_time"`
+	EndTime     string   `json:"end_time"`
+	Attendees   []string `json:"attendees"`
+	Location    string   `json:"location"`
+	Description string   `json:"description"`
+}
+
+func parseToolTime(name, value string) (time.Time, error) {
+	t, err := time.ParseInLocation(toolTimeLayout, strings.TrimSpace(value), time.Local)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s %q, format should be YYYY-MM-DD HH:MM", name, value)
+	}
+
+	return t, nil
+}
+
+// 用户为组织者，参与者需要在通讯录和提问人的可见范围内
+func (svr *WeComServer) createSchedule(ctx *chatbot.ToolContext, args json.RawMessage) (string, error) {
+	var req createScheduleArgs
+	if err := json.Unmarshal(args, &req); err != nil {
+		return "", err
+	}
+
+	start, err := parseToolTime("start_time", req.StartTime)
+	if err != nil {
+		return "", err
+	}
+
+	end := start.Add(defaultScheduleMinutes * time.Minute)
+	if req.EndTime != "" {
+		if end, err = parseToolTime("end_time", req.EndTime); err != nil {
+			return "", err
+		}
+
+		if !end.After(start) {
+			return "", errors.New("end_time must be after start_time")
+		}
+	}
+
+	schedule := &wecom.Schedule{
+		Organizer:   ctx.UserID,
+		StartTime:   start.Unix(),
+		EndTime:     end.Unix(),
+		Summary:     req.Summary,
+		Description: req.Description,
+		Location:    req.Location,
+		Reminders: &wecom.ScheduleReminders{
+			IsRemind:              1,
+			RemindBeforeEventSecs: scheduleRemindSecs,
+		},
+	}
+
+	names := []string{svr.userName(ctx.UserID)}
+	for _, userID := range req.Attendees {
+		if userID == ctx.UserID {
+			continue
+		}
+
+		if !svr.contactVisible(ctx.UserID, userID) {
+			return "", fmt.Errorf("attendee %s: %w", userID, errContactNotVisible)
+		}
+
+		user, err := svr.wc.GetUser(userID)
+		if err != nil {
+			return "", fmt.Errorf("attendee %s not found, use %s to get the userid", userID, toolLookupColleague)
+		}
+
+		schedule.Attendees = append(schedule.Attendees, wecom.ScheduleAttendee{UserId: user.UserId})
+		names = append(names, user.Name)
+	}
+
+	content := fmt.Sprintf("主题: %s\n时间: %s ~ %s\n参与人: %s", req.Summary, start.Format(toolTimeLayout), end.Format(toolTimeLayout), strings.Join(names, "、"))
+	if req.Location != "" {
+		content += "\n地点: " + req.Location
+	}
+
+	return chatbot.MustChatbot().RequestConfirmation(ctx.UserID, "创建日程", content, func() (string, error) {
+		if _, err := svr.wc.AddSchedule(schedule); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("日程\"%s\"已创建", req.Summary), nil
+	})
+}
+
+type createTodoArgs struct {
+	Content string `json:"content"`
+	DueTime string `json:"due_time"`
+}
+
+// 应用没有开放的待办接口，待办以截止时间开始的日程代替，开始前提醒用户
+func (svr *WeComServer) createTodo(ctx *chatbot.ToolContext, args json.RawMessage) (string, error) {
+	var req createTodoArgs
+	if err := json.Unmarshal(args, &req); err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(req.Content) == "" {
+		return "", errors.New("content is empty")
+	}
+
+	due, err := parseToolTime("due_time", req.DueTime)
+	if err != nil {
+		return "", err
+	}
+
+	schedule := &wecom.Schedule{
+		Organizer: ctx.UserID,
+		StartTime: due.Unix(),
+		EndTime:   due.Add(todoScheduleMinutes * time.Minute).Unix(),
+		Summary:   "[待办] " + req.Content,
+		Reminders: &wecom.ScheduleReminders{
+			IsRemind:              1,
+			RemindBeforeEventSecs: scheduleRemindSecs,
+		},
+	}
+
+	content := fmt.Sprintf("待办: %s\n截止时间: %s", req.Content, due.Format(toolTimeLayout))
+
+	return chatbot.MustChatbot().RequestConfirmation(ctx.UserID, "创建待办", content, func() (string, error) {
+		if _, err := svr.wc.AddSchedule(schedule); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("待办\"%s\"已创建，将在%s前提醒", req.Content, due.Format(toolTimeLayout)), nil
+	})
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/walkerdu/wecom-backend/internal/pkg/middleware"
+	"github.com/walkerdu/wecom-backend/pkg/chatbot"
+	"github.com/walkerdu/wecom-backend/pkg/wecom"
+)
+
+// 平台部可以使用工具，只能给平台部的同事发送消息，设计部没有权限
+func newToolTestServer() *WeComServer {
+	profiles := map[string]*wecom.UserProfile{
+		"alice": {UserId: "alice", Departments: []string{"平台部"}},
+		"bob":   {UserId: "bob", Departments: []string{"平台部"}},
+		"carol": {UserId: "carol", Departments: []string{"设计部"}},
+	}
+
+	config := &middleware.AuthConfig{
+		Enable: true,
+		Allow: []middleware.AuthRule{
+			{
+				AuthList: middleware.AuthList{Departments: []string{"平台部"}},
+				Contacts: middleware.AuthList{Departments: []string{"平台部"}},
+			},
+		},
+	}
+
+	return &WeComServer{
+		auth: middleware.NewAuthMiddleware(config, func(userID string) (*wecom.UserProfile, error) {
+			if profile, exist := profiles[userID]; exist {
+				return profile, nil
+			}
+			return nil, errors.New("user not found")
+		}),
+	}
+}
+
+func TestToolDenied(t *testing.T) {
+	svr := newToolTestServer()
+
+	var called bool
+	handler := svr.authorizeTool(func(ctx *chatbot.ToolContext, args json.RawMessage) (string, error) {
+		called = true
+		return "ok", nil
+	})
+
+	tests := []struct {
+		name    string
+		userID  string
+		wantErr error
+	}{
+		{"allowed", "alice", nil},
+		{"other department", "carol", errToolDenied},
+		{"unknown user", "dave", errToolDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			_, err := handler(&chatbot.ToolContext{SessionID: tt.userID, UserID: tt.userID}, json.RawMessage(`{}`))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if called != (tt.wantErr == nil) {
+				t.Fatalf("handler called = %v", called)
+			}
+		})
+	}
+}
+
+func TestSendMessageContactNotVisible(t *testing.T) {
+	svr := newToolTestServer()
+
+	tests := []struct {
+		name   string
+		userID string
+		target string
+	}{
+		{"other department", "alice", "carol"},
+		{"unknown user", "alice", "dave"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if svr.contactVisible(tt.userID, tt.target) {
+				t.Fatalf("%s should not be visible to %s", tt.target, tt.userID)
+			}
+
+			args, _ := json.Marshal(&sendMessageArgs{UserId: tt.target, Content: "hello"})
+			_, err := svr.sendMessage(&chatbot.ToolContext{SessionID: tt.userID, UserID: tt.userID}, args)
+			if !errors.Is(err, errContactNotVisible) {
+				t.Fatalf("err = %v, want %v", err, errContactNotVisible)
+			}
+		})
+	}
+
+	if !svr.contactVisible("alice", "bob") {
+		t.Fatal("bob should be visible to alice")
+	}
+}
@@ -0,0 +1,93 @@
+package chatbot
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	continueCommand = "继续"
+
+	// 上一条回复被截断时，请求AI从中断的地方接着生成
+	continuePrompt = "你上一条回复因为长度限制被截断了，请从中断的地方继续输出，不要重复已经输出的内容"
+
+	truncatedAnswerHint = "\n\n(回复过长被截断，发送\"继续\"获取后续内容)"
+)
+
+var answerSeq atomic.Uint32
+
+// newAnswerID 生成AI回复的id，毫秒时间戳加序号的36进制，方便用户输入
+func newAnswerID() string {
+	return strconv.FormatInt(time.Now().UnixMilli(), 36) + strconv.FormatUint(uint64(answerSeq.Add(1)%36), 36)
+}
+
+// lastAnswer 用户当前对话中最近的一条AI回复
+func (c *Chatbot) lastAnswer(userID string) *HistoryMessage {
+	c.sessionCtxMu.Lock()
+	defer c.sessionCtxMu.Unlock()
+
+	messages := c.getSessionMessages(userID)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == ChatRoleAI {
+			return messages[i]
+		}
+	}
+
+	return nil
+}
+
+// GetAnswer 按照id获取用户的AI回复，查找所有对话的历史
+func (c *Chatbot) GetAnswer(userID, id string) *HistoryMessage {
+	history := c.loadHistory(userID)
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == ChatRoleAI && history[i].Id == id {
+			return history[i]
+		}
+	}
+
+	return nil
+}
+
+func formatAnswer(msg *HistoryMessage) string {
+	header := fmt.Sprintf("[%s] %s", time.Unix(msg.Ts, 0).Format("01-02 15:04"), historyRoleName(msg))
+	if msg.Id != "" {
+		header += " #" + msg.Id
+	}
+
+	content := header + "\n" + msg.Content
+	if msg.Truncated {
+		content += truncatedAnswerHint
+	}
+
+	return content
+}
+
+// /last 重新获取当前对话最近的一条AI回复
+func (c *Chatbot) handleLastCommand(userID string, args string) (string, error) {
+	answer := c.lastAnswer(userID)
+	if answer == nil {
+		return "当前对话还没有AI回复", nil
+	}
+
+	return formatAnswer(answer), nil
+}
+
+// /get 按照id获取AI回复，id可以通过/history查看
+func (c *Chatbot) handleGetCommand(userID string, args string) (string, error) {
+	id := strings.TrimPrefix(strings.TrimSpace(args), "#")
+	if id == "" {
+		return "使用 /get <id> 获取AI回复，id可以通过 /history 查看", nil
+	}
+
+	answer := c.GetAnswer(userID, id)
+	if answer == nil {
+		log.Printf("[INFO][handleGetCommand] answer not found, userID=%s, id=%s", userID, id)
+		return fmt.Sprintf("没有找到id为%s的回复", id), nil
+	}
+
+	return formatAnswer(answer), nil
+}
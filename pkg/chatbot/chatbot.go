@@ -3,11 +3,12 @@
 package chatbot
 
 import (
-	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +24,7 @@ import (
 const (
 	maxChatSessionCtxLength     = 6   // 聊天的最大会话长度
 	maxChatResponseCahceTimeout = 120 // 聊天回包保存的最大时效2min
+	chatPlaceholderDelaySecs    = 30  // 回包生成超过该时长，先推送"生成中"的占位消息，最终回包推送后撤回
 
 	ChatRoleUser = "user"
 	ChatRoleAI   = "ai"
@@ -32,28 +34,6 @@ const (
 	AIName_Claude = "claude"
 )
 
-// 保存用户聊天请求的对应的回包，因为可能是异步触发返回
-type chatResponseCache struct {
-	content      string
-	msgId        int64
-	begin        int64
-	asyncMsgChan chan string
-	ai           string
-}
-
-// 每条消息，按userid持久化到DB
-type chatMessage struct {
-	Content string `json:"content"`
-	Ts      int64  `json:"ts"`
-	Role    string `json:"role"`
-	Ai      string `json:"ai"`
-}
-
-type chatSessionCtx struct {
-	//chatHistory []*openai.ChatMessage // 保证OpenAI聊天具有上下文感知能力
-	chatHistory *list.List
-}
-
 // Chatbot 是聊天机器人结构体
 type Chatbot struct {
 	openaiClient *openai.Client
@@ -62,12 +42,61 @@ type Chatbot struct {
 
 	redisClient *redis.Client
 
-	publisher func(string, string) error
-
-	chatResponseCacheMap map[string]*chatResponseCache // 用户消息处理结果的cache，用于并发限制和cache异步回包数据, 目前异步推送后会立刻清除
-	rspCacheMu           sync.Mutex
-	chatSessionCtxMap    map[string]*chatSessionCtx // 保存聊天的上下文
-	sessionCtxMu         sync.Mutex
+	publisher func(string, string) (string, error)
+	recaller  func(string) error
+
+	filePublisher func(string, string, []byte) error // 推送文件的回调
+	pushQueue     *pushQueue                         // 异步回包的推送队列，保证推送失败后可以重试
+
+	groupPublisher  func(string, string) (string, error)
+	groupCreator    func(string, string, []string) (string, error)
+	groupMemberList func(string) ([]string, error)
+
+	commandHandlerMap map[string]commandHandler // 注册用户指令对应的处理Handler
+
+	profileProvider func(string) (*UserProfile, error) // 获取用户资料的回调
+	departmentRoute map[string]string                  // 部门 -> AI名称的路由
+	modelAuthorizer func(string, string, string) bool  // 模型权限校验的回调
+	quota           *quotaManager                      // 用户和部门的频率限制和token额度，未开启时为nil
+	usage           *usageAccounting                   // 用量统计，未开启时为nil
+	knowledge       *knowledgeBase                     // 知识库，未开启时为nil
+	admins          []string                           // 管理员的userid列表
+
+	chatJobMap         map[string]*chatJob         // 会话id -> 正在进行的提问，用于并发限制和保存异步回包
+	requestQueues      map[string][]*queuedRequest // 会话id -> 排队等待处理的提问，由jobMu保护
+	requestQueueConfig RequestQueueConfig
+	jobMu              sync.Mutex
+	historyStore       HistoryStore // 聊天历史的存储
+	sessionCtxMu       sync.Mutex
+	migratedUsers      sync.Map    // 已经将按照AI保存的历史合并到统一会话的用户
+	threadStore        threadStore // 用户的对话列表
+	threadMu           sync.Mutex
+	tools              map[string]*Tool // 工具名称 -> AI可以调用的工具
+	toolConfig         ToolConfig
+	toolMu             sync.RWMutex
+
+	confirmPublisher func(string, string, string, string) error // 推送确认卡片的回调
+	confirmUpdater   func(string, string, string) error         // 更新确认卡片按钮的回调
+	pendingActions   map[string]*pendingAction                  // 卡片的任务id -> 等待用户确认的操作
+	confirmMu        sync.Mutex
+
+	imageConfig    ImageConfig
+	imagePublisher func(string, string, []byte) error // 推送图片的回调
+	imageLoader    func(string) ([]byte, error)       // 下载用户发送的图片的回调
+	receivedImages map[string]*receivedImage          // userid -> 用户最近发送的图片，用于编辑和生成变体
+	imageMu        sync.Mutex
+	drawing        sync.Map // 正在生成图片的用户，每个用户同时只能生成一张
+
+	voiceConfig       VoiceConfig
+	speechSynthesizer SpeechSynthesizer                  // 语音合成，未开启时为nil
+	voicePublisher    func(string, string, []byte) error // 推送语音的回调
+	voiceLoader       func(string) ([]byte, error)       // 下载用户发送的语音的回调
+	voiceModes        sync.Map                           // userid -> 语音回复模式，未开启Redis时使用
+	voiceInputs       sync.Map                           // 最近一次通过语音提问的用户
+
+	forgetter func(string, []string) // 删除用户数据时清理外部缓存的回调，参数为userid和用户发送过的素材
+	userMedia map[string][]string    // userid -> 下载过的用户发送的素材，未开启Redis时使用
+	mediaMu   sync.Mutex
 }
 
 var chatbot *Chatbot
@@ -75,10 +104,23 @@ var chatbot *Chatbot
 // NewChatbot 返回一个新的Chatbot实例
 func NewChatbot(config *Config) *Chatbot {
 	chatbot = &Chatbot{
-		chatResponseCacheMap: make(map[string]*chatResponseCache),
-		chatSessionCtxMap:    make(map[string]*chatSessionCtx),
+		chatJobMap:         make(map[string]*chatJob),
+		requestQueues:      make(map[string][]*queuedRequest),
+		requestQueueConfig: config.RequestQueue,
+		tools:              make(map[string]*Tool),
+		toolConfig:         config.Tool,
+		pendingActions:     make(map[string]*pendingAction),
+		imageConfig:        config.Image,
+		receivedImages:     make(map[string]*receivedImage),
+		userMedia:          make(map[string][]string),
+		commandHandlerMap:  make(map[string]commandHandler),
+		departmentRoute:    config.DepartmentRoute,
+		admins:             config.Admins,
 	}
 
+	chatbot.registerCommandHandler()
+	chatbot.registerBuiltinTools()
+
 	if config.OpenAI.Enable {
 		log.Printf("[INFO][NewChatbot] create openai client")
 		chatbot.openaiClient = openai.NewClient(config.OpenAI.ApiKey)
@@ -109,12 +151,45 @@ func NewChatbot(config *Config) *Chatbot {
 		})
 
 		if rdb == nil {
-			log.Fatal("NewChatbot| create redis client failed, config:%+v", config.Redis)
+			log.Fatalf("NewChatbot| create redis client failed, config:%+v", config.Redis)
 		}
 
 		chatbot.redisClient = rdb
 	}
 
+	chatbot.initVoice(&config.Voice)
+
+	chatbot.pushQueue = newPushQueue(&config.PushQueue, chatbot.redisClient, chatbot.deliverPushJob)
+
+	if config.Quota.Enable {
+		chatbot.quota = newQuotaManager(&config.Quota, chatbot.redisClient)
+	}
+
+	if config.Usage.Enable {
+		chatbot.usage = newUsageAccounting(&config.Usage, chatbot.redisClient)
+	}
+
+	historyStore, err := newHistoryStore(&config.History, chatbot.redisClient)
+	if err != nil {
+		log.Fatalf("NewChatbot| create history store failed, err=%s", err)
+	}
+
+	chatbot.historyStore = historyStore
+	chatbot.threadStore = newThreadStore(historyStore)
+
+	if config.Knowledge.Enable {
+		if chatbot.openaiClient == nil {
+			log.Printf("[WARN][NewChatbot] knowledge need openai enable for embedding, ignored")
+		} else {
+			knowledge, err := newKnowledgeBase(&config.Knowledge, chatbot.redisClient)
+			if err != nil {
+				log.Fatalf("NewChatbot| create knowledge base failed, err=%s", err)
+			}
+
+			chatbot.knowledge = knowledge
+		}
+	}
+
 	return chatbot
 }
 
@@ -122,398 +197,413 @@ func MustChatbot() *Chatbot {
 	return chatbot
 }
 
-// 判断会话是否进行中，同时只能并发一个会话，超时时间2min
-func (c *Chatbot) isProcessing(userID string) bool {
-	c.rspCacheMu.Lock()
-	defer c.rspCacheMu.Unlock()
+// RedisClient 返回Chatbot使用的Redis客户端，未开启Redis时返回nil
+func (c *Chatbot) RedisClient() *redis.Client {
+	return c.redisClient
+}
 
-	cache, exist := c.chatResponseCacheMap[userID]
-	if exist && cache.begin+maxChatResponseCahceTimeout < time.Now().Unix() {
-		delete(c.chatResponseCacheMap, userID)
-		return false
-	}
+// 注册聊天消息的异步推送回调
+// 其实这里比较好的设计应该是调用ChatBot的调用方，在发起聊天请求中注册一下异步推送的回调，这样就可以支持不同的pusher了
+func (c *Chatbot) RegsiterMessagePublish(publisher func(string, string) (string, error)) {
+	c.publisher = publisher
+}
 
-	return exist
+// 注册群聊的回调，分别用于群聊消息推送、创建群聊和获取群成员
+func (c *Chatbot) RegisterGroupChat(publisher func(string, string) (string, error), creator func(string, string, []string) (string, error), memberList func(string) ([]string, error)) {
+	c.groupPublisher = publisher
+	c.groupCreator = creator
+	c.groupMemberList = memberList
 }
 
-// 读取channel中异步推送的数据
-func (c *Chatbot) preHitProcess(userID string, input string) (string, error) {
-	c.rspCacheMu.Lock()
-	defer c.rspCacheMu.Unlock()
+// 注册消息撤回的回调，用于撤回推送的占位消息和AI回复
+func (c *Chatbot) RegisterMessageRecall(recaller func(string) error) {
+	c.recaller = recaller
+}
+
+// 推送消息，chatID不为空时推送到群聊，否则推送给用户
+func (c *Chatbot) publish(userID, chatID, content string) (string, error) {
+	if chatID != "" {
+		if c.groupPublisher == nil {
+			return "", errors.New("group publisher not registered")
+		}
 
-	cache, exist := c.chatResponseCacheMap[userID]
-	if !exist {
-		return "", nil
+		return c.groupPublisher(chatID, content)
 	}
 
-	return cache.content, nil
-}
+	if c.publisher == nil {
+		return "", errors.New("publisher not registered")
+	}
 
-// 创建chatResponseCacheMap
-// 用户消息处理结果的cache，用于并发限制和cache异步回包数据, 目前异步推送后会立刻清除
-func (c *Chatbot) buildChatCache(userID string) *chatResponseCache {
-	c.rspCacheMu.Lock()
-	defer c.rspCacheMu.Unlock()
+	return c.publisher(userID, content)
+}
 
-	if cache, exist := c.chatResponseCacheMap[userID]; exist {
-		cache.begin = time.Now().Unix()
-		return cache
+// 推送队列的推送回调，推送成功后回写msgid，并撤回占位消息
+func (c *Chatbot) deliverPushJob(job *pushJob) error {
+	msgId, err := c.publish(job.UserID, job.ChatId, job.Content)
+	if err != nil {
+		log.Printf("[ERROR]deliverPushJob|publish message failed, userID=%s, err=%s", job.UserID, err)
+		return err
 	}
 
-	cache := &chatResponseCache{
-		asyncMsgChan: make(chan string, 1),
-		begin:        time.Now().Unix(),
+	log.Printf("[INFO]|PushTextMessage success, userID:%s, msgId:%s", job.UserID, msgId)
+
+	if job.Ts != 0 {
+		conversation := job.Conversation
+		if conversation == "" {
+			conversation = job.Ai
+		}
+		c.setChatMessageMsgId(job.UserID, conversation, job.Ts, msgId)
 	}
 
-	c.chatResponseCacheMap[userID] = cache
+	if job.PlaceholderMsgId != "" && c.recaller != nil {
+		if err := c.recaller(job.PlaceholderMsgId); err != nil {
+			log.Printf("[ERROR]deliverPushJob|recall placeholder failed, userID=%s, err=%s", job.UserID, err)
+		}
+	}
 
-	return cache
+	return nil
 }
 
-// 清理chatResponseCacheMap
-func (c *Chatbot) clearChatCache(userID string) {
-	c.rspCacheMu.Lock()
-	defer c.rspCacheMu.Unlock()
-
-	delete(c.chatResponseCacheMap, userID)
+// 聊天上下文在DB中的key
+func chatSessionKey(userID, aiName string) string {
+	return "chatbot-" + aiName + "-" + userID
 }
 
-// 注册聊天消息的异步推送回调
-// 其实这里比较好的设计应该是调用ChatBot的调用方，在发起聊天请求中注册一下异步推送的回调，这样就可以支持不同的pusher了
-func (c *Chatbot) RegsiterMessagePublish(publisher func(string, string) error) {
-	c.publisher = publisher
+// AddChatSessionCtx 保存聊天上下文到用户当前使用的对话，aiName为发起请求的AI
+func (c *Chatbot) AddChatSessionCtx(userID string, content string, role, aiName string) {
+	c.addChatMessage(userID, c.conversationName(userID), &HistoryMessage{
+		Content: content,
+		Ts:      time.Now().Unix(),
+		Role:    role,
+		Ai:      aiName,
+	})
 }
 
-func (c *Chatbot) WaitChatResponse(userID string) {
-	c.rspCacheMu.Lock()
+func (c *Chatbot) addChatMessage(userID, conversation string, message *HistoryMessage) {
+	c.sessionCtxMu.Lock()
+	defer c.sessionCtxMu.Unlock()
+
+	c.migrateLegacyHistory(userID)
 
-	cache, exist := c.chatResponseCacheMap[userID]
-	if !exist {
-		log.Printf("[ERROR]WaitChatResponse|cache not exist userID=%s", userID)
+	if err := c.historyStore.Append(userID, conversation, message); err != nil {
+		log.Printf("[ERROR][AddChatSessionCtx] history store Append failed, userID=%s, err=%s", userID, err)
 		return
 	}
-	c.rspCacheMu.Unlock()
 
-	go func() {
-		select {
-		case content := <-cache.asyncMsgChan:
-			if content == "" {
-				// 异常结束
-				content = cache.content
-			} else {
-				// 保存聊天上下文
-				// TODO: 存入DB
-				c.AddChatSessionCtx(userID, content, ChatRoleAI, cache.ai)
-				log.Printf("[INFO]WaitChatResponse|userID=%s wait sucess", userID)
-				cache.content = content
-			}
+	log.Printf("[INFO][AddChatSessionCtx] history store Append success, userID=%s, message=%+v", userID, *message)
+}
 
-			// 消息推送
-			if err := c.publisher(userID, content); err != nil {
-				log.Printf("[ERROR]WaitChatResponse|publish message failed, userID=%s, err=%s", userID, err)
-				return
-			}
+// 回写聊天上下文中AI回复推送后的msgid，按照时间戳从后往前查找
+func (c *Chatbot) setChatMessageMsgId(userID, conversation string, ts int64, msgId string) {
+	c.sessionCtxMu.Lock()
+	defer c.sessionCtxMu.Unlock()
 
-			log.Printf("[INFO]|PushTextMessage success, userID:%s", userID)
-			c.clearChatCache(userID)
+	messages, err := c.historyStore.Range(userID, conversation, -maxChatSessionCtxLength, -1)
+	if err != nil {
+		log.Printf("[ERROR][setChatMessageMsgId] history store Range failed, err=%s", err)
+		return
+	}
 
-		case <-time.After(maxChatResponseCahceTimeout * time.Second):
-			log.Printf("[WARN]WaitChatResponse|timeout, userID=%s", userID)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != ChatRoleAI || messages[i].Ts != ts {
+			continue
 		}
-	}()
+
+		// 修改副本后写回，不直接修改读取到的消息
+		message := *messages[i]
+		message.MsgId = msgId
+
+		// 倒数第len(messages)-i个元素
+		if err := c.historyStore.Set(userID, conversation, i-len(messages), &message); err != nil {
+			log.Printf("[ERROR][setChatMessageMsgId] history store Set failed, err=%s", err)
+		}
+		return
+	}
 }
 
-func (c *Chatbot) AddChatSessionCtx(userID string, content string, role, aiName string) {
+// 获取聊天上下文中最近一条AI回复，最后一条不是AI回复时返回nil
+func (c *Chatbot) lastChatAnswer(userID, conversation string) *HistoryMessage {
 	c.sessionCtxMu.Lock()
 	defer c.sessionCtxMu.Unlock()
 
-	message := &chatMessage{
-		Content: content,
-		Ts:      time.Now().Unix(),
-		Role:    role,
-		Ai:      aiName,
+	messages, err := c.historyStore.Range(userID, conversation, -1, -1)
+	if err != nil || len(messages) == 0 {
+		log.Printf("[ERROR][lastChatAnswer] history store Range failed, err=%v", err)
+		return nil
 	}
 
-	if c.redisClient != nil {
-		ctx := context.Background()
-		key := "chatbot-" + aiName + "-" + userID
+	if messages[0].Role != ChatRoleAI {
+		return nil
+	}
 
-		data, err := json.Marshal(message)
-		if err != nil {
-			log.Printf("[ERROR][AddChatSessionCtx] json Marshal failed, err=%s", err)
-			return
-		}
+	return messages[0]
+}
 
-		_, err = c.redisClient.RPush(ctx, key, data).Result()
-		if err != nil {
-			log.Printf("[ERROR][AddChatSessionCtx] redis RPush failed, err=%s", err)
-		}
+// 删除聊天上下文中最近一轮的对话，只有最后一条仍然是answer时才删除，避免删除之后新生成的回复
+func (c *Chatbot) popLastChatTurn(userID, conversation string, answer *HistoryMessage) error {
+	c.sessionCtxMu.Lock()
+	defer c.sessionCtxMu.Unlock()
 
-		log.Printf("[INFO][AddChatSessionCtx] redis RPush success, message=%v", string(data))
-	} else {
-		var chatCtx *chatSessionCtx
-		chatCtx, exist := c.chatSessionCtxMap[userID]
-		if !exist {
-			chatCtx = &chatSessionCtx{
-				chatHistory: list.New(),
-			}
+	messages, err := c.historyStore.Range(userID, conversation, -2, -1)
+	if err != nil {
+		return err
+	}
 
-			c.chatSessionCtxMap[userID] = chatCtx
-		}
+	if len(messages) == 0 {
+		return errors.New("session ctx empty")
+	}
 
-		if chatCtx.chatHistory.Len() >= maxChatSessionCtxLength {
-			chatCtx.chatHistory.Remove(chatCtx.chatHistory.Front())
-		}
+	last := messages[len(messages)-1]
+	if last.Role != ChatRoleAI || last.Ts != answer.Ts || last.MsgId != answer.MsgId {
+		return errors.New("last answer changed")
+	}
 
-		chatCtx.chatHistory.PushBack(message)
+	popCnt := 1
+	if len(messages) == 2 && messages[0].Role == ChatRoleUser {
+		popCnt = 2
 	}
+
+	return c.historyStore.Trim(userID, conversation, 0, -popCnt-1)
 }
 
-func (c *Chatbot) GetChatMessageFromDB(userID, aiName string) []chatMessage {
-	ctx := context.Background()
-	key := "chatbot-" + aiName + "-" + userID
+// 没有可以撤回的AI回复
+var ErrNoAnswerToRecall = errors.New("no answer can be recalled")
 
-	result, err := c.redisClient.LRange(ctx, key, -maxChatSessionCtxLength, -1).Result()
-	if err != nil {
-		log.Printf("[ERROR][GetChatMessageFromDB] redis LRange failed, err=%s", err)
-		return nil
+// RecallLastAnswer 撤回用户最近一次的AI回复，同时从聊天上下文中删除该轮对话
+// 可用于/undo指令，也可以作为内容审核的Hook来撤回不合规的回复
+// 先撤回消息，撤回成功后再删除上下文，撤回失败时保留该轮对话
+func (c *Chatbot) RecallLastAnswer(userID string) error {
+	conversation := c.conversationName(userID)
+
+	message := c.lastChatAnswer(userID, conversation)
+	if message == nil {
+		return ErrNoAnswerToRecall
 	}
 
-	messages := []chatMessage{}
-	for _, data := range result {
-		var message chatMessage
-		err := json.Unmarshal([]byte(data), &message)
-		if err != nil {
-			log.Printf("[ERROR][GetChatMessageFromDB] json Unmarshal failed, err=%s", err)
-			continue
-		}
+	if message.MsgId == "" || c.recaller == nil {
+		log.Printf("[WARN][RecallLastAnswer] answer has no msgid, only remove from session ctx, userID=%s", userID)
+	} else if err := c.recaller(message.MsgId); err != nil {
+		return err
+	}
 
-		messages = append(messages, message)
+	if err := c.popLastChatTurn(userID, conversation, message); err != nil {
+		log.Printf("[ERROR][RecallLastAnswer] popLastChatTurn failed, userID=%s, err=%s", userID, err)
+		return err
 	}
 
-	log.Printf("[INFO][GetChatMessageFromDB] redis LRange success, message=%+v", messages)
+	return nil
+}
+
+// 获取用户当前对话最近的会话上下文，调用方需要持有sessionCtxMu
+func (c *Chatbot) getSessionMessages(userID string) []*HistoryMessage {
+	c.migrateLegacyHistory(userID)
+
+	messages, err := c.historyStore.Range(userID, c.conversationName(userID), -maxChatSessionCtxLength, -1)
+	if err != nil {
+		log.Printf("[ERROR][getSessionMessages] history store Range failed, err=%s", err)
+		return nil
+	}
 
 	return messages
 }
 
+// GetChatSessionCtx 获取OpenAI格式的聊天上下文，追加在ctxs之后
 func (c *Chatbot) GetChatSessionCtx(userID string, ctxs []openai.ChatMessage) []openai.ChatMessage {
 	c.sessionCtxMu.Lock()
 	defer c.sessionCtxMu.Unlock()
 
-	if c.redisClient != nil {
-		messages := c.GetChatMessageFromDB(userID, AIName_OpenAI)
-		if messages == nil || len(messages) == 0 {
-			return ctxs
-		}
+	return toOpenAIMessages(ctxs, c.getSessionMessages(userID))
+}
 
-		for _, msg := range messages {
-			role := msg.Role
-			if role == ChatRoleAI {
-				role = "assistant"
-			}
+// GetClaudeChatSessionCtx 获取Claude格式的聊天上下文
+func (c *Chatbot) GetClaudeChatSessionCtx(userID string) []claude.Message {
+	c.sessionCtxMu.Lock()
+	defer c.sessionCtxMu.Unlock()
 
-			ctxs = append(ctxs, openai.ChatMessage{
-				Content: msg.Content,
-				Role:    openai.RoleType(role),
-			})
-		}
-	} else {
-		chatCtx, exist := c.chatSessionCtxMap[userID]
-		if !exist {
-			return ctxs
-		}
+	return toClaudeMessages(c.getSessionMessages(userID))
+}
 
-		// 遍历队列中的元素
-		for e := chatCtx.chatHistory.Front(); e != nil; e = e.Next() {
-			msg, _ := e.Value.(*chatMessage)
+// GetGeminiChatSessionCtx 获取Gemini格式的聊天历史，不包含最后一条提问
+func (c *Chatbot) GetGeminiChatSessionCtx(userID string) []*genai.Content {
+	c.sessionCtxMu.Lock()
+	defer c.sessionCtxMu.Unlock()
 
-			role := msg.Role
-			if role == ChatRoleAI {
-				role = "assistant"
-			}
+	return toGeminiHistory(c.getSessionMessages(userID))
+}
 
-			ctxs = append(ctxs, openai.ChatMessage{
-				Content: msg.Content,
-				Role:    openai.RoleType(role),
-			})
-		}
+// 当前使用的AI，按照OpenAI、Gemini、Claude的优先级选择
+func (c *Chatbot) getAIName() string {
+	if c.openaiClient != nil {
+		return AIName_OpenAI
+	} else if c.geminiClient != nil {
+		return AIName_Gemini
+	} else if c.claudeClient != nil {
+		return AIName_Claude
 	}
 
-	return ctxs
+	return ""
 }
 
-func (c *Chatbot) GetClaudeChatSessionCtx(userID string, ctxs []claude.Message) []claude.Message {
-	c.sessionCtxMu.Lock()
-	defer c.sessionCtxMu.Unlock()
+// GetResponse 调用聊天机器人API获取响应，pending为true时rsp为占位回复，生成完成后由Chatbot推送最终的回包
+func (c *Chatbot) GetResponse(userID string, input string) (rsp string, pending bool, err error) {
+	// 文字提问，auto模式下不再回复语音
+	c.voiceInputs.Delete(userID)
 
-	if c.redisClient != nil {
-		messages := c.GetChatMessageFromDB(userID, AIName_Claude)
-		if messages == nil || len(messages) == 0 {
-			return ctxs
-		}
+	// "/"开头的用户指令
+	if rsp, hit, err := c.handleCommand(userID, input); hit {
+		return rsp, false, err
+	}
 
-		for _, msg := range messages {
-			role := msg.Role
-			if role == ChatRoleAI {
-				role = "assistant"
-			}
+	return c.getResponse(userID, "", userID, input)
+}
 
-			ctxs = append(ctxs, claude.Message{
-				Content: msg.Content,
-				Role:    role,
-			})
-		}
-	} else {
-		chatCtx, exist := c.chatSessionCtxMap[userID]
-		if !exist {
-			return ctxs
-		}
+// 群聊的会话id，群聊的上下文按照chatid保存
+func groupSessionID(chatID string) string {
+	return "appchat-" + chatID
+}
 
-		// 遍历队列中的元素
-		for e := chatCtx.chatHistory.Front(); e != nil; e = e.Next() {
-			msg, _ := e.Value.(*chatMessage)
+// GetGroupResponse 在群聊的上下文中获取响应，异步生成的回包推送到群聊中
+func (c *Chatbot) GetGroupResponse(chatID, userID, input string) (string, error) {
+	// 群聊中区分不同的提问人
+	rsp, _, err := c.getResponse(groupSessionID(chatID), chatID, userID, "["+userID+"] "+input)
+	return rsp, err
+}
 
-			role := msg.Role
-			if role == ChatRoleAI {
-				role = "assistant"
-			}
-			ctxs = append(ctxs, claude.Message{
-				Content: msg.Content,
-				Role:    role,
-			})
+// getResponse userID为单聊的用户id或者群聊的会话id, chatID不为空时回包推送到群聊, askerID为提问人
+// 发起了请求并且没有被中止时pending为true，最终的回包由waitJob推送
+func (c *Chatbot) getResponse(userID, chatID, askerID, input string) (string, bool, error) {
+	// 用户指令，获取已经生成但是没有推送成功的回包，或者接着生成被截断的回复
+	if strings.TrimSpace(input) == continueCommand {
+		if content, ok := c.takeFinishedJob(userID); ok {
+			return content, false, nil
 		}
-	}
 
-	var postCtx []claude.Message
-	for _, msg := range ctxs {
-		// 第一个一定要是user
-		if len(postCtx) == 0 && msg.Role != "user" {
-			continue
+		if c.isProcessing(userID) {
+			return "后台数据生成中，请稍后，生成完成会进行推送~", false, nil
 		}
 
-		// 每个要不一样, 如果一样后面覆盖前面
-		if len(postCtx) > 0 && postCtx[len(postCtx)-1].Role == msg.Role {
-			postCtx[len(postCtx)-1] = msg
-			continue
+		if last := c.lastAnswer(userID); last != nil && last.Truncated {
+			input = continuePrompt
 		}
+	}
 
-		postCtx = append(postCtx, msg)
+	// 并发控制，有提问进行中时排队
+	job, rsp := c.submitRequest(userID, chatID, askerID, input)
+	if job == nil {
+		return rsp, false, nil
 	}
 
-	return postCtx
-}
+	rsp, err := c.sendChatRequest(job, input)
+	if err != nil {
+		return rsp, false, err
+	}
 
-func (c *Chatbot) GetGeminiChatSessionCtx(userID string) []*genai.Content {
-	c.sessionCtxMu.Lock()
-	defer c.sessionCtxMu.Unlock()
+	// 没有权限、超过额度等情况下提问被中止，rsp为最终的回包
+	state, _ := job.snapshot()
 
-	ctxs := []*genai.Content{}
+	return rsp, state != jobCancelled, nil
+}
 
-	if c.redisClient != nil {
-		messages := c.GetChatMessageFromDB(userID, AIName_Gemini)
-		if messages == nil || len(messages) == 0 {
-			return ctxs
-		}
+// GetStreamResponse 获取流式回复，用于智能机器人等由调用方拉取回包的场景
+// chatID不为空时使用群聊的上下文，返回当前已经生成的内容，finish为true表示已经生成完成
+func (c *Chatbot) GetStreamResponse(userID, chatID, input string) (string, bool, error) {
+	sessionID := userID
+	if chatID != "" {
+		sessionID = groupSessionID(chatID)
+		input = "[" + userID + "] " + input
+	} else if rsp, hit, err := c.handleCommand(userID, input); hit {
+		// 单聊支持"/"开头的用户指令
+		return rsp, true, err
+	}
 
-		for _, msg := range messages {
-			role := msg.Role
-			if role == ChatRoleAI {
-				role = "model"
-			}
+	job, ok := c.startJob(sessionID, chatID, userID, true)
+	if !ok {
+		return "有提问正在生成中，请稍后再试~", true, nil
+	}
 
-			ctxs = append(ctxs, &genai.Content{
-				Parts: []genai.Part{
-					genai.Text(msg.Content),
-				},
-				Role: role,
-			})
-		}
-	} else {
-		chatCtx, exist := c.chatSessionCtxMap[userID]
-		if !exist {
-			return ctxs
-		}
+	rsp, err := c.sendChatRequest(job, input)
+	if err != nil {
+		return "", true, err
+	}
 
-		// 遍历队列中的元素
-		// gemini要求history必须是成对的，不能只有"user" 或者 "model"
-		for e := chatCtx.chatHistory.Front(); e != nil; e = e.Next() {
-			msg, _ := e.Value.(*chatMessage)
+	// 还没有生成内容，或者没有发起请求时，返回请求的回包
+	content, finish := c.GetStreamContent(userID, chatID)
+	if content == "" {
+		content = rsp
+	}
 
-			role := msg.Role
-			if role == ChatRoleAI {
-				role = "model"
-			}
+	return content, finish, nil
+}
 
-			ctxs = append(ctxs, &genai.Content{
-				Parts: []genai.Part{
-					genai.Text(msg.Content),
-				},
-				Role: role,
-			})
-		}
+// GetStreamContent 拉取流式回复当前已经生成的内容，生成结束后删除提问
+func (c *Chatbot) GetStreamContent(userID, chatID string) (string, bool) {
+	sessionID := userID
+	if chatID != "" {
+		sessionID = groupSessionID(chatID)
 	}
 
-	roleUserCnt := 0
-	for _, ctx := range ctxs {
-		if ctx.Role != "model" {
-			roleUserCnt++
-		}
-
-		log.Printf("[DEBUG][GetGeminiChatSessionCtx] %#v", *ctx)
+	job := c.getJob(sessionID)
+	if job == nil || !job.stream {
+		return "", true
 	}
 
-	// 历史错误，会导致gemini拒绝请求，400错误
-	if roleUserCnt != len(ctxs)/2 {
-		log.Printf("[ERROR][GetGeminiChatSessionCtx] history invalid")
-		return []*genai.Content{}
+	state, content := job.snapshot()
+	if state.terminal() {
+		c.removeJob(job)
 	}
 
-	return ctxs
+	return content, state.terminal()
 }
 
-// GetResponse 调用聊天机器人API获取响应
-func (c *Chatbot) GetResponse(userID string, input string) (string, error) {
-	// 用户指令，命中后，直接从cache中读取
-	if strings.TrimSpace(input) == "继续" {
-		cacheContent, _ := c.preHitProcess(userID, input)
-		if cacheContent != "" {
-			c.clearChatCache(userID)
-			return cacheContent, nil
-		} else {
-			return "后台数据生成中，请稍后，生成完成会进行推送~", nil
-		}
-	} else if c.isProcessing(userID) {
-		return "有提问在后台数据生成中，请稍后，生成完成会进行推送~", nil
+// sendChatRequest 按照当前使用的AI发送聊天请求
+func (c *Chatbot) sendChatRequest(job *chatJob, input string) (string, error) {
+	ai, allowed := c.selectAIName(job.userID)
+	if !allowed {
+		c.abortJob(job)
+		return modelDeniedMessage, nil
 	}
 
-	// 构造请求参数
-	//chatMsg := openai.ChatMessage{
-	//	Role:    openai.User,
-	//	Content: input,
-	//}
+	if msg, ok := c.checkQuota(job.userID); !ok {
+		c.abortJob(job)
+		return msg, nil
+	}
 
-	// 并发控制
-	cache := c.buildChatCache(userID)
+	job.ai = ai
+	job.requestAt = time.Now()
 
-	if c.openaiClient != nil {
-		cache.ai = AIName_OpenAI
-		return c.OpenAIRequest(cache, userID, input)
-	} else if c.geminiClient != nil {
-		cache.ai = AIName_Gemini
-		return c.GeminiRequest(cache, userID, input)
-	} else if c.claudeClient != nil {
-		cache.ai = AIName_Claude
-		return c.ClaudeRequest(cache, userID, input)
+	// 检索知识库中和提问相关的文档
+	c.retrieveKnowledge(job, input)
+
+	// 开启工具调用时，由AI决定是否调用工具，不调用工具时和普通提问一样流式回复
+	if c.toolEnabled() {
+		return c.ToolRequest(job, input)
+	}
+
+	switch job.ai {
+	case AIName_OpenAI:
+		return c.OpenAIRequest(job, job.sessionID, input)
+	case AIName_Gemini:
+		return c.GeminiRequest(job, job.sessionID, input)
+	case AIName_Claude:
+		return c.ClaudeRequest(job, job.sessionID, input)
 	}
 
+	c.abortJob(job)
+
 	return "no ai support", nil
 }
 
-func (c *Chatbot) OpenAIRequest(cache *chatResponseCache, userID string, input string) (string, error) {
+func (c *Chatbot) OpenAIRequest(job *chatJob, userID string, input string) (string, error) {
 	// OpenAI的多段对话需要先保存聊天上下文
 	c.AddChatSessionCtx(userID, input, ChatRoleUser, AIName_OpenAI)
 
 	messages := []openai.ChatMessage{}
+	if prompt := c.requestSystemPrompt(job); prompt != "" {
+		messages = append(messages, openai.ChatMessage{
+			Role:    openai.System,
+			Content: prompt,
+		})
+	}
 	messages = c.GetChatSessionCtx(userID, messages)
 
 	req := &openai.ChatCompletionReq{
@@ -521,132 +611,273 @@ func (c *Chatbot) OpenAIRequest(cache *chatResponseCache, userID string, input s
 		Messages: messages,
 		User:     userID,
 		Stream:   true,
+		StreamOptions: &openai.StreamOptions{
+			IncludeUsage: true,
+		},
 	}
 
 	reqBytes, err := json.Marshal(req)
 	if err != nil {
 		log.Printf("[ERROR][GetResponse] Marshal failed, err:%s", err)
+		c.abortJob(job)
 		return "", err
 	}
 
+	// 推流的时长不固定，只限制等待回包头的时间，推流的等待时间由streamReader限制
 	client := &http.Client{
-		Timeout: time.Second * 10,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: time.Second * 10,
+		},
 	}
 
+	// 推流的增量内容实时写入提问，流式回复时由调用方拉取
+	observer := &openai.StreamObserver{
+		OnDelta: job.appendDelta,
+		OnUsage: func(usage *openai.Usage) {
+			c.recordUsage(job, usage.PromptTokens, usage.CompletionTokens)
+		},
+		OnFinish: func(finishReason string) {
+			if finishReason == openai.FinishReasonLength {
+				job.markTruncated()
+			}
+		},
+	}
+
+	// 推流结束后完整的回复写入rspChan
+	rspChan := make(chan string, 1)
+
 	// 发送HTTP请求
-	rsp, err := c.openaiClient.Post(client, string(openai.OpenAIPathChatCompletion), reqBytes, cache.asyncMsgChan)
+	rsp, err := c.openaiClient.PostStream(client, string(openai.OpenAIPathChatCompletion), reqBytes, rspChan, observer)
 	if err != nil {
 		log.Printf("[ERROR]GetResponse] Post failed, err:%s", err)
-		c.clearChatCache(userID)
+		c.abortJob(job)
 		return "", err
 	}
 
 	chatRsp, ok := rsp.(*openai.ChatCompletionRsp)
 	if !ok {
 		log.Printf("[ERROR]GetResponse] rsp invalid rsp:%v", rsp)
-		c.clearChatCache(userID)
-		return "", err
+		c.abortJob(job)
+		return "", errors.New("openai rsp invalid")
 	}
 
-	c.WaitChatResponse(userID)
+	go func() {
+		select {
+		case content := <-rspChan:
+			job.complete(content)
+		case <-job.Done():
+		}
+	}()
+
+	c.waitJob(job)
 
 	return chatRsp.GetContent(), nil
 
 }
 
-func (c *Chatbot) ClaudeRequest(cache *chatResponseCache, userID string, input string) (string, error) {
+func (c *Chatbot) ClaudeRequest(job *chatJob, userID string, input string) (string, error) {
 	// Claude的多段对话需要先保存聊天上下文
 	c.AddChatSessionCtx(userID, input, ChatRoleUser, AIName_Claude)
 
-	messages := []claude.Message{}
-	messages = c.GetClaudeChatSessionCtx(userID, messages)
+	messages := c.GetClaudeChatSessionCtx(userID)
 
 	req := &claude.Request{
 		Model:     claude.Claude3Opus,
 		Messages:  messages,
 		MaxTokens: 2048,
+		System:    c.requestSystemPrompt(job),
 	}
 
 	reqBytes, err := json.Marshal(req)
 	if err != nil {
 		log.Printf("[ERROR][GetResponse] Marshal failed, err:%s", err)
+		c.abortJob(job)
 		return "", err
 	}
 
+	// Claude为非流式请求，需要等待完整的回复生成
 	client := &http.Client{
-		Timeout: time.Second * 10,
+		Timeout: maxChatResponseCahceTimeout * time.Second,
 	}
 
 	go func() {
+		rspChan := make(chan string, 1)
+
 		// 发送HTTP请求
-		err := c.claudeClient.Post(client, reqBytes, cache.asyncMsgChan)
+		err := c.claudeClient.PostWithObserver(client, reqBytes, rspChan, &claude.Observer{
+			OnUsage: func(usage *claude.Usage) {
+				c.recordUsage(job, usage.InputTokens, usage.OutputTokens)
+			},
+			OnStop: func(stopReason string) {
+				if stopReason == claude.StopReasonMaxTokens {
+					job.markTruncated()
+				}
+			},
+		})
 		if err != nil {
 			log.Printf("[ERROR]Claude Post failed, err:%s", err)
-			cache.content = err.Error()
-			close(cache.asyncMsgChan)
+			job.fail(err.Error())
 			return
 		}
+
+		job.complete(<-rspChan)
 	}()
 
-	c.WaitChatResponse(userID)
+	c.waitJob(job)
 
 	return "Claude生成中...", nil
 
 }
 
-func (c *Chatbot) GeminiRequest(cache *chatResponseCache, userID string, input string) (string, error) {
+func (c *Chatbot) GeminiRequest(job *chatJob, userID string, input string) (string, error) {
+	// Gemini的历史不包含本次的提问，先保存聊天上下文，读取历史时去掉最后一条提问
+	c.AddChatSessionCtx(userID, input, ChatRoleUser, AIName_Gemini)
+
 	// For text-only input, use the gemini-pro model
-	model := c.geminiClient.GenerativeModel("gemini-pro")
+	model := c.geminiClient.GenerativeModel(geminiModel)
 	// Initialize the chat
 	cs := model.StartChat()
 	cs.History = c.GetGeminiChatSessionCtx(userID)
 
+	// gemini-pro不支持系统提示词，在历史的最前面插入一轮对话代替
+	if prompt := c.requestSystemPrompt(job); prompt != "" {
+		cs.History = append([]*genai.Content{
+			{Parts: []genai.Part{genai.Text(prompt)}, Role: ChatRoleUser},
+			{Parts: []genai.Part{genai.Text("好的")}, Role: "model"},
+		}, cs.History...)
+	}
+
 	ctx := context.Background()
 
+	// 提问的token数包括上下文
+	prompt := append(slices.Clone(cs.History), &genai.Content{Parts: []genai.Part{genai.Text(input)}, Role: ChatRoleUser})
+
 	go func() {
 		resp, err := cs.SendMessage(ctx, genai.Text(input))
 		if err != nil {
 			log.Printf("[ERROR]|GeminiRequest:SendMessage failed, err:%v, resp:%v", err, resp)
-			cache.content = err.Error()
-			close(cache.asyncMsgChan)
+			job.fail(err.Error())
 			return
 		}
 
 		log.Printf("[INFO]|GeminiRequest: recv response::%v", resp)
 		candidates := resp.Candidates
 		if len(candidates) <= 0 {
-			cache.content = "response candidates empty"
-			close(cache.asyncMsgChan)
+			job.fail("response candidates empty")
 			return
 		}
 
 		content := candidates[0].Content
 		if content == nil {
-			cache.content = "response content invalid"
-			close(cache.asyncMsgChan)
+			job.fail("response content invalid")
 			return
 		}
 
+		if candidates[0].FinishReason == genai.FinishReasonMaxTokens {
+			job.markTruncated()
+		}
+
 		parts := content.Parts
 		if len(parts) == 0 {
-			cache.content = "response parts empty"
-			close(cache.asyncMsgChan)
+			job.fail("response parts empty")
 			return
 		}
 
 		if text, ok := parts[0].(genai.Text); !ok {
-			cache.content = "response parts not text"
-			close(cache.asyncMsgChan)
+			job.fail("response parts not text")
 			return
 		} else {
-			cache.asyncMsgChan <- string(text)
+			job.complete(string(text))
+			c.recordGeminiUsage(job, model, prompt, content)
 		}
 	}()
 
-	// Gemini的多段聊天需要事后保存聊天上下文, 其实它自己有History的能力，但是为了简单这里自己构造
-	c.AddChatSessionCtx(userID, input, ChatRoleUser, AIName_Gemini)
-
-	c.WaitChatResponse(userID)
+	c.waitJob(job)
 
 	return "Gemini生成中...", nil
 }
+
+// completeText 同步发起一次不带上下文的请求，用于生成对话标题等辅助功能，用量计入userID
+func (c *Chatbot) completeText(userID, aiName, prompt string) (string, error) {
+	job := &chatJob{
+		userID:    userID,
+		ai:        aiName,
+		requestAt: time.Now(),
+	}
+
+	client := &http.Client{
+		Timeout: time.Second * 30,
+	}
+
+	switch aiName {
+	case AIName_OpenAI:
+		reqBytes, err := json.Marshal(&openai.ChatCompletionReq{
+			Model:    openai.Gpt35Turbo,
+			Messages: []openai.ChatMessage{{Role: openai.User, Content: prompt}},
+			User:     userID,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		rsp, err := c.openaiClient.PostStream(client, string(openai.OpenAIPathChatCompletion), reqBytes, nil, &openai.StreamObserver{
+			OnUsage: func(usage *openai.Usage) {
+				c.recordUsage(job, usage.PromptTokens, usage.CompletionTokens)
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+
+		chatRsp, ok := rsp.(*openai.ChatCompletionRsp)
+		if !ok {
+			return "", errors.New("openai rsp invalid")
+		}
+
+		return chatRsp.GetContent(), nil
+
+	case AIName_Claude:
+		reqBytes, err := json.Marshal(&claude.Request{
+			Model:     claude.Claude3Opus,
+			Messages:  []claude.Message{{Role: ChatRoleUser, Content: prompt}},
+			MaxTokens: 256,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		rspChan := make(chan string, 1)
+		err = c.claudeClient.PostWithUsage(client, reqBytes, rspChan, func(usage *claude.Usage) {
+			c.recordUsage(job, usage.InputTokens, usage.OutputTokens)
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return <-rspChan, nil
+
+	case AIName_Gemini:
+		model := c.geminiClient.GenerativeModel(geminiModel)
+		resp, err := model.GenerateContent(context.Background(), genai.Text(prompt))
+		if err != nil {
+			return "", err
+		}
+
+		if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+			c.recordGeminiUsage(job, model, []*genai.Content{{Parts: []genai.Part{genai.Text(prompt)}}}, nil)
+			return "", errors.New("gemini response empty")
+		}
+
+		c.recordGeminiUsage(job, model, []*genai.Content{{Parts: []genai.Part{genai.Text(prompt)}}}, resp.Candidates[0].Content)
+
+		text, ok := resp.Candidates[0].Content.Parts[0].(genai.Text)
+		if !ok {
+			return "", errors.New("gemini response parts not text")
+		}
+
+		return string(text), nil
+	}
+
+	return "", errors.New("no ai support")
+}
@@ -0,0 +1,131 @@
+package chatbot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// 用户指令的处理Handler，args为指令后面的参数
+type commandHandler func(userID string, args string) (string, error)
+
+// registerCommandHandler 注册用户指令的处理器
+func (c *Chatbot) registerCommandHandler() {
+	c.commandHandlerMap["/undo"] = c.handleUndoCommand
+	c.commandHandlerMap["/group"] = c.handleGroupCommand
+	c.commandHandlerMap["/quota"] = c.handleQuotaCommand
+	c.commandHandlerMap["/usage"] = c.handleUsageCommand
+	c.commandHandlerMap["/history"] = c.handleHistoryCommand
+	c.commandHandlerMap["/export"] = c.handleExportCommand
+	c.commandHandlerMap["/forget"] = c.handleForgetCommand
+	c.commandHandlerMap["/new"] = c.handleNewCommand
+	c.commandHandlerMap["/list"] = c.handleListCommand
+	c.commandHandlerMap["/switch"] = c.handleSwitchCommand
+	c.commandHandlerMap["/rename"] = c.handleRenameCommand
+	c.commandHandlerMap["/last"] = c.handleLastCommand
+	c.commandHandlerMap["/get"] = c.handleGetCommand
+	c.commandHandlerMap["/kb"] = c.handleKnowledgeCommand
+	c.commandHandlerMap["/draw"] = c.handleDrawCommand
+	c.commandHandlerMap["/voice"] = c.handleVoiceCommand
+}
+
+// handleCommand 处理"/"开头的用户指令，未命中指令时返回false
+func (c *Chatbot) handleCommand(userID string, input string) (string, bool, error) {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, "/") {
+		return "", false, nil
+	}
+
+	name, args, _ := strings.Cut(input, " ")
+	handler, ok := c.commandHandlerMap[name]
+	if !ok {
+		return "", false, nil
+	}
+
+	log.Printf("[INFO][handleCommand] userID=%s, command=%s, args=%s", userID, name, args)
+
+	rsp, err := handler(userID, strings.TrimSpace(args))
+	return rsp, true, err
+}
+
+// /undo 撤回上一条AI回复，并从聊天上下文中删除该轮对话
+func (c *Chatbot) handleUndoCommand(userID string, args string) (string, error) {
+	if c.isProcessing(userID) {
+		return "有提问在后台数据生成中，请生成完成后再撤回~", nil
+	}
+
+	if err := c.RecallLastAnswer(userID); err != nil {
+		if errors.Is(err, ErrNoAnswerToRecall) {
+			return "没有可以撤回的回复", nil
+		}
+
+		log.Printf("[ERROR][handleUndoCommand] RecallLastAnswer failed, userID=%s, err=%s", userID, err)
+		return "撤回失败，请稍后再试", nil
+	}
+
+	return "已撤回上一轮对话", nil
+}
+
+const groupCommandUsage = `群聊指令:
+/group create <群名> <userid1,userid2,...> 创建群聊
+/group <chatid> <问题> 在群聊中提问，回答推送到群聊`
+
+// /group 创建群聊，或者在群聊的上下文中提问
+func (c *Chatbot) handleGroupCommand(userID string, args string) (string, error) {
+	if c.groupPublisher == nil {
+		return "暂不支持群聊", nil
+	}
+
+	sub, rest, _ := strings.Cut(args, " ")
+	rest = strings.TrimSpace(rest)
+	if sub == "" || rest == "" {
+		return groupCommandUsage, nil
+	}
+
+	if sub == "create" {
+		if c.groupCreator == nil {
+			return "暂不支持创建群聊", nil
+		}
+
+		name, users, _ := strings.Cut(rest, " ")
+
+		// 创建人作为群主，群聊至少需要2人
+		userList := []string{userID}
+		for _, user := range strings.Split(users, ",") {
+			user = strings.TrimSpace(user)
+			if user != "" && !slices.Contains(userList, user) {
+				userList = append(userList, user)
+			}
+		}
+
+		if len(userList) < 2 {
+			return "群聊至少需要2人\n" + groupCommandUsage, nil
+		}
+
+		chatID, err := c.groupCreator(name, userID, userList)
+		if err != nil {
+			log.Printf("[ERROR][handleGroupCommand] create group failed, userID=%s, err=%s", userID, err)
+			return "创建群聊失败:" + err.Error(), nil
+		}
+
+		return fmt.Sprintf("群聊[%s]创建成功, chatid: %s\n使用 /group %s <问题> 在群聊中提问", name, chatID, chatID), nil
+	}
+
+	// 只有群成员可以在群聊中提问
+	chatID := sub
+	if c.groupMemberList != nil {
+		members, err := c.groupMemberList(chatID)
+		if err != nil {
+			log.Printf("[ERROR][handleGroupCommand] get group members failed, chatID=%s, err=%s", chatID, err)
+			return "获取群聊信息失败，请检查chatid", nil
+		}
+
+		if !slices.Contains(members, userID) {
+			return "你不是该群聊的成员", nil
+		}
+	}
+
+	return c.GetGroupResponse(chatID, userID, rest)
+}
@@ -26,9 +26,118 @@ type RedisConfig struct {
 	Enable   bool   `json:"enable"`
 }
 
+// 推送队列配置，开启Redis时队列持久化到Redis
+type PushQueueConfig struct {
+	Workers        int     `json:"workers"`          // 推送的worker数
+	MaxRetry       int     `json:"max_retry"`        // 最大推送次数，超过后进入死信队列
+	RetryInterval  int     `json:"retry_interval"`   // 首次重试间隔，之后指数退避，单位秒
+	RateLimit      float64 `json:"rate_limit"`       // 每秒最大推送消息数
+	Capacity       int     `json:"capacity"`         // 内存队列的容量
+	DeadLetterSize int     `json:"dead_letter_size"` // 死信队列保留的最大条数
+}
+
+// 频率限制和token额度，为0表示不限制
+type QuotaLimit struct {
+	Rate          float64 `json:"rate"`           // 每分钟最多的请求数，按照令牌桶限频
+	Burst         int     `json:"burst"`          // 令牌桶的容量，默认等于Rate
+	DailyTokens   int64   `json:"daily_tokens"`   // 每日的token额度
+	MonthlyTokens int64   `json:"monthly_tokens"` // 每月的token额度
+}
+
+// 用户和部门的额度配置，开启Redis时额度计数保存在Redis
+type QuotaConfig struct {
+	Enable      bool                  `json:"enable"`
+	User        QuotaLimit            `json:"user"`        // 每个用户默认的额度
+	Department  QuotaLimit            `json:"department"`  // 每个部门默认的额度
+	Users       map[string]QuotaLimit `json:"users"`       // userid -> 单独配置的额度
+	Departments map[string]QuotaLimit `json:"departments"` // 部门id或者部门名称 -> 单独配置的额度
+}
+
+// 模型价格，单位为每1000 token的价格
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// 用量统计配置，开启Redis时用量明细保存在Redis
+type UsageConfig struct {
+	Enable        bool                  `json:"enable"`
+	RetentionDays int                   `json:"retention_days"` // 用量明细的保留天数，默认90天
+	Prices        map[string]ModelPrice `json:"prices"`         // 模型名称 -> 价格，覆盖默认的价格表
+}
+
+// 提问的排队配置，有提问生成中时，之后的提问按照顺序排队处理
+type RequestQueueConfig struct {
+	Depth       int   `json:"depth"`        // 每个会话最多排队的提问数，为0时不排队，直接提示稍后再试
+	Merge       bool  `json:"merge"`        // 是否将同一个人连续发送的消息合并为一个提问
+	MergeWindow int64 `json:"merge_window"` // 合并的时间窗口，和排队中的上一条消息间隔不超过该时长时合并，单位秒，默认5s
+}
+
+// 聊天历史的存储和保留策略
+type HistoryConfig struct {
+	Store           string `json:"store"`            // 存储类型，memory、redis或者bolt，默认开启Redis时为redis，否则为memory
+	Path            string `json:"path"`             // bolt存储的文件路径，默认chat_history.db
+	MaxLength       int    `json:"max_length"`       // 每个会话保存的最大历史条数，默认1000
+	TTL             int64  `json:"ttl"`              // 历史的保留时长，最后一次写入后开始计算，单位秒，为0不过期
+	IdleTimeout     int64  `json:"idle_timeout"`     // 内存中空闲用户的淘汰时长，单位秒，为0时不淘汰
+	JanitorInterval int64  `json:"janitor_interval"` // 内存和bolt存储的清理间隔，单位秒，默认10min
+}
+
+// 工具调用配置，开启后AI可以按需调用注册的工具，例如查询内部数据
+type ToolConfig struct {
+	Enable   bool `json:"enable"`
+	MaxSteps int  `json:"max_steps"` // 一次提问最多请求AI的轮数，超过后提问失败，默认5
+}
+
+// 知识库配置，将目录下的文档切片后生成embedding，提问时检索相关的片段作为参考资料，依赖OpenAI
+type KnowledgeConfig struct {
+	Enable       bool    `json:"enable"`
+	Dir          string  `json:"dir"`           // 文档目录，支持markdown、txt和pdf，pdf需要安装pdftotext
+	Store        string  `json:"store"`         // 向量索引的存储类型，memory或者redis，默认开启Redis时为redis，否则为memory
+	Path         string  `json:"path"`          // memory存储持久化的文件路径，为空时不持久化
+	Model        string  `json:"model"`         // embedding模型，默认text-embedding-3-small
+	ChunkSize    int     `json:"chunk_size"`    // 每个片段的最大字符数，默认500
+	ChunkOverlap int     `json:"chunk_overlap"` // 相邻片段重叠的字符数，默认50
+	TopK         int     `json:"top_k"`         // 每次提问最多引用的片段数，默认3
+	MinScore     float64 `json:"min_score"`     // 引用片段的最低相似度，默认0.3
+}
+
+// 图片生成配置，/draw指令生成和编辑图片，依赖OpenAI
+type ImageConfig struct {
+	Enable    bool   `json:"enable"`
+	Model     string `json:"model"`      // 生成图片的模型，默认dall-e-3
+	EditModel string `json:"edit_model"` // 编辑图片的模型，默认gpt-image-1，图片变体固定使用dall-e-2
+	Size      string `json:"size"`       // 图片的尺寸，默认1024x1024
+	Quality   string `json:"quality"`    // 图片的质量，为空时使用模型的默认值
+}
+
+// 语音配置，回答合成语音后推送，语音消息识别后提问，依赖ffmpeg转码为企业微信要求的amr格式
+type VoiceConfig struct {
+	Enable             bool   `json:"enable"`
+	Mode               string `json:"mode"`                // 用户默认的语音回复模式，auto、on或者off，默认auto，即发送语音提问时回复语音
+	Model              string `json:"model"`               // OpenAI语音合成的模型，默认tts-1
+	Voice              string `json:"voice"`               // OpenAI语音合成的音色，默认alloy
+	TranscriptionModel string `json:"transcription_model"` // OpenAI语音识别的模型，默认whisper-1
+	FFmpeg             string `json:"ffmpeg"`              // ffmpeg的路径，默认从PATH中查找，需要支持libopencore_amrnb编码
+}
+
 type Config struct {
-	OpenAI OpenAIConfig `json:"open_ai"`
-	Gemini GeminiConfig `json:"gemini"`
-	Claude ClaudeConfig `json:"claude"`
-	Redis  RedisConfig  `json:"redis"`
+	OpenAI    OpenAIConfig    `json:"open_ai"`
+	Gemini    GeminiConfig    `json:"gemini"`
+	Claude    ClaudeConfig    `json:"claude"`
+	Redis     RedisConfig     `json:"redis"`
+	PushQueue PushQueueConfig `json:"push_queue"`
+	Quota     QuotaConfig     `json:"quota"`
+	Usage     UsageConfig     `json:"usage"`
+	History   HistoryConfig   `json:"history"`
+
+	RequestQueue RequestQueueConfig `json:"request_queue"`
+	Tool         ToolConfig         `json:"tool"`
+	Knowledge    KnowledgeConfig    `json:"knowledge"`
+	Image        ImageConfig        `json:"image"`
+	Voice        VoiceConfig        `json:"voice"`
+
+	Admins []string `json:"admins"` // 管理员的userid列表，可以使用管理指令
+
+	DepartmentRoute map[string]string `json:"department_route"` // 部门id或者部门名称 -> AI名称，按照用户所在部门选择AI
 }
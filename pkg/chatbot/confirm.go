@@ -0,0 +1,119 @@
+package chatbot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	ConfirmKeyConfirm = "confirm" // 确认卡片中确认按钮的key
+	ConfirmKeyCancel  = "cancel"  // 确认卡片中取消按钮的key
+
+	confirmTimeout = 600 // 待确认操作的有效期，单位秒
+)
+
+// 等待用户确认的操作，有副作用的工具需要用户在卡片中点击确认后才执行
+type pendingAction struct {
+	userID   string // 只有发起操作的用户可以确认
+	title    string
+	action   func() (string, error)
+	expireAt int64
+}
+
+// 注册确认卡片的回调，publisher推送带确认和取消按钮的卡片，updater在用户点击后将按钮替换为处理结果
+func (c *Chatbot) RegisterConfirmCard(publisher func(userID, taskID, title, content string) error, updater func(userID, responseCode, replaceName string) error) {
+	c.confirmPublisher = publisher
+	c.confirmUpdater = updater
+}
+
+// RequestConfirmation 推送确认卡片给userID，用户点击确认后才执行action，返回给AI的说明
+func (c *Chatbot) RequestConfirmation(userID, title, content string, action func() (string, error)) (string, error) {
+	if c.confirmPublisher == nil {
+		return "", errors.New("confirm card publisher not registered")
+	}
+
+	// 任务id同一个应用不能重复
+	taskID := "confirm_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	now := time.Now().Unix()
+
+	c.confirmMu.Lock()
+	for id, pending := range c.pendingActions {
+		if pending.expireAt < now {
+			delete(c.pendingActions, id)
+		}
+	}
+
+	c.pendingActions[taskID] = &pendingAction{
+		userID:   userID,
+		title:    title,
+		action:   action,
+		expireAt: now + confirmTimeout,
+	}
+	c.confirmMu.Unlock()
+
+	if err := c.confirmPublisher(userID, taskID, title, content); err != nil {
+		log.Printf("[ERROR][RequestConfirmation] publish confirm card failed, userID=%s, err=%s", userID, err)
+
+		c.confirmMu.Lock()
+		delete(c.pendingActions, taskID)
+		c.confirmMu.Unlock()
+
+		return "", err
+	}
+
+	log.Printf("[INFO][RequestConfirmation] userID=%s, taskID=%s, title=%s", userID, taskID, title)
+
+	return fmt.Sprintf("已向用户推送\"%s\"的确认卡片，用户在%d分钟内点击确认后才会执行，请告知用户在卡片中确认", title, confirmTimeout/60), nil
+}
+
+// HandleConfirmEvent 处理确认卡片的按钮点击事件，返回回复给用户的处理结果
+func (c *Chatbot) HandleConfirmEvent(userID, taskID, key, responseCode string) string {
+	c.confirmMu.Lock()
+	pending, exist := c.pendingActions[taskID]
+	if exist && pending.userID == userID {
+		delete(c.pendingActions, taskID)
+	}
+	c.confirmMu.Unlock()
+
+	if !exist || pending.userID != userID {
+		log.Printf("[WARN][HandleConfirmEvent] pending action not found, userID=%s, taskID=%s", userID, taskID)
+		c.updateConfirmCard(userID, responseCode, "已失效")
+		return ""
+	}
+
+	if pending.expireAt < time.Now().Unix() {
+		c.updateConfirmCard(userID, responseCode, "已过期")
+		return fmt.Sprintf("\"%s\"的确认已过期，请重新发起", pending.title)
+	}
+
+	if key != ConfirmKeyConfirm {
+		log.Printf("[INFO][HandleConfirmEvent] cancelled, userID=%s, taskID=%s", userID, taskID)
+		c.updateConfirmCard(userID, responseCode, "已取消")
+		return fmt.Sprintf("已取消\"%s\"", pending.title)
+	}
+
+	result, err := pending.action()
+	if err != nil {
+		log.Printf("[ERROR][HandleConfirmEvent] action failed, userID=%s, taskID=%s, err=%s", userID, taskID, err)
+		c.updateConfirmCard(userID, responseCode, "执行失败")
+		return fmt.Sprintf("\"%s\"执行失败: %s", pending.title, err)
+	}
+
+	log.Printf("[INFO][HandleConfirmEvent] confirmed, userID=%s, taskID=%s", userID, taskID)
+	c.updateConfirmCard(userID, responseCode, "已确认")
+
+	return result
+}
+
+func (c *Chatbot) updateConfirmCard(userID, responseCode, replaceName string) {
+	if c.confirmUpdater == nil || responseCode == "" {
+		return
+	}
+
+	if err := c.confirmUpdater(userID, responseCode, replaceName); err != nil {
+		log.Printf("[ERROR][updateConfirmCard] update confirm card failed, userID=%s, err=%s", userID, err)
+	}
+}
@@ -0,0 +1,298 @@
+package chatbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HistoryFormatMarkdown = "md"
+	HistoryFormatJSON     = "json"
+
+	historyPageSize      = 10
+	historyPreviewLength = 60 // 列表中每条消息预览的最大字数
+)
+
+// 聊天历史中的一条消息
+type HistoryMessage struct {
+	Id        string `json:"id,omitempty"` // AI回复的id，可以通过/get获取
+	Role      string `json:"role"`
+	Content   string `json:"content"`
+	Ai        string `json:"ai"`
+	Ts        int64  `json:"ts"`
+	MsgId     string `json:"msgid,omitempty"`     // AI回复推送后返回的msgid，用于撤回消息
+	Truncated bool   `json:"truncated,omitempty"` // AI回复达到长度限制被截断
+}
+
+// 聊天历史的查询条件，字段为空时不过滤
+type HistoryQuery struct {
+	Keyword string    // 包含的关键词，不区分大小写
+	From    time.Time // 开始时间
+	To      time.Time // 结束时间
+}
+
+func (q *HistoryQuery) match(msg *HistoryMessage) bool {
+	if q.Keyword != "" && !strings.Contains(strings.ToLower(msg.Content), strings.ToLower(q.Keyword)) {
+		return false
+	}
+
+	ts := time.Unix(msg.Ts, 0)
+	if !q.From.IsZero() && ts.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && ts.After(q.To) {
+		return false
+	}
+
+	return true
+}
+
+// 注册文件推送的回调，参数为userid、文件名和文件内容，用于导出聊天历史
+func (c *Chatbot) RegisterFilePublish(filePublisher func(string, string, []byte) error) {
+	c.filePublisher = filePublisher
+}
+
+// loadHistory 读取用户所有会话的完整聊天历史，按照时间排序
+func (c *Chatbot) loadHistory(userID string) []*HistoryMessage {
+	c.sessionCtxMu.Lock()
+	defer c.sessionCtxMu.Unlock()
+
+	history := []*HistoryMessage{}
+
+	conversations, err := c.historyStore.List(userID)
+	if err != nil {
+		log.Printf("[ERROR][loadHistory] history store List failed, userID=%s, err=%s", userID, err)
+		return history
+	}
+
+	for _, conversation := range conversations {
+		messages, err := c.historyStore.Range(userID, conversation, 0, -1)
+		if err != nil {
+			log.Printf("[ERROR][loadHistory] history store Range failed, userID=%s, err=%s", userID, err)
+			continue
+		}
+
+		history = append(history, messages...)
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Ts < history[j].Ts
+	})
+
+	return history
+}
+
+// GetHistoryPage 分页获取聊天历史，page从1开始，按照时间从新到旧，返回当页的消息和总条数
+func (c *Chatbot) GetHistoryPage(userID string, page, pageSize int) ([]*HistoryMessage, int) {
+	history := c.loadHistory(userID)
+	total := len(history)
+
+	if page <= 0 {
+		page = 1
+	}
+
+	end := total - (page-1)*pageSize
+	if end <= 0 {
+		return nil, total
+	}
+
+	begin := max(end-pageSize, 0)
+
+	messages := make([]*HistoryMessage, 0, end-begin)
+	for i := end - 1; i >= begin; i-- {
+		messages = append(messages, history[i])
+	}
+
+	return messages, total
+}
+
+// SearchHistory 按照关键词和时间范围搜索聊天历史，按照时间从旧到新
+func (c *Chatbot) SearchHistory(userID string, query *HistoryQuery) []*HistoryMessage {
+	messages := []*HistoryMessage{}
+	for _, msg := range c.loadHistory(userID) {
+		if query.match(msg) {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// ExportHistory 导出聊天历史，format为md或者json，返回文件名和文件内容
+func (c *Chatbot) ExportHistory(userID string, format string, query *HistoryQuery) (string, []byte, error) {
+	messages := c.SearchHistory(userID, query)
+	if len(messages) == 0 {
+		return "", nil, errors.New("history is empty")
+	}
+
+	fileName := fmt.Sprintf("chat-history-%s-%s.%s", userID, time.Now().Format("20060102150405"), format)
+
+	switch format {
+	case HistoryFormatJSON:
+		data, err := json.MarshalIndent(messages, "", "  ")
+		return fileName, data, err
+	case HistoryFormatMarkdown:
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("# 聊天历史 %s\n\n", userID))
+		for _, msg := range messages {
+			buf.WriteString(fmt.Sprintf("### %s %s\n\n%s\n\n", historyRoleName(msg), time.Unix(msg.Ts, 0).Format("2006-01-02 15:04:05"), msg.Content))
+		}
+		return fileName, buf.Bytes(), nil
+	}
+
+	return "", nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+func historyRoleName(msg *HistoryMessage) string {
+	if msg.Role == ChatRoleAI {
+		return "🤖 " + msg.Ai
+	}
+
+	return "🧑 我"
+}
+
+// 消息的预览，过长时截断
+func historyPreview(msg *HistoryMessage) string {
+	content := []rune(strings.ReplaceAll(msg.Content, "\n", " "))
+	if len(content) > historyPreviewLength {
+		content = append(content[:historyPreviewLength], []rune("...")...)
+	}
+
+	if msg.Id != "" {
+		return fmt.Sprintf("[%s] %s #%s: %s", time.Unix(msg.Ts, 0).Format("01-02 15:04"), historyRoleName(msg), msg.Id, string(content))
+	}
+
+	return fmt.Sprintf("[%s] %s: %s", time.Unix(msg.Ts, 0).Format("01-02 15:04"), historyRoleName(msg), string(content))
+}
+
+// 解析查询条件，参数格式为[关键词] [from=2024-01-02] [to=2024-01-31]
+func parseHistoryQuery(args []string) (*HistoryQuery, error) {
+	query := &HistoryQuery{}
+	keywords := []string{}
+
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "from="); ok {
+			t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return nil, err
+			}
+			query.From = t
+		} else if value, ok := strings.CutPrefix(arg, "to="); ok {
+			t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return nil, err
+			}
+			// 包含结束日期当天
+			query.To = t.AddDate(0, 0, 1).Add(-time.Second)
+		} else {
+			keywords = append(keywords, arg)
+		}
+	}
+
+	query.Keyword = strings.Join(keywords, " ")
+
+	return query, nil
+}
+
+const historyCommandUsage = `聊天历史指令:
+/history [页码] 分页查看聊天历史，从新到旧
+/history search <关键词> [from=2024-01-02] [to=2024-01-31] 搜索聊天历史
+/export [md|json] [关键词] [from=2024-01-02] [to=2024-01-31] 导出聊天历史为文件`
+
+// /history 分页查看或者搜索聊天历史
+func (c *Chatbot) handleHistoryCommand(userID string, args string) (string, error) {
+	fields := strings.Fields(args)
+
+	if len(fields) > 0 && fields[0] == "search" {
+		query, err := parseHistoryQuery(fields[1:])
+		if err != nil || len(fields) == 1 {
+			return historyCommandUsage, nil
+		}
+
+		messages := c.SearchHistory(userID, query)
+		if len(messages) == 0 {
+			return "没有找到相关的聊天记录", nil
+		}
+
+		lines := []string{fmt.Sprintf("找到%d条聊天记录:", len(messages))}
+		for i, msg := range messages {
+			// 只展示最近的一页，完整结果可以导出
+			if i < len(messages)-historyPageSize {
+				continue
+			}
+			lines = append(lines, historyPreview(msg))
+		}
+
+		if len(messages) > historyPageSize {
+			lines = append(lines, fmt.Sprintf("仅展示最近%d条，使用 /export md %s 导出全部", historyPageSize, strings.Join(fields[1:], " ")))
+		}
+
+		return strings.Join(lines, "\n"), nil
+	}
+
+	page := 1
+	if len(fields) > 0 {
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n <= 0 {
+			return historyCommandUsage, nil
+		}
+		page = n
+	}
+
+	messages, total := c.GetHistoryPage(userID, page, historyPageSize)
+	if len(messages) == 0 {
+		if total == 0 {
+			return "还没有聊天记录", nil
+		}
+		return fmt.Sprintf("没有第%d页，共%d条聊天记录", page, total), nil
+	}
+
+	pages := (total + historyPageSize - 1) / historyPageSize
+	lines := []string{fmt.Sprintf("聊天记录 第%d/%d页，共%d条:", page, pages, total)}
+	for _, msg := range messages {
+		lines = append(lines, historyPreview(msg))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// /export 导出聊天历史，以文件的形式推送给用户
+func (c *Chatbot) handleExportCommand(userID string, args string) (string, error) {
+	if c.filePublisher == nil {
+		return "暂不支持导出文件", nil
+	}
+
+	fields := strings.Fields(args)
+
+	format := HistoryFormatMarkdown
+	if len(fields) > 0 && (fields[0] == HistoryFormatMarkdown || fields[0] == HistoryFormatJSON) {
+		format = fields[0]
+		fields = fields[1:]
+	}
+
+	query, err := parseHistoryQuery(fields)
+	if err != nil {
+		return historyCommandUsage, nil
+	}
+
+	fileName, data, err := c.ExportHistory(userID, format, query)
+	if err != nil {
+		log.Printf("[WARN][handleExportCommand] ExportHistory failed, userID=%s, err=%s", userID, err)
+		return "没有可以导出的聊天记录", nil
+	}
+
+	if err := c.filePublisher(userID, fileName, data); err != nil {
+		log.Printf("[ERROR][handleExportCommand] publish file failed, userID=%s, err=%s", userID, err)
+		return "导出文件发送失败，请稍后再试", nil
+	}
+
+	return "聊天记录已导出，请查收文件: " + fileName, nil
+}
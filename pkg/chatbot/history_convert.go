@@ -0,0 +1,153 @@
+package chatbot
+
+import (
+	"log"
+	"strings"
+
+	"github.com/walkerdu/wecom-backend/pkg/claude"
+	openai "github.com/walkerdu/wecom-backend/pkg/openai-v1"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// 聊天历史统一保存为与AI无关的格式，角色只有ChatRoleUser和ChatRoleAI，每条消息的Ai字段记录回复的模型
+// 请求时再按照各个AI的要求转换，切换模型后可以继续之前的对话
+
+const historyConversationPrefix = "chat" // 统一历史的会话名称，默认对话为chat，其他对话为chat@<对话id>
+
+// normalizeTurns 规范化聊天历史：跳过空消息和未知角色，连续相同角色时保留最后一条
+// 之前的提问没有得到回复时，只保留最新的提问
+func normalizeTurns(history []*HistoryMessage) []*HistoryMessage {
+	turns := make([]*HistoryMessage, 0, len(history))
+	for _, msg := range history {
+		if strings.TrimSpace(msg.Content) == "" || (msg.Role != ChatRoleUser && msg.Role != ChatRoleAI) {
+			continue
+		}
+
+		if len(turns) > 0 && turns[len(turns)-1].Role == msg.Role {
+			turns[len(turns)-1] = msg
+			continue
+		}
+
+		turns = append(turns, msg)
+	}
+
+	return turns
+}
+
+// 去掉开头的AI回复，Claude和Gemini要求第一条必须是用户的消息
+func trimLeadingAI(turns []*HistoryMessage) []*HistoryMessage {
+	for len(turns) > 0 && turns[0].Role == ChatRoleAI {
+		turns = turns[1:]
+	}
+
+	return turns
+}
+
+// toOpenAIMessages 转换为OpenAI的消息，追加在ctxs之后
+func toOpenAIMessages(ctxs []openai.ChatMessage, history []*HistoryMessage) []openai.ChatMessage {
+	for _, msg := range normalizeTurns(history) {
+		role := openai.User
+		if msg.Role == ChatRoleAI {
+			role = openai.Assistant
+		}
+
+		ctxs = append(ctxs, openai.ChatMessage{
+			Content: msg.Content,
+			Role:    role,
+		})
+	}
+
+	return ctxs
+}
+
+// toClaudeMessages 转换为Claude的消息，要求user和assistant严格交替，并且以user开头
+func toClaudeMessages(history []*HistoryMessage) []claude.Message {
+	messages := []claude.Message{}
+	for _, msg := range trimLeadingAI(normalizeTurns(history)) {
+		role := "user"
+		if msg.Role == ChatRoleAI {
+			role = "assistant"
+		}
+
+		messages = append(messages, claude.Message{
+			Content: msg.Content,
+			Role:    role,
+		})
+	}
+
+	return messages
+}
+
+// toGeminiHistory 转换为Gemini的历史，要求user和model成对出现，以user开头、model结尾
+// 本次的提问通过SendMessage发送，不包含在历史中
+func toGeminiHistory(history []*HistoryMessage) []*genai.Content {
+	turns := trimLeadingAI(normalizeTurns(history))
+	if len(turns) > 0 && turns[len(turns)-1].Role == ChatRoleUser {
+		turns = turns[:len(turns)-1]
+	}
+
+	contents := []*genai.Content{}
+	for _, msg := range turns {
+		role := "user"
+		if msg.Role == ChatRoleAI {
+			role = "model"
+		}
+
+		contents = append(contents, &genai.Content{
+			Parts: []genai.Part{
+				genai.Text(msg.Content),
+			},
+			Role: role,
+		})
+	}
+
+	return contents
+}
+
+// 之前按照AI分别保存的会话名称，返回对应的统一会话名称
+func legacyConversationTarget(conversation string) (string, bool) {
+	name, suffix, found := strings.Cut(conversation, "@")
+	if name != AIName_OpenAI && name != AIName_Gemini && name != AIName_Claude {
+		return "", false
+	}
+
+	if !found {
+		return historyConversationPrefix, true
+	}
+
+	return historyConversationPrefix + "@" + suffix, true
+}
+
+// migrateLegacyHistory 将用户之前按照AI分别保存的聊天历史，按照时间顺序合并到统一的会话中
+// 合并和删除之前的会话由存储在同一个事务中完成，中途失败或者多个实例同时合并时不会丢失或者重复消息
+// 每个用户只在进程内检查一次，调用方需要持有sessionCtxMu
+func (c *Chatbot) migrateLegacyHistory(userID string) {
+	if _, done := c.migratedUsers.Load(userID); done {
+		return
+	}
+
+	conversations, err := c.historyStore.List(userID)
+	if err != nil {
+		log.Printf("[ERROR][migrateLegacyHistory] history store List failed, userID=%s, err=%s", userID, err)
+		return
+	}
+
+	targets := map[string][]string{}
+	for _, conversation := range conversations {
+		if target, ok := legacyConversationTarget(conversation); ok {
+			targets[target] = append(targets[target], conversation)
+		}
+	}
+
+	for target, legacy := range targets {
+		if err := c.historyStore.Merge(userID, target, legacy); err != nil {
+			log.Printf("[ERROR][migrateLegacyHistory] history store Merge failed, userID=%s, target=%s, err=%s", userID, target, err)
+			return
+		}
+
+		log.Printf("[INFO][migrateLegacyHistory] userID=%s, target=%s, migrate conversations=%v", userID, target, legacy)
+	}
+
+	c.migratedUsers.Store(userID, struct{}{})
+}
@@ -0,0 +1,78 @@
+package chatbot
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newMigrateTestStores(t *testing.T) map[string]HistoryStore {
+	bolt, err := newBoltHistoryStore(&HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db")}, defaultHistoryMaxLength)
+	if err != nil {
+		t.Fatalf("newBoltHistoryStore failed, err=%s", err)
+	}
+	t.Cleanup(func() { bolt.db.Close() })
+
+	return map[string]HistoryStore{
+		HistoryStoreMemory: newMemoryHistoryStore(&HistoryConfig{}, defaultHistoryMaxLength),
+		HistoryStoreBolt:   bolt,
+	}
+}
+
+// 按照AI保存的历史按照时间顺序合并到统一会话，重复合并和并发合并都不会产生重复的消息
+func TestMigrateLegacyHistory(t *testing.T) {
+	seed := []struct {
+		conversation string
+		ts           int64
+	}{
+		{AIName_OpenAI, 1},
+		{AIName_Gemini, 2},
+		{historyConversationPrefix, 3},
+		{AIName_OpenAI, 4},
+		{AIName_Claude + "@2", 5},
+		{historyConversationPrefix + "@2", 6},
+	}
+
+	want := map[string][]int64{
+		historyConversationPrefix:        {1, 2, 3, 4},
+		historyConversationPrefix + "@2": {5, 6},
+	}
+
+	for name, store := range newMigrateTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, msg := range seed {
+				store.Append("alice", msg.conversation, &HistoryMessage{Role: ChatRoleUser, Content: "hi", Ts: msg.ts})
+			}
+
+			// 模拟多个实例同时合并，之后进程重启再次检查
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					(&Chatbot{historyStore: store}).migrateLegacyHistory("alice")
+				}()
+			}
+			wg.Wait()
+			(&Chatbot{historyStore: store}).migrateLegacyHistory("alice")
+
+			conversations, _ := store.List("alice")
+			if len(conversations) != len(want) {
+				t.Fatalf("conversations = %v, want %d", conversations, len(want))
+			}
+
+			for conversation, wantTs := range want {
+				messages, _ := store.Range("alice", conversation, 0, -1)
+				if len(messages) != len(wantTs) {
+					t.Fatalf("%s has %d messages, want %d", conversation, len(messages), len(wantTs))
+				}
+
+				for i, msg := range messages {
+					if msg.Ts != wantTs[i] {
+						t.Fatalf("%s message %d ts = %d, want %d", conversation, i, msg.Ts, wantTs[i])
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,514 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	HistoryStoreMemory = "memory"
+	HistoryStoreRedis  = "redis"
+	HistoryStoreBolt   = "bolt"
+
+	historyConversationsKeyPrefix = "chatbot-convs-" // Redis中保存用户所有会话名称的set
+	historyMergeMaxRetry          = 3                // Redis合并会话时会话被并发修改的重试次数
+)
+
+// HistoryStore 聊天历史的存储，每个用户可以有多个会话，每个会话是按时间顺序追加的消息列表
+// 下标的含义和Redis list一致，负数表示从后往前，-1为最后一条
+type HistoryStore interface {
+	// Append 追加一条消息，按照保留策略裁剪长度和刷新过期时间
+	Append(userID, conversation string, message *HistoryMessage) error
+	// Range 获取[start, stop]之间的消息
+	Range(userID, conversation string, start, stop int) ([]*HistoryMessage, error)
+	// Set 修改指定下标的消息
+	Set(userID, conversation string, index int, message *HistoryMessage) error
+	// Trim 只保留[start, stop]之间的消息
+	Trim(userID, conversation string, start, stop int) error
+	// Delete 删除会话，conversation为空时删除用户的所有会话
+	Delete(userID, conversation string) error
+	// List 获取用户的所有会话名称
+	List(userID string) ([]string, error)
+	// Merge 将sources会话的消息按照时间顺序合并到target会话后删除sources，写入和删除在同一个事务中完成
+	// sources已经被合并时不会重复写入
+	Merge(userID, target string, sources []string) error
+}
+
+// newHistoryStore 按照配置创建聊天历史的存储，未配置时开启Redis使用Redis，否则使用内存
+func newHistoryStore(config *HistoryConfig, rdb *redis.Client) (HistoryStore, error) {
+	storeType := config.Store
+	if storeType == "" {
+		storeType = HistoryStoreMemory
+		if rdb != nil {
+			storeType = HistoryStoreRedis
+		}
+	}
+
+	maxLength := config.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultHistoryMaxLength
+	}
+
+	switch storeType {
+	case HistoryStoreMemory:
+		return newMemoryHistoryStore(config, maxLength), nil
+	case HistoryStoreRedis:
+		if rdb == nil {
+			return nil, fmt.Errorf("redis history store need redis enable")
+		}
+		return &redisHistoryStore{client: rdb, maxLength: maxLength, ttl: time.Duration(config.TTL) * time.Second}, nil
+	case HistoryStoreBolt:
+		return newBoltHistoryStore(config, maxLength)
+	}
+
+	return nil, fmt.Errorf("unsupported history store: %s", storeType)
+}
+
+// mergeHistoryMessages 按照时间顺序合并多个会话的消息，时间相同时保持原来的顺序，只保留最新的maxLength条
+func mergeHistoryMessages(maxLength int, conversations ...[]*HistoryMessage) []*HistoryMessage {
+	var messages []*HistoryMessage
+	for _, conversation := range conversations {
+		messages = append(messages, conversation...)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Ts < messages[j].Ts
+	})
+
+	if len(messages) > maxLength {
+		messages = messages[len(messages)-maxLength:]
+	}
+
+	return messages
+}
+
+// 将Redis风格的下标转换为切片的[begin, end)，越界时返回false
+func historyRange(length, start, stop int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+
+	start = max(start, 0)
+	stop = min(stop, length-1)
+	if start > stop {
+		return 0, 0, false
+	}
+
+	return start, stop + 1, true
+}
+
+func historyIndex(length, index int) (int, bool) {
+	if index < 0 {
+		index += length
+	}
+
+	return index, index >= 0 && index < length
+}
+
+// 内存存储，进程重启后丢失，定期淘汰空闲的用户和过期的消息
+type memoryHistoryStore struct {
+	maxLength int
+	ttl       int64
+	users     map[string]*memoryHistoryUser
+	mu        sync.Mutex
+}
+
+type memoryHistoryUser struct {
+	conversations map[string][]*HistoryMessage
+	lastActive    int64 // 最近一次写入的时间，用于淘汰空闲的用户
+}
+
+// 内存存储的消息和调用方之间互相复制，调用方修改读取到的消息不会影响存储
+func cloneHistoryMessage(message *HistoryMessage) *HistoryMessage {
+	clone := *message
+	return &clone
+}
+
+func newMemoryHistoryStore(config *HistoryConfig, maxLength int) *memoryHistoryStore {
+	m := &memoryHistoryStore{
+		maxLength: maxLength,
+		ttl:       config.TTL,
+		users:     make(map[string]*memoryHistoryUser),
+	}
+
+	startHistoryJanitor(config.JanitorInterval, func(now int64) {
+		m.sweep(now, config.IdleTimeout)
+	})
+
+	return m
+}
+
+func (m *memoryHistoryStore) Append(userID, conversation string, message *HistoryMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exist := m.users[userID]
+	if !exist {
+		user = &memoryHistoryUser{
+			conversations: make(map[string][]*HistoryMessage),
+		}
+		m.users[userID] = user
+	}
+
+	messages := append(user.conversations[conversation], cloneHistoryMessage(message))
+	if len(messages) > m.maxLength {
+		messages = messages[len(messages)-m.maxLength:]
+	}
+
+	user.conversations[conversation] = messages
+	user.lastActive = time.Now().Unix()
+
+	return nil
+}
+
+func (m *memoryHistoryStore) Range(userID, conversation string, start, stop int) ([]*HistoryMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exist := m.users[userID]
+	if !exist {
+		return nil, nil
+	}
+
+	messages := user.conversations[conversation]
+	begin, end, ok := historyRange(len(messages), start, stop)
+	if !ok {
+		return nil, nil
+	}
+
+	result := make([]*HistoryMessage, 0, end-begin)
+	for _, message := range messages[begin:end] {
+		result = append(result, cloneHistoryMessage(message))
+	}
+
+	return result, nil
+}
+
+func (m *memoryHistoryStore) Set(userID, conversation string, index int, message *HistoryMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exist := m.users[userID]
+	if !exist {
+		return fmt.Errorf("conversation not exist")
+	}
+
+	messages := user.conversations[conversation]
+	i, ok := historyIndex(len(messages), index)
+	if !ok {
+		return fmt.Errorf("index out of range")
+	}
+
+	messages[i] = cloneHistoryMessage(message)
+
+	return nil
+}
+
+func (m *memoryHistoryStore) Trim(userID, conversation string, start, stop int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exist := m.users[userID]
+	if !exist {
+		return nil
+	}
+
+	messages := user.conversations[conversation]
+	begin, end, ok := historyRange(len(messages), start, stop)
+	if !ok {
+		delete(user.conversations, conversation)
+		return nil
+	}
+
+	user.conversations[conversation] = messages[begin:end]
+
+	return nil
+}
+
+func (m *memoryHistoryStore) Delete(userID, conversation string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if conversation == "" {
+		delete(m.users, userID)
+	} else if user, exist := m.users[userID]; exist {
+		delete(user.conversations, conversation)
+	}
+
+	return nil
+}
+
+func (m *memoryHistoryStore) List(userID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversations := []string{}
+	if user, exist := m.users[userID]; exist {
+		for conversation := range user.conversations {
+			conversations = append(conversations, conversation)
+		}
+	}
+
+	sort.Strings(conversations)
+
+	return conversations, nil
+}
+
+func (m *memoryHistoryStore) Merge(userID, target string, sources []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exist := m.users[userID]
+	if !exist {
+		return nil
+	}
+
+	conversations := [][]*HistoryMessage{user.conversations[target]}
+	for _, source := range sources {
+		conversations = append(conversations, user.conversations[source])
+		delete(user.conversations, source)
+	}
+
+	if messages := mergeHistoryMessages(m.maxLength, conversations...); len(messages) > 0 {
+		user.conversations[target] = messages
+	}
+
+	return nil
+}
+
+// sweep 淘汰空闲的用户，删除超过保留时长的消息，idleTimeout为0时不淘汰空闲的用户
+func (m *memoryHistoryStore) sweep(now, idleTimeout int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	evicted := 0
+	for userID, user := range m.users {
+		if idleTimeout > 0 && user.lastActive+idleTimeout < now {
+			delete(m.users, userID)
+			evicted++
+			continue
+		}
+
+		if m.ttl <= 0 {
+			continue
+		}
+
+		for conversation, messages := range user.conversations {
+			i := sort.Search(len(messages), func(i int) bool {
+				return messages[i].Ts+m.ttl >= now
+			})
+			if i == len(messages) {
+				delete(user.conversations, conversation)
+			} else {
+				user.conversations[conversation] = messages[i:]
+			}
+		}
+	}
+
+	if evicted > 0 {
+		log.Printf("[INFO][memoryHistoryStore] evict %d idle users, remain %d", evicted, len(m.users))
+	}
+}
+
+// Redis存储，每个会话一个list，key兼容之前的chatbot-<ai>-<userid>
+type redisHistoryStore struct {
+	client    *redis.Client
+	maxLength int
+	ttl       time.Duration
+}
+
+func (r *redisHistoryStore) Append(userID, conversation string, message *HistoryMessage) error {
+	ctx := context.Background()
+	key := chatSessionKey(userID, conversation)
+	convsKey := historyConversationsKeyPrefix + userID
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, data)
+		pipe.LTrim(ctx, key, int64(-r.maxLength), -1)
+		pipe.SAdd(ctx, convsKey, conversation)
+		if r.ttl > 0 {
+			pipe.Expire(ctx, key, r.ttl)
+			pipe.Expire(ctx, convsKey, r.ttl)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (r *redisHistoryStore) Range(userID, conversation string, start, stop int) ([]*HistoryMessage, error) {
+	result, err := r.client.LRange(context.Background(), chatSessionKey(userID, conversation), int64(start), int64(stop)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRedisHistory(result), nil
+}
+
+func decodeRedisHistory(result []string) []*HistoryMessage {
+	messages := make([]*HistoryMessage, 0, len(result))
+	for _, data := range result {
+		message := &HistoryMessage{}
+		if err := json.Unmarshal([]byte(data), message); err != nil {
+			log.Printf("[ERROR][redisHistoryStore] json Unmarshal failed, err=%s", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+func (r *redisHistoryStore) Set(userID, conversation string, index int, message *HistoryMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return r.client.LSet(context.Background(), chatSessionKey(userID, conversation), int64(index), data).Err()
+}
+
+func (r *redisHistoryStore) Trim(userID, conversation string, start, stop int) error {
+	return r.client.LTrim(context.Background(), chatSessionKey(userID, conversation), int64(start), int64(stop)).Err()
+}
+
+func (r *redisHistoryStore) Delete(userID, conversation string) error {
+	ctx := context.Background()
+
+	if conversation != "" {
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, chatSessionKey(userID, conversation))
+			pipe.SRem(ctx, historyConversationsKeyPrefix+userID, conversation)
+			return nil
+		})
+		return err
+	}
+
+	conversations, err := r.List(userID)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{historyConversationsKeyPrefix + userID}
+	for _, conversation := range conversations {
+		keys = append(keys, chatSessionKey(userID, conversation))
+	}
+
+	return r.client.Del(ctx, keys...).Err()
+}
+
+func (r *redisHistoryStore) List(userID string) ([]string, error) {
+	ctx := context.Background()
+
+	conversations, err := r.client.SMembers(ctx, historyConversationsKeyPrefix+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// 兼容没有会话索引的历史数据
+	for _, aiName := range []string{AIName_OpenAI, AIName_Gemini, AIName_Claude} {
+		if slices.Contains(conversations, aiName) {
+			continue
+		}
+
+		if n, err := r.client.Exists(ctx, chatSessionKey(userID, aiName)).Result(); err == nil && n > 0 {
+			conversations = append(conversations, aiName)
+		}
+	}
+
+	sort.Strings(conversations)
+
+	return conversations, nil
+}
+
+// Merge 通过WATCH保证读取和写入之间会话没有被修改，多个实例同时合并时只有一个成功，其他的重试时sources已经为空
+func (r *redisHistoryStore) Merge(userID, target string, sources []string) error {
+	ctx := context.Background()
+	targetKey := chatSessionKey(userID, target)
+	convsKey := historyConversationsKeyPrefix + userID
+
+	keys := []string{targetKey}
+	members := make([]any, 0, len(sources))
+	for _, source := range sources {
+		keys = append(keys, chatSessionKey(userID, source))
+		members = append(members, source)
+	}
+
+	merge := func(tx *redis.Tx) error {
+		conversations := make([][]*HistoryMessage, 0, len(keys))
+		for _, key := range keys {
+			result, err := tx.LRange(ctx, key, 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			conversations = append(conversations, decodeRedisHistory(result))
+		}
+
+		messages := mergeHistoryMessages(r.maxLength, conversations...)
+		values := make([]any, 0, len(messages))
+		for _, message := range messages {
+			data, err := json.Marshal(message)
+			if err != nil {
+				return err
+			}
+			values = append(values, data)
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, keys...)
+			pipe.SRem(ctx, convsKey, members...)
+			if len(values) > 0 {
+				pipe.RPush(ctx, targetKey, values...)
+				pipe.SAdd(ctx, convsKey, target)
+				if r.ttl > 0 {
+					pipe.Expire(ctx, targetKey, r.ttl)
+					pipe.Expire(ctx, convsKey, r.ttl)
+				}
+			}
+			return nil
+		})
+
+		return err
+	}
+
+	for i := 0; i < historyMergeMaxRetry; i++ {
+		err := r.client.Watch(ctx, merge, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// startHistoryJanitor 定期执行存储的清理
+func startHistoryJanitor(interval int64, sweep func(now int64)) {
+	if interval <= 0 {
+		interval = defaultHistoryJanitorInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			sweep(time.Now().Unix())
+		}
+	}()
+}
@@ -0,0 +1,297 @@
+package chatbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultHistoryBoltPath = "chat_history.db"
+
+	historyBoltBucket = "history"
+	historyBoltSep    = "\x00" // key中userid和会话名称的分隔符
+)
+
+// bolt存储的会话，整个会话序列化为一个value
+type boltHistoryConversation struct {
+	Updated  int64             `json:"updated"` // 最近一次写入的时间，用于过期清理
+	Messages []*HistoryMessage `json:"messages"`
+}
+
+// bolt存储，单机部署时不依赖Redis也可以持久化聊天历史
+type boltHistoryStore struct {
+	db        *bolt.DB
+	maxLength int
+	ttl       int64
+}
+
+func newBoltHistoryStore(config *HistoryConfig, maxLength int) (*boltHistoryStore, error) {
+	path := config.Path
+	if path == "" {
+		path = defaultHistoryBoltPath
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt db %s failed, err=%w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(historyBoltBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	b := &boltHistoryStore{
+		db:        db,
+		maxLength: maxLength,
+		ttl:       config.TTL,
+	}
+
+	if b.ttl > 0 {
+		startHistoryJanitor(config.JanitorInterval, b.sweep)
+	}
+
+	return b, nil
+}
+
+func boltHistoryKey(userID, conversation string) []byte {
+	return []byte(userID + historyBoltSep + conversation)
+}
+
+func getBoltConversation(bucket *bolt.Bucket, key []byte) (*boltHistoryConversation, error) {
+	conv := &boltHistoryConversation{}
+
+	data := bucket.Get(key)
+	if data == nil {
+		return conv, nil
+	}
+
+	if err := json.Unmarshal(data, conv); err != nil {
+		return nil, err
+	}
+
+	return conv, nil
+}
+
+func putBoltConversation(bucket *bolt.Bucket, key []byte, conv *boltHistoryConversation) error {
+	if len(conv.Messages) == 0 {
+		return bucket.Delete(key)
+	}
+
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, data)
+}
+
+// 在事务中读取并修改会话
+func (b *boltHistoryStore) update(userID, conversation string, fn func(conv *boltHistoryConversation) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBoltBucket))
+		key := boltHistoryKey(userID, conversation)
+
+		conv, err := getBoltConversation(bucket, key)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(conv); err != nil {
+			return err
+		}
+
+		return putBoltConversation(bucket, key, conv)
+	})
+}
+
+func (b *boltHistoryStore) Append(userID, conversation string, message *HistoryMessage) error {
+	return b.update(userID, conversation, func(conv *boltHistoryConversation) error {
+		conv.Messages = append(conv.Messages, message)
+		if len(conv.Messages) > b.maxLength {
+			conv.Messages = conv.Messages[len(conv.Messages)-b.maxLength:]
+		}
+
+		conv.Updated = time.Now().Unix()
+		return nil
+	})
+}
+
+func (b *boltHistoryStore) Range(userID, conversation string, start, stop int) ([]*HistoryMessage, error) {
+	var messages []*HistoryMessage
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		conv, err := getBoltConversation(tx.Bucket([]byte(historyBoltBucket)), boltHistoryKey(userID, conversation))
+		if err != nil {
+			return err
+		}
+
+		if begin, end, ok := historyRange(len(conv.Messages), start, stop); ok {
+			messages = conv.Messages[begin:end]
+		}
+
+		return nil
+	})
+
+	return messages, err
+}
+
+func (b *boltHistoryStore) Set(userID, conversation string, index int, message *HistoryMessage) error {
+	return b.update(userID, conversation, func(conv *boltHistoryConversation) error {
+		i, ok := historyIndex(len(conv.Messages), index)
+		if !ok {
+			return fmt.Errorf("index out of range")
+		}
+
+		conv.Messages[i] = message
+		return nil
+	})
+}
+
+func (b *boltHistoryStore) Trim(userID, conversation string, start, stop int) error {
+	return b.update(userID, conversation, func(conv *boltHistoryConversation) error {
+		begin, end, ok := historyRange(len(conv.Messages), start, stop)
+		if !ok {
+			conv.Messages = nil
+			return nil
+		}
+
+		conv.Messages = conv.Messages[begin:end]
+		return nil
+	})
+}
+
+func (b *boltHistoryStore) Delete(userID, conversation string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBoltBucket))
+
+		if conversation != "" {
+			return bucket.Delete(boltHistoryKey(userID, conversation))
+		}
+
+		// 先收集key，遍历过程中不能删除
+		prefix := boltHistoryKey(userID, "")
+		keys := [][]byte{}
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *boltHistoryStore) List(userID string) ([]string, error) {
+	conversations := []string{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := boltHistoryKey(userID, "")
+		cursor := tx.Bucket([]byte(historyBoltBucket)).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			conversations = append(conversations, string(k[len(prefix):]))
+		}
+
+		return nil
+	})
+
+	return conversations, err
+}
+
+func (b *boltHistoryStore) Merge(userID, target string, sources []string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBoltBucket))
+		targetKey := boltHistoryKey(userID, target)
+
+		conv, err := getBoltConversation(bucket, targetKey)
+		if err != nil {
+			return err
+		}
+
+		conversations := [][]*HistoryMessage{conv.Messages}
+		for _, source := range sources {
+			key := boltHistoryKey(userID, source)
+
+			sourceConv, err := getBoltConversation(bucket, key)
+			if err != nil {
+				return err
+			}
+
+			conversations = append(conversations, sourceConv.Messages)
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		conv.Messages = mergeHistoryMessages(b.maxLength, conversations...)
+		conv.Updated = time.Now().Unix()
+
+		return putBoltConversation(bucket, targetKey, conv)
+	})
+}
+
+// sweep 删除超过保留时长的消息
+func (b *boltHistoryStore) sweep(now int64) {
+	expired := 0
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBoltBucket))
+
+		updates := map[string]*boltHistoryConversation{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			conv := &boltHistoryConversation{}
+			if err := json.Unmarshal(v, conv); err != nil {
+				log.Printf("[ERROR][boltHistoryStore] json Unmarshal failed, key=%q, err=%s", k, err)
+				return nil
+			}
+
+			remain := conv.Messages[:0]
+			for _, message := range conv.Messages {
+				if message.Ts+b.ttl >= now {
+					remain = append(remain, message)
+				}
+			}
+
+			if len(remain) != len(conv.Messages) {
+				expired += len(conv.Messages) - len(remain)
+				conv.Messages = remain
+				updates[string(k)] = conv
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for key, conv := range updates {
+			if err := putBoltConversation(bucket, []byte(key), conv); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][boltHistoryStore] sweep failed, err=%s", err)
+		return
+	}
+
+	if expired > 0 {
+		log.Printf("[INFO][boltHistoryStore] delete %d expired messages", expired)
+	}
+}
@@ -0,0 +1,132 @@
+package chatbot
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestHistoryStores(t *testing.T, maxLength int) map[string]HistoryStore {
+	bolt, err := newBoltHistoryStore(&HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db")}, maxLength)
+	if err != nil {
+		t.Fatalf("newBoltHistoryStore failed, err=%s", err)
+	}
+	t.Cleanup(func() { bolt.db.Close() })
+
+	return map[string]HistoryStore{
+		HistoryStoreMemory: newMemoryHistoryStore(&HistoryConfig{}, maxLength),
+		HistoryStoreBolt:   bolt,
+	}
+}
+
+func historyContents(t *testing.T, store HistoryStore, conversation string) []string {
+	messages, err := store.Range("alice", conversation, 0, -1)
+	if err != nil {
+		t.Fatalf("Range failed, err=%s", err)
+	}
+
+	contents := []string{}
+	for _, message := range messages {
+		contents = append(contents, message.Content)
+	}
+
+	return contents
+}
+
+func TestHistoryStore(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(store HistoryStore) error
+		want []string
+	}{
+		{"append trims to max length", func(store HistoryStore) error { return nil }, []string{"2", "3", "4"}},
+		{"set negative index", func(store HistoryStore) error {
+			return store.Set("alice", "chat", -1, &HistoryMessage{Role: ChatRoleAI, Content: "x"})
+		}, []string{"2", "3", "x"}},
+		{"set out of range", func(store HistoryStore) error {
+			if store.Set("alice", "chat", 5, &HistoryMessage{Content: "x"}) == nil {
+				t.Error("Set out of range should fail")
+			}
+			return nil
+		}, []string{"2", "3", "4"}},
+		{"trim", func(store HistoryStore) error { return store.Trim("alice", "chat", 0, -2) }, []string{"2", "3"}},
+		{"trim all", func(store HistoryStore) error { return store.Trim("alice", "chat", 5, -1) }, []string{}},
+		{"delete conversation", func(store HistoryStore) error { return store.Delete("alice", "chat") }, []string{}},
+	}
+
+	for _, tt := range tests {
+		for name, store := range newTestHistoryStores(t, 3) {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				for _, content := range []string{"1", "2", "3", "4"} {
+					if err := store.Append("alice", "chat", &HistoryMessage{Role: ChatRoleUser, Content: content}); err != nil {
+						t.Fatalf("Append failed, err=%s", err)
+					}
+				}
+				store.Append("alice", "chat@2", &HistoryMessage{Role: ChatRoleUser, Content: "other"})
+
+				if err := tt.op(store); err != nil {
+					t.Fatalf("op failed, err=%s", err)
+				}
+
+				if got := historyContents(t, store, "chat"); !slices.Equal(got, tt.want) {
+					t.Fatalf("contents = %v, want %v", got, tt.want)
+				}
+
+				// 其他会话不受影响
+				if got := historyContents(t, store, "chat@2"); !slices.Equal(got, []string{"other"}) {
+					t.Fatalf("other conversation = %v", got)
+				}
+			})
+		}
+	}
+}
+
+// 修改读取到的消息不影响存储，需要通过Set写回
+func TestHistoryStoreRangeCopy(t *testing.T) {
+	for name, store := range newTestHistoryStores(t, 10) {
+		t.Run(name, func(t *testing.T) {
+			message := &HistoryMessage{Role: ChatRoleAI, Content: "answer", Ts: 1}
+			store.Append("alice", "chat", message)
+			message.MsgId = "appended"
+
+			messages, _ := store.Range("alice", "chat", -1, -1)
+			messages[0].MsgId = "modified"
+
+			if messages, _ = store.Range("alice", "chat", -1, -1); messages[0].MsgId != "" {
+				t.Fatalf("msgid = %q, want empty", messages[0].MsgId)
+			}
+
+			(&Chatbot{historyStore: store}).setChatMessageMsgId("alice", "chat", 1, "msgid")
+
+			if messages, _ = store.Range("alice", "chat", -1, -1); messages[0].MsgId != "msgid" {
+				t.Fatalf("msgid = %q, want msgid", messages[0].MsgId)
+			}
+		})
+	}
+}
+
+func TestHistoryStoreDeleteUser(t *testing.T) {
+	for name, store := range newTestHistoryStores(t, 10) {
+		t.Run(name, func(t *testing.T) {
+			store.Append("alice", "chat", &HistoryMessage{Content: "a"})
+			store.Append("alice", "chat@2", &HistoryMessage{Content: "b"})
+			store.Append("bob", "chat", &HistoryMessage{Content: "c"})
+
+			if conversations, _ := store.List("alice"); !slices.Equal(conversations, []string{"chat", "chat@2"}) {
+				t.Fatalf("conversations = %v", conversations)
+			}
+
+			if err := store.Delete("alice", ""); err != nil {
+				t.Fatalf("Delete failed, err=%s", err)
+			}
+
+			if conversations, _ := store.List("alice"); len(conversations) != 0 {
+				t.Fatalf("conversations = %v, want empty", conversations)
+			}
+
+			if conversations, _ := store.List("bob"); !slices.Equal(conversations, []string{"chat"}) {
+				t.Fatalf("bob conversations = %v", conversations)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package chatbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	openai "github.com/walkerdu/wecom-backend/pkg/openai-v1"
+)
+
+const (
+	imageRequestTimeout  = 180  // 生成图片的超时时间，单位秒
+	receivedImageTimeout = 600  // 用户发送的图片在该时长内可以编辑和生成变体，单位秒
+	maxImageSide         = 1024 // 上传给OpenAI的图片的最大边长
+)
+
+// 用户发送的图片
+type receivedImage struct {
+	mediaID string
+	ts      int64
+}
+
+// 注册图片推送的回调，参数为userid、文件名和图片内容
+func (c *Chatbot) RegisterImagePublish(imagePublisher func(string, string, []byte) error) {
+	c.imagePublisher = imagePublisher
+}
+
+// 注册下载用户发送的图片的回调，参数为图片的media_id
+func (c *Chatbot) RegisterImageLoader(imageLoader func(string) ([]byte, error)) {
+	c.imageLoader = imageLoader
+}
+
+func (c *Chatbot) imageEnabled() bool {
+	return c.imageConfig.Enable && c.openaiClient != nil && c.imagePublisher != nil
+}
+
+// HandleImageMessage 保存用户发送的图片，之后可以通过/draw编辑图片或者生成变体，返回回复给用户的提示
+func (c *Chatbot) HandleImageMessage(userID, mediaID string) string {
+	if !c.imageEnabled() || c.imageLoader == nil {
+		return ""
+	}
+
+	now := time.Now().Unix()
+
+	c.imageMu.Lock()
+	defer c.imageMu.Unlock()
+
+	for id, received := range c.receivedImages {
+		if received.ts+receivedImageTimeout < now {
+			delete(c.receivedImages, id)
+		}
+	}
+
+	c.receivedImages[userID] = &receivedImage{
+		mediaID: mediaID,
+		ts:      now,
+	}
+
+	return fmt.Sprintf("已收到图片，%d分钟内可以发送:\n/draw edit <修改要求> 按照要求修改这张图片\n/draw variation 生成这张图片的变体", receivedImageTimeout/60)
+}
+
+// 用户最近发送的还在有效期内的图片
+func (c *Chatbot) lastReceivedImage(userID string) *receivedImage {
+	c.imageMu.Lock()
+	defer c.imageMu.Unlock()
+
+	received, exist := c.receivedImages[userID]
+	if !exist || received.ts+receivedImageTimeout < time.Now().Unix() {
+		return nil
+	}
+
+	return received
+}
+
+const drawCommandUsage = `图片指令:
+/draw <描述> 按照描述生成图片
+/draw edit <修改要求> 修改最近发送的图片
+/draw variation 生成最近发送的图片的变体`
+
+// /draw 生成图片，或者编辑用户最近发送的图片，生成耗时较长，完成后推送图片
+func (c *Chatbot) handleDrawCommand(userID string, args string) (string, error) {
+	if !c.imageEnabled() {
+		return "当前没有开启图片生成", nil
+	}
+
+	if args == "" {
+		return drawCommandUsage, nil
+	}
+
+	sub, rest, _ := strings.Cut(args, " ")
+	rest = strings.TrimSpace(rest)
+
+	var draw func() ([]byte, error)
+	var model openai.ModelType // 计费的模型
+	switch sub {
+	case "edit", "variation":
+		if sub == "edit" && rest == "" {
+			return drawCommandUsage, nil
+		}
+
+		if c.imageLoader == nil {
+			return "暂不支持编辑图片", nil
+		}
+
+		received := c.lastReceivedImage(userID)
+		if received == nil {
+			return fmt.Sprintf("请先发送一张图片，%d分钟内再使用/draw %s", receivedImageTimeout/60, sub), nil
+		}
+
+		if sub == "edit" {
+			draw = func() ([]byte, error) { return c.editImage(userID, received.mediaID, rest) }
+			model = c.imageEditModel()
+		} else {
+			draw = func() ([]byte, error) { return c.createImageVariation(userID, received.mediaID) }
+			model = openai.DallE2
+		}
+
+	default:
+		draw = func() ([]byte, error) { return c.generateImage(userID, args) }
+		model = c.imageModel()
+	}
+
+	if msg, ok := c.checkQuota(userID); !ok {
+		return msg, nil
+	}
+
+	if _, loaded := c.drawing.LoadOrStore(userID, struct{}{}); loaded {
+		return "有图片正在生成中，请稍后再试~", nil
+	}
+
+	go func() {
+		defer c.drawing.Delete(userID)
+
+		begin := time.Now()
+		data, err := draw()
+		if err == nil {
+			// 按照张数计入用量和额度，生成成功即计费，不论之后是否推送成功
+			c.recordModelUsage(userID, AIName_OpenAI, string(model), begin, 0, 1, imageQuotaTokens)
+
+			err = c.imagePublisher(userID, fmt.Sprintf("image_%d.png", begin.Unix()), data)
+		}
+
+		if err != nil {
+			log.Printf("[ERROR][handleDrawCommand] draw failed, userID=%s, args=%s, err=%s", userID, args, err)
+			if _, err := c.publish(userID, "", "图片生成失败，请修改描述后重试"); err != nil {
+				log.Printf("[ERROR][handleDrawCommand] publish failed, userID=%s, err=%s", userID, err)
+			}
+			return
+		}
+
+		log.Printf("[INFO][handleDrawCommand] userID=%s, args=%s, cost=%s", userID, args, time.Since(begin))
+	}()
+
+	return "正在生成图片，请稍候~", nil
+}
+
+func (c *Chatbot) imageModel() openai.ModelType {
+	if c.imageConfig.Model == "" {
+		return openai.DallE3
+	}
+
+	return openai.ModelType(c.imageConfig.Model)
+}
+
+func (c *Chatbot) imageEditModel() openai.ModelType {
+	if c.imageConfig.EditModel == "" {
+		return openai.GptImage1
+	}
+
+	return openai.ModelType(c.imageConfig.EditModel)
+}
+
+func (c *Chatbot) imageSize() string {
+	if c.imageConfig.Size == "" {
+		return openai.ImageSize1024x1024
+	}
+
+	return c.imageConfig.Size
+}
+
+// gpt-image-1只返回base64，不支持指定response_format
+func imageResponseFormat(model openai.ModelType) string {
+	if model == openai.GptImage1 {
+		return ""
+	}
+
+	return openai.ImageResponseFormatB64Json
+}
+
+func imageHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: imageRequestTimeout * time.Second,
+	}
+}
+
+// generateImage 按照描述生成图片
+func (c *Chatbot) generateImage(userID, prompt string) ([]byte, error) {
+	model := c.imageModel()
+
+	reqBytes, err := json.Marshal(&openai.ImageReq{
+		Model:          model,
+		Prompt:         prompt,
+		N:              1,
+		Size:           c.imageSize(),
+		Quality:        c.imageConfig.Quality,
+		ResponseFormat: imageResponseFormat(model),
+		User:           userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := c.openaiClient.PostStream(imageHTTPClient(), string(openai.OpenAIPathImage), reqBytes, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return imageFromRsp(rsp)
+}
+
+// editImage 按照要求修改用户发送的图片
+func (c *Chatbot) editImage(userID, mediaID, prompt string) ([]byte, error) {
+	data, err := c.loadImage(userID, mediaID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	model := c.imageEditModel()
+	fields := map[string]string{
+		"model":  string(model),
+		"prompt": prompt,
+		"n":      "1",
+		"size":   c.imageSize(),
+		"user":   userID,
+	}
+
+	if format := imageResponseFormat(model); format != "" {
+		fields["response_format"] = format
+	}
+
+	if c.imageConfig.Quality != "" {
+		fields["quality"] = c.imageConfig.Quality
+	}
+
+	rsp, err := c.openaiClient.PostForm(imageHTTPClient(), string(openai.OpenAIPathImageEdits), fields, []*openai.FormFile{
+		{Field: "image", FileName: "image.png", ContentType: "image/png", Data: data},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return imageFromRsp(rsp)
+}
+
+// createImageVariation 生成用户发送的图片的变体，只有dall-e-2支持，图片需要为正方形的png
+func (c *Chatbot) createImageVariation(userID, mediaID string) ([]byte, error) {
+	data, err := c.loadImage(userID, mediaID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{
+		"model":           string(openai.DallE2),
+		"n":               "1",
+		"size":            openai.ImageSize1024x1024,
+		"response_format": openai.ImageResponseFormatB64Json,
+		"user":            userID,
+	}
+
+	rsp, err := c.openaiClient.PostForm(imageHTTPClient(), string(openai.OpenAIPathImageVariation), fields, []*openai.FormFile{
+		{Field: "image", FileName: "image.png", ContentType: "image/png", Data: data},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return imageFromRsp(rsp)
+}
+
+// 下载用户发送的图片并转为png
+func (c *Chatbot) loadImage(userID, mediaID string, square bool) ([]byte, error) {
+	c.trackMedia(userID, mediaID)
+
+	data, err := c.imageLoader(mediaID)
+	if err != nil {
+		return nil, err
+	}
+
+	return toPNG(data, square)
+}
+
+// 获取回包中的第一张图片，返回url时下载图片
+func imageFromRsp(rsp openai.MessageIF) ([]byte, error) {
+	imageRsp, ok := rsp.(*openai.ImageRsp)
+	if !ok || len(imageRsp.Data) == 0 {
+		return nil, errors.New("openai image rsp invalid")
+	}
+
+	imageData := imageRsp.Data[0]
+	if imageData.RevisedPrompt != "" {
+		log.Printf("[DEBUG][imageFromRsp] revised prompt: %s", imageData.RevisedPrompt)
+	}
+
+	if imageData.B64Json != "" {
+		return imageData.Decode()
+	}
+
+	if imageData.Url == "" {
+		return nil, errors.New("openai image rsp has no image")
+	}
+
+	res, err := imageHTTPClient().Get(imageData.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download image returned %d status code", res.StatusCode)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+// toPNG 将图片转为png，边长超过maxImageSide时等比缩小，square为true时居中裁剪为正方形
+func toPNG(data []byte, square bool) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	rect := src.Bounds()
+	if square {
+		side := min(rect.Dx(), rect.Dy())
+		x := rect.Min.X + (rect.Dx()-side)/2
+		y := rect.Min.Y + (rect.Dy()-side)/2
+		rect = image.Rect(x, y, x+side, y+side)
+	}
+
+	width, height := rect.Dx(), rect.Dy()
+	if longest := max(width, height); longest > maxImageSide {
+		width = max(width*maxImageSide/longest, 1)
+		height = max(height*maxImageSide/longest, 1)
+	}
+
+	// 最近邻缩放，用于AI识别足够了
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(rect.Min.X+x*rect.Dx()/width, rect.Min.Y+y*rect.Dy()/height))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
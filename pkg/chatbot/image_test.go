@@ -0,0 +1,84 @@
+package chatbot
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodeTestImage(t *testing.T, width, height int, encode func(*bytes.Buffer, image.Image) error) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	// 左半边红色，右半边蓝色，用于检查裁剪的位置
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, img); err != nil {
+		t.Fatalf("encode failed, err=%s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestToPNG(t *testing.T) {
+	encodePNG := func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) }
+	encodeJPEG := func(buf *bytes.Buffer, img image.Image) error { return jpeg.Encode(buf, img, nil) }
+
+	tests := []struct {
+		name       string
+		width      int
+		height     int
+		encode     func(*bytes.Buffer, image.Image) error
+		square     bool
+		wantWidth  int
+		wantHeight int
+	}{
+		{"small png", 200, 100, encodePNG, false, 200, 100},
+		{"jpeg", 200, 100, encodeJPEG, false, 200, 100},
+		{"square crop", 300, 100, encodePNG, true, 100, 100},
+		{"scale down", 2048, 1024, encodePNG, false, maxImageSide, maxImageSide / 2},
+		{"scale down square", 3000, 2000, encodePNG, true, maxImageSide, maxImageSide},
+		{"thin", 4096, 2, encodePNG, false, maxImageSide, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := toPNG(encodeTestImage(t, tt.width, tt.height, tt.encode), tt.square)
+			if err != nil {
+				t.Fatalf("toPNG failed, err=%s", err)
+			}
+
+			img, format, err := image.Decode(bytes.NewReader(data))
+			if err != nil || format != "png" {
+				t.Fatalf("decode result failed, format=%s, err=%v", format, err)
+			}
+
+			if size := img.Bounds().Size(); size.X != tt.wantWidth || size.Y != tt.wantHeight {
+				t.Fatalf("size = %dx%d, want %dx%d", size.X, size.Y, tt.wantWidth, tt.wantHeight)
+			}
+
+			// 居中裁剪后两侧的颜色不变
+			if tt.square {
+				left, _, _, _ := img.At(0, 0).RGBA()
+				_, _, right, _ := img.At(img.Bounds().Dx()-1, 0).RGBA()
+				if left == 0 || right == 0 {
+					t.Fatalf("square crop not centered")
+				}
+			}
+		})
+	}
+
+	if _, err := toPNG([]byte("not an image"), false); err == nil {
+		t.Fatal("toPNG should fail for invalid image")
+	}
+}
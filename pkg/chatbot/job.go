@@ -0,0 +1,376 @@
+package chatbot
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// 提问的处理状态，只能从pending、streaming进入终态，进入终态后不再变化
+type jobState int
+
+const (
+	jobPending   jobState = iota // 已经发起请求，等待AI回包
+	jobStreaming                 // 正在接收AI的推流
+	jobDone                      // 生成完成
+	jobFailed                    // 生成失败或者超时，content为失败原因
+	jobCancelled                 // 被取消，例如用户删除聊天历史
+)
+
+func (s jobState) String() string {
+	switch s {
+	case jobPending:
+		return "pending"
+	case jobStreaming:
+		return "streaming"
+	case jobDone:
+		return "done"
+	case jobFailed:
+		return "failed"
+	case jobCancelled:
+		return "cancelled"
+	}
+
+	return "unknown"
+}
+
+func (s jobState) terminal() bool {
+	return s == jobDone || s == jobFailed || s == jobCancelled
+}
+
+// chatJob 用户的一次提问，记录从发起请求到回包推送完成的状态
+// AI的回包只能通过complete、fail、cancel进入终态，终态只会设置一次，之后由等待协程统一处理
+type chatJob struct {
+	// 创建后只读
+	sessionID string    // 单聊为用户的userid，群聊为群聊的会话id
+	chatID    string    // 群聊id，不为空时回包推送到群聊
+	userID    string    // 提问人的userid，用于选择AI和权限校验，群聊中为提问的群成员
+	stream    bool      // 流式回复，回包由调用方拉取，不需要推送
+	begin     time.Time // 创建的时间，用于超时清理
+
+	// 发起AI请求前设置，之后只读
+	ai        string
+	requestAt time.Time // 发起AI请求的时间，用于统计耗时
+	knowledge string    // 检索到的知识库参考资料，加入系统提示词
+	citations []string  // 参考资料的来源，和参考资料的编号一一对应
+
+	mu               sync.Mutex
+	state            jobState
+	content          string // 已经生成的内容，终态时为完整的回复或者失败原因
+	placeholderMsgId string // 推送的占位消息的msgid，最终回包推送后撤回
+	truncated        bool   // 回复达到长度限制被截断，可以通过"继续"接着生成
+	done             chan struct{}
+}
+
+func newChatJob(sessionID, chatID, userID string, stream bool) *chatJob {
+	return &chatJob{
+		sessionID: sessionID,
+		chatID:    chatID,
+		userID:    userID,
+		stream:    stream,
+		begin:     time.Now(),
+		state:     jobPending,
+		done:      make(chan struct{}),
+	}
+}
+
+// Done 进入终态时关闭
+func (j *chatJob) Done() <-chan struct{} {
+	return j.done
+}
+
+// appendDelta 追加推流的增量内容，进入终态后忽略
+func (j *chatJob) appendDelta(delta string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state.terminal() {
+		return
+	}
+
+	j.state = jobStreaming
+	j.content += delta
+}
+
+// resetDelta 丢弃已经推流的内容，用于AI在这一轮推流后要求调用工具，进入终态后忽略
+func (j *chatJob) resetDelta() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state.terminal() {
+		return
+	}
+
+	j.state = jobPending
+	j.content = ""
+}
+
+// 进入终态，已经是终态时返回false
+func (j *chatJob) finish(state jobState, content string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state.terminal() {
+		return false
+	}
+
+	j.state = state
+	j.content = content
+	close(j.done)
+
+	return true
+}
+
+// complete 生成完成，content为完整的回复
+func (j *chatJob) complete(content string) bool {
+	return j.finish(jobDone, content)
+}
+
+// fail 生成失败，reason为推送给用户的失败原因
+func (j *chatJob) fail(reason string) bool {
+	return j.finish(jobFailed, reason)
+}
+
+// cancel 取消生成，不再推送回包和保存聊天上下文
+func (j *chatJob) cancel() bool {
+	return j.finish(jobCancelled, "")
+}
+
+// snapshot 当前的状态和已经生成的内容
+func (j *chatJob) snapshot() (jobState, string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.state, j.content
+}
+
+// markTruncated 标记回复被截断，需要在complete之前调用
+func (j *chatJob) markTruncated() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.truncated = true
+}
+
+func (j *chatJob) isTruncated() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.truncated
+}
+
+func (j *chatJob) setPlaceholder(msgId string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.placeholderMsgId = msgId
+}
+
+func (j *chatJob) placeholder() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.placeholderMsgId
+}
+
+// 超时的提问
+func (j *chatJob) expired(now time.Time) bool {
+	return j.begin.Add(maxChatResponseCahceTimeout * time.Second).Before(now)
+}
+
+// startJob 创建用户的提问，同一个会话同时只能有一个提问，已经有提问时返回false
+func (c *Chatbot) startJob(sessionID, chatID, userID string, stream bool) (*chatJob, bool) {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+
+	if c.getJobLocked(sessionID) != nil {
+		return nil, false
+	}
+
+	job := newChatJob(sessionID, chatID, userID, stream)
+	c.chatJobMap[sessionID] = job
+
+	return job, true
+}
+
+// 获取会话当前的提问，超时的提问会被取消
+func (c *Chatbot) getJob(sessionID string) *chatJob {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+
+	return c.getJobLocked(sessionID)
+}
+
+// 调用方需要持有jobMu
+func (c *Chatbot) getJobLocked(sessionID string) *chatJob {
+	job, exist := c.chatJobMap[sessionID]
+	if !exist {
+		return nil
+	}
+
+	if job.expired(time.Now()) {
+		job.cancel()
+		c.releaseJobLocked(job)
+
+		// 可能已经开始处理排队的提问
+		return c.chatJobMap[sessionID]
+	}
+
+	return job
+}
+
+// removeJob 删除会话的提问，只删除job本身，避免误删新的提问，之后开始处理排队的提问
+func (c *Chatbot) removeJob(job *chatJob) {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+
+	c.releaseJobLocked(job)
+}
+
+// abortJob 没有发起AI请求时结束提问，例如没有权限或者额度不足
+func (c *Chatbot) abortJob(job *chatJob) {
+	job.cancel()
+	c.removeJob(job)
+}
+
+// cancelJob 取消会话正在进行和排队的提问
+func (c *Chatbot) cancelJob(sessionID string) {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+
+	delete(c.requestQueues, sessionID)
+
+	if job, exist := c.chatJobMap[sessionID]; exist {
+		if job.cancel() {
+			log.Printf("[INFO][cancelJob] sessionID=%s", sessionID)
+		}
+		delete(c.chatJobMap, sessionID)
+	}
+}
+
+// 判断会话是否有提问进行中，同时只能并发一个提问，超时时间2min
+func (c *Chatbot) isProcessing(sessionID string) bool {
+	return c.getJob(sessionID) != nil
+}
+
+// takeFinishedJob 获取已经结束但是没有推送成功的回包，获取后删除
+func (c *Chatbot) takeFinishedJob(sessionID string) (string, bool) {
+	job := c.getJob(sessionID)
+	if job == nil {
+		return "", false
+	}
+
+	state, content := job.snapshot()
+	if !state.terminal() {
+		return "", false
+	}
+
+	c.removeJob(job)
+
+	return content, true
+}
+
+// waitJob 等待AI回包，超时后置为失败，所有结束的提问都通过finishJob处理
+func (c *Chatbot) waitJob(job *chatJob) {
+	go func() {
+		placeholderTimer := time.NewTimer(chatPlaceholderDelaySecs * time.Second)
+		defer placeholderTimer.Stop()
+
+		timeout := time.NewTimer(maxChatResponseCahceTimeout * time.Second)
+		defer timeout.Stop()
+
+		for {
+			select {
+			case <-placeholderTimer.C:
+				// 流式回复的内容由调用方拉取，不需要占位消息
+				if job.stream {
+					continue
+				}
+
+				// 生成耗时较长，先推送占位消息告知用户
+				msgId, err := c.publish(job.sessionID, job.chatID, "内容较长，仍在生成中，请稍候~")
+				if err != nil {
+					log.Printf("[ERROR][waitJob] publish placeholder failed, sessionID=%s, err=%s", job.sessionID, err)
+					continue
+				}
+
+				job.setPlaceholder(msgId)
+
+			case <-timeout.C:
+				log.Printf("[WARN][waitJob] timeout, sessionID=%s", job.sessionID)
+				job.fail("回复生成超时，请重新提问")
+
+			case <-job.Done():
+				c.finishJob(job)
+				return
+			}
+		}
+	}()
+}
+
+// finishJob 提问结束后保存聊天上下文，并将回包放入推送队列，由推送队列负责失败重试
+func (c *Chatbot) finishJob(job *chatJob) {
+	state, content := job.snapshot()
+	log.Printf("[INFO][finishJob] sessionID=%s, ai=%s, state=%s", job.sessionID, job.ai, state)
+
+	if state == jobCancelled {
+		c.removeJob(job)
+		return
+	}
+
+	push := &pushJob{
+		UserID:           job.sessionID,
+		Ai:               job.ai,
+		PlaceholderMsgId: job.placeholder(),
+		ChatId:           job.chatID,
+		Content:          content,
+	}
+
+	if state == jobDone {
+		// 回复引用了知识库时列出参考资料
+		content = appendCitations(content, job.citations)
+		push.Content = content
+
+		// 保存聊天上下文，推送成功后回写msgid
+		threadID := c.activeThread(job.sessionID)
+		answer := &HistoryMessage{
+			Id:        newAnswerID(),
+			Content:   content,
+			Ts:        time.Now().Unix(),
+			Role:      ChatRoleAI,
+			Ai:        job.ai,
+			Truncated: job.isTruncated(),
+		}
+
+		push.Ts = answer.Ts
+		push.Conversation = threadConversation(threadID)
+		c.addChatMessage(job.sessionID, push.Conversation, answer)
+
+		if answer.Truncated {
+			push.Content += truncatedAnswerHint
+		}
+
+		if job.chatID == "" {
+			c.touchThread(job.sessionID)
+			go c.autoTitleThread(job.sessionID, threadID, job.ai)
+		}
+	}
+
+	// 流式回复由调用方拉取，拉取到终态后删除
+	if job.stream {
+		return
+	}
+
+	if err := c.pushQueue.Push(push); err != nil {
+		// 入队失败保留提问，用户可以通过"继续"获取
+		log.Printf("[ERROR][finishJob] push queue failed, sessionID=%s, err=%s", job.sessionID, err)
+		return
+	}
+
+	// 单聊的回答按照用户的设置同时推送语音
+	if state == jobDone && job.chatID == "" && c.shouldReplyVoice(job.sessionID) {
+		go c.replyVoice(job.sessionID, content)
+	}
+
+	c.removeJob(job)
+}
@@ -0,0 +1,251 @@
+package chatbot
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestChatbot(depth int) *Chatbot {
+	return &Chatbot{
+		chatJobMap:         make(map[string]*chatJob),
+		requestQueues:      make(map[string][]*queuedRequest),
+		requestQueueConfig: RequestQueueConfig{Depth: depth},
+	}
+}
+
+// 并发进入终态，只有一个调用成功，done只关闭一次
+func TestChatJobFinishOnce(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		job := newChatJob("session", "", "user", false)
+
+		var wins atomic.Int32
+		var winner atomic.Value
+
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				content := fmt.Sprintf("content-%d", i)
+
+				var ok bool
+				var state jobState
+				switch i % 3 {
+				case 0:
+					ok, state = job.complete(content), jobDone
+				case 1:
+					ok, state = job.fail(content), jobFailed
+				default:
+					ok, state, content = job.cancel(), jobCancelled, ""
+				}
+
+				if ok {
+					wins.Add(1)
+					winner.Store([2]any{state, content})
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if n := wins.Load(); n != 1 {
+			t.Fatalf("round %d: %d calls won, want 1", round, n)
+		}
+
+		select {
+		case <-job.Done():
+		default:
+			t.Fatalf("round %d: done not closed", round)
+		}
+
+		state, content := job.snapshot()
+		want := winner.Load().([2]any)
+		if state != want[0].(jobState) || content != want[1].(string) {
+			t.Fatalf("round %d: got (%s, %q), want (%s, %q)", round, state, content, want[0], want[1])
+		}
+	}
+}
+
+// 推流的增量内容和进入终态并发，终态之后的增量被忽略
+func TestChatJobAppendDeltaRaceWithFinish(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		job := newChatJob("session", "", "user", true)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					job.appendDelta("x")
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job.complete("final")
+		}()
+		wg.Wait()
+
+		state, content := job.snapshot()
+		if state != jobDone || content != "final" {
+			t.Fatalf("round %d: got (%s, %q), want (done, \"final\")", round, state, content)
+		}
+
+		job.appendDelta("late")
+		if _, content := job.snapshot(); content != "final" {
+			t.Fatalf("round %d: delta appended after finish, content=%q", round, content)
+		}
+	}
+}
+
+// 超时的提问在获取时被取消并删除
+func TestGetJobLockedExpired(t *testing.T) {
+	c := newTestChatbot(0)
+
+	job, ok := c.startJob("session", "", "user", false)
+	if !ok {
+		t.Fatal("startJob failed")
+	}
+
+	if got := c.getJob("session"); got != job {
+		t.Fatalf("getJob = %p, want %p", got, job)
+	}
+
+	job.begin = time.Now().Add(-(maxChatResponseCahceTimeout + 1) * time.Second)
+
+	if got := c.getJob("session"); got != nil {
+		t.Fatalf("getJob of expired job = %p, want nil", got)
+	}
+
+	if state, _ := job.snapshot(); state != jobCancelled {
+		t.Fatalf("expired job state = %s, want cancelled", state)
+	}
+
+	if _, ok := c.startJob("session", "", "user", false); !ok {
+		t.Fatal("startJob after expiry failed")
+	}
+}
+
+// 释放旧的提问时不影响之后创建的提问，也不消费排队的提问
+func TestReleaseJobLockedKeepsNewerJob(t *testing.T) {
+	c := newTestChatbot(2)
+
+	old := newChatJob("session", "", "user", false)
+	newer := newChatJob("session", "", "user", false)
+
+	c.jobMu.Lock()
+	c.chatJobMap["session"] = newer
+	c.requestQueues["session"] = []*queuedRequest{{userID: "user", input: "queued"}}
+
+	c.releaseJobLocked(old)
+
+	if c.chatJobMap["session"] != newer {
+		t.Fatal("newer job clobbered by releasing old job")
+	}
+	if len(c.requestQueues["session"]) != 1 {
+		t.Fatal("queued request consumed by releasing old job")
+	}
+	c.jobMu.Unlock()
+}
+
+// 释放当前的提问后，按照顺序开始处理排队的下一个提问
+func TestReleaseJobLockedStartsNextQueued(t *testing.T) {
+	c := newTestChatbot(2)
+
+	job, msg := c.submitRequest("session", "", "user", "first")
+	if job == nil {
+		t.Fatalf("submitRequest failed, msg=%s", msg)
+	}
+
+	for _, input := range []string{"second", "third"} {
+		if queued, _ := c.submitRequest("session", "", "user2", input); queued != nil {
+			t.Fatalf("request %q not queued", input)
+		}
+	}
+
+	if _, msg := c.submitRequest("session", "", "user3", "fourth"); msg == "" {
+		t.Fatal("request queued beyond depth")
+	}
+
+	c.jobMu.Lock()
+	c.releaseJobLocked(job)
+
+	next := c.chatJobMap["session"]
+	if next == nil || next == job {
+		c.jobMu.Unlock()
+		t.Fatal("next queued request not started")
+	}
+	if next.userID != "user2" {
+		t.Errorf("next job userID = %s, want user2", next.userID)
+	}
+
+	queue := c.requestQueues["session"]
+	if len(queue) != 1 || queue[0].input != "third" {
+		t.Errorf("remaining queue = %+v, want [third]", queue)
+	}
+	c.jobMu.Unlock()
+
+	// 没有开启AI时排队的提问被中止，之后继续处理剩下的提问，直到队列为空
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.jobMu.Lock()
+		_, running := c.chatJobMap["session"]
+		remaining := len(c.requestQueues["session"])
+		c.jobMu.Unlock()
+
+		if !running && remaining == 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("queued requests not drained")
+}
+
+// 提前返回的路径同样释放jobMu，之后的提问不会被阻塞
+func TestJobMuReleasedOnEarlyReturn(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(c *Chatbot)
+	}{
+		{"remove unknown job", func(c *Chatbot) {
+			c.removeJob(newChatJob("session", "", "user", false))
+		}},
+		{"remove replaced job", func(c *Chatbot) {
+			old, _ := c.startJob("session", "", "user", false)
+			c.cancelJob("session")
+			c.startJob("session", "", "user", false)
+			c.removeJob(old)
+		}},
+		{"get expired job", func(c *Chatbot) {
+			job, _ := c.startJob("session", "", "user", false)
+			job.begin = time.Now().Add(-2 * maxChatResponseCahceTimeout * time.Second)
+			if c.getJob("session") != nil {
+				t.Error("expired job not released")
+			}
+		}},
+		{"abort job", func(c *Chatbot) {
+			job, _ := c.startJob("session", "", "user", false)
+			c.abortJob(job)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestChatbot(0)
+			tt.run(c)
+
+			if !c.jobMu.TryLock() {
+				t.Fatal("jobMu still held")
+			}
+			c.jobMu.Unlock()
+		})
+	}
+}
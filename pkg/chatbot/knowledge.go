@@ -0,0 +1,645 @@
+package chatbot
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	openai "github.com/walkerdu/wecom-backend/pkg/openai-v1"
+)
+
+const (
+	defaultKnowledgeChunkSize    = 500
+	defaultKnowledgeChunkOverlap = 50
+	defaultKnowledgeTopK         = 3
+	defaultKnowledgeMinScore     = 0.3
+
+	knowledgeEmbedBatch     = 64 // 导入时每次请求生成embedding的片段数
+	knowledgeRequestTimeout = 30 // 导入时生成embedding的超时时间，单位秒
+	knowledgeSearchTimeout  = 3  // 提问时检索的超时时间，单位秒，超时后不带参考资料直接提问
+)
+
+// 知识库，导入目录下的文档生成向量索引，提问时检索相关的片段
+type knowledgeBase struct {
+	config KnowledgeConfig
+	index  knowledgeIndex
+
+	ingesting  atomic.Bool // 同时只能有一个导入任务
+	lastIngest string      // 最近一次导入的结果
+	mu         sync.Mutex
+}
+
+func newKnowledgeBase(config *KnowledgeConfig, rdb *redis.Client) (*knowledgeBase, error) {
+	index, err := newKnowledgeIndex(config, rdb)
+	if err != nil {
+		return nil, err
+	}
+
+	kb := &knowledgeBase{
+		config: *config,
+		index:  index,
+	}
+
+	if kb.config.Model == "" {
+		kb.config.Model = string(openai.TextEmbedding3Small)
+	}
+	if kb.config.ChunkSize <= 0 {
+		kb.config.ChunkSize = defaultKnowledgeChunkSize
+	}
+	if kb.config.ChunkOverlap < 0 || kb.config.ChunkOverlap >= kb.config.ChunkSize {
+		kb.config.ChunkOverlap = defaultKnowledgeChunkOverlap
+	}
+	if kb.config.TopK <= 0 {
+		kb.config.TopK = defaultKnowledgeTopK
+	}
+	if kb.config.MinScore <= 0 {
+		kb.config.MinScore = defaultKnowledgeMinScore
+	}
+
+	return kb, nil
+}
+
+// embed 调用OpenAI生成embedding，返回的向量和inputs一一对应，以及消耗的token数，timeout为每次请求的超时时间
+func (c *Chatbot) embed(inputs []string, timeout time.Duration) ([][]float32, int, error) {
+	if c.openaiClient == nil {
+		return nil, 0, errors.New("openai not enable")
+	}
+
+	httpClient := &http.Client{
+		Timeout: timeout,
+	}
+
+	tokens := 0
+	vectors := make([][]float32, 0, len(inputs))
+	for begin := 0; begin < len(inputs); begin += knowledgeEmbedBatch {
+		batch := inputs[begin:min(begin+knowledgeEmbedBatch, len(inputs))]
+
+		reqBytes, err := json.Marshal(&openai.EmbeddingReq{
+			Model: openai.ModelType(c.knowledge.config.Model),
+			Input: batch,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rsp, err := c.openaiClient.PostStream(httpClient, string(openai.OpenAIPathEmbedding), reqBytes, nil, &openai.StreamObserver{
+			OnUsage: func(usage *openai.Usage) {
+				log.Printf("[INFO][embed] model=%s, inputs=%d, tokens=%d", c.knowledge.config.Model, len(batch), usage.TotalTokens)
+				tokens += usage.TotalTokens
+			},
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		embeddingRsp, ok := rsp.(*openai.EmbeddingRsp)
+		if !ok {
+			return nil, 0, errors.New("openai embedding rsp invalid")
+		}
+
+		batchVectors := embeddingRsp.Vectors()
+		for i, vector := range batchVectors {
+			if len(vector) == 0 {
+				return nil, 0, fmt.Errorf("embedding of input %d missing", begin+i)
+			}
+		}
+
+		vectors = append(vectors, batchVectors...)
+	}
+
+	return vectors, tokens, nil
+}
+
+// 文档中的一段内容，title为所在的markdown标题
+type knowledgeSection struct {
+	title   string
+	content string
+}
+
+var markdownHeadingPattern = regexp.MustCompile(`^#{1,6}\s+(.+?)\s*#*$`)
+
+// chunkDocument 将文档切分为片段，按照markdown标题分节，节内按段落合并到不超过size个字符
+// 超长的段落按照字符切分，同一节内相邻的片段重叠overlap个字符，避免句子被切断后无法检索
+func chunkDocument(text string, size, overlap int) []knowledgeSection {
+	sections := []knowledgeSection{}
+
+	title := ""
+	inFence := false // 代码块中的"#"不是标题
+	paragraphs := []string{}
+	paragraph := []string{}
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			paragraphs = append(paragraphs, strings.Join(paragraph, "\n"))
+			paragraph = nil
+		}
+	}
+
+	flushSection := func() {
+		flushParagraph()
+		for _, chunk := range mergeParagraphs(paragraphs, size, overlap) {
+			sections = append(sections, knowledgeSection{title: title, content: chunk})
+		}
+		paragraphs = nil
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, " \t")
+
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		}
+
+		if match := markdownHeadingPattern.FindStringSubmatch(line); match != nil && !inFence {
+			flushSection()
+			title = match[1]
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			flushParagraph()
+			continue
+		}
+
+		paragraph = append(paragraph, line)
+	}
+
+	flushSection()
+
+	return sections
+}
+
+// 合并段落为不超过size个字符的片段
+func mergeParagraphs(paragraphs []string, size, overlap int) []string {
+	chunks := []string{}
+	current := []rune{}
+
+	flush := func() {
+		if strings.TrimSpace(string(current)) == "" {
+			current = current[:0]
+			return
+		}
+
+		chunks = append(chunks, string(current))
+
+		// 下一个片段以当前片段的结尾开头
+		tail := current[max(len(current)-overlap, 0):]
+		current = append([]rune{}, tail...)
+	}
+
+	for _, paragraph := range paragraphs {
+		runes := []rune(paragraph)
+
+		if len(current) > overlap && len(current)+len(runes)+1 > size {
+			flush()
+		}
+
+		if len(current) > 0 {
+			current = append(current, '\n')
+		}
+
+		for len(current)+len(runes) > size {
+			n := size - len(current)
+			current = append(current, runes[:n]...)
+			runes = runes[n:]
+			flush()
+		}
+
+		current = append(current, runes...)
+	}
+
+	if len(current) > overlap || len(chunks) == 0 {
+		flush()
+	}
+
+	return chunks
+}
+
+// 读取文档的文本，pdf通过pdftotext提取
+func readKnowledgeDocument(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown", ".txt":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case ".pdf":
+		if _, err := exec.LookPath("pdftotext"); err != nil {
+			return "", errors.New("pdftotext not installed")
+		}
+
+		output, err := exec.Command("pdftotext", "-enc", "UTF-8", "-layout", path, "-").Output()
+		if err != nil {
+			return "", err
+		}
+		return string(output), nil
+	}
+
+	return "", errUnsupportedDocument
+}
+
+var errUnsupportedDocument = errors.New("unsupported document")
+
+// ingestKnowledge 导入知识库目录下的文档，内容没有变化的文档不重新生成embedding，已经删除的文档从索引中删除
+func (c *Chatbot) ingestKnowledge() (string, error) {
+	kb := c.knowledge
+	if kb.config.Dir == "" {
+		return "", errors.New("knowledge dir not configured")
+	}
+
+	existing, err := kb.index.Chunks()
+	if err != nil {
+		return "", err
+	}
+
+	begin := time.Now()
+	seen := make(map[string]bool)
+	updated, unchanged, removed := 0, 0, 0
+	failed := []string{}
+
+	err = filepath.WalkDir(kb.config.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		source, err := filepath.Rel(kb.config.Dir, path)
+		if err != nil {
+			return err
+		}
+		source = filepath.ToSlash(source)
+
+		text, err := readKnowledgeDocument(path)
+		if err == errUnsupportedDocument {
+			return nil
+		}
+
+		seen[source] = true
+
+		if err != nil {
+			log.Printf("[ERROR][ingestKnowledge] read document failed, source=%s, err=%s", source, err)
+			failed = append(failed, source)
+			return nil
+		}
+
+		sum := sha1.Sum([]byte(text))
+		hash := hex.EncodeToString(sum[:])
+
+		if chunks := existing[source]; len(chunks) > 0 && chunks[0].Hash == hash {
+			unchanged++
+			return nil
+		}
+
+		chunks, err := c.embedDocument(source, hash, text)
+		if err != nil {
+			log.Printf("[ERROR][ingestKnowledge] embed document failed, source=%s, err=%s", source, err)
+			failed = append(failed, source)
+			return nil
+		}
+
+		if err := kb.index.Replace(source, chunks); err != nil {
+			log.Printf("[ERROR][ingestKnowledge] index Replace failed, source=%s, err=%s", source, err)
+			failed = append(failed, source)
+			return nil
+		}
+
+		log.Printf("[INFO][ingestKnowledge] source=%s, chunks=%d", source, len(chunks))
+		updated++
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for source := range existing {
+		if seen[source] {
+			continue
+		}
+
+		if err := kb.index.Replace(source, nil); err != nil {
+			log.Printf("[ERROR][ingestKnowledge] index remove failed, source=%s, err=%s", source, err)
+			continue
+		}
+
+		removed++
+	}
+
+	result := fmt.Sprintf("知识库导入完成，耗时%s: 更新%d篇，未变化%d篇，删除%d篇", time.Since(begin).Round(time.Second), updated, unchanged, removed)
+	if len(failed) > 0 {
+		result += fmt.Sprintf("，失败%d篇: %s", len(failed), strings.Join(failed, "、"))
+	}
+
+	return result, nil
+}
+
+// 切分文档并生成每个片段的embedding
+func (c *Chatbot) embedDocument(source, hash, text string) ([]*KnowledgeChunk, error) {
+	kb := c.knowledge
+	sections := chunkDocument(text, kb.config.ChunkSize, kb.config.ChunkOverlap)
+	if len(sections) == 0 {
+		return nil, nil
+	}
+
+	// 片段带上文档和标题，标题中的关键词同样可以被检索到
+	inputs := make([]string, 0, len(sections))
+	for _, section := range sections {
+		inputs = append(inputs, strings.TrimSpace(source+" "+section.title)+"\n"+section.content)
+	}
+
+	vectors, _, err := c.embed(inputs, knowledgeRequestTimeout*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make([]*KnowledgeChunk, 0, len(sections))
+	for i, section := range sections {
+		chunks = append(chunks, &KnowledgeChunk{
+			Id:      source + "#" + strconv.Itoa(i),
+			Source:  source,
+			Title:   section.title,
+			Content: section.content,
+			Hash:    hash,
+			Vector:  vectors[i],
+		})
+	}
+
+	return chunks, nil
+}
+
+// 检索到的片段和相似度
+type knowledgeHit struct {
+	chunk *KnowledgeChunk
+	score float64
+}
+
+// searchKnowledge 检索和query最相似的topK个片段，相似度低于MinScore的片段不返回，生成embedding的用量记录到userID
+func (c *Chatbot) searchKnowledge(userID, query string, topK int) ([]*knowledgeHit, error) {
+	kb := c.knowledge
+
+	all, err := kb.index.Chunks()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(all) == 0 {
+		return nil, nil
+	}
+
+	begin := time.Now()
+	vectors, tokens, err := c.embed([]string{query}, knowledgeSearchTimeout*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordModelUsage(userID, AIName_OpenAI, kb.config.Model, begin, tokens, 0, int64(tokens))
+
+	return rankKnowledge(all, vectors[0], kb.config.MinScore, topK), nil
+}
+
+// rankKnowledge 按照和vector的相似度从高到低返回topK个片段
+func rankKnowledge(all map[string][]*KnowledgeChunk, vector []float32, minScore float64, topK int) []*knowledgeHit {
+	hits := []*knowledgeHit{}
+	for _, chunks := range all {
+		for _, chunk := range chunks {
+			score := cosineSimilarity(vector, chunk.Vector)
+			if score >= minScore {
+				hits = append(hits, &knowledgeHit{chunk: chunk, score: score})
+			}
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].score > hits[j].score
+	})
+
+	return hits[:min(topK, len(hits))]
+}
+
+// 余弦相似度，向量维度不一致时为0，例如更换了embedding模型后没有重新导入
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// retrieveKnowledge 检索和提问相关的片段，作为参考资料加入系统提示词，检索失败或者超时时不影响提问
+func (c *Chatbot) retrieveKnowledge(job *chatJob, input string) {
+	if c.knowledge == nil {
+		return
+	}
+
+	// 群聊的提问带有"[userid] "前缀区分提问人，检索时去掉，避免影响相似度
+	query := knowledgeQuery(job, input)
+
+	// 接着生成被截断的回复时，提问和文档无关，不需要检索，排队的续写提问出队时同样跳过
+	if query == continuePrompt || strings.TrimSpace(query) == continueCommand {
+		return
+	}
+
+	hits, err := c.searchKnowledge(job.userID, query, c.knowledge.config.TopK)
+	if err != nil {
+		log.Printf("[ERROR][retrieveKnowledge] searchKnowledge failed, sessionID=%s, err=%s", job.sessionID, err)
+		return
+	}
+
+	if len(hits) == 0 {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("以下是从企业内部文档中检索到的参考资料，回答时如果用到了参考资料，请在对应内容后用[编号]标注来源；参考资料和问题无关时忽略，不要编造文档中没有的内容。\n")
+
+	citations := make([]string, 0, len(hits))
+	for i, hit := range hits {
+		citations = append(citations, hit.chunk.citation())
+		fmt.Fprintf(&sb, "\n[%d] 来源: %s\n%s\n", i+1, hit.chunk.citation(), hit.chunk.Content)
+	}
+
+	job.knowledge = sb.String()
+	job.citations = citations
+
+	log.Printf("[INFO][retrieveKnowledge] sessionID=%s, citations=%v", job.sessionID, citations)
+}
+
+// 检索使用的提问内容，去掉群聊中提问人的前缀
+func knowledgeQuery(job *chatJob, input string) string {
+	if job.chatID == "" {
+		return input
+	}
+
+	return strings.TrimPrefix(input, "["+job.userID+"] ")
+}
+
+var citationRefPattern = regexp.MustCompile(`\[(\d+)\]`)
+
+// appendCitations 在回复的最后列出引用的参考资料，只列出回复中通过[编号]标注了的资料
+func appendCitations(content string, citations []string) string {
+	if len(citations) == 0 {
+		return content
+	}
+
+	referenced := make(map[int]bool)
+	for _, match := range citationRefPattern.FindAllStringSubmatch(content, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err == nil && n >= 1 && n <= len(citations) {
+			referenced[n] = true
+		}
+	}
+
+	if len(referenced) == 0 {
+		return content
+	}
+
+	var sb strings.Builder
+	sb.WriteString(content)
+	sb.WriteString("\n\n参考资料:")
+	for i, citation := range citations {
+		if referenced[i+1] {
+			fmt.Fprintf(&sb, "\n[%d] %s", i+1, citation)
+		}
+	}
+
+	return sb.String()
+}
+
+const knowledgeCommandUsage = `知识库指令:
+/kb status 查看知识库的状态
+/kb search <问题> 检索和问题相关的文档片段
+/kb ingest 重新导入知识库目录下的文档(仅管理员)`
+
+// /kb 知识库的导入和检索
+func (c *Chatbot) handleKnowledgeCommand(userID string, args string) (string, error) {
+	if c.knowledge == nil {
+		return "当前没有开启知识库", nil
+	}
+
+	sub, rest, _ := strings.Cut(args, " ")
+	rest = strings.TrimSpace(rest)
+
+	switch sub {
+	case "status":
+		return c.knowledgeStatus(), nil
+
+	case "search":
+		if rest == "" {
+			return knowledgeCommandUsage, nil
+		}
+
+		hits, err := c.searchKnowledge(userID, rest, c.knowledge.config.TopK)
+		if err != nil {
+			log.Printf("[ERROR][handleKnowledgeCommand] searchKnowledge failed, userID=%s, err=%s", userID, err)
+			return "检索失败，请稍后再试", nil
+		}
+
+		if len(hits) == 0 {
+			return "没有检索到相关的文档", nil
+		}
+
+		var sb strings.Builder
+		for i, hit := range hits {
+			if i > 0 {
+				sb.WriteString("\n\n")
+			}
+			fmt.Fprintf(&sb, "[%d] %s (相似度%.2f)\n%s", i+1, hit.chunk.citation(), hit.score, hit.chunk.Content)
+		}
+
+		return sb.String(), nil
+
+	case "ingest":
+		if !c.isAdmin(userID) {
+			return "只有管理员可以导入知识库", nil
+		}
+
+		if !c.knowledge.ingesting.CompareAndSwap(false, true) {
+			return "知识库正在导入中，请稍后再试", nil
+		}
+
+		// 导入耗时较长，完成后推送结果
+		go func() {
+			defer c.knowledge.ingesting.Store(false)
+
+			result, err := c.ingestKnowledge()
+			if err != nil {
+				log.Printf("[ERROR][handleKnowledgeCommand] ingestKnowledge failed, userID=%s, err=%s", userID, err)
+				result = "知识库导入失败: " + err.Error()
+			}
+
+			c.knowledge.mu.Lock()
+			c.knowledge.lastIngest = time.Now().Format("2006-01-02 15:04:05 ") + result
+			c.knowledge.mu.Unlock()
+
+			if _, err := c.publish(userID, "", result); err != nil {
+				log.Printf("[ERROR][handleKnowledgeCommand] publish result failed, userID=%s, err=%s", userID, err)
+			}
+		}()
+
+		return "开始导入知识库，完成后推送结果", nil
+	}
+
+	return knowledgeCommandUsage, nil
+}
+
+func (c *Chatbot) knowledgeStatus() string {
+	kb := c.knowledge
+
+	all, err := kb.index.Chunks()
+	if err != nil {
+		log.Printf("[ERROR][knowledgeStatus] index Chunks failed, err=%s", err)
+		return "获取知识库状态失败，请稍后再试"
+	}
+
+	chunkCnt := 0
+	for _, chunks := range all {
+		chunkCnt += len(chunks)
+	}
+
+	status := fmt.Sprintf("知识库目录: %s\n文档数: %d\n片段数: %d", kb.config.Dir, len(all), chunkCnt)
+	if kb.ingesting.Load() {
+		status += "\n正在导入中"
+	}
+
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	if kb.lastIngest != "" {
+		status += "\n最近一次导入: " + kb.lastIngest
+	}
+
+	return status
+}
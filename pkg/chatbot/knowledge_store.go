@@ -0,0 +1,230 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	KnowledgeStoreMemory = "memory"
+	KnowledgeStoreRedis  = "redis"
+
+	knowledgeKey        = "chatbot-knowledge"         // Redis中保存知识库片段的hash，field为文档路径
+	knowledgeVersionKey = "chatbot-knowledge-version" // 知识库的版本号，每次修改后递增，用于刷新进程内的缓存
+)
+
+// 知识库中文档的一个片段
+type KnowledgeChunk struct {
+	Id      string    `json:"id"`     // 文档路径#序号
+	Source  string    `json:"source"` // 文档相对于知识库目录的路径
+	Title   string    `json:"title"`  // 片段所在的标题，没有标题时为空
+	Content string    `json:"content"`
+	Hash    string    `json:"hash"` // 文档内容的hash，文档没有变化时不重新生成embedding
+	Vector  []float32 `json:"vector"`
+}
+
+// 片段的引用名称，文档路径加上标题
+func (k *KnowledgeChunk) citation() string {
+	if k.Title == "" {
+		return k.Source
+	}
+
+	return k.Source + "#" + k.Title
+}
+
+// knowledgeIndex 知识库的向量索引，按照文档整体替换，检索时在进程内计算相似度
+type knowledgeIndex interface {
+	// Chunks 获取所有文档的片段，文档路径 -> 片段列表
+	Chunks() (map[string][]*KnowledgeChunk, error)
+	// Replace 替换文档的所有片段，chunks为空时删除文档
+	Replace(source string, chunks []*KnowledgeChunk) error
+}
+
+// newKnowledgeIndex 按照配置创建向量索引，未配置时开启Redis使用Redis，否则使用内存
+func newKnowledgeIndex(config *KnowledgeConfig, rdb *redis.Client) (knowledgeIndex, error) {
+	storeType := config.Store
+	if storeType == "" {
+		storeType = KnowledgeStoreMemory
+		if rdb != nil {
+			storeType = KnowledgeStoreRedis
+		}
+	}
+
+	switch storeType {
+	case KnowledgeStoreMemory:
+		return newMemoryKnowledgeIndex(config.Path)
+	case KnowledgeStoreRedis:
+		if rdb == nil {
+			return nil, fmt.Errorf("redis knowledge store need redis enable")
+		}
+		return &redisKnowledgeIndex{client: rdb, version: -1}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported knowledge store: %s", storeType)
+}
+
+// 进程内的向量索引，path不为空时每次修改后保存到文件，启动时加载
+type memoryKnowledgeIndex struct {
+	path   string
+	chunks map[string][]*KnowledgeChunk
+	mu     sync.RWMutex
+}
+
+func newMemoryKnowledgeIndex(path string) (*memoryKnowledgeIndex, error) {
+	index := &memoryKnowledgeIndex{
+		path:   path,
+		chunks: make(map[string][]*KnowledgeChunk),
+	}
+
+	if path == "" {
+		return index, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &index.chunks); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO][newMemoryKnowledgeIndex] load knowledge index, path=%s, documents=%d", path, len(index.chunks))
+
+	return index, nil
+}
+
+func (m *memoryKnowledgeIndex) Chunks() (map[string][]*KnowledgeChunk, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.chunks, nil
+}
+
+func (m *memoryKnowledgeIndex) Replace(source string, chunks []*KnowledgeChunk) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// 检索时直接使用map，修改时复制一份，避免并发读写
+	updated := make(map[string][]*KnowledgeChunk, len(m.chunks)+1)
+	for name, list := range m.chunks {
+		updated[name] = list
+	}
+
+	if len(chunks) == 0 {
+		delete(updated, source)
+	} else {
+		updated[source] = chunks
+	}
+
+	if err := m.save(updated); err != nil {
+		return err
+	}
+
+	m.chunks = updated
+
+	return nil
+}
+
+// 先写临时文件再重命名，避免写入中途退出导致文件损坏
+func (m *memoryKnowledgeIndex) save(chunks map[string][]*KnowledgeChunk) error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(chunks)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.path)
+}
+
+// Redis中的向量索引，多个实例共享，检索时使用进程内的缓存，版本号变化时重新加载
+type redisKnowledgeIndex struct {
+	client *redis.Client
+
+	chunks  map[string][]*KnowledgeChunk
+	version int64
+	mu      sync.Mutex
+}
+
+func (r *redisKnowledgeIndex) Chunks() (map[string][]*KnowledgeChunk, error) {
+	ctx := context.Background()
+
+	version, err := r.client.Get(ctx, knowledgeVersionKey).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if version == r.version {
+		return r.chunks, nil
+	}
+
+	values, err := r.client.HGetAll(ctx, knowledgeKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(map[string][]*KnowledgeChunk, len(values))
+	for source, value := range values {
+		var list []*KnowledgeChunk
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			log.Printf("[ERROR][redisKnowledgeIndex] json Unmarshal failed, source=%s, err=%s", source, err)
+			continue
+		}
+		chunks[source] = list
+	}
+
+	r.chunks = chunks
+	r.version = version
+
+	return chunks, nil
+}
+
+func (r *redisKnowledgeIndex) Replace(source string, chunks []*KnowledgeChunk) error {
+	ctx := context.Background()
+
+	if len(chunks) == 0 {
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, knowledgeKey, source)
+			pipe.Incr(ctx, knowledgeVersionKey)
+			return nil
+		})
+		return err
+	}
+
+	data, err := json.Marshal(chunks)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, knowledgeKey, source, data)
+		pipe.Incr(ctx, knowledgeVersionKey)
+		return nil
+	})
+
+	return err
+}
@@ -0,0 +1,104 @@
+package chatbot
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestChunkDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []knowledgeSection
+	}{
+		{"empty", "\n\n", 500, 50, []knowledgeSection{}},
+		{"headings", "intro\n# 安装\n步骤一\r\n步骤二\n\n## 配置 ##\n修改config.json", 500, 50, []knowledgeSection{
+			{"", "intro"},
+			{"安装", "步骤一\n步骤二"},
+			{"配置", "修改config.json"},
+		}},
+		{"code fence", "# 示例\n```\n# 注释\n```", 500, 50, []knowledgeSection{
+			{"示例", "```\n# 注释\n```"},
+		}},
+		{"merge paragraphs", "aa\n\nbb\n\ncc", 5, 0, []knowledgeSection{
+			{"", "aa\nbb"},
+			{"", "cc"},
+		}},
+		{"split long paragraph with overlap", "abcdefghij", 4, 1, []knowledgeSection{
+			{"", "abcd"},
+			{"", "defg"},
+			{"", "ghij"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkDocument(tt.text, tt.size, tt.overlap); !slices.Equal(got, tt.want) {
+				t.Fatalf("chunkDocument = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankKnowledge(t *testing.T) {
+	all := map[string][]*KnowledgeChunk{
+		"a.md": {
+			{Id: "a.md#0", Vector: []float32{1, 0}},
+			{Id: "a.md#1", Vector: []float32{0, 1}},
+		},
+		"b.md": {
+			{Id: "b.md#0", Vector: []float32{1, 1}},
+			{Id: "b.md#1", Vector: []float32{1, 0, 0}}, // 更换模型前的向量
+		},
+	}
+
+	tests := []struct {
+		name     string
+		vector   []float32
+		minScore float64
+		topK     int
+		want     []string
+	}{
+		{"ordered by score", []float32{1, 0.1}, 0.3, 3, []string{"a.md#0", "b.md#0"}},
+		{"top k", []float32{1, 0.1}, 0.3, 1, []string{"a.md#0"}},
+		{"min score", []float32{0, 1}, 0.8, 3, []string{"a.md#1"}},
+		{"no hits", []float32{-1, -1}, 0.3, 3, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, hit := range rankKnowledge(all, tt.vector, tt.minScore, tt.topK) {
+				got = append(got, hit.chunk.Id)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("hits = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKnowledgeQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		job   *chatJob
+		input string
+		want  string
+	}{
+		{"single chat", newChatJob("alice", "", "alice", false), "[alice] 报销流程", "[alice] 报销流程"},
+		{"group chat", newChatJob(groupSessionID("chat"), "chat", "alice", false), "[alice] 报销流程", "报销流程"},
+		{"group continue", newChatJob(groupSessionID("chat"), "chat", "alice", false), "[alice] " + continueCommand, continueCommand},
+		{"other asker", newChatJob(groupSessionID("chat"), "chat", "alice", false), "[bob] 报销流程", "[bob] 报销流程"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := knowledgeQuery(tt.job, tt.input); got != tt.want {
+				t.Fatalf("knowledgeQuery = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
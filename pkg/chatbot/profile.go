@@ -0,0 +1,165 @@
+package chatbot
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/walkerdu/wecom-backend/pkg/claude"
+	openai "github.com/walkerdu/wecom-backend/pkg/openai-v1"
+)
+
+const (
+	geminiModel = "gemini-pro"
+
+	modelDeniedMessage = "抱歉，你暂时没有可以使用的模型权限，如有需要请联系管理员开通~"
+)
+
+// 用户资料，由接入平台的通讯录提供，用于构造系统提示词、按部门路由AI和权限控制
+type UserProfile struct {
+	Name           string
+	Position       string
+	Departments    []string
+	DepartmentIds  []int
+	MainDepartment int
+	Tags           []string
+	TagIds         []int
+}
+
+// 注册获取用户资料的回调
+func (c *Chatbot) RegisterUserProfile(provider func(string) (*UserProfile, error)) {
+	c.profileProvider = provider
+}
+
+// getUserProfile 获取用户资料，未注册回调或者获取失败时返回nil，群聊的会话id没有用户资料
+func (c *Chatbot) getUserProfile(userID string) *UserProfile {
+	if c.profileProvider == nil || strings.HasPrefix(userID, groupSessionID("")) {
+		return nil
+	}
+
+	profile, err := c.profileProvider(userID)
+	if err != nil {
+		log.Printf("[WARN][getUserProfile] get user profile failed, userID=%s, err=%s", userID, err)
+		return nil
+	}
+
+	return profile
+}
+
+// 根据用户资料构造系统提示词，没有用户资料时返回空
+func (c *Chatbot) systemPrompt(userID string) string {
+	profile := c.getUserProfile(userID)
+	if profile == nil || profile.Name == "" {
+		return ""
+	}
+
+	prompt := fmt.Sprintf("你是企业内部的智能助手，正在和%s对话", profile.Name)
+	if len(profile.Departments) > 0 {
+		prompt += fmt.Sprintf("，TA所在的部门是%s", strings.Join(profile.Departments, "、"))
+	}
+	if profile.Position != "" {
+		prompt += fmt.Sprintf("，职务是%s", profile.Position)
+	}
+
+	return prompt + "。请结合TA的身份进行回答。"
+}
+
+// 提问的系统提示词，用户资料之后追加检索到的知识库参考资料
+func (c *Chatbot) requestSystemPrompt(job *chatJob) string {
+	prompt := c.systemPrompt(job.sessionID)
+	if job.knowledge == "" {
+		return prompt
+	} else if prompt == "" {
+		return job.knowledge
+	}
+
+	return prompt + "\n\n" + job.knowledge
+}
+
+// routeAIName 按照用户所在部门路由到配置的AI，未命中或者AI未开启时使用默认的AI
+func (c *Chatbot) routeAIName(userID string) string {
+	if len(c.departmentRoute) == 0 {
+		return c.getAIName()
+	}
+
+	profile := c.getUserProfile(userID)
+	if profile == nil {
+		return c.getAIName()
+	}
+
+	for i, id := range profile.DepartmentIds {
+		keys := []string{strconv.Itoa(id)}
+		if i < len(profile.Departments) {
+			keys = append(keys, profile.Departments[i])
+		}
+
+		for _, key := range keys {
+			if aiName, ok := c.departmentRoute[key]; ok && c.hasAI(aiName) {
+				return aiName
+			}
+		}
+	}
+
+	return c.getAIName()
+}
+
+// 注册模型权限校验的回调，参数为提问人的userid、AI名称和模型名称
+func (c *Chatbot) RegisterModelAuthorizer(authorizer func(string, string, string) bool) {
+	c.modelAuthorizer = authorizer
+}
+
+// 各个AI使用的模型
+func modelName(aiName string) string {
+	switch aiName {
+	case AIName_OpenAI:
+		return string(openai.Gpt35Turbo)
+	case AIName_Gemini:
+		return geminiModel
+	case AIName_Claude:
+		return string(claude.Claude3Opus)
+	}
+
+	return ""
+}
+
+// selectAIName 选择提问人可以使用的AI，优先使用部门路由的AI，没有权限时按照默认优先级选择其他AI
+// 所有开启的AI都没有权限时返回false
+func (c *Chatbot) selectAIName(userID string) (string, bool) {
+	aiName := c.routeAIName(userID)
+	if c.modelAuthorizer == nil || aiName == "" {
+		return aiName, true
+	}
+
+	for _, name := range append([]string{aiName}, c.enabledAINames()...) {
+		if c.modelAuthorizer(userID, name, modelName(name)) {
+			return name, true
+		}
+	}
+
+	log.Printf("[WARN][selectAIName] no model authorized, userID=%s", userID)
+
+	return "", false
+}
+
+// 判断AI是否开启
+func (c *Chatbot) hasAI(aiName string) bool {
+	return slices.Contains(c.enabledAINames(), aiName)
+}
+
+// 开启的AI列表
+func (c *Chatbot) enabledAINames() []string {
+	names := []string{}
+	if c.openaiClient != nil {
+		names = append(names, AIName_OpenAI)
+	}
+	if c.geminiClient != nil {
+		names = append(names, AIName_Gemini)
+	}
+	if c.claudeClient != nil {
+		names = append(names, AIName_Claude)
+	}
+
+	return names
+}
@@ -0,0 +1,389 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+const (
+	pushQueueKey           = "chatbot-push-queue"      // 待推送队列
+	pushQueueProcessingKey = "chatbot-push-processing" // 推送中队列，租约过期后重新放回待推送队列
+	pushQueueLeaseKey      = "chatbot-push-lease"      // 推送中任务的租约，zset的score为租约过期的时间戳
+	pushQueueDeadLetterKey = "chatbot-push-deadletter" // 重试失败的死信队列
+
+	defaultPushWorkers        = 4
+	defaultPushMaxRetry       = 5
+	defaultPushRetryInterval  = 2    // 首次重试间隔，之后指数退避，单位秒
+	defaultPushRateLimit      = 50   // 每秒推送的消息数，企业微信每个应用每分钟最多推送2万人次
+	defaultPushQueueCapacity  = 1000 // 内存队列的容量
+	defaultPushDeadLetterSize = 1000 // 死信队列保留的最大条数
+
+	pushQueuePopTimeout      = 5 * time.Second
+	pushQueueLeaseTimeout    = 60 * time.Second // 推送中任务的租约时长，不包括重试的退避时间
+	pushQueueRecoverInterval = 30 * time.Second // 检查租约过期任务的间隔
+)
+
+var ErrPushQueueFull = errors.New("push queue is full")
+
+// 推送任务
+type pushJob struct {
+	Id               string `json:"id"`
+	UserID           string `json:"user_id"`
+	Content          string `json:"content"`
+	Ai               string `json:"ai"`
+	Ts               int64  `json:"ts"`                          // 对应聊天上下文中AI回复的时间戳，推送成功后回写msgid，为0表示不需要回写
+	PlaceholderMsgId string `json:"placeholder_msgid,omitempty"` // 推送成功后需要撤回的占位消息
+	ChatId           string `json:"chat_id,omitempty"`           // 群聊id，不为空时推送到群聊
+	Conversation     string `json:"conversation,omitempty"`      // AI回复保存的会话，为空时为Ai
+	Attempts         int    `json:"attempts"`
+	LastErr          string `json:"last_err,omitempty"`
+
+	raw string // 出队时的原始数据，用于从推送中队列删除
+}
+
+// 推送队列的存储，开启Redis时使用Redis list，否则使用有界的内存队列
+type pushQueueStore interface {
+	Push(job *pushJob) error
+	Pop(timeout time.Duration) (*pushJob, error) // 出队，超时返回nil
+	Ack(job *pushJob)                            // 推送完成，从推送中队列删除
+	DeadLetter(job *pushJob)
+	DeleteUser(userID string) error // 删除用户待推送的任务，推送中和等待重试的任务不处理
+}
+
+type memoryPushQueueStore struct {
+	jobs           chan *pushJob
+	deadLetters    []*pushJob
+	deadLetterSize int
+	mu             sync.Mutex
+}
+
+func newMemoryPushQueueStore(capacity, deadLetterSize int) *memoryPushQueueStore {
+	return &memoryPushQueueStore{
+		jobs:           make(chan *pushJob, capacity),
+		deadLetterSize: deadLetterSize,
+	}
+}
+
+func (m *memoryPushQueueStore) Push(job *pushJob) error {
+	select {
+	case m.jobs <- job:
+		return nil
+	default:
+		return ErrPushQueueFull
+	}
+}
+
+func (m *memoryPushQueueStore) Pop(timeout time.Duration) (*pushJob, error) {
+	select {
+	case job := <-m.jobs:
+		return job, nil
+	case <-time.After(timeout):
+		return nil, nil
+	}
+}
+
+func (m *memoryPushQueueStore) Ack(job *pushJob) {
+}
+
+func (m *memoryPushQueueStore) DeadLetter(job *pushJob) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.deadLetters) >= m.deadLetterSize {
+		m.deadLetters = m.deadLetters[1:]
+	}
+
+	m.deadLetters = append(m.deadLetters, job)
+}
+
+// 多个实例共用推送队列，出队时记录租约，推送完成时删除，租约过期说明处理的实例已经退出
+func (m *memoryPushQueueStore) DeleteUser(userID string) error {
+	// 取出所有待推送的任务，放回不属于该用户的任务
+	var remain []*pushJob
+	for done := false; !done; {
+		select {
+		case job := <-m.jobs:
+			if job.UserID != userID {
+				remain = append(remain, job)
+			}
+		default:
+			done = true
+		}
+	}
+
+	for _, job := range remain {
+		if err := m.Push(job); err != nil {
+			log.Printf("[ERROR][memoryPushQueueStore] push back failed, jobId=%s, err=%s", job.Id, err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deadLetters = slices.DeleteFunc(m.deadLetters, func(job *pushJob) bool {
+		return job.UserID == userID
+	})
+
+	return nil
+}
+
+type redisPushQueueStore struct {
+	client         *redis.Client
+	deadLetterSize int
+	leaseTimeout   time.Duration
+}
+
+func newRedisPushQueueStore(client *redis.Client, deadLetterSize int, leaseTimeout time.Duration) *redisPushQueueStore {
+	r := &redisPushQueueStore{
+		client:         client,
+		deadLetterSize: deadLetterSize,
+		leaseTimeout:   leaseTimeout,
+	}
+
+	go func() {
+		for {
+			r.recover()
+			time.Sleep(pushQueueRecoverInterval)
+		}
+	}()
+
+	return r
+}
+
+// 租约过期的任务放回待推送队列的头部，没有租约的任务可能是刚出队还没有记录租约，先补上租约，过期后再恢复
+var pushQueueRecoverScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local lease = tonumber(ARGV[2])
+local cnt = 0
+for _, item in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+	local expireAt = redis.call('ZSCORE', KEYS[3], item)
+	if not expireAt then
+		redis.call('ZADD', KEYS[3], now + lease, item)
+	elseif tonumber(expireAt) < now then
+		redis.call('LREM', KEYS[1], 1, item)
+		redis.call('ZREM', KEYS[3], item)
+		redis.call('LPUSH', KEYS[2], item)
+		cnt = cnt + 1
+	end
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now - lease)
+return cnt
+`)
+
+// 将租约过期的推送任务重新放回待推送队列，只恢复已经退出的实例未完成的任务
+func (r *redisPushQueueStore) recover() {
+	cnt, err := pushQueueRecoverScript.Run(context.Background(), r.client,
+		[]string{pushQueueProcessingKey, pushQueueKey, pushQueueLeaseKey},
+		time.Now().Unix(), int64(r.leaseTimeout/time.Second)).Int()
+	if err != nil {
+		log.Printf("[ERROR][redisPushQueueStore] recover failed, err=%s", err)
+		return
+	}
+
+	if cnt > 0 {
+		log.Printf("[INFO][redisPushQueueStore] recover %d push jobs", cnt)
+	}
+}
+
+func (r *redisPushQueueStore) Push(job *pushJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return r.client.RPush(context.Background(), pushQueueKey, data).Err()
+}
+
+func (r *redisPushQueueStore) Pop(timeout time.Duration) (*pushJob, error) {
+	data, err := r.client.BLMove(context.Background(), pushQueueKey, pushQueueProcessingKey, "LEFT", "RIGHT", timeout).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	job := &pushJob{}
+	if err := json.Unmarshal([]byte(data), job); err != nil {
+		// 异常数据直接丢弃，避免阻塞队列
+		r.client.LRem(context.Background(), pushQueueProcessingKey, 1, data)
+		return nil, err
+	}
+
+	job.raw = data
+
+	expireAt := time.Now().Add(r.leaseTimeout).Unix()
+	if err := r.client.ZAdd(context.Background(), pushQueueLeaseKey, redis.Z{Score: float64(expireAt), Member: data}).Err(); err != nil {
+		log.Printf("[ERROR][redisPushQueueStore] redis ZAdd lease failed, jobId=%s, err=%s", job.Id, err)
+	}
+
+	return job, nil
+}
+
+func (r *redisPushQueueStore) Ack(job *pushJob) {
+	ctx := context.Background()
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, pushQueueProcessingKey, 1, job.raw)
+		pipe.ZRem(ctx, pushQueueLeaseKey, job.raw)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][redisPushQueueStore] redis LRem failed, jobId=%s, err=%s", job.Id, err)
+	}
+}
+
+func (r *redisPushQueueStore) DeadLetter(job *pushJob) {
+	ctx := context.Background()
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("[ERROR][redisPushQueueStore] json Marshal failed, jobId=%s, err=%s", job.Id, err)
+		return
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, pushQueueDeadLetterKey, data)
+		pipe.LTrim(ctx, pushQueueDeadLetterKey, int64(-r.deadLetterSize), -1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][redisPushQueueStore] redis RPush dead letter failed, jobId=%s, err=%s", job.Id, err)
+	}
+}
+
+// 删除待推送队列和死信队列中属于用户的任务
+var pushQueueDeleteUserScript = redis.NewScript(`
+local cnt = 0
+for _, key in ipairs(KEYS) do
+	for _, item in ipairs(redis.call('LRANGE', key, 0, -1)) do
+		local ok, job = pcall(cjson.decode, item)
+		if ok and job.user_id == ARGV[1] then
+			cnt = cnt + redis.call('LREM', key, 0, item)
+		end
+	end
+end
+return cnt
+`)
+
+func (r *redisPushQueueStore) DeleteUser(userID string) error {
+	return pushQueueDeleteUserScript.Run(context.Background(), r.client, []string{pushQueueKey, pushQueueDeadLetterKey}, userID).Err()
+}
+
+// 推送队列，由多个worker按照频率限制进行推送，失败后指数退避重试，重试失败进入死信队列
+type pushQueue struct {
+	config  PushQueueConfig
+	store   pushQueueStore
+	limiter *rate.Limiter
+	deliver func(*pushJob) error
+}
+
+func newPushQueue(config *PushQueueConfig, rdb *redis.Client, deliver func(*pushJob) error) *pushQueue {
+	q := &pushQueue{
+		config:  *config,
+		deliver: deliver,
+	}
+
+	if q.config.Workers <= 0 {
+		q.config.Workers = defaultPushWorkers
+	}
+	if q.config.MaxRetry <= 0 {
+		q.config.MaxRetry = defaultPushMaxRetry
+	}
+	if q.config.RetryInterval <= 0 {
+		q.config.RetryInterval = defaultPushRetryInterval
+	}
+	if q.config.RateLimit <= 0 {
+		q.config.RateLimit = defaultPushRateLimit
+	}
+	if q.config.Capacity <= 0 {
+		q.config.Capacity = defaultPushQueueCapacity
+	}
+	if q.config.DeadLetterSize <= 0 {
+		q.config.DeadLetterSize = defaultPushDeadLetterSize
+	}
+
+	q.limiter = rate.NewLimiter(rate.Limit(q.config.RateLimit), q.config.Workers)
+
+	if rdb != nil {
+		// 重试的退避期间任务保留在推送中队列，租约需要覆盖最长的退避时间
+		leaseTimeout := pushQueueLeaseTimeout + time.Duration(q.config.RetryInterval)*time.Second<<(q.config.MaxRetry-1)
+		q.store = newRedisPushQueueStore(rdb, q.config.DeadLetterSize, leaseTimeout)
+	} else {
+		q.store = newMemoryPushQueueStore(q.config.Capacity, q.config.DeadLetterSize)
+	}
+
+	for i := 0; i < q.config.Workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+func (q *pushQueue) Push(job *pushJob) error {
+	if job.Id == "" {
+		job.Id = fmt.Sprintf("%s-%d", job.UserID, time.Now().UnixNano())
+	}
+
+	return q.store.Push(job)
+}
+
+func (q *pushQueue) work() {
+	for {
+		job, err := q.store.Pop(pushQueuePopTimeout)
+		if err != nil {
+			log.Printf("[ERROR][pushQueue] Pop failed, err=%s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if job == nil {
+			continue
+		}
+
+		q.limiter.Wait(context.Background())
+
+		if err := q.deliver(job); err != nil {
+			q.retry(job, err)
+			continue
+		}
+
+		log.Printf("[INFO][pushQueue] deliver success, jobId=%s, userID=%s, attempts=%d", job.Id, job.UserID, job.Attempts+1)
+		q.store.Ack(job)
+	}
+}
+
+// 推送失败后指数退避重试，等待期间任务保留在推送中队列，进程退出后租约过期可以恢复
+func (q *pushQueue) retry(job *pushJob, err error) {
+	next := *job
+	next.Attempts++
+	next.LastErr = err.Error()
+	next.raw = ""
+
+	if next.Attempts >= q.config.MaxRetry {
+		log.Printf("[ERROR][pushQueue] deliver failed, move to dead letter, jobId=%s, userID=%s, err=%s", job.Id, job.UserID, err)
+		q.store.DeadLetter(&next)
+		q.store.Ack(job)
+		return
+	}
+
+	backoff := time.Duration(q.config.RetryInterval) * time.Second << (next.Attempts - 1)
+	log.Printf("[WARN][pushQueue] deliver failed, retry after %s, jobId=%s, userID=%s, err=%s", backoff, job.Id, job.UserID, err)
+
+	time.AfterFunc(backoff, func() {
+		if err := q.store.Push(&next); err != nil {
+			log.Printf("[ERROR][pushQueue] retry push failed, jobId=%s, err=%s", job.Id, err)
+			q.store.DeadLetter(&next)
+		}
+
+		q.store.Ack(job)
+	})
+}
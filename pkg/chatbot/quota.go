@@ -0,0 +1,360 @@
+package chatbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+const (
+	quotaKeyPrefix = "chatbot-quota-"
+
+	quotaScopeUser       = "user"
+	quotaScopeDepartment = "department"
+
+	quotaExceededMessage = "你的提问太频繁了，请稍后再试~"
+)
+
+// 令牌桶，按照(rate, burst)计算可用令牌，Redis中使用hash保存令牌数和更新时间
+var redisTokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local data = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(data[1]) or burst
+local ts = tonumber(data[2]) or now
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`)
+
+// 额度的存储，开启Redis时使用Redis，多实例共享额度
+type quotaStore interface {
+	// Allow 从令牌桶中取一个令牌，ratePerSec为每秒生成的令牌数，burst为桶的容量
+	Allow(key string, ratePerSec float64, burst int) bool
+	// AddTokens 增加token用量，ttl为计数的有效时长
+	AddTokens(key string, tokens int64, ttl time.Duration)
+	// GetTokens 获取token用量
+	GetTokens(key string) int64
+	// Delete 删除令牌桶和token用量
+	Delete(keys ...string)
+}
+
+type memoryQuotaStore struct {
+	limiters map[string]*rate.Limiter
+	counters map[string]*quotaCounter
+	mu       sync.Mutex
+}
+
+type quotaCounter struct {
+	tokens   int64
+	expireAt time.Time
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{
+		limiters: make(map[string]*rate.Limiter),
+		counters: make(map[string]*quotaCounter),
+	}
+}
+
+func (m *memoryQuotaStore) Allow(key string, ratePerSec float64, burst int) bool {
+	m.mu.Lock()
+	limiter, exist := m.limiters[key]
+	if !exist {
+		limiter = rate.NewLimiter(rate.Limit(ratePerSec), burst)
+		m.limiters[key] = limiter
+	}
+	m.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+func (m *memoryQuotaStore) AddTokens(key string, tokens int64, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	counter, exist := m.counters[key]
+	if !exist || counter.expireAt.Before(now) {
+		// 新的计数周期，顺便清理过期的计数
+		for k, v := range m.counters {
+			if v.expireAt.Before(now) {
+				delete(m.counters, k)
+			}
+		}
+
+		counter = &quotaCounter{expireAt: now.Add(ttl)}
+		m.counters[key] = counter
+	}
+
+	counter.tokens += tokens
+}
+
+func (m *memoryQuotaStore) GetTokens(key string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counter, exist := m.counters[key]
+	if !exist || counter.expireAt.Before(time.Now()) {
+		return 0
+	}
+
+	return counter.tokens
+}
+
+func (m *memoryQuotaStore) Delete(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.limiters, key)
+		delete(m.counters, key)
+	}
+}
+
+type redisQuotaStore struct {
+	client *redis.Client
+}
+
+func (r *redisQuotaStore) Allow(key string, ratePerSec float64, burst int) bool {
+	allowed, err := redisTokenBucketScript.Run(context.Background(), r.client, []string{key},
+		ratePerSec, burst, time.Now().UnixMilli()).Int()
+	if err != nil {
+		// Redis异常时不限频，保证服务可用
+		log.Printf("[ERROR][redisQuotaStore] run token bucket script failed, key=%s, err=%s", key, err)
+		return true
+	}
+
+	return allowed == 1
+}
+
+func (r *redisQuotaStore) AddTokens(key string, tokens int64, ttl time.Duration) {
+	ctx := context.Background()
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.IncrBy(ctx, key, tokens)
+		pipe.Expire(ctx, key, ttl) // ttl为到计数周期结束的时长，每次刷新不影响周期
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][redisQuotaStore] redis IncrBy failed, key=%s, err=%s", key, err)
+	}
+}
+
+func (r *redisQuotaStore) GetTokens(key string) int64 {
+	tokens, err := r.client.Get(context.Background(), key).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("[ERROR][redisQuotaStore] redis Get failed, key=%s, err=%s", key, err)
+	}
+
+	return tokens
+}
+
+func (r *redisQuotaStore) Delete(keys ...string) {
+	if err := r.client.Del(context.Background(), keys...).Err(); err != nil {
+		log.Printf("[ERROR][redisQuotaStore] redis Del failed, keys=%v, err=%s", keys, err)
+	}
+}
+
+// 用户和部门的频率限制和token额度
+type quotaManager struct {
+	config QuotaConfig
+	store  quotaStore
+}
+
+func newQuotaManager(config *QuotaConfig, rdb *redis.Client) *quotaManager {
+	q := &quotaManager{
+		config: *config,
+	}
+
+	if rdb != nil {
+		q.store = &redisQuotaStore{client: rdb}
+	} else {
+		q.store = newMemoryQuotaStore()
+	}
+
+	return q
+}
+
+// 用户或者部门的额度配置，优先使用单独配置的额度
+func (q *quotaManager) getLimit(scope, id string, names ...string) *QuotaLimit {
+	overrides, limit := q.config.Users, q.config.User
+	if scope == quotaScopeDepartment {
+		overrides, limit = q.config.Departments, q.config.Department
+	}
+
+	for _, key := range append([]string{id}, names...) {
+		if override, ok := overrides[key]; ok {
+			return &override
+		}
+	}
+
+	return &limit
+}
+
+// 日额度和月额度的计数key，以及计数的有效时长
+func quotaTokenKeys(scope, id string, now time.Time) (string, time.Duration, string, time.Duration) {
+	dayKey := fmt.Sprintf("%stokens-%s-%s-%s", quotaKeyPrefix, scope, id, now.Format("20060102"))
+	monthKey := fmt.Sprintf("%stokens-%s-%s-%s", quotaKeyPrefix, scope, id, now.Format("200601"))
+
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+
+	return dayKey, tomorrow.Sub(now), monthKey, nextMonth.Sub(now)
+}
+
+// check 检查频率限制和token额度，超限时返回提示信息
+func (q *quotaManager) check(scope, id string, names ...string) (string, bool) {
+	if id == "" {
+		return "", true
+	}
+
+	limit := q.getLimit(scope, id, names...)
+
+	if limit.Rate > 0 {
+		burst := limit.Burst
+		if burst <= 0 {
+			burst = max(int(limit.Rate), 1)
+		}
+
+		if !q.store.Allow(q.rateKey(scope, id), limit.Rate/60, burst) {
+			return quotaExceededMessage, false
+		}
+	}
+
+	dayKey, _, monthKey, _ := quotaTokenKeys(scope, id, time.Now())
+	if limit.DailyTokens > 0 && q.store.GetTokens(dayKey) >= limit.DailyTokens {
+		return fmt.Sprintf("今日的token额度(%d)已用完，请明天再试~", limit.DailyTokens), false
+	}
+
+	if limit.MonthlyTokens > 0 && q.store.GetTokens(monthKey) >= limit.MonthlyTokens {
+		return fmt.Sprintf("本月的token额度(%d)已用完，请下个月再试~", limit.MonthlyTokens), false
+	}
+
+	return "", true
+}
+
+// 频率限制的令牌桶的key
+func (q *quotaManager) rateKey(scope, id string) string {
+	return quotaKeyPrefix + "rate-" + scope + "-" + id
+}
+
+// addTokens 增加日额度和月额度的用量
+func (q *quotaManager) addTokens(scope, id string, tokens int64) {
+	if id == "" || tokens <= 0 {
+		return
+	}
+
+	dayKey, dayTTL, monthKey, monthTTL := quotaTokenKeys(scope, id, time.Now())
+	q.store.AddTokens(dayKey, tokens, dayTTL)
+	q.store.AddTokens(monthKey, tokens, monthTTL)
+}
+
+// forget 删除用户的频率限制和本日、本月的token用量，之前周期的计数已经过期
+func (q *quotaManager) forget(userID string) {
+	dayKey, _, monthKey, _ := quotaTokenKeys(quotaScopeUser, userID, time.Now())
+	q.store.Delete(q.rateKey(quotaScopeUser, userID), dayKey, monthKey)
+}
+
+// describe 额度的使用情况
+func (q *quotaManager) describe(title, scope, id string, names ...string) string {
+	limit := q.getLimit(scope, id, names...)
+	dayKey, _, monthKey, _ := quotaTokenKeys(scope, id, time.Now())
+
+	var sb strings.Builder
+	sb.WriteString(title + ":\n")
+
+	if limit.Rate > 0 {
+		sb.WriteString(fmt.Sprintf("  频率限制: %g次/分钟\n", limit.Rate))
+	} else {
+		sb.WriteString("  频率限制: 不限\n")
+	}
+
+	sb.WriteString(describeTokens("今日", q.store.GetTokens(dayKey), limit.DailyTokens))
+	sb.WriteString(describeTokens("本月", q.store.GetTokens(monthKey), limit.MonthlyTokens))
+
+	return sb.String()
+}
+
+func describeTokens(period string, used, limit int64) string {
+	if limit <= 0 {
+		return fmt.Sprintf("  %s已用token: %d，不限额度\n", period, used)
+	}
+
+	remain := limit - used
+	if remain < 0 {
+		remain = 0
+	}
+
+	return fmt.Sprintf("  %s已用token: %d，剩余: %d/%d\n", period, used, remain, limit)
+}
+
+// 用户计算额度的部门，优先使用主部门，返回部门id和部门名称
+func (c *Chatbot) quotaDepartment(userID string) (string, string) {
+	profile := c.getUserProfile(userID)
+	if profile == nil || len(profile.DepartmentIds) == 0 {
+		return "", ""
+	}
+
+	for i, id := range profile.DepartmentIds {
+		if id == profile.MainDepartment && i < len(profile.Departments) {
+			return strconv.Itoa(id), profile.Departments[i]
+		}
+	}
+
+	name := ""
+	if len(profile.Departments) > 0 {
+		name = profile.Departments[0]
+	}
+
+	return strconv.Itoa(profile.DepartmentIds[0]), name
+}
+
+// checkQuota 发起请求前检查用户和部门的频率限制和token额度
+func (c *Chatbot) checkQuota(userID string) (string, bool) {
+	if c.quota == nil {
+		return "", true
+	}
+
+	if msg, ok := c.quota.check(quotaScopeUser, userID); !ok {
+		log.Printf("[INFO][checkQuota] user quota exceeded, userID=%s, msg=%s", userID, msg)
+		return msg, false
+	}
+
+	departmentID, departmentName := c.quotaDepartment(userID)
+	if msg, ok := c.quota.check(quotaScopeDepartment, departmentID, departmentName); !ok {
+		log.Printf("[INFO][checkQuota] department quota exceeded, userID=%s, department=%s, msg=%s", userID, departmentID, msg)
+		return "你所在部门的" + msg, false
+	}
+
+	return "", true
+}
+
+// /quota 查看用户和所在部门的剩余额度
+func (c *Chatbot) handleQuotaCommand(userID string, args string) (string, error) {
+	if c.quota == nil {
+		return "当前没有开启额度限制", nil
+	}
+
+	rsp := c.quota.describe("个人额度", quotaScopeUser, userID)
+
+	if departmentID, departmentName := c.quotaDepartment(userID); departmentID != "" {
+		rsp += c.quota.describe("部门额度("+departmentName+")", quotaScopeDepartment, departmentID, departmentName)
+	}
+
+	return strings.TrimSuffix(rsp, "\n"), nil
+}
@@ -0,0 +1,96 @@
+package chatbot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaCheck(t *testing.T) {
+	config := &QuotaConfig{
+		Enable:      true,
+		User:        QuotaLimit{Rate: 60, Burst: 2, DailyTokens: 100},
+		Department:  QuotaLimit{MonthlyTokens: 1000},
+		Users:       map[string]QuotaLimit{"vip": {}},
+		Departments: map[string]QuotaLimit{"平台部": {MonthlyTokens: 50}},
+	}
+
+	tests := []struct {
+		name     string
+		scope    string
+		id       string
+		names    []string
+		requests int   // 检查前的请求数
+		tokens   int64 // 检查前已经使用的token
+		want     bool
+	}{
+		{"within burst", quotaScopeUser, "alice", nil, 1, 0, true},
+		{"burst exceeded", quotaScopeUser, "alice", nil, 2, 0, false},
+		{"daily tokens used up", quotaScopeUser, "alice", nil, 0, 100, false},
+		{"override without limit", quotaScopeUser, "vip", nil, 10, 10000, true},
+		{"department default", quotaScopeDepartment, "2", []string{"设计部"}, 0, 999, true},
+		{"department override by name", quotaScopeDepartment, "1", []string{"平台部"}, 0, 50, false},
+		{"empty id", quotaScopeDepartment, "", nil, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuotaManager(config, nil)
+
+			for i := 0; i < tt.requests; i++ {
+				q.check(tt.scope, tt.id, tt.names...)
+			}
+			q.addTokens(tt.scope, tt.id, tt.tokens)
+
+			if _, ok := q.check(tt.scope, tt.id, tt.names...); ok != tt.want {
+				t.Fatalf("check = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+// 令牌桶按照每分钟的请求数补充令牌
+func TestMemoryQuotaStoreAllow(t *testing.T) {
+	store := newMemoryQuotaStore()
+
+	tests := []struct {
+		name  string
+		sleep time.Duration
+		want  bool
+	}{
+		{"first", 0, true},
+		{"second", 0, true},
+		{"bucket empty", 0, false},
+		{"refilled", 60 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			time.Sleep(tt.sleep)
+			if got := store.Allow("key", 20, 2); got != tt.want {
+				t.Fatalf("Allow = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaTokenKeys(t *testing.T) {
+	now := time.Date(2026, 1, 31, 23, 0, 0, 0, time.Local)
+	dayKey, dayTTL, monthKey, monthTTL := quotaTokenKeys(quotaScopeUser, "alice", now)
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"day key", dayKey, quotaKeyPrefix + "tokens-user-alice-20260131"},
+		{"day ttl", dayTTL, time.Hour},
+		{"month key", monthKey, quotaKeyPrefix + "tokens-user-alice-202601"},
+		{"month ttl", monthTTL, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
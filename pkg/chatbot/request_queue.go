@@ -0,0 +1,116 @@
+package chatbot
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultRequestMergeWindow = 5 // 合并连续提问的时间窗口，单位秒
+
+	processingMessage = "有提问在后台数据生成中，请稍后，生成完成会进行推送~"
+)
+
+// 排队等待处理的提问
+type queuedRequest struct {
+	chatID   string
+	userID   string // 提问人
+	input    string
+	queuedAt time.Time // 最近一次入队或者合并的时间
+}
+
+// submitRequest 会话没有进行中的提问时创建提问，否则放入排队队列，返回创建的提问，或者排队的提示
+func (c *Chatbot) submitRequest(sessionID, chatID, userID, input string) (*chatJob, string) {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+
+	if c.getJobLocked(sessionID) == nil {
+		job := newChatJob(sessionID, chatID, userID, false)
+		c.chatJobMap[sessionID] = job
+		return job, ""
+	}
+
+	depth := c.requestQueueConfig.Depth
+	if depth <= 0 {
+		return nil, processingMessage
+	}
+
+	now := time.Now()
+	queue := c.requestQueues[sessionID]
+
+	// 同一个人连续发送的消息合并为一个提问
+	if c.requestQueueConfig.Merge && len(queue) > 0 {
+		window := c.requestQueueConfig.MergeWindow
+		if window <= 0 {
+			window = defaultRequestMergeWindow
+		}
+
+		last := queue[len(queue)-1]
+		if last.userID == userID && now.Sub(last.queuedAt) <= time.Duration(window)*time.Second {
+			last.input += "\n" + input
+			last.queuedAt = now
+			return nil, fmt.Sprintf("已合并到排队中的第%d个提问，前面的提问生成完成后自动处理", len(queue))
+		}
+	}
+
+	if len(queue) >= depth {
+		return nil, fmt.Sprintf("排队的提问已满(%d个)，请稍后再试~", depth)
+	}
+
+	c.requestQueues[sessionID] = append(queue, &queuedRequest{
+		chatID:   chatID,
+		userID:   userID,
+		input:    input,
+		queuedAt: now,
+	})
+
+	log.Printf("[INFO][submitRequest] request queued, sessionID=%s, position=%d", sessionID, len(queue)+1)
+
+	return nil, fmt.Sprintf("已加入排队，第%d位，前面的提问生成完成后自动处理", len(queue)+1)
+}
+
+// releaseJobLocked 删除会话的提问，只删除job本身，之后开始处理排队的下一个提问，调用方需要持有jobMu
+func (c *Chatbot) releaseJobLocked(job *chatJob) {
+	if c.chatJobMap[job.sessionID] != job {
+		return
+	}
+
+	delete(c.chatJobMap, job.sessionID)
+
+	queue := c.requestQueues[job.sessionID]
+	if len(queue) == 0 {
+		return
+	}
+
+	req := queue[0]
+	if len(queue) == 1 {
+		delete(c.requestQueues, job.sessionID)
+	} else {
+		c.requestQueues[job.sessionID] = queue[1:]
+	}
+
+	next := newChatJob(job.sessionID, req.chatID, req.userID, false)
+	c.chatJobMap[job.sessionID] = next
+
+	go c.runQueuedRequest(next, req.input)
+}
+
+// runQueuedRequest 处理排队的提问，没有发起AI请求时(例如额度不足)，将同步的回包推送给用户
+func (c *Chatbot) runQueuedRequest(job *chatJob, input string) {
+	log.Printf("[INFO][runQueuedRequest] sessionID=%s, userID=%s", job.sessionID, job.userID)
+
+	rsp, err := c.sendChatRequest(job, input)
+	if err != nil {
+		log.Printf("[ERROR][runQueuedRequest] sendChatRequest failed, sessionID=%s, err=%s", job.sessionID, err)
+		rsp = "排队的提问处理失败，请重新提问"
+	}
+
+	if state, _ := job.snapshot(); state != jobCancelled {
+		return
+	}
+
+	if _, err := c.publish(job.sessionID, job.chatID, rsp); err != nil {
+		log.Printf("[ERROR][runQueuedRequest] publish failed, sessionID=%s, err=%s", job.sessionID, err)
+	}
+}
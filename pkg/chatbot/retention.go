@@ -0,0 +1,173 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultHistoryMaxLength       = 1000 // 每个会话保存的最大历史条数
+	defaultHistoryJanitorInterval = 600
+
+	userMediaKeyPrefix = "chatbot-user-media-" // Redis中保存用户发送过的素材的set，用于删除用户数据时清理素材缓存
+	userMediaTTL       = 3 * 24 * time.Hour    // 和临时素材的有效期一致
+)
+
+// 注册删除用户数据时清理外部缓存的回调，例如通讯录资料和素材的缓存，参数为userid和用户发送过的素材的media_id
+func (c *Chatbot) RegisterUserForgetter(forgetter func(string, []string)) {
+	c.forgetter = forgetter
+}
+
+// trackMedia 记录用户发送过的素材，删除用户数据时一起清理素材缓存
+func (c *Chatbot) trackMedia(userID, mediaID string) {
+	if c.redisClient != nil {
+		ctx := context.Background()
+		key := userMediaKeyPrefix + userID
+
+		_, err := c.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SAdd(ctx, key, mediaID)
+			pipe.Expire(ctx, key, userMediaTTL)
+			return nil
+		})
+		if err != nil {
+			log.Printf("[ERROR][trackMedia] redis SAdd failed, userID=%s, err=%s", userID, err)
+		}
+		return
+	}
+
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+
+	if !slices.Contains(c.userMedia[userID], mediaID) {
+		c.userMedia[userID] = append(c.userMedia[userID], mediaID)
+	}
+}
+
+// takeUserMedia 获取并删除用户发送过的素材
+func (c *Chatbot) takeUserMedia(userID string) ([]string, error) {
+	if c.redisClient != nil {
+		ctx := context.Background()
+		key := userMediaKeyPrefix + userID
+
+		mediaIDs, err := c.redisClient.SMembers(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		return mediaIDs, c.redisClient.Del(ctx, key).Err()
+	}
+
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+
+	mediaIDs := c.userMedia[userID]
+	delete(c.userMedia, userID)
+
+	return mediaIDs, nil
+}
+
+// ForgetUser 删除用户的所有数据，包括所有对话和AI下的聊天历史、对话列表、生成中和排队的提问、待推送的回包、
+// 语音回复模式、发送的图片和素材缓存、用户资料缓存、用量明细和额度计数，部门的用量计数不属于个人数据，不删除
+// 单项删除失败时继续删除其他数据，返回遇到的错误
+func (c *Chatbot) ForgetUser(userID string) error {
+	var errs []error
+
+	c.cancelJob(userID)
+
+	// 群聊中排队的该用户的提问
+	c.jobMu.Lock()
+	for sessionID, queue := range c.requestQueues {
+		c.requestQueues[sessionID] = slices.DeleteFunc(queue, func(req *queuedRequest) bool {
+			return req.userID == userID
+		})
+	}
+	c.jobMu.Unlock()
+
+	c.sessionCtxMu.Lock()
+	if err := c.historyStore.Delete(userID, ""); err != nil {
+		log.Printf("[ERROR][ForgetUser] history store Delete failed, userID=%s, err=%s", userID, err)
+		errs = append(errs, err)
+	}
+
+	if err := c.threadStore.Delete(userID); err != nil {
+		log.Printf("[ERROR][ForgetUser] thread store Delete failed, userID=%s, err=%s", userID, err)
+		errs = append(errs, err)
+	}
+	c.migratedUsers.Delete(userID)
+	c.sessionCtxMu.Unlock()
+
+	if c.pushQueue != nil {
+		if err := c.pushQueue.store.DeleteUser(userID); err != nil {
+			log.Printf("[ERROR][ForgetUser] push queue DeleteUser failed, userID=%s, err=%s", userID, err)
+			errs = append(errs, err)
+		}
+	}
+
+	c.confirmMu.Lock()
+	for taskID, action := range c.pendingActions {
+		if action.userID == userID {
+			delete(c.pendingActions, taskID)
+		}
+	}
+	c.confirmMu.Unlock()
+
+	c.imageMu.Lock()
+	delete(c.receivedImages, userID)
+	c.imageMu.Unlock()
+
+	c.voiceInputs.Delete(userID)
+	c.voiceModes.Delete(userID)
+	if c.redisClient != nil {
+		if err := c.redisClient.HDel(context.Background(), voiceModeKey, userID).Err(); err != nil {
+			log.Printf("[ERROR][ForgetUser] redis HDel voice mode failed, userID=%s, err=%s", userID, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if c.usage != nil {
+		if err := c.usage.store.DeleteUser(userID); err != nil {
+			log.Printf("[ERROR][ForgetUser] usage store DeleteUser failed, userID=%s, err=%s", userID, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if c.quota != nil {
+		c.quota.forget(userID)
+	}
+
+	mediaIDs, err := c.takeUserMedia(userID)
+	if err != nil {
+		log.Printf("[ERROR][ForgetUser] takeUserMedia failed, userID=%s, err=%s", userID, err)
+		errs = append(errs, err)
+	}
+
+	if c.forgetter != nil {
+		c.forgetter(userID, mediaIDs)
+	}
+
+	log.Printf("[INFO][ForgetUser] delete all data of user, userID=%s, media=%d", userID, len(mediaIDs))
+
+	return errors.Join(errs...)
+}
+
+// /forget 删除用户的所有聊天历史，需要二次确认
+func (c *Chatbot) handleForgetCommand(userID string, args string) (string, error) {
+	if args != "confirm" {
+		return "该操作会删除你的所有聊天记录、用量记录和发送过的图片语音等数据且不可恢复，确认删除请发送: /forget confirm", nil
+	}
+
+	if c.isProcessing(userID) {
+		return "有提问在后台数据生成中，请生成完成后再删除~", nil
+	}
+
+	if err := c.ForgetUser(userID); err != nil {
+		return "删除失败，请稍后再试", nil
+	}
+
+	return "你的所有聊天记录已删除", nil
+}
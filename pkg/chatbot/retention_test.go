@@ -0,0 +1,128 @@
+package chatbot
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func newForgetTestChatbot() *Chatbot {
+	c := newTestChatbot(5)
+	c.historyStore = newMemoryHistoryStore(&HistoryConfig{}, defaultHistoryMaxLength)
+	c.threadStore = newThreadStore(c.historyStore)
+	c.pushQueue = &pushQueue{store: newMemoryPushQueueStore(10, 10)}
+	c.usage = &usageAccounting{store: newMemoryUsageStore(90), prices: map[string]ModelPrice{}}
+	c.quota = &quotaManager{store: newMemoryQuotaStore()}
+	c.pendingActions = make(map[string]*pendingAction)
+	c.receivedImages = make(map[string]*receivedImage)
+	c.userMedia = make(map[string][]string)
+
+	return c
+}
+
+// 删除用户数据后该用户的所有存储都被清空，其他用户的数据保留
+func TestForgetUser(t *testing.T) {
+	c := newForgetTestChatbot()
+
+	var forgotUser string
+	var forgotMedia []string
+	c.RegisterUserForgetter(func(userID string, mediaIDs []string) {
+		forgotUser, forgotMedia = userID, mediaIDs
+	})
+
+	now := time.Now()
+	groupID := groupSessionID("chat")
+	for _, userID := range []string{"alice", "bob"} {
+		c.historyStore.Append(userID, "gpt", &HistoryMessage{Role: "user", Content: "hi", Ts: now.Unix()})
+		c.threadStore.Put(userID, []byte(`{}`))
+		c.requestQueues[groupID] = append(c.requestQueues[groupID], &queuedRequest{chatID: "chat", userID: userID})
+		c.pushQueue.store.Push(&pushJob{Id: userID, UserID: userID})
+		c.pendingActions["task-"+userID] = &pendingAction{userID: userID}
+		c.receivedImages[userID] = &receivedImage{mediaID: "image-" + userID}
+		c.voiceModes.Store(userID, "always")
+		c.trackMedia(userID, "voice-"+userID)
+		c.trackMedia(userID, "voice-"+userID)
+		c.recordModelUsage(userID, "openai", "gpt-4o", now, 10, 20, 30)
+	}
+
+	if err := c.ForgetUser("alice"); err != nil {
+		t.Fatalf("ForgetUser failed, err=%s", err)
+	}
+
+	if forgotUser != "alice" || !slices.Equal(forgotMedia, []string{"voice-alice"}) {
+		t.Fatalf("forgetter got user=%s, media=%v", forgotUser, forgotMedia)
+	}
+
+	dayKey, _, monthKey, _ := quotaTokenKeys(quotaScopeUser, "alice", now)
+	bobDayKey, _, _, _ := quotaTokenKeys(quotaScopeUser, "bob", now)
+
+	var usageUsers []string
+	for _, record := range c.usage.store.Range(now, now) {
+		usageUsers = append(usageUsers, record.UserID)
+	}
+
+	var pushUsers []string
+	for {
+		job, _ := c.pushQueue.store.Pop(time.Millisecond)
+		if job == nil {
+			break
+		}
+		pushUsers = append(pushUsers, job.UserID)
+	}
+
+	conversations, _ := c.historyStore.List("alice")
+	bobConversations, _ := c.historyStore.List("bob")
+	thread, _ := c.threadStore.Get("alice")
+	_, aliceVoice := c.voiceModes.Load("alice")
+	_, bobVoice := c.voiceModes.Load("bob")
+
+	checks := []struct {
+		name string
+		ok   bool
+	}{
+		{"history", len(conversations) == 0 && len(bobConversations) == 1},
+		{"threads", len(thread) == 0},
+		{"request queue", len(c.requestQueues[groupID]) == 1 && c.requestQueues[groupID][0].userID == "bob"},
+		{"push queue", slices.Equal(pushUsers, []string{"bob"})},
+		{"pending actions", c.pendingActions["task-alice"] == nil && c.pendingActions["task-bob"] != nil},
+		{"received images", c.receivedImages["alice"] == nil && c.receivedImages["bob"] != nil},
+		{"voice mode", !aliceVoice && bobVoice},
+		{"user media", c.userMedia["alice"] == nil && len(c.userMedia["bob"]) == 1},
+		{"usage", slices.Equal(usageUsers, []string{"bob"})},
+		{"quota", c.quota.store.GetTokens(dayKey) == 0 && c.quota.store.GetTokens(monthKey) == 0 && c.quota.store.GetTokens(bobDayKey) == 30},
+	}
+
+	for _, check := range checks {
+		if !check.ok {
+			t.Errorf("%s not forgotten correctly", check.name)
+		}
+	}
+}
+
+// idleTimeout为0时不淘汰空闲的用户
+func TestMemoryHistoryStoreSweepIdle(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleTimeout int64
+		idle        int64
+		wantKept    bool
+	}{
+		{"disabled", 0, 365 * 86400, true},
+		{"active", 3600, 60, true},
+		{"idle", 3600, 7200, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemoryHistoryStore(&HistoryConfig{}, defaultHistoryMaxLength)
+			m.Append("alice", "gpt", &HistoryMessage{Role: "user", Content: "hi", Ts: time.Now().Unix()})
+
+			m.sweep(time.Now().Unix()+tt.idle, tt.idleTimeout)
+
+			conversations, _ := m.List("alice")
+			if kept := len(conversations) == 1; kept != tt.wantKept {
+				t.Fatalf("kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	threadKeyPrefix  = "chatbot-threads-" // Redis中保存用户对话列表的key
+	threadBoltBucket = "threads"
+
+	defaultThreadID    = 0 // 默认对话，没有对话列表的用户都使用默认对话
+	defaultThreadTitle = "默认对话"
+	maxThreadTitleLen  = 20
+)
+
+// 用户的一个对话，每个对话有独立的聊天上下文
+type ChatThread struct {
+	Id        int    `json:"id"`
+	Title     string `json:"title"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// 用户的对话列表和当前使用的对话
+type userThreads struct {
+	Active  int           `json:"active"`
+	NextId  int           `json:"next_id"`
+	Threads []*ChatThread `json:"threads"`
+}
+
+func newUserThreads() *userThreads {
+	return &userThreads{
+		Active: defaultThreadID,
+		NextId: defaultThreadID + 1,
+		Threads: []*ChatThread{
+			{Id: defaultThreadID, Title: defaultThreadTitle},
+		},
+	}
+}
+
+func (u *userThreads) get(id int) *ChatThread {
+	for _, thread := range u.Threads {
+		if thread.Id == id {
+			return thread
+		}
+	}
+
+	return nil
+}
+
+// 对话列表的存储，和聊天历史使用相同的存储类型
+type threadStore interface {
+	Get(userID string) ([]byte, error) // 不存在时返回nil
+	Put(userID string, data []byte) error
+	Delete(userID string) error
+}
+
+func newThreadStore(historyStore HistoryStore) threadStore {
+	switch store := historyStore.(type) {
+	case *redisHistoryStore:
+		return &redisThreadStore{client: store.client, ttl: store.ttl}
+	case *boltHistoryStore:
+		return &boltThreadStore{db: store.db}
+	}
+
+	return &memoryThreadStore{threads: make(map[string][]byte)}
+}
+
+type memoryThreadStore struct {
+	threads map[string][]byte
+	mu      sync.Mutex
+}
+
+func (m *memoryThreadStore) Get(userID string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.threads[userID], nil
+}
+
+func (m *memoryThreadStore) Put(userID string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.threads[userID] = data
+	return nil
+}
+
+func (m *memoryThreadStore) Delete(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.threads, userID)
+	return nil
+}
+
+type redisThreadStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func (r *redisThreadStore) Get(userID string) ([]byte, error) {
+	data, err := r.client.Get(context.Background(), threadKeyPrefix+userID).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+func (r *redisThreadStore) Put(userID string, data []byte) error {
+	return r.client.Set(context.Background(), threadKeyPrefix+userID, data, r.ttl).Err()
+}
+
+func (r *redisThreadStore) Delete(userID string) error {
+	return r.client.Del(context.Background(), threadKeyPrefix+userID).Err()
+}
+
+type boltThreadStore struct {
+	db *bolt.DB
+}
+
+func (b *boltThreadStore) Get(userID string) ([]byte, error) {
+	var data []byte
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(threadBoltBucket)); bucket != nil {
+			data = append([]byte(nil), bucket.Get([]byte(userID))...)
+		}
+		return nil
+	})
+
+	if len(data) == 0 {
+		return nil, err
+	}
+
+	return data, err
+}
+
+func (b *boltThreadStore) Put(userID string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(threadBoltBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(userID), data)
+	})
+}
+
+func (b *boltThreadStore) Delete(userID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(threadBoltBucket)); bucket != nil {
+			return bucket.Delete([]byte(userID))
+		}
+		return nil
+	})
+}
+
+// 读取用户的对话列表，没有时返回只包含默认对话的列表
+func (c *Chatbot) loadThreads(userID string) *userThreads {
+	data, err := c.threadStore.Get(userID)
+	if err != nil {
+		log.Printf("[ERROR][loadThreads] thread store Get failed, userID=%s, err=%s", userID, err)
+	}
+
+	threads := newUserThreads()
+	if len(data) == 0 {
+		return threads
+	}
+
+	if err := json.Unmarshal(data, threads); err != nil {
+		log.Printf("[ERROR][loadThreads] json Unmarshal failed, userID=%s, err=%s", userID, err)
+		return newUserThreads()
+	}
+
+	return threads
+}
+
+// 修改用户的对话列表，fn返回错误时不保存
+func (c *Chatbot) updateThreads(userID string, fn func(threads *userThreads) error) error {
+	c.threadMu.Lock()
+	defer c.threadMu.Unlock()
+
+	threads := c.loadThreads(userID)
+	if err := fn(threads); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(threads)
+	if err != nil {
+		return err
+	}
+
+	if err := c.threadStore.Put(userID, data); err != nil {
+		log.Printf("[ERROR][updateThreads] thread store Put failed, userID=%s, err=%s", userID, err)
+		return err
+	}
+
+	return nil
+}
+
+// 用户当前使用的对话
+func (c *Chatbot) activeThread(userID string) int {
+	c.threadMu.Lock()
+	defer c.threadMu.Unlock()
+
+	return c.loadThreads(userID).Active
+}
+
+// conversationName 用户当前对话在聊天历史中的会话名称
+func (c *Chatbot) conversationName(userID string) string {
+	return threadConversation(c.activeThread(userID))
+}
+
+// 默认对话的会话名称为chat，其他对话为chat@<对话id>，所有AI共享同一个会话
+func threadConversation(threadID int) string {
+	if threadID == defaultThreadID {
+		return historyConversationPrefix
+	}
+
+	return historyConversationPrefix + "@" + strconv.Itoa(threadID)
+}
+
+// 清理标题中的换行、引号，过长时截断
+func normalizeThreadTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	title = strings.Trim(title, "\"'“”《》「」")
+
+	if runes := []rune(title); len(runes) > maxThreadTitleLen {
+		title = string(runes[:maxThreadTitleLen])
+	}
+
+	return title
+}
+
+// 对话的最近一次提问，用于刷新对话的更新时间
+func (c *Chatbot) touchThread(userID string) {
+	err := c.updateThreads(userID, func(threads *userThreads) error {
+		if thread := threads.get(threads.Active); thread != nil {
+			thread.UpdatedAt = time.Now().Unix()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][touchThread] update threads failed, userID=%s, err=%s", userID, err)
+	}
+}
+
+// autoTitleThread 新对话的第一轮问答完成后，由AI生成简短的标题
+func (c *Chatbot) autoTitleThread(userID string, threadID int, aiName string) {
+	c.threadMu.Lock()
+	thread := c.loadThreads(userID).get(threadID)
+	c.threadMu.Unlock()
+
+	if thread == nil || thread.Title != "" {
+		return
+	}
+
+	messages, err := c.historyStore.Range(userID, threadConversation(threadID), 0, 1)
+	if err != nil || len(messages) == 0 {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("请用不超过10个字概括下面对话的主题，只输出标题，不要标点:\n")
+	for _, msg := range messages {
+		sb.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, msg.Content))
+	}
+
+	title, err := c.completeText(userID, aiName, sb.String())
+	if err != nil {
+		log.Printf("[ERROR][autoTitleThread] completeText failed, userID=%s, err=%s", userID, err)
+		return
+	}
+
+	title = normalizeThreadTitle(title)
+	if title == "" {
+		return
+	}
+
+	err = c.updateThreads(userID, func(threads *userThreads) error {
+		// 生成期间用户可能已经手动命名
+		if thread := threads.get(threadID); thread != nil && thread.Title == "" {
+			thread.Title = title
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][autoTitleThread] update threads failed, userID=%s, err=%s", userID, err)
+		return
+	}
+
+	log.Printf("[INFO][autoTitleThread] userID=%s, threadID=%d, title=%s", userID, threadID, title)
+}
+
+func threadTitle(thread *ChatThread) string {
+	if thread.Title == "" {
+		return "新对话"
+	}
+
+	return thread.Title
+}
+
+const threadCommandUsage = `对话指令:
+/new [标题] 新建对话并切换，不填标题时根据第一轮问答自动生成
+/list 查看所有对话
+/switch <序号> 切换到指定的对话
+/rename <标题> 重命名当前对话`
+
+// /new 新建对话，之后的提问使用新对话的上下文
+func (c *Chatbot) handleNewCommand(userID string, args string) (string, error) {
+	if c.isProcessing(userID) {
+		return "有提问在后台数据生成中，请生成完成后再新建对话~", nil
+	}
+
+	title := normalizeThreadTitle(args)
+	var index int
+
+	err := c.updateThreads(userID, func(threads *userThreads) error {
+		now := time.Now().Unix()
+		threads.Threads = append(threads.Threads, &ChatThread{
+			Id:        threads.NextId,
+			Title:     title,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+
+		threads.Active = threads.NextId
+		threads.NextId++
+		index = len(threads.Threads)
+		return nil
+	})
+	if err != nil {
+		return "新建对话失败，请稍后再试", nil
+	}
+
+	if title == "" {
+		return fmt.Sprintf("已新建对话#%d，标题将根据第一轮问答自动生成", index), nil
+	}
+
+	return fmt.Sprintf("已新建对话#%d: %s", index, title), nil
+}
+
+// /list 查看所有对话，当前对话前面标记*
+func (c *Chatbot) handleListCommand(userID string, args string) (string, error) {
+	c.threadMu.Lock()
+	threads := c.loadThreads(userID)
+	c.threadMu.Unlock()
+
+	lines := []string{"对话列表:"}
+	for i, thread := range threads.Threads {
+		mark := "  "
+		if thread.Id == threads.Active {
+			mark = "* "
+		}
+
+		line := fmt.Sprintf("%s%d. %s", mark, i+1, threadTitle(thread))
+		if thread.UpdatedAt > 0 {
+			line += time.Unix(thread.UpdatedAt, 0).Format(" (01-02 15:04)")
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, "使用 /switch <序号> 切换对话，/new [标题] 新建对话")
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// /switch 切换到列表中指定序号的对话
+func (c *Chatbot) handleSwitchCommand(userID string, args string) (string, error) {
+	n, err := strconv.Atoi(args)
+	if err != nil || n <= 0 {
+		return threadCommandUsage, nil
+	}
+
+	if c.isProcessing(userID) {
+		return "有提问在后台数据生成中，请生成完成后再切换对话~", nil
+	}
+
+	var title string
+	err = c.updateThreads(userID, func(threads *userThreads) error {
+		if n > len(threads.Threads) {
+			return fmt.Errorf("thread %d not exist", n)
+		}
+
+		thread := threads.Threads[n-1]
+		threads.Active = thread.Id
+		title = threadTitle(thread)
+		return nil
+	})
+	if err != nil {
+		return fmt.Sprintf("对话#%d不存在，使用 /list 查看所有对话", n), nil
+	}
+
+	return fmt.Sprintf("已切换到对话#%d: %s", n, title), nil
+}
+
+// /rename 重命名当前对话
+func (c *Chatbot) handleRenameCommand(userID string, args string) (string, error) {
+	title := normalizeThreadTitle(args)
+	if title == "" {
+		return threadCommandUsage, nil
+	}
+
+	err := c.updateThreads(userID, func(threads *userThreads) error {
+		thread := threads.get(threads.Active)
+		if thread == nil {
+			return fmt.Errorf("active thread %d not exist", threads.Active)
+		}
+
+		thread.Title = title
+		return nil
+	})
+	if err != nil {
+		return "重命名失败，请稍后再试", nil
+	}
+
+	return "当前对话已重命名为: " + title, nil
+}
@@ -0,0 +1,254 @@
+package chatbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	defaultToolMaxSteps = 5  // 一次提问默认最多请求AI的轮数
+	toolRequestTimeout  = 60 // Claude和Gemini带工具的请求为同步回包，单位秒
+)
+
+// 参数的类型，和JSON Schema一致
+const (
+	ToolTypeObject  = "object"
+	ToolTypeString  = "string"
+	ToolTypeNumber  = "number"
+	ToolTypeInteger = "integer"
+	ToolTypeBoolean = "boolean"
+	ToolTypeArray   = "array"
+)
+
+// ToolSchema 工具参数的JSON Schema，只支持各家AI都支持的子集
+type ToolSchema struct {
+	Type        string                 `json:"type"`
+	Description string                 `json:"description,omitempty"`
+	Enum        []string               `json:"enum,omitempty"`       // 字符串的可选值
+	Items       *ToolSchema            `json:"items,omitempty"`      // 数组元素的类型
+	Properties  map[string]*ToolSchema `json:"properties,omitempty"` // 对象的字段
+	Required    []string               `json:"required,omitempty"`   // 对象必填的字段
+}
+
+// ToolContext 工具执行时的上下文
+type ToolContext struct {
+	SessionID string // 单聊为用户的userid，群聊为群聊的会话id
+	ChatID    string // 群聊id，单聊时为空
+	UserID    string // 提问人的userid，工具需要自行校验提问人的权限
+}
+
+// ToolHandler 执行工具，args为AI生成的JSON参数，返回的结果发给AI继续生成回复
+// 返回错误时，错误信息同样会发给AI，由AI决定重试或者告知用户
+type ToolHandler func(ctx *ToolContext, args json.RawMessage) (string, error)
+
+// Tool 可以被AI调用的工具
+type Tool struct {
+	Name        string      // 工具名称，只能包含字母、数字、下划线和中划线
+	Description string      // 工具的描述，AI根据描述决定什么时候调用
+	Parameters  *ToolSchema // 参数的定义，为nil时表示没有参数
+	Handler     ToolHandler
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// RegisterTool 注册AI可以调用的工具，同名的工具会被覆盖，需要开启tool配置才会生效
+func (c *Chatbot) RegisterTool(tool *Tool) error {
+	if !toolNamePattern.MatchString(tool.Name) {
+		return fmt.Errorf("invalid tool name %q", tool.Name)
+	}
+
+	if tool.Handler == nil {
+		return fmt.Errorf("tool %s handler is nil", tool.Name)
+	}
+
+	registered := *tool
+	if registered.Parameters == nil {
+		registered.Parameters = &ToolSchema{Type: ToolTypeObject}
+	}
+
+	if registered.Parameters.Type != ToolTypeObject {
+		return fmt.Errorf("tool %s parameters must be object", tool.Name)
+	}
+
+	c.toolMu.Lock()
+	defer c.toolMu.Unlock()
+
+	c.tools[tool.Name] = &registered
+
+	log.Printf("[INFO][RegisterTool] name=%s", tool.Name)
+
+	return nil
+}
+
+// 注册的所有工具，按照名称排序，保证每次请求的工具列表一致
+func (c *Chatbot) registeredTools() []*Tool {
+	c.toolMu.RLock()
+	defer c.toolMu.RUnlock()
+
+	tools := make([]*Tool, 0, len(c.tools))
+	for _, tool := range c.tools {
+		tools = append(tools, tool)
+	}
+
+	sort.Slice(tools, func(i, j int) bool {
+		return tools[i].Name < tools[j].Name
+	})
+
+	return tools
+}
+
+func (c *Chatbot) getTool(name string) *Tool {
+	c.toolMu.RLock()
+	defer c.toolMu.RUnlock()
+
+	return c.tools[name]
+}
+
+// 开启了工具调用并且注册了工具
+func (c *Chatbot) toolEnabled() bool {
+	if !c.toolConfig.Enable {
+		return false
+	}
+
+	c.toolMu.RLock()
+	defer c.toolMu.RUnlock()
+
+	return len(c.tools) > 0
+}
+
+// 内置的工具
+func (c *Chatbot) registerBuiltinTools() {
+	err := c.RegisterTool(&Tool{
+		Name:        "current_time",
+		Description: "获取当前的日期、时间和星期，回答和时间相关的问题时使用",
+		Handler: func(ctx *ToolContext, args json.RawMessage) (string, error) {
+			now := time.Now()
+			return now.Format("2006-01-02 15:04:05 ") + now.Weekday().String(), nil
+		},
+	})
+	if err != nil {
+		log.Printf("[ERROR][registerBuiltinTools] RegisterTool failed, err=%s", err)
+	}
+}
+
+// AI要求的一次工具调用
+type toolCall struct {
+	Id   string // 调用id，工具的结果需要带上对应的调用id，Gemini没有调用id时为工具名称
+	Name string
+	Args json.RawMessage
+}
+
+// 带工具的一次提问，由各家AI分别实现请求和消息格式的转换
+type toolSession interface {
+	// next 发起一次请求，返回AI的回复，或者需要执行的工具调用
+	next() (string, []*toolCall, error)
+
+	// addResults 将工具的执行结果加入对话，下一次请求时发给AI，results和calls一一对应
+	addResults(calls []*toolCall, results []string)
+}
+
+// ToolRequest 带工具的提问，AI要求调用工具时执行工具并把结果发给AI，直到AI给出最终的回复
+// 中间的工具调用不保存到聊天上下文，OpenAI每一轮都是流式请求，最终回复和不带工具时一样实时推流
+func (c *Chatbot) ToolRequest(job *chatJob, input string) (string, error) {
+	userID := job.sessionID
+	c.AddChatSessionCtx(userID, input, ChatRoleUser, job.ai)
+
+	tools := c.registeredTools()
+
+	var session toolSession
+	switch job.ai {
+	case AIName_OpenAI:
+		session = c.newOpenAIToolSession(job, tools)
+	case AIName_Claude:
+		session = c.newClaudeToolSession(job, tools)
+	case AIName_Gemini:
+		session = c.newGeminiToolSession(job, tools, input)
+	default:
+		c.abortJob(job)
+		return "no ai support", nil
+	}
+
+	go c.runToolLoop(job, session)
+
+	c.waitJob(job)
+
+	return "生成中...", nil
+}
+
+// runToolLoop 循环请求AI并执行工具，超过最大轮数时提问失败
+func (c *Chatbot) runToolLoop(job *chatJob, session toolSession) {
+	maxSteps := c.toolConfig.MaxSteps
+	if maxSteps <= 0 {
+		maxSteps = defaultToolMaxSteps
+	}
+
+	for step := 1; step <= maxSteps; step++ {
+		content, calls, err := session.next()
+		if err != nil {
+			log.Printf("[ERROR][runToolLoop] request failed, sessionID=%s, ai=%s, step=%d, err=%s", job.sessionID, job.ai, step, err)
+			job.fail(err.Error())
+			return
+		}
+
+		if len(calls) == 0 {
+			job.complete(content)
+			return
+		}
+
+		// 提问已经超时或者被取消，不再执行工具
+		if state, _ := job.snapshot(); state.terminal() {
+			return
+		}
+
+		results := make([]string, 0, len(calls))
+		for _, call := range calls {
+			results = append(results, c.callTool(job, call))
+		}
+
+		session.addResults(calls, results)
+	}
+
+	log.Printf("[WARN][runToolLoop] exceed max steps, sessionID=%s, ai=%s, maxSteps=%d", job.sessionID, job.ai, maxSteps)
+	job.fail(fmt.Sprintf("工具调用超过%d轮仍未完成，请简化问题后重新提问", maxSteps))
+}
+
+// callTool 执行一次工具调用，失败时返回错误信息，由AI决定重试或者告知用户
+func (c *Chatbot) callTool(job *chatJob, call *toolCall) string {
+	tool := c.getTool(call.Name)
+	if tool == nil {
+		log.Printf("[ERROR][callTool] tool not found, sessionID=%s, name=%s", job.sessionID, call.Name)
+		return fmt.Sprintf("error: tool %s not found", call.Name)
+	}
+
+	args := call.Args
+	if len(bytes.TrimSpace(args)) == 0 {
+		args = json.RawMessage("{}")
+	}
+
+	if !json.Valid(args) {
+		log.Printf("[ERROR][callTool] invalid arguments, sessionID=%s, name=%s, args=%s", job.sessionID, call.Name, args)
+		return "error: arguments is not valid json"
+	}
+
+	ctx := &ToolContext{
+		SessionID: job.sessionID,
+		ChatID:    job.chatID,
+		UserID:    job.userID,
+	}
+
+	begin := time.Now()
+	result, err := tool.Handler(ctx, args)
+	if err != nil {
+		log.Printf("[ERROR][callTool] handler failed, sessionID=%s, name=%s, args=%s, err=%s", job.sessionID, call.Name, args, err)
+		return "error: " + err.Error()
+	}
+
+	log.Printf("[INFO][callTool] sessionID=%s, name=%s, args=%s, cost=%s", job.sessionID, call.Name, args, time.Since(begin))
+
+	return result
+}
@@ -0,0 +1,408 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/walkerdu/wecom-backend/pkg/claude"
+	openai "github.com/walkerdu/wecom-backend/pkg/openai-v1"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// 工具的定义和调用在各家AI之间的转换
+
+func toolHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: toolRequestTimeout * time.Second,
+	}
+}
+
+// 流式请求的推流时长不固定，只限制等待回包头的时间，推流的等待时间由streamReader限制
+func toolStreamHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: time.Second * 10,
+		},
+	}
+}
+
+// toOpenAITools 转换为OpenAI的function定义
+func toOpenAITools(tools []*Tool) []openai.ChatTool {
+	chatTools := make([]openai.ChatTool, 0, len(tools))
+	for _, tool := range tools {
+		chatTools = append(chatTools, openai.ChatTool{
+			Type: openai.ToolTypeFunction,
+			Function: openai.ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	return chatTools
+}
+
+// toClaudeTools 转换为Claude的工具定义
+func toClaudeTools(tools []*Tool) []claude.Tool {
+	claudeTools := make([]claude.Tool, 0, len(tools))
+	for _, tool := range tools {
+		claudeTools = append(claudeTools, claude.Tool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: tool.Parameters,
+		})
+	}
+
+	return claudeTools
+}
+
+// toGeminiTools 转换为Gemini的function declaration，所有工具放在同一个Tool中
+func toGeminiTools(tools []*Tool) []*genai.Tool {
+	declarations := make([]*genai.FunctionDeclaration, 0, len(tools))
+	for _, tool := range tools {
+		declaration := &genai.FunctionDeclaration{
+			Name:        tool.Name,
+			Description: tool.Description,
+		}
+
+		// Gemini不接受没有字段的object参数，没有参数时不设置
+		if len(tool.Parameters.Properties) > 0 {
+			declaration.Parameters = toGeminiSchema(tool.Parameters)
+		}
+
+		declarations = append(declarations, declaration)
+	}
+
+	return []*genai.Tool{{FunctionDeclarations: declarations}}
+}
+
+func toGeminiSchema(schema *ToolSchema) *genai.Schema {
+	if schema == nil {
+		return nil
+	}
+
+	geminiSchema := &genai.Schema{
+		Description: schema.Description,
+		Enum:        schema.Enum,
+		Items:       toGeminiSchema(schema.Items),
+		Required:    schema.Required,
+	}
+
+	switch schema.Type {
+	case ToolTypeObject:
+		geminiSchema.Type = genai.TypeObject
+	case ToolTypeString:
+		geminiSchema.Type = genai.TypeString
+	case ToolTypeNumber:
+		geminiSchema.Type = genai.TypeNumber
+	case ToolTypeInteger:
+		geminiSchema.Type = genai.TypeInteger
+	case ToolTypeBoolean:
+		geminiSchema.Type = genai.TypeBoolean
+	case ToolTypeArray:
+		geminiSchema.Type = genai.TypeArray
+	}
+
+	if len(schema.Enum) > 0 {
+		geminiSchema.Format = "enum"
+	}
+
+	if len(schema.Properties) > 0 {
+		geminiSchema.Properties = make(map[string]*genai.Schema, len(schema.Properties))
+		for name, property := range schema.Properties {
+			geminiSchema.Properties[name] = toGeminiSchema(property)
+		}
+	}
+
+	return geminiSchema
+}
+
+// OpenAI的工具调用，assistant的tool_calls和tool的执行结果依次追加到messages中
+// 每一轮都是流式请求，回复的增量内容实时写入提问，要求调用工具时丢弃这一轮已经推流的内容
+type openaiToolSession struct {
+	c   *Chatbot
+	job *chatJob
+	req *openai.ChatCompletionReq
+}
+
+func (c *Chatbot) newOpenAIToolSession(job *chatJob, tools []*Tool) *openaiToolSession {
+	userID := job.sessionID
+
+	messages := []openai.ChatMessage{}
+	if prompt := c.requestSystemPrompt(job); prompt != "" {
+		messages = append(messages, openai.ChatMessage{
+			Role:    openai.System,
+			Content: prompt,
+		})
+	}
+
+	return &openaiToolSession{
+		c:   c,
+		job: job,
+		req: &openai.ChatCompletionReq{
+			Model:    openai.Gpt35Turbo,
+			Messages: c.GetChatSessionCtx(userID, messages),
+			User:     userID,
+			Tools:    toOpenAITools(tools),
+			Stream:   true,
+			StreamOptions: &openai.StreamOptions{
+				IncludeUsage: true,
+			},
+		},
+	}
+}
+
+func (s *openaiToolSession) next() (string, []*toolCall, error) {
+	reqBytes, err := json.Marshal(s.req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 工具调用在推流结束、写入rspChan之前回调
+	var toolCalls []openai.ToolCall
+	rspChan := make(chan string, 1)
+
+	_, err = s.c.openaiClient.PostStream(toolStreamHTTPClient(), string(openai.OpenAIPathChatCompletion), reqBytes, rspChan, &openai.StreamObserver{
+		OnDelta: s.job.appendDelta,
+		OnUsage: func(usage *openai.Usage) {
+			s.c.recordUsage(s.job, usage.PromptTokens, usage.CompletionTokens)
+		},
+		OnFinish: func(finishReason string) {
+			if finishReason == openai.FinishReasonLength {
+				s.job.markTruncated()
+			}
+		},
+		OnToolCalls: func(calls []openai.ToolCall) {
+			toolCalls = calls
+		},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	var content string
+	select {
+	case content = <-rspChan:
+	case <-s.job.Done():
+		return "", nil, errors.New("job finished")
+	}
+
+	if len(toolCalls) == 0 {
+		return content, nil, nil
+	}
+
+	s.job.resetDelta()
+
+	s.req.Messages = append(s.req.Messages, openai.ChatMessage{
+		Role:      openai.Assistant,
+		Content:   content,
+		ToolCalls: toolCalls,
+	})
+
+	calls := make([]*toolCall, 0, len(toolCalls))
+	for _, call := range toolCalls {
+		calls = append(calls, &toolCall{
+			Id:   call.Id,
+			Name: call.Function.Name,
+			Args: json.RawMessage(call.Function.Arguments),
+		})
+	}
+
+	return "", calls, nil
+}
+
+func (s *openaiToolSession) addResults(calls []*toolCall, results []string) {
+	for i, call := range calls {
+		s.req.Messages = append(s.req.Messages, openai.ChatMessage{
+			Role:       openai.Tool,
+			Content:    results[i],
+			ToolCallId: call.Id,
+		})
+	}
+}
+
+// Claude的工具调用，assistant的tool_use和user的tool_result依次追加到messages中
+type claudeToolSession struct {
+	c   *Chatbot
+	job *chatJob
+	req *claude.Request
+}
+
+func (c *Chatbot) newClaudeToolSession(job *chatJob, tools []*Tool) *claudeToolSession {
+	userID := job.sessionID
+
+	return &claudeToolSession{
+		c:   c,
+		job: job,
+		req: &claude.Request{
+			Model:     claude.Claude3Opus,
+			Messages:  c.GetClaudeChatSessionCtx(userID),
+			MaxTokens: 2048,
+			System:    c.requestSystemPrompt(job),
+			Tools:     toClaudeTools(tools),
+		},
+	}
+}
+
+func (s *claudeToolSession) next() (string, []*toolCall, error) {
+	reqBytes, err := json.Marshal(s.req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rsp, err := s.c.claudeClient.Send(toolHTTPClient(), reqBytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.c.recordUsage(s.job, rsp.Usage.InputTokens, rsp.Usage.OutputTokens)
+
+	if rsp.StopReason == claude.StopReasonMaxTokens {
+		s.job.markTruncated()
+	}
+
+	calls := []*toolCall{}
+	for _, content := range rsp.Content {
+		if content.Type != claude.ContentTypeToolUse {
+			continue
+		}
+
+		calls = append(calls, &toolCall{
+			Id:   content.Id,
+			Name: content.Name,
+			Args: content.Input,
+		})
+	}
+
+	if len(calls) == 0 {
+		return rsp.GetText(), nil, nil
+	}
+
+	s.req.Messages = append(s.req.Messages, claude.Message{
+		Role:    "assistant",
+		Content: rsp.Content,
+	})
+
+	return "", calls, nil
+}
+
+func (s *claudeToolSession) addResults(calls []*toolCall, results []string) {
+	// 所有的执行结果放在同一条user消息中
+	contents := make([]claude.Content, 0, len(calls))
+	for i, call := range calls {
+		contents = append(contents, claude.Content{
+			Type:      claude.ContentTypeToolResult,
+			ToolUseId: call.Id,
+			Content:   results[i],
+			IsError:   strings.HasPrefix(results[i], "error: "),
+		})
+	}
+
+	s.req.Messages = append(s.req.Messages, claude.Message{
+		Role:    ChatRoleUser,
+		Content: contents,
+	})
+}
+
+// Gemini的工具调用，ChatSession会自动将请求和回包追加到历史中，只需要发送执行结果
+type geminiToolSession struct {
+	c       *Chatbot
+	job     *chatJob
+	model   *genai.GenerativeModel
+	cs      *genai.ChatSession
+	pending []genai.Part // 下一次请求发送的内容，第一次为提问，之后为工具的执行结果
+}
+
+func (c *Chatbot) newGeminiToolSession(job *chatJob, tools []*Tool, input string) *geminiToolSession {
+	userID := job.sessionID
+
+	model := c.geminiClient.GenerativeModel(geminiModel)
+	model.Tools = toGeminiTools(tools)
+
+	cs := model.StartChat()
+	cs.History = c.GetGeminiChatSessionCtx(userID)
+
+	// gemini-pro不支持系统提示词，在历史的最前面插入一轮对话代替
+	if prompt := c.requestSystemPrompt(job); prompt != "" {
+		cs.History = append([]*genai.Content{
+			{Parts: []genai.Part{genai.Text(prompt)}, Role: ChatRoleUser},
+			{Parts: []genai.Part{genai.Text("好的")}, Role: "model"},
+		}, cs.History...)
+	}
+
+	return &geminiToolSession{
+		c:       c,
+		job:     job,
+		model:   model,
+		cs:      cs,
+		pending: []genai.Part{genai.Text(input)},
+	}
+}
+
+func (s *geminiToolSession) next() (string, []*toolCall, error) {
+	// 提问的token数包括上下文和之前的工具调用
+	prompt := append(slices.Clone(s.cs.History), &genai.Content{Parts: s.pending, Role: ChatRoleUser})
+
+	resp, err := s.cs.SendMessage(context.Background(), s.pending...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.pending = nil
+
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		s.c.recordGeminiUsage(s.job, s.model, prompt, nil)
+		return "", nil, errors.New("gemini response empty")
+	}
+
+	s.c.recordGeminiUsage(s.job, s.model, prompt, resp.Candidates[0].Content)
+
+	candidate := resp.Candidates[0]
+	if candidate.FinishReason == genai.FinishReasonMaxTokens {
+		s.job.markTruncated()
+	}
+
+	if functionCalls := candidate.FunctionCalls(); len(functionCalls) > 0 {
+		calls := make([]*toolCall, 0, len(functionCalls))
+		for _, call := range functionCalls {
+			args, err := json.Marshal(call.Args)
+			if err != nil {
+				return "", nil, err
+			}
+
+			calls = append(calls, &toolCall{
+				Id:   call.Name,
+				Name: call.Name,
+				Args: args,
+			})
+		}
+
+		return "", calls, nil
+	}
+
+	var sb strings.Builder
+	for _, part := range candidate.Content.Parts {
+		if text, ok := part.(genai.Text); ok {
+			sb.WriteString(string(text))
+		}
+	}
+
+	return sb.String(), nil, nil
+}
+
+func (s *geminiToolSession) addResults(calls []*toolCall, results []string) {
+	for i, call := range calls {
+		s.pending = append(s.pending, genai.FunctionResponse{
+			Name:     call.Name,
+			Response: map[string]any{"result": results[i]},
+		})
+	}
+}
@@ -0,0 +1,505 @@
+package chatbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	usageKeyPrefix = "chatbot-usage-" // 按天保存用量明细的Redis list
+
+	defaultUsageRetentionDays = 90
+
+	UsageGroupByUser       = "user"
+	UsageGroupByDepartment = "department"
+	UsageGroupByDay        = "day"
+	UsageGroupByModel      = "model"
+)
+
+// 默认的模型价格，单位美元/1000 token
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-3.5-turbo":            {Prompt: 0.0005, Completion: 0.0015},
+	"claude-3-opus-20240229":   {Prompt: 0.015, Completion: 0.075},
+	"claude-3-sonnet-20240229": {Prompt: 0.003, Completion: 0.015},
+	"claude-3-haiku-20240307":  {Prompt: 0.00025, Completion: 0.00125},
+	"gemini-pro":               {Prompt: 0.0005, Completion: 0.0015},
+
+	// 语音和图片不按照token计费，语音合成的Prompt为每1000个字符的价格，语音识别的Prompt为每1000秒的价格，图片的Completion为每1000张的价格
+	"tts-1":       {Prompt: 0.015},
+	"tts-1-hd":    {Prompt: 0.03},
+	"whisper-1":   {Prompt: 0.1},
+	"dall-e-2":    {Completion: 20},
+	"dall-e-3":    {Completion: 40},
+	"gpt-image-1": {Completion: 42},
+}
+
+// 语音和图片计入额度时折算的token数，按照价格折算为gpt-3.5-turbo回复的token数
+const (
+	speechCharQuotaTokens       = 10    // 语音合成每个字符
+	transcriptionSecQuotaTokens = 60    // 语音识别每秒
+	imageQuotaTokens            = 25000 // 每张图片
+)
+
+// 一次生成的用量明细
+type usageRecord struct {
+	Ts               int64   `json:"ts"`
+	UserID           string  `json:"user_id"`
+	Department       string  `json:"department,omitempty"`
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	LatencyMs        int64   `json:"latency_ms"`
+	Cost             float64 `json:"cost"`
+}
+
+// 用量的存储，按天保存明细，开启Redis时使用Redis
+type usageStore interface {
+	Add(record *usageRecord)
+	// Range 获取[from, to]之间每天的用量明细
+	Range(from, to time.Time) []*usageRecord
+	// DeleteUser 删除用户的所有用量明细
+	DeleteUser(userID string) error
+}
+
+type memoryUsageStore struct {
+	retentionDays int
+	days          map[string][]*usageRecord // 日期 -> 用量明细
+	mu            sync.Mutex
+}
+
+func newMemoryUsageStore(retentionDays int) *memoryUsageStore {
+	return &memoryUsageStore{
+		retentionDays: retentionDays,
+		days:          make(map[string][]*usageRecord),
+	}
+}
+
+func usageDay(t time.Time) string {
+	return t.Format("20060102")
+}
+
+func (m *memoryUsageStore) Add(record *usageRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	day := usageDay(now)
+	if _, exist := m.days[day]; !exist {
+		// 新的一天，清理超过保留时长的明细
+		expired := usageDay(now.AddDate(0, 0, -m.retentionDays))
+		for d := range m.days {
+			if d < expired {
+				delete(m.days, d)
+			}
+		}
+	}
+
+	m.days[day] = append(m.days[day], record)
+}
+
+func (m *memoryUsageStore) Range(from, to time.Time) []*usageRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := []*usageRecord{}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		records = append(records, m.days[usageDay(d)]...)
+	}
+
+	return records
+}
+
+func (m *memoryUsageStore) DeleteUser(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for day, records := range m.days {
+		m.days[day] = slices.DeleteFunc(records, func(record *usageRecord) bool {
+			return record.UserID == userID
+		})
+	}
+
+	return nil
+}
+
+type redisUsageStore struct {
+	client        *redis.Client
+	retentionDays int
+}
+
+func (r *redisUsageStore) Add(record *usageRecord) {
+	ctx := context.Background()
+	key := usageKeyPrefix + usageDay(time.Unix(record.Ts, 0))
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("[ERROR][redisUsageStore] json Marshal failed, err=%s", err)
+		return
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, data)
+		pipe.Expire(ctx, key, time.Duration(r.retentionDays)*24*time.Hour)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR][redisUsageStore] redis RPush failed, key=%s, err=%s", key, err)
+	}
+}
+
+func (r *redisUsageStore) Range(from, to time.Time) []*usageRecord {
+	ctx := context.Background()
+
+	records := []*usageRecord{}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		key := usageKeyPrefix + usageDay(d)
+		result, err := r.client.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			log.Printf("[ERROR][redisUsageStore] redis LRange failed, key=%s, err=%s", key, err)
+			continue
+		}
+
+		for _, data := range result {
+			record := &usageRecord{}
+			if err := json.Unmarshal([]byte(data), record); err != nil {
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+
+	return records
+}
+
+// 删除每天的用量明细中属于用户的记录
+var usageDeleteUserScript = redis.NewScript(`
+local cnt = 0
+for _, key in ipairs(KEYS) do
+	for _, item in ipairs(redis.call('LRANGE', key, 0, -1)) do
+		local ok, record = pcall(cjson.decode, item)
+		if ok and record.user_id == ARGV[1] then
+			cnt = cnt + redis.call('LREM', key, 0, item)
+		end
+	end
+end
+return cnt
+`)
+
+func (r *redisUsageStore) DeleteUser(userID string) error {
+	now := time.Now()
+
+	keys := make([]string, 0, r.retentionDays+1)
+	for i := 0; i <= r.retentionDays; i++ {
+		keys = append(keys, usageKeyPrefix+usageDay(now.AddDate(0, 0, -i)))
+	}
+
+	return usageDeleteUserScript.Run(context.Background(), r.client, keys, userID).Err()
+}
+
+// 用量的聚合报表的一行
+type usageReportRow struct {
+	Key              string
+	Requests         int
+	PromptTokens     int64
+	CompletionTokens int64
+	Cost             float64
+	TotalLatencyMs   int64
+}
+
+func (r *usageReportRow) avgLatencyMs() int64 {
+	if r.Requests == 0 {
+		return 0
+	}
+
+	return r.TotalLatencyMs / int64(r.Requests)
+}
+
+// 用量统计，记录每次生成的用量，并按照用户、部门、日期聚合
+type usageAccounting struct {
+	prices map[string]ModelPrice
+	store  usageStore
+}
+
+func newUsageAccounting(config *UsageConfig, rdb *redis.Client) *usageAccounting {
+	u := &usageAccounting{
+		prices: make(map[string]ModelPrice),
+	}
+
+	for model, price := range defaultModelPrices {
+		u.prices[model] = price
+	}
+	for model, price := range config.Prices {
+		u.prices[model] = price
+	}
+
+	retentionDays := config.RetentionDays
+	if retentionDays <= 0 {
+		retentionDays = defaultUsageRetentionDays
+	}
+
+	if rdb != nil {
+		u.store = &redisUsageStore{client: rdb, retentionDays: retentionDays}
+	} else {
+		u.store = newMemoryUsageStore(retentionDays)
+	}
+
+	return u
+}
+
+// 按照价格表计算费用
+func (u *usageAccounting) cost(model string, promptTokens, completionTokens int) float64 {
+	price, ok := u.prices[model]
+	if !ok {
+		return 0
+	}
+
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1000
+}
+
+// report 聚合最近days天的用量，按照费用从高到低排序，按天聚合时按照日期排序
+func (u *usageAccounting) report(groupBy string, days int) ([]*usageReportRow, error) {
+	if !slices.Contains([]string{UsageGroupByUser, UsageGroupByDepartment, UsageGroupByDay, UsageGroupByModel}, groupBy) {
+		return nil, fmt.Errorf("unsupported group by: %s", groupBy)
+	}
+
+	if days <= 0 {
+		days = 1
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, 1-days)
+
+	rows := map[string]*usageReportRow{}
+	for _, record := range u.store.Range(from, to) {
+		var key string
+		switch groupBy {
+		case UsageGroupByUser:
+			key = record.UserID
+		case UsageGroupByDepartment:
+			key = record.Department
+		case UsageGroupByDay:
+			key = time.Unix(record.Ts, 0).Format("2006-01-02")
+		case UsageGroupByModel:
+			key = record.Provider + "/" + record.Model
+		}
+
+		row, exist := rows[key]
+		if !exist {
+			row = &usageReportRow{Key: key}
+			rows[key] = row
+		}
+
+		row.Requests++
+		row.PromptTokens += int64(record.PromptTokens)
+		row.CompletionTokens += int64(record.CompletionTokens)
+		row.Cost += record.Cost
+		row.TotalLatencyMs += record.LatencyMs
+	}
+
+	result := make([]*usageReportRow, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, row)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if groupBy == UsageGroupByDay {
+			return result[i].Key < result[j].Key
+		}
+		return result[i].Cost > result[j].Cost
+	})
+
+	return result, nil
+}
+
+// recordUsage 记录AI回包的用量，计入提问人和所在部门的额度
+func (c *Chatbot) recordUsage(job *chatJob, promptTokens, completionTokens int) {
+	c.recordModelUsage(job.userID, job.ai, modelName(job.ai), job.requestAt, promptTokens, completionTokens, int64(promptTokens+completionTokens))
+}
+
+// recordModelUsage 记录指定模型的用量，quotaTokens为计入额度的token数
+// 语音和图片的promptTokens和completionTokens为字符数、秒数或者张数，计入额度时按照价格折算为token数
+func (c *Chatbot) recordModelUsage(userID, provider, model string, requestAt time.Time, promptTokens, completionTokens int, quotaTokens int64) {
+	c.addModelUsage(userID, provider, model, time.Since(requestAt), promptTokens, completionTokens, quotaTokens)
+}
+
+// addModelUsage 记录用量，latency为请求的耗时，异步统计用量时由调用方在回包时计算
+func (c *Chatbot) addModelUsage(userID, provider, model string, latency time.Duration, promptTokens, completionTokens int, quotaTokens int64) {
+	log.Printf("[INFO][recordUsage] userID=%s, ai=%s, model=%s, promptTokens=%d, completionTokens=%d, quotaTokens=%d", userID, provider, model, promptTokens, completionTokens, quotaTokens)
+
+	departmentID, departmentName := c.quotaDepartment(userID)
+
+	if c.quota != nil {
+		c.quota.addTokens(quotaScopeUser, userID, quotaTokens)
+		c.quota.addTokens(quotaScopeDepartment, departmentID, quotaTokens)
+	}
+
+	if c.usage == nil {
+		return
+	}
+
+	c.usage.store.Add(&usageRecord{
+		Ts:               time.Now().Unix(),
+		UserID:           userID,
+		Department:       departmentName,
+		Provider:         provider,
+		Model:            model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		LatencyMs:        latency.Milliseconds(),
+		Cost:             c.usage.cost(model, promptTokens, completionTokens),
+	})
+}
+
+// recordGeminiUsage Gemini的回包没有token用量，通过CountTokens分别计算提问(包括上下文)和回答的token数
+// CountTokens为两次同步请求，在协程中统计，不阻塞回包的推送
+func (c *Chatbot) recordGeminiUsage(job *chatJob, model *genai.GenerativeModel, prompt []*genai.Content, reply *genai.Content) {
+	latency := time.Since(job.requestAt)
+
+	go func() {
+		promptTokens := countGeminiTokens(model, prompt)
+		completionTokens := 0
+		if reply != nil {
+			completionTokens = countGeminiTokens(model, []*genai.Content{reply})
+		}
+
+		c.addModelUsage(job.userID, job.ai, modelName(job.ai), latency, promptTokens, completionTokens, int64(promptTokens+completionTokens))
+	}()
+}
+
+// countGeminiTokens 计算内容的token数，CountTokens失败时按照每个字符一个token估算，中文接近实际，英文偏高
+func countGeminiTokens(model *genai.GenerativeModel, contents []*genai.Content) int {
+	var parts []genai.Part
+	for _, content := range contents {
+		parts = append(parts, content.Parts...)
+	}
+
+	if len(parts) == 0 {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rsp, err := model.CountTokens(ctx, parts...)
+	if err == nil {
+		return int(rsp.TotalTokens)
+	}
+
+	log.Printf("[WARN][countGeminiTokens] CountTokens failed, estimate by length, err=%s", err)
+
+	tokens := 0
+	for _, part := range parts {
+		if text, ok := part.(genai.Text); ok {
+			tokens += len([]rune(string(text)))
+		} else if data, err := json.Marshal(part); err == nil {
+			tokens += len(data)
+		}
+	}
+
+	return tokens
+}
+
+// ExportUsageCSV 导出最近days天按照groupBy聚合的用量报表，groupBy参考UsageGroupByUser等定义
+func (c *Chatbot) ExportUsageCSV(groupBy string, days int) ([]byte, error) {
+	if c.usage == nil {
+		return nil, fmt.Errorf("usage accounting not enabled")
+	}
+
+	rows, err := c.usage.report(groupBy, days)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{groupBy, "requests", "prompt_tokens", "completion_tokens", "cost", "avg_latency_ms"})
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Key,
+			strconv.Itoa(row.Requests),
+			strconv.FormatInt(row.PromptTokens, 10),
+			strconv.FormatInt(row.CompletionTokens, 10),
+			strconv.FormatFloat(row.Cost, 'f', 4, 64),
+			strconv.FormatInt(row.avgLatencyMs(), 10),
+		})
+	}
+
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// 判断是否为管理员
+func (c *Chatbot) isAdmin(userID string) bool {
+	return slices.Contains(c.admins, userID)
+}
+
+const usageCommandUsage = `用量报表指令(仅管理员):
+/usage [user|department|day|model] [天数] 查看最近N天的用量，默认按用户聚合最近7天`
+
+// /usage 管理员查看用量报表
+func (c *Chatbot) handleUsageCommand(userID string, args string) (string, error) {
+	if !c.isAdmin(userID) {
+		return "只有管理员可以查看用量报表", nil
+	}
+
+	if c.usage == nil {
+		return "当前没有开启用量统计", nil
+	}
+
+	groupBy, days := UsageGroupByUser, 7
+	fields := strings.Fields(args)
+	if len(fields) > 0 {
+		groupBy = fields[0]
+	}
+	if len(fields) > 1 {
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			return usageCommandUsage, nil
+		}
+		days = n
+	}
+
+	rows, err := c.usage.report(groupBy, days)
+	if err != nil {
+		return usageCommandUsage, nil
+	}
+
+	if len(rows) == 0 {
+		return fmt.Sprintf("最近%d天没有用量记录", days), nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("最近%d天用量(按%s):\n", days, groupBy))
+
+	var total usageReportRow
+	for i, row := range rows {
+		total.Requests += row.Requests
+		total.PromptTokens += row.PromptTokens
+		total.CompletionTokens += row.CompletionTokens
+		total.Cost += row.Cost
+
+		// 企业微信文本消息长度有限，只展示前20行
+		if i < 20 {
+			sb.WriteString(fmt.Sprintf("%s: %d次, token %d/%d, $%.4f, 平均耗时%dms\n",
+				row.Key, row.Requests, row.PromptTokens, row.CompletionTokens, row.Cost, row.avgLatencyMs()))
+		}
+	}
+
+	sb.WriteString(fmt.Sprintf("合计: %d次, token %d/%d, $%.4f", total.Requests, total.PromptTokens, total.CompletionTokens, total.Cost))
+
+	return sb.String(), nil
+}
@@ -0,0 +1,371 @@
+package chatbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	openai "github.com/walkerdu/wecom-backend/pkg/openai-v1"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	VoiceModeAuto = "auto" // 用户发送语音提问时回复语音
+	VoiceModeOn   = "on"   // 总是回复语音
+	VoiceModeOff  = "off"  // 不回复语音
+
+	voiceModeKey = "chatbot-voice-mode" // Redis中保存用户语音回复模式的hash，field为userid
+
+	maxSpeechTextLength = 240 // 合成语音的最大字符数，企业微信的语音消息最长60s
+	maxVoiceSeconds     = 59  // 转码时截断的最大时长，单位秒
+	voiceRequestTimeout = 60  // 语音合成和识别的超时时间，单位秒
+)
+
+// SpeechSynthesizer 文本转语音，返回的音频格式不限，推送前统一转码为amr
+type SpeechSynthesizer interface {
+	Synthesize(text string) ([]byte, error)
+}
+
+// OpenAI的语音合成
+type openaiSpeechSynthesizer struct {
+	client *openai.Client
+	model  string
+	voice  string
+}
+
+func (s *openaiSpeechSynthesizer) Synthesize(text string) ([]byte, error) {
+	reqBytes, err := json.Marshal(&openai.SpeechReq{
+		Model:          openai.ModelType(s.model),
+		Input:          text,
+		Voice:          s.voice,
+		ResponseFormat: openai.SpeechFormatMp3,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{
+		Timeout: voiceRequestTimeout * time.Second,
+	}
+
+	rsp, err := s.client.PostStream(httpClient, string(openai.OpenAIPathAudioSpeech), reqBytes, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	speechRsp, ok := rsp.(*openai.SpeechRsp)
+	if !ok || len(speechRsp.Audio) == 0 {
+		return nil, errors.New("openai speech rsp invalid")
+	}
+
+	return speechRsp.Audio, nil
+}
+
+// 创建语音回复的组件，没有ffmpeg时不开启，开启OpenAI时默认使用OpenAI的语音合成
+func (c *Chatbot) initVoice(config *VoiceConfig) {
+	c.voiceConfig = *config
+	if c.voiceConfig.Mode == "" {
+		c.voiceConfig.Mode = VoiceModeAuto
+	}
+	if c.voiceConfig.Model == "" {
+		c.voiceConfig.Model = string(openai.Tts1)
+	}
+	if c.voiceConfig.Voice == "" {
+		c.voiceConfig.Voice = openai.VoiceAlloy
+	}
+	if c.voiceConfig.TranscriptionModel == "" {
+		c.voiceConfig.TranscriptionModel = string(openai.Whisper1)
+	}
+	if c.voiceConfig.FFmpeg == "" {
+		c.voiceConfig.FFmpeg = "ffmpeg"
+	}
+
+	if !config.Enable {
+		return
+	}
+
+	if _, err := exec.LookPath(c.voiceConfig.FFmpeg); err != nil {
+		log.Printf("[WARN][initVoice] ffmpeg not found, voice ignored, ffmpeg=%s, err=%s", c.voiceConfig.FFmpeg, err)
+		c.voiceConfig.Enable = false
+		return
+	}
+
+	if c.openaiClient != nil {
+		c.speechSynthesizer = &openaiSpeechSynthesizer{
+			client: c.openaiClient,
+			model:  c.voiceConfig.Model,
+			voice:  c.voiceConfig.Voice,
+		}
+	}
+}
+
+// RegisterSpeechSynthesizer 注册语音合成的实现，覆盖默认的OpenAI语音合成
+func (c *Chatbot) RegisterSpeechSynthesizer(synthesizer SpeechSynthesizer) {
+	c.speechSynthesizer = synthesizer
+}
+
+// 注册语音推送的回调，参数为userid、文件名和amr格式的语音内容
+func (c *Chatbot) RegisterVoicePublish(voicePublisher func(string, string, []byte) error) {
+	c.voicePublisher = voicePublisher
+}
+
+// 注册下载用户发送的语音的回调，参数为语音的media_id
+func (c *Chatbot) RegisterVoiceLoader(voiceLoader func(string) ([]byte, error)) {
+	c.voiceLoader = voiceLoader
+}
+
+func (c *Chatbot) voiceEnabled() bool {
+	return c.voiceConfig.Enable && c.speechSynthesizer != nil && c.voicePublisher != nil
+}
+
+// 用户的语音回复模式，没有设置时为配置的默认模式
+func (c *Chatbot) voiceMode(userID string) string {
+	if c.redisClient != nil {
+		mode, err := c.redisClient.HGet(context.Background(), voiceModeKey, userID).Result()
+		if err == nil {
+			return mode
+		} else if err != redis.Nil {
+			log.Printf("[ERROR][voiceMode] redis HGet failed, userID=%s, err=%s", userID, err)
+		}
+
+		return c.voiceConfig.Mode
+	}
+
+	if mode, ok := c.voiceModes.Load(userID); ok {
+		return mode.(string)
+	}
+
+	return c.voiceConfig.Mode
+}
+
+func (c *Chatbot) setVoiceMode(userID, mode string) error {
+	if c.redisClient != nil {
+		return c.redisClient.HSet(context.Background(), voiceModeKey, userID, mode).Err()
+	}
+
+	c.voiceModes.Store(userID, mode)
+
+	return nil
+}
+
+// 是否需要将回答转为语音，voiceInputs记录了最近一次提问为语音的用户
+func (c *Chatbot) shouldReplyVoice(userID string) bool {
+	if !c.voiceEnabled() {
+		return false
+	}
+
+	switch c.voiceMode(userID) {
+	case VoiceModeOn:
+		return true
+	case VoiceModeAuto:
+		_, ok := c.voiceInputs.Load(userID)
+		return ok
+	}
+
+	return false
+}
+
+const voiceCommandUsage = `语音回复指令:
+/voice on 回答同时推送语音
+/voice off 不推送语音
+/voice auto 发送语音提问时推送语音`
+
+// /voice 设置语音回复模式，不带参数时查看当前模式
+func (c *Chatbot) handleVoiceCommand(userID string, args string) (string, error) {
+	if !c.voiceEnabled() {
+		return "当前没有开启语音回复", nil
+	}
+
+	switch args {
+	case "":
+		return fmt.Sprintf("当前的语音回复模式为%s\n%s", c.voiceMode(userID), voiceCommandUsage), nil
+	case VoiceModeOn, VoiceModeOff, VoiceModeAuto:
+	default:
+		return voiceCommandUsage, nil
+	}
+
+	if err := c.setVoiceMode(userID, args); err != nil {
+		log.Printf("[ERROR][handleVoiceCommand] setVoiceMode failed, userID=%s, err=%s", userID, err)
+		return "设置失败，请稍后再试", nil
+	}
+
+	return "语音回复模式已设置为" + args, nil
+}
+
+// GetVoiceResponse 识别用户发送的语音后提问，下载、转码和识别耗时较长，先回复已收到，识别结果和回答之后推送
+// 之后的回答在auto模式下会同时推送语音，pending为true时rsp为占位回复
+func (c *Chatbot) GetVoiceResponse(userID, mediaID string) (rsp string, pending bool, err error) {
+	if c.openaiClient == nil || c.voiceLoader == nil || !c.voiceConfig.Enable {
+		return "暂不支持语音消息，请发送文字提问", false, nil
+	}
+
+	if msg, ok := c.checkQuota(userID); !ok {
+		return msg, false, nil
+	}
+
+	go func() {
+		rsp := c.voiceResponse(userID, mediaID)
+		if _, err := c.publish(userID, "", rsp); err != nil {
+			log.Printf("[ERROR][GetVoiceResponse] publish failed, userID=%s, err=%s", userID, err)
+		}
+	}()
+
+	return "已收到语音，正在识别中，请稍候~", true, nil
+}
+
+// voiceResponse 识别语音后提问，返回推送给用户的识别结果和回答
+func (c *Chatbot) voiceResponse(userID, mediaID string) string {
+	text, err := c.transcribeVoice(userID, mediaID)
+	if err != nil {
+		log.Printf("[ERROR][voiceResponse] transcribeVoice failed, userID=%s, err=%s", userID, err)
+		return "语音识别失败，请重试或者发送文字提问"
+	}
+
+	if text == "" {
+		return "没有识别到语音内容，请重试"
+	}
+
+	log.Printf("[INFO][voiceResponse] userID=%s, text=%s", userID, text)
+
+	c.voiceInputs.Store(userID, struct{}{})
+
+	rsp, _, err := c.getResponse(userID, "", userID, text)
+	if err != nil {
+		log.Printf("[ERROR][voiceResponse] getResponse failed, userID=%s, err=%s", userID, err)
+		rsp = "chatbot something wrong, errMsg:" + err.Error()
+	}
+
+	// 回复识别的内容，方便用户确认
+	return fmt.Sprintf("语音识别: %s\n\n%s", text, rsp)
+}
+
+// 下载语音并转码为mp3后调用OpenAI识别，企业微信的语音为amr格式，OpenAI不支持，按照语音的时长计入用量
+func (c *Chatbot) transcribeVoice(userID, mediaID string) (string, error) {
+	c.trackMedia(userID, mediaID)
+
+	data, err := c.voiceLoader(mediaID)
+	if err != nil {
+		return "", err
+	}
+
+	mp3, err := c.transcode(data, "-f", "mp3")
+	if err != nil {
+		return "", err
+	}
+
+	httpClient := &http.Client{
+		Timeout: voiceRequestTimeout * time.Second,
+	}
+
+	requestAt := time.Now()
+
+	rsp, err := c.openaiClient.PostForm(httpClient, string(openai.OpenAIPathAudioTranscription), map[string]string{
+		"model":           c.voiceConfig.TranscriptionModel,
+		"response_format": openai.TranscriptionFormatVerboseJson,
+	}, []*openai.FormFile{
+		{Field: "file", FileName: "voice.mp3", ContentType: "audio/mpeg", Data: mp3},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	transcriptionRsp, ok := rsp.(*openai.TranscriptionRsp)
+	if !ok {
+		return "", errors.New("openai transcription rsp invalid")
+	}
+
+	seconds := int(math.Ceil(transcriptionRsp.Duration))
+	c.recordModelUsage(userID, AIName_OpenAI, c.voiceConfig.TranscriptionModel, requestAt, seconds, 0, int64(seconds*transcriptionSecQuotaTokens))
+
+	return strings.TrimSpace(transcriptionRsp.Text), nil
+}
+
+// replyVoice 将回答合成语音后推送，失败时只记录日志，文字回答已经推送
+func (c *Chatbot) replyVoice(userID, content string) {
+	text := speechText(content)
+	if text == "" {
+		return
+	}
+
+	begin := time.Now()
+
+	audio, err := c.speechSynthesizer.Synthesize(text)
+	if err != nil {
+		log.Printf("[ERROR][replyVoice] Synthesize failed, userID=%s, err=%s", userID, err)
+		return
+	}
+
+	// 按照字符数计入用量，自定义的语音合成同样按照配置的model计费，价格可以在用量统计的配置中覆盖
+	provider := "speech"
+	if _, ok := c.speechSynthesizer.(*openaiSpeechSynthesizer); ok {
+		provider = AIName_OpenAI
+	}
+	chars := len([]rune(text))
+	c.recordModelUsage(userID, provider, c.voiceConfig.Model, begin, chars, 0, int64(chars*speechCharQuotaTokens))
+
+	// 企业微信的语音消息只支持amr格式，8k采样率单声道
+	amr, err := c.transcode(audio, "-t", fmt.Sprint(maxVoiceSeconds), "-ar", "8000", "-ac", "1", "-c:a", "libopencore_amrnb", "-b:a", "12.2k", "-f", "amr")
+	if err != nil {
+		log.Printf("[ERROR][replyVoice] transcode failed, userID=%s, err=%s", userID, err)
+		return
+	}
+
+	if err := c.voicePublisher(userID, fmt.Sprintf("voice_%d.amr", begin.Unix()), amr); err != nil {
+		log.Printf("[ERROR][replyVoice] publish voice failed, userID=%s, err=%s", userID, err)
+		return
+	}
+
+	log.Printf("[INFO][replyVoice] userID=%s, textLength=%d, size=%d, cost=%s", userID, len([]rune(text)), len(amr), time.Since(begin))
+}
+
+// transcode 调用ffmpeg转码，输入和输出都通过管道，args为输出的参数
+func (c *Chatbot) transcode(data []byte, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), voiceRequestTimeout*time.Second)
+	defer cancel()
+
+	cmdArgs := append([]string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0"}, args...)
+	cmdArgs = append(cmdArgs, "pipe:1")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.voiceConfig.FFmpeg, cmdArgs...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %s, stderr=%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+var (
+	speechCitationPattern = regexp.MustCompile(`(?s)\n\n参考资料:.*$`)
+	speechRefPattern      = regexp.MustCompile(`\[\d+\]`)
+	speechMarkdownPattern = regexp.MustCompile("(?m)^#{1,6}\\s+|[*`>|]+|^\\s*[-+]\\s+")
+)
+
+// speechText 去掉回答中不适合朗读的内容，例如markdown符号和参考资料，过长时截断
+func speechText(content string) string {
+	text := strings.TrimSuffix(content, truncatedAnswerHint)
+	text = speechCitationPattern.ReplaceAllString(text, "")
+	text = speechRefPattern.ReplaceAllString(text, "")
+	text = speechMarkdownPattern.ReplaceAllString(text, "")
+	text = strings.TrimSpace(text)
+
+	if runes := []rune(text); len(runes) > maxSpeechTextLength {
+		text = string(runes[:maxSpeechTextLength]) + "……详细内容请查看文字回复"
+	}
+
+	return text
+}
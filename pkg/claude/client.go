@@ -23,14 +23,57 @@ func NewClient(apiKey string) *Client {
 	return client
 }
 
+// 回包token用量的观察者
+type UsageObserver func(usage *Usage)
+
+// 回包的观察者，回调均可以为nil
+type Observer struct {
+	OnUsage func(usage *Usage)      // 回包成功后回调token用量
+	OnStop  func(stopReason string) // 回包成功后回调结束的原因，例如max_tokens表示回复被截断
+}
+
 func (c *Client) Post(httpClient *http.Client, requestBody []byte, asyncMsgChan chan string) error {
+	return c.PostWithObserver(httpClient, requestBody, asyncMsgChan, nil)
+}
+
+// PostWithUsage 发送请求，回包成功后先回调token用量，再将回复放入asyncMsgChan
+func (c *Client) PostWithUsage(httpClient *http.Client, requestBody []byte, asyncMsgChan chan string, observer UsageObserver) error {
+	return c.PostWithObserver(httpClient, requestBody, asyncMsgChan, &Observer{OnUsage: observer})
+}
+
+// PostWithObserver 发送请求，回包成功后先回调observer，再将回复放入asyncMsgChan
+func (c *Client) PostWithObserver(httpClient *http.Client, requestBody []byte, asyncMsgChan chan string, observer *Observer) error {
+	if observer == nil {
+		observer = &Observer{}
+	}
+
+	resp, err := c.Send(httpClient, requestBody)
+	if err != nil {
+		return err
+	}
+
+	if observer.OnUsage != nil {
+		observer.OnUsage(&resp.Usage)
+	}
+
+	if observer.OnStop != nil {
+		observer.OnStop(resp.StopReason)
+	}
+
+	asyncMsgChan <- resp.GetText()
+
+	return nil
+}
+
+// Send 同步发送请求，返回完整的回包，用于需要处理tool_use等非文本内容的场景
+func (c *Client) Send(httpClient *http.Client, requestBody []byte) (*Response, error) {
 	log.Printf("[DEBUG][Post]requestBody %s", requestBody)
 
 	// 构造HTTP请求
 	url := c.baseURL
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(requestBody))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Set("x-api-key", c.apiKey)
@@ -38,14 +81,14 @@ func (c *Client) Post(httpClient *http.Client, requestBody []byte, asyncMsgChan
 	req.Header.Set("anthropic-version", string(V20230601))
 
 	// 发送HTTP请求
-	if httpClient != nil {
+	if httpClient == nil {
 		httpClient = &http.Client{}
 	}
 
 	httpRsp, err := httpClient.Do(req)
 	if err != nil {
 		log.Printf("[ERROR][Post]httpClient Do() err:%s", err)
-		return err
+		return nil, err
 	}
 
 	defer httpRsp.Body.Close()
@@ -53,24 +96,22 @@ func (c *Client) Post(httpClient *http.Client, requestBody []byte, asyncMsgChan
 	body, err := ioutil.ReadAll(httpRsp.Body)
 	if err != nil {
 		log.Printf("Error reading response body:%s", err)
-		return err
+		return nil, err
 	}
 
 	var resp Response
 	err = json.Unmarshal(body, &resp)
 	if err != nil {
 		log.Printf("Error reading response body:%s", err)
-		return err
+		return nil, err
 	}
 
 	log.Printf("Claude response:%+v", resp)
 
 	if resp.Error != nil {
 		log.Printf("Claude response error:%s", resp.Error.Message)
-		return errors.New(resp.Error.Message)
+		return nil, errors.New(resp.Error.Message)
 	}
 
-	asyncMsgChan <- resp.Content[0].Text
-
-	return nil
+	return &resp, nil
 }
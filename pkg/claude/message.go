@@ -1,5 +1,7 @@
 package claude
 
+import "encoding/json"
+
 type ModelType string
 
 // https://docs.anthropic.com/claude/docs/models-overview
@@ -11,15 +13,36 @@ const (
 
 type AnthropicVersion string
 
+// 结束响应的原因
+const (
+	StopReasonEndTurn   = "end_turn"
+	StopReasonMaxTokens = "max_tokens" // 达到max_tokens，回复被截断
+	StopReasonToolUse   = "tool_use"   // 模型要求调用工具
+)
+
 // https://docs.anthropic.com/claude/reference/versions
 const (
 	V20230601 AnthropicVersion = "2023-06-01"
 	V20230101 AnthropicVersion = "2023-01-01"
 )
 
+// 内容块的类型
+const (
+	ContentTypeText       = "text"
+	ContentTypeToolUse    = "tool_use"
+	ContentTypeToolResult = "tool_result"
+)
+
 type Message struct {
 	Role    string `json:"role"`    // 消息的角色,可能是 "user" 或 "assistant"
-	Content string `json:"content"` // 消息的实际内容
+	Content any    `json:"content"` // 消息的实际内容,纯文本时为string,包含工具调用和结果时为[]Content
+}
+
+// 可以被模型调用的工具
+type Tool struct {
+	Name        string `json:"name"`                  // 工具名称
+	Description string `json:"description,omitempty"` // 工具的描述,模型根据描述决定什么时候调用
+	InputSchema any    `json:"input_schema"`          // 参数的JSON Schema
 }
 
 type Metadata struct {
@@ -30,12 +53,14 @@ type Request struct {
 	Model         ModelType `json:"model"`                    // 要使用的 Claude 模型名称,例如 "claude-v1.3"
 	MaxTokens     int       `json:"max_tokens"`               // 响应的最大令牌数量
 	Messages      []Message `json:"messages"`                 // 对话历史记录,包含用户和助手之前的消息
+	System        string    `json:"system,omitempty"`         // 系统提示词,为模型提供上下文和指令
 	Metadata      Metadata  `json:"metadata,omitempty"`       // 与用户相关的元数据
 	StopSequences []string  `json:"stop_sequences,omitempty"` // 指定在遇到哪些序列时应该终止响应
 	Stream        bool      `json:"stream,omitempty"`         // 是否启用流式响应模式
 	Temperature   float32   `json:"temperature,omitempty"`    // 控制输出随机性的温度参数,范围 0-1
 	TopP          float32   `json:"top_p,omitempty"`          // 另一个控制输出随机性的参数,范围 0-1
 	TopK          int       `json:"top_k,omitempty"`          // 控制输出随机性的另一个参数
+	Tools         []Tool    `json:"tools,omitempty"`          // 模型可以调用的工具列表
 }
 
 type Error struct {
@@ -44,7 +69,15 @@ type Error struct {
 
 type Content struct {
 	Text string `json:"text,omitempty"` // 响应内容文本
-	Type string `json:"type,omitempty"` // 内容类型,通常为 "text"
+	Type string `json:"type,omitempty"` // 内容类型,通常为 "text",调用工具时为 "tool_use" 或 "tool_result"
+
+	Id    string          `json:"id,omitempty"`    // tool_use的调用id
+	Name  string          `json:"name,omitempty"`  // tool_use调用的工具名称
+	Input json.RawMessage `json:"input,omitempty"` // tool_use的调用参数
+
+	ToolUseId string `json:"tool_use_id,omitempty"` // tool_result对应的调用id
+	Content   string `json:"content,omitempty"`     // tool_result的执行结果
+	IsError   bool   `json:"is_error,omitempty"`    // tool_result是否为执行失败
 }
 
 type Usage struct {
@@ -63,3 +96,15 @@ type Response struct {
 	Type         string    `json:"type,omitempty"`          // 响应类型,通常为 "message"
 	Usage        Usage     `json:"usage,omitempty"`         // 用量统计信息
 }
+
+// GetText 拼接回复中所有的文本内容
+func (r *Response) GetText() string {
+	var text string
+	for _, content := range r.Content {
+		if content.Type == ContentTypeText {
+			text += content.Text
+		}
+	}
+
+	return text
+}
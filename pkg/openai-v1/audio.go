@@ -0,0 +1,81 @@
+package openai
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+const (
+	Tts1     ModelType = "tts-1"    // 语音合成模型，延迟低
+	Tts1HD   ModelType = "tts-1-hd" // 语音合成模型，音质高
+	Whisper1 ModelType = "whisper-1"
+
+	VoiceAlloy = "alloy" // 语音合成的默认音色
+
+	MessageTypeSpeech        MessageType = "speech"
+	MessageTypeTranscription MessageType = "transcription"
+
+	SpeechFormatMp3  = "mp3"
+	SpeechFormatOpus = "opus"
+	SpeechFormatWav  = "wav"
+
+	TranscriptionFormatVerboseJson = "verbose_json" // 识别结果包含音频时长等信息
+)
+
+// 语音合成的请求，回包为音频文件
+type SpeechReq struct {
+	Model          ModelType `json:"model"`
+	Input          string    `json:"input"`                     // 需要合成的文本，最长4096个字符
+	Voice          string    `json:"voice"`                     // 音色，例如alloy
+	ResponseFormat string    `json:"response_format,omitempty"` // 音频格式，默认mp3
+	Speed          float64   `json:"speed,omitempty"`           // 语速，0.25~4.0，默认1.0
+}
+
+// 语音合成的回包
+type SpeechRsp struct {
+	Message
+	ContentType string
+	Audio       []byte
+}
+
+// 语音识别的回包，请求为multipart表单，字段为file和model
+type TranscriptionRsp struct {
+	Message
+	Text     string  `json:"text"`
+	Duration float64 `json:"duration,omitempty"` // 音频时长，单位秒，response_format为verbose_json时返回
+}
+
+func (c *Client) handleSpeechMessage(rsp *http.Response, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
+	audio, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		log.Printf("[ERROR][handleSpeechMessage]ReadAll err=%s", err)
+		return nil, err
+	}
+
+	return &SpeechRsp{
+		Message:     Message{msgType: MessageTypeSpeech},
+		ContentType: rsp.Header.Get("Content-Type"),
+		Audio:       audio,
+	}, nil
+}
+
+func (c *Client) handleTranscriptionMessage(rsp *http.Response, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
+	rspBytes, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		log.Printf("[ERROR][handleTranscriptionMessage]ReadAll err=%s", err)
+		return nil, err
+	}
+
+	transcriptionRsp := &TranscriptionRsp{
+		Message: Message{msgType: MessageTypeTranscription},
+	}
+
+	if err := json.Unmarshal(rspBytes, transcriptionRsp); err != nil {
+		log.Printf("[ERROR][handleTranscriptionMessage]Unmarshal failed err=%s", err)
+		return nil, err
+	}
+
+	return transcriptionRsp, nil
+}
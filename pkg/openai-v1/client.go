@@ -23,7 +23,17 @@ type Client struct {
 	msgHandlerMap map[OpenAIPath]MessageHandler
 }
 
-type MessageHandler func(*http.Response, chan string) (MessageIF, error)
+type MessageHandler func(*http.Response, chan string, *StreamObserver) (MessageIF, error)
+
+// 回包的观察者，回调均可以为nil
+type StreamObserver struct {
+	OnDelta func(delta string) // 流式回包每收到一段推流回调一次增量内容
+	OnUsage func(usage *Usage) // 回包结束时回调token用量，流式回包需要开启StreamOptions.IncludeUsage
+
+	OnFinish func(finishReason string) // 回包结束时回调生成结束的原因，例如length表示回复被截断
+
+	OnToolCalls func(calls []ToolCall) // 流式回包结束时回调模型要求的工具调用，分段推流的参数合并后回调
+}
 
 // 创建一个新的OpenAI实例
 func NewClient(apiKey string) *Client {
@@ -40,10 +50,21 @@ func NewClient(apiKey string) *Client {
 
 func (c *Client) RegisterMessageHandler() {
 	c.msgHandlerMap[OpenAIPathChatCompletion] = c.handleChatMessage
+	c.msgHandlerMap[OpenAIPathEmbedding] = c.handleEmbeddingMessage
+	c.msgHandlerMap[OpenAIPathImage] = c.handleImageMessage
+	c.msgHandlerMap[OpenAIPathImageEdits] = c.handleImageMessage
+	c.msgHandlerMap[OpenAIPathImageVariation] = c.handleImageMessage
+	c.msgHandlerMap[OpenAIPathAudioSpeech] = c.handleSpeechMessage
+	c.msgHandlerMap[OpenAIPathAudioTranscription] = c.handleTranscriptionMessage
 }
 
 // Post 发送HTTP POST请求到OpenAI API
 func (c *Client) Post(httpClient *http.Client, path string, requestBody []byte, asyncMsgChan chan string) (MessageIF, error) {
+	return c.PostStream(httpClient, path, requestBody, asyncMsgChan, nil)
+}
+
+// PostStream 发送HTTP POST请求到OpenAI API，流式回包时每收到一段推流都会回调observer
+func (c *Client) PostStream(httpClient *http.Client, path string, requestBody []byte, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
 	log.Printf("[DEBUG][Post]requestBody %s", requestBody)
 
 	// 构造HTTP请求
@@ -53,10 +74,16 @@ func (c *Client) Post(httpClient *http.Client, path string, requestBody []byte,
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+
+	return c.send(httpClient, path, req, asyncMsgChan, observer)
+}
+
+// send 发送构造好的HTTP请求，按照path对应的handler处理回包
+func (c *Client) send(httpClient *http.Client, path string, req *http.Request, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
 	req.Header.Set("Authorization", "Bearer "+c.apiKey)
 
 	// 发送HTTP请求
-	if httpClient != nil {
+	if httpClient == nil {
 		httpClient = &http.Client{}
 	}
 
@@ -76,7 +103,7 @@ func (c *Client) Post(httpClient *http.Client, path string, requestBody []byte,
 		return nil, fmt.Errorf("OpenAI API returned %d status code", resp.StatusCode)
 	}
 
-	rspMsg, err := c.handleMessage(path, resp, asyncMsgChan)
+	rspMsg, err := c.handleMessage(path, resp, asyncMsgChan, observer)
 	if err != nil {
 		log.Printf("[ERROR][Post]handlerMessage err=%s", err)
 		return nil, err
@@ -85,16 +112,40 @@ func (c *Client) Post(httpClient *http.Client, path string, requestBody []byte,
 	return rspMsg, nil
 }
 
-func (c *Client) handleMessage(path string, rsp *http.Response, asyncMsgChan chan string) (MessageIF, error) {
+func (c *Client) handleMessage(path string, rsp *http.Response, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
 	if handler, ok := c.msgHandlerMap[OpenAIPath(path)]; !ok {
 		err := fmt.Errorf("Unsupported message type, path=%s", path)
 		return nil, err
 	} else {
-		return handler(rsp, asyncMsgChan)
+		return handler(rsp, asyncMsgChan, observer)
+	}
+}
+
+// mergeToolCallDeltas 合并推流中的工具调用，第一段带有id和函数名，参数按照index分多段推流
+func mergeToolCallDeltas(calls []ToolCall, deltas []ToolCallDelta) []ToolCall {
+	for _, delta := range deltas {
+		for len(calls) <= delta.Index {
+			calls = append(calls, ToolCall{Type: ToolTypeFunction})
+		}
+
+		call := &calls[delta.Index]
+		if delta.Id != "" {
+			call.Id = delta.Id
+		}
+		if delta.Function.Name != "" {
+			call.Function.Name = delta.Function.Name
+		}
+		call.Function.Arguments += delta.Function.Arguments
 	}
+
+	return calls
 }
 
-func (c *Client) handleChatMessage(rsp *http.Response, asyncMsgChan chan string) (MessageIF, error) {
+func (c *Client) handleChatMessage(rsp *http.Response, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
+	if observer == nil {
+		observer = &StreamObserver{}
+	}
+
 	log.Printf("[DEBUG][handleChatMessage] rsp Header:%v", rsp.Header)
 
 	var chatRsp ChatCompletionRsp
@@ -120,13 +171,16 @@ func (c *Client) handleChatMessage(rsp *http.Response, asyncMsgChan chan string)
 			defer rsp.Body.Close()
 
 			begin := time.Now().Unix()
-			var asyncStream string
+			var asyncStream, finishReason string
+			var toolCalls []ToolCall
 
 			log.Printf("[INFO][handleChatMessage] Ready to streamReader.Recv()")
 			firstRecv := false
 
 			for !streamReader.isFinished {
-				if err := streamReader.Recv(); err != nil && err != io.EOF {
+				if err := streamReader.Recv(); err == io.EOF {
+					break
+				} else if err != nil {
 					log.Printf("[ERROR][handleChatMessage] streamReader.Recv() error:%s", err)
 					break
 				}
@@ -134,6 +188,13 @@ func (c *Client) handleChatMessage(rsp *http.Response, asyncMsgChan chan string)
 				// 收到一条推流
 				for _, choice := range streamReader.response.Choices {
 					asyncStream += choice.GetDeltaContent()
+					if choice.FinishReason != "" {
+						finishReason = choice.FinishReason
+					}
+					if observer.OnDelta != nil && choice.GetDeltaContent() != "" {
+						observer.OnDelta(choice.GetDeltaContent())
+					}
+					toolCalls = mergeToolCallDeltas(toolCalls, choice.DeltaMessage.ToolCalls)
 					if !firstRecv {
 						firstRecv = true
 						log.Printf("[INFO][handleChatMessage] streamReader.Recv() first response, choice:%v", choice)
@@ -151,6 +212,19 @@ func (c *Client) handleChatMessage(rsp *http.Response, asyncMsgChan chan string)
 				log.Printf("[INFO][handleChatMessage] streamReader.Recv() finish, full message:%v", asyncStream)
 			}
 
+			// 开启include_usage时，最后一段推流中返回整个请求的token用量
+			if usage := streamReader.response.Usage; observer.OnUsage != nil && usage.TotalTokens > 0 {
+				observer.OnUsage(&usage)
+			}
+
+			if observer.OnFinish != nil {
+				observer.OnFinish(finishReason)
+			}
+
+			if observer.OnToolCalls != nil && len(toolCalls) > 0 {
+				observer.OnToolCalls(toolCalls)
+			}
+
 			select {
 			case asyncMsgChan <- asyncStream:
 				log.Printf("[INFO][handleChatMessage] push stream into recv chan")
@@ -175,5 +249,13 @@ func (c *Client) handleChatMessage(rsp *http.Response, asyncMsgChan chan string)
 		return nil, err
 	}
 
+	if observer.OnUsage != nil && chatRsp.Usage.TotalTokens > 0 {
+		observer.OnUsage(&chatRsp.Usage)
+	}
+
+	if observer.OnFinish != nil && len(chatRsp.Choices) > 0 {
+		observer.OnFinish(chatRsp.Choices[0].FinishReason)
+	}
+
 	return &chatRsp, nil
 }
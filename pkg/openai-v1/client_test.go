@@ -0,0 +1,90 @@
+package openai
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newStreamResponse(events ...string) *http.Response {
+	var sb strings.Builder
+	for _, event := range events {
+		sb.WriteString("data: " + event + "\n\n")
+	}
+	sb.WriteString("data: [DONE]\n\n")
+
+	return &http.Response{
+		Header: http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:   io.NopCloser(strings.NewReader(sb.String())),
+	}
+}
+
+// 推流的内容和分段推流的工具调用在结束时合并回调
+func TestHandleChatMessageStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		events      []string
+		wantContent string
+		wantDeltas  []string
+		wantCalls   []ToolCall
+	}{
+		{
+			name: "content",
+			events: []string{
+				`{"choices":[{"delta":{"role":"assistant","content":"你好"}}]}`,
+				`{"choices":[{"delta":{"content":"，世界"},"finish_reason":"stop"}]}`,
+			},
+			wantContent: "你好，世界",
+			wantDeltas:  []string{"你好", "，世界"},
+		},
+		{
+			name: "tool calls",
+			events: []string{
+				`{"choices":[{"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"current_time","arguments":""}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"lookup","arguments":"{\"key"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"function":{"arguments":"word\":\"alice\"}"}}]}}]}`,
+				`{"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+			},
+			wantCalls: []ToolCall{
+				{Id: "call_a", Type: ToolTypeFunction, Function: ToolCallFunction{Name: "current_time"}},
+				{Id: "call_b", Type: ToolTypeFunction, Function: ToolCallFunction{Name: "lookup", Arguments: `{"keyword":"alice"}`}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deltas []string
+			var calls []ToolCall
+			var finishReason string
+
+			rspChan := make(chan string, 1)
+			_, err := (&Client{}).handleChatMessage(newStreamResponse(tt.events...), rspChan, &StreamObserver{
+				OnDelta:     func(delta string) { deltas = append(deltas, delta) },
+				OnFinish:    func(reason string) { finishReason = reason },
+				OnToolCalls: func(toolCalls []ToolCall) { calls = toolCalls },
+			})
+			if err != nil {
+				t.Fatalf("handleChatMessage failed, err=%s", err)
+			}
+
+			if content := <-rspChan; content != tt.wantContent {
+				t.Fatalf("content = %q, want %q", content, tt.wantContent)
+			}
+
+			if !slices.Equal(deltas, tt.wantDeltas) {
+				t.Fatalf("deltas = %q, want %q", deltas, tt.wantDeltas)
+			}
+
+			if !slices.Equal(calls, tt.wantCalls) {
+				t.Fatalf("calls = %+v, want %+v", calls, tt.wantCalls)
+			}
+
+			if finishReason == "" {
+				t.Fatal("finish reason not reported")
+			}
+		})
+	}
+}
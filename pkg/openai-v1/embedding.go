@@ -0,0 +1,75 @@
+package openai
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+const (
+	TextEmbedding3Small ModelType = "text-embedding-3-small" // 1536维，性价比最高的embedding模型
+	TextEmbedding3Large ModelType = "text-embedding-3-large" // 3072维
+	TextEmbeddingAda002 ModelType = "text-embedding-ada-002"
+
+	MessageTypeEmbedding MessageType = "list"
+
+	MaxEmbeddingInputs = 2048 // 一次请求最多的输入条数
+)
+
+// 生成embedding的请求
+type EmbeddingReq struct {
+	Model ModelType `json:"model"`
+	Input []string  `json:"input"`          // 需要生成embedding的文本，每条不超过模型的最大token数
+	User  string    `json:"user,omitempty"` // 终端用户ID
+}
+
+type EmbeddingData struct {
+	Object    string    `json:"object"`
+	Index     int       `json:"index"`     // 对应请求中Input的下标
+	Embedding []float32 `json:"embedding"` // 向量，已经归一化为单位长度
+}
+
+// 生成embedding的回包
+type EmbeddingRsp struct {
+	Message
+	Object string          `json:"object"`
+	Data   []EmbeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  Usage           `json:"usage"`
+}
+
+// Vectors 按照请求中Input的顺序返回向量
+func (e *EmbeddingRsp) Vectors() [][]float32 {
+	vectors := make([][]float32, len(e.Data))
+	for _, data := range e.Data {
+		if data.Index >= 0 && data.Index < len(vectors) {
+			vectors[data.Index] = data.Embedding
+		}
+	}
+
+	return vectors
+}
+
+func (c *Client) handleEmbeddingMessage(rsp *http.Response, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
+	rspBytes, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		log.Printf("[ERROR][handleEmbeddingMessage]ReadAll err=%s", err)
+		return nil, err
+	}
+
+	embeddingRsp := &EmbeddingRsp{
+		Message: Message{msgType: MessageTypeEmbedding},
+	}
+
+	if err := json.Unmarshal(rspBytes, embeddingRsp); err != nil {
+		log.Printf("[ERROR][handleEmbeddingMessage]Unmarshal failed err=%s", err)
+		return nil, err
+	}
+
+	if observer != nil && observer.OnUsage != nil && embeddingRsp.Usage.TotalTokens > 0 {
+		observer.OnUsage(&embeddingRsp.Usage)
+	}
+
+	return embeddingRsp, nil
+}
@@ -0,0 +1,127 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+const (
+	DallE2    ModelType = "dall-e-2"    // 支持生成、编辑和变体，编辑和变体只支持正方形的png
+	DallE3    ModelType = "dall-e-3"    // 只支持生成
+	GptImage1 ModelType = "gpt-image-1" // 支持生成和编辑，只返回base64，不支持response_format
+
+	MessageTypeImage MessageType = "image"
+
+	ImageSize1024x1024 = "1024x1024"
+
+	ImageResponseFormatUrl     = "url"
+	ImageResponseFormatB64Json = "b64_json"
+)
+
+// 生成图片的请求
+type ImageReq struct {
+	Model          ModelType `json:"model"`
+	Prompt         string    `json:"prompt"`                    // 图片的描述
+	N              int       `json:"n,omitempty"`               // 生成的图片数，dall-e-3只支持1
+	Size           string    `json:"size,omitempty"`            // 图片的尺寸，例如1024x1024
+	Quality        string    `json:"quality,omitempty"`         // 图片的质量，dall-e-3为standard或者hd
+	ResponseFormat string    `json:"response_format,omitempty"` // 返回url或者b64_json，url的有效期为1小时
+	User           string    `json:"user,omitempty"`            // 终端用户ID
+}
+
+type ImageData struct {
+	Url           string `json:"url,omitempty"`
+	B64Json       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"` // dall-e-3改写后的描述
+}
+
+// Decode 解码base64格式的图片，返回url格式时为空
+func (d *ImageData) Decode() ([]byte, error) {
+	if d.B64Json == "" {
+		return nil, nil
+	}
+
+	return base64.StdEncoding.DecodeString(d.B64Json)
+}
+
+// 生成、编辑图片和图片变体的回包
+type ImageRsp struct {
+	Message
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+}
+
+// 表单中上传的文件
+type FormFile struct {
+	Field       string // 表单字段名，例如image、mask
+	FileName    string
+	ContentType string // 文件的类型，例如image/png，部分模型会校验文件类型
+	Data        []byte
+}
+
+// PostForm 以multipart表单的方式发送HTTP POST请求到OpenAI API，用于上传文件的接口，例如编辑图片
+func (c *Client) PostForm(httpClient *http.Client, path string, fields map[string]string, files []*FormFile, observer *StreamObserver) (MessageIF, error) {
+	log.Printf("[DEBUG][PostForm]path=%s, fields=%v, files=%d", path, fields, len(files))
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, file.Field, file.FileName))
+		header.Set("Content-Type", file.ContentType)
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := part.Write(file.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return c.send(httpClient, path, req, nil, observer)
+}
+
+func (c *Client) handleImageMessage(rsp *http.Response, asyncMsgChan chan string, observer *StreamObserver) (MessageIF, error) {
+	rspBytes, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		log.Printf("[ERROR][handleImageMessage]ReadAll err=%s", err)
+		return nil, err
+	}
+
+	imageRsp := &ImageRsp{
+		Message: Message{msgType: MessageTypeImage},
+	}
+
+	if err := json.Unmarshal(rspBytes, imageRsp); err != nil {
+		log.Printf("[ERROR][handleImageMessage]Unmarshal failed err=%s", err)
+		return nil, err
+	}
+
+	return imageRsp, nil
+}
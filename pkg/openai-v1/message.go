@@ -38,6 +38,7 @@ const (
 	OpenAIPathEmbedding          OpenAIPath = "v1/embeddings"
 	OpenAIPathAudioTranscription OpenAIPath = "v1/audio/transcriptions"
 	OpenAIPathAudioTranslation   OpenAIPath = "v1/audio/translations"
+	OpenAIPathAudioSpeech        OpenAIPath = "v1/audio/speech"
 )
 
 type ModelType string
@@ -57,13 +58,50 @@ const (
 	System    RoleType = "system"    // 系统
 	User      RoleType = "user"      // 用户
 	Assistant RoleType = "assistant" // 机器人助手
+	Tool      RoleType = "tool"      // 工具的执行结果
 )
 
 type ChatMessage struct {
-	Role    RoleType `json:"role"`    // 消息的角色，可以是“system”，“user”或“assistant”
-	Content string   `json:"content"` // 消息的内容
+	Role       RoleType   `json:"role"`                   // 消息的角色，可以是“system”，“user”，“assistant”或“tool”
+	Content    string     `json:"content"`                // 消息的内容
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // assistant要求调用的工具
+	ToolCallId string     `json:"tool_call_id,omitempty"` // tool消息对应的工具调用id
 }
 
+// 可以被模型调用的工具，目前只支持function
+type ChatTool struct {
+	Type     string       `json:"type"` // 固定为function
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string `json:"name"`                  // 函数名称
+	Description string `json:"description,omitempty"` // 函数的描述，模型根据描述决定什么时候调用
+	Parameters  any    `json:"parameters,omitempty"`  // 参数的JSON Schema
+}
+
+// 模型返回的工具调用
+type ToolCall struct {
+	Id       string           `json:"id"`
+	Type     string           `json:"type"` // 固定为function
+	Function ToolCallFunction `json:"function"`
+}
+
+// 推流中的工具调用，同一个调用的参数分多段推流，通过index合并
+type ToolCallDelta struct {
+	Index    int              `json:"index"`
+	Id       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON格式的调用参数，模型生成的参数不一定合法，需要校验
+}
+
+const ToolTypeFunction = "function"
+
 type ChatCompletionReq struct {
 	Model            ModelType      `json:"model"`                       // 模型的名称或ID
 	Messages         []ChatMessage  `json:"messages"`                    // 包含多个消息的数组
@@ -75,14 +113,35 @@ type ChatCompletionReq struct {
 	Stop             []string       `json:"stop,omitempty"`              // 控制生成文本的停止条件。例如，Stop 字段的值为“我”，则模型会在生成回复时在“我”这个词处停止。这个字段可以用来控制模型生成回复的长度和内容。
 	N                int            `json:"n,omitempty"`                 // 控制生成回复的选项数，默认值为1，假设你想让模型生成一个关于“狗”的回复，然后在n字段中指定要生成的回复数量。例如设置为 3，则模型将生成三个关于“狗”的回复供你选择。
 	Stream           bool           `json:"stream,omitempty"`            // 开启流式传输，默认为false，开启后，生成的回复将会以text/event-stream的方式多次进行推送，直到全部回复完毕。
+	StreamOptions    *StreamOptions `json:"stream_options,omitempty"`    // 流式传输的选项，只有Stream为true时才可以设置
 	LogitBias        map[string]int `json:"logit_bias,omitempty"`        // 控制生成文本中, 模型输出的概率分布，取值[-100, 100],例如可以更改模型生成某些单词或标记的倾向性。例如，如果您希望模型生成更积极的回复，可以为积极词汇设置较高的偏置值。相反，如果您希望减少某些单词或短语的出现频率，可以为它们设置较低的偏置值。
 	User             string         `json:"user,omitempty"`              // 用来标识终端用户ID，作用是让模型能够根据不同的用户生成不同的文本，从而提高生成文本的个性化程度。
+	Tools            []ChatTool     `json:"tools,omitempty"`             // 模型可以调用的工具列表
+	ToolChoice       any            `json:"tool_choice,omitempty"`       // 控制模型是否调用工具，可以是"none"、"auto"或者指定的工具
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // 开启后，最后一段推流会返回整个请求的token用量，choices为空
+}
+
+// 生成结束的原因
+const (
+	FinishReasonStop      = "stop"
+	FinishReasonLength    = "length"     // 达到max_tokens或者上下文长度限制，回复被截断
+	FinishReasonToolCalls = "tool_calls" // 模型要求调用工具
+)
+
+// stream方式回包的增量内容
+type ChatDelta struct {
+	Role      RoleType        `json:"role"`
+	Content   string          `json:"content"`
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
 }
 
 type ChatCompletionChoice struct {
 	Index        int         `json:"index"`
 	Message      ChatMessage `json:"message"`
-	DeltaMessage ChatMessage `json:"delta"` // stream方式的回包结构
+	DeltaMessage ChatDelta   `json:"delta"` // stream方式的回包结构
 	FinishReason string      `json:"finish_reason"`
 }
 
@@ -56,10 +56,13 @@ waitForData:
 		return
 	}
 
-	if err = json.Unmarshal(line, stream.response); nil != err {
+	// 每段推流解析到新的结构中，避免上一段推流的字段残留
+	response := &ChatCompletionRsp{}
+	if err = json.Unmarshal(line, response); nil != err {
 		log.Printf("[ERROR][handleChatMessage]Unmarshal failed err=%s", err)
 		return
 	}
+	stream.response = response
 
 	return
 }
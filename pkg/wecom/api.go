@@ -0,0 +1,76 @@
+package wecom
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const apiBaseURL = "https://qyapi.weixin.qq.com/cgi-bin/"
+
+// 企业微信接口的回包，需要内嵌CommonRsp
+type commonRspIF interface {
+	getCommonRsp() *CommonRsp
+}
+
+// callAPI 调用企业微信的服务端接口，reqBody不为nil时以POST方式发送JSON请求，否则以GET方式请求
+func (w *WeCom) callAPI(api string, query url.Values, reqBody interface{}, rsp commonRspIF) error {
+	accessToken := w.getAccessToken()
+	if accessToken == "" {
+		err := errors.New("access token is invalid")
+		log.Printf("[ERROR]callAPI|getAccessToken failed, api:%s, err:%s", api, err)
+		return err
+	}
+
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("access_token", accessToken)
+	apiURL := apiBaseURL + api + "?" + query.Encode()
+
+	var res *http.Response
+	var err error
+	if reqBody != nil {
+		var reqBytes []byte
+		reqBytes, err = json.Marshal(reqBody)
+		if err != nil {
+			log.Printf("[ERROR]callAPI|json Marshal failed, api:%s, err:%s", api, err)
+			return err
+		}
+
+		log.Printf("[DEBUG]callAPI|api:%s, request:%s", api, reqBytes)
+		res, err = http.Post(apiURL, "application/json", bytes.NewReader(reqBytes))
+	} else {
+		res, err = http.Get(apiURL)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR]callAPI|http request failed, api:%s, err:%s", api, err)
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("[ERROR]callAPI|ReadAll failed, api:%s, err:%s", api, err)
+		return err
+	}
+
+	if err := json.Unmarshal(body, rsp); err != nil {
+		log.Printf("[ERROR]callAPI|json Unmarshal failed, api:%s, err:%s", api, err)
+		return err
+	}
+
+	if commonRsp := rsp.getCommonRsp(); commonRsp.ErrCode != 0 {
+		err := fmt.Errorf("%s|return error, errcode: %d, errmsg: %s", api, commonRsp.ErrCode, commonRsp.ErrMsg)
+		log.Printf("[ERROR]|:%s", err)
+		return err
+	}
+
+	return nil
+}
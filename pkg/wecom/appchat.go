@@ -0,0 +1,81 @@
+// 应用群聊会话的接口
+// https://developer.work.weixin.qq.com/document/path/90244
+
+package wecom
+
+import (
+	"log"
+	"net/url"
+)
+
+// CreateAppChat 创建群聊会话，返回群聊id
+func (w *WeCom) CreateAppChat(name, owner string, userList []string) (string, error) {
+	req := &AppChatCreateReq{
+		Name:     name,
+		Owner:    owner,
+		UserList: userList,
+	}
+
+	var rsp AppChatCreateRsp
+	if err := w.callAPI("appchat/create", nil, req, &rsp); err != nil {
+		return "", err
+	}
+
+	log.Printf("[INFO]CreateAppChat|create app chat success, chatId:%s, name:%s", rsp.ChatId, name)
+
+	return rsp.ChatId, nil
+}
+
+// UpdateAppChat 修改群聊会话，可以修改群名、群主和成员
+func (w *WeCom) UpdateAppChat(req *AppChatUpdateReq) error {
+	var rsp CommonRsp
+	return w.callAPI("appchat/update", nil, req, &rsp)
+}
+
+// GetAppChat 获取群聊会话
+func (w *WeCom) GetAppChat(chatId string) (*AppChatInfo, error) {
+	var rsp AppChatGetRsp
+	if err := w.callAPI("appchat/get", url.Values{"chatid": {chatId}}, nil, &rsp); err != nil {
+		return nil, err
+	}
+
+	return &rsp.ChatInfo, nil
+}
+
+// GetAppChatMembers 获取群聊会话的成员列表
+func (w *WeCom) GetAppChatMembers(chatId string) ([]string, error) {
+	chatInfo, err := w.GetAppChat(chatId)
+	if err != nil {
+		return nil, err
+	}
+
+	return chatInfo.UserList, nil
+}
+
+// 推送文本消息到群聊的pusher，群聊消息没有msgid，不支持撤回
+func (w *WeCom) PushAppChatTextMessage(chatId, content string) (string, error) {
+	pushMsg := &AppChatTextPushMessage{
+		AppChatPushMessage: AppChatPushMessage{
+			ChatId:  chatId,
+			MsgType: MessageTypeText,
+		},
+	}
+	pushMsg.Text.Content = content
+
+	var rsp CommonRsp
+	return "", w.callAPI("appchat/send", nil, pushMsg, &rsp)
+}
+
+// 推送Markdown消息到群聊的pusher
+func (w *WeCom) PushAppChatMarkdownMessage(chatId, content string) (string, error) {
+	pushMsg := &AppChatMarkdownPushMessage{
+		AppChatPushMessage: AppChatPushMessage{
+			ChatId:  chatId,
+			MsgType: MessageTypeMarkdown,
+		},
+	}
+	pushMsg.Markdown.Content = content
+
+	var rsp CommonRsp
+	return "", w.callAPI("appchat/send", nil, pushMsg, &rsp)
+}
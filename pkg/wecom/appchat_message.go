@@ -0,0 +1,72 @@
+package wecom
+
+// 企业微信接口的通用回包
+type CommonRsp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (c *CommonRsp) getCommonRsp() *CommonRsp {
+	return c
+}
+
+// 创建群聊会话的请求
+type AppChatCreateReq struct {
+	Name     string   `json:"name,omitempty"`   // 群聊名，最多50个utf8字符，超过将截断
+	Owner    string   `json:"owner,omitempty"`  // 指定群主的id。如果不指定，系统会随机从userlist中选一人作为群主
+	UserList []string `json:"userlist"`         // 群成员id列表。至少2人，至多2000人
+	ChatId   string   `json:"chatid,omitempty"` // 群聊的唯一标志，不能与已有的群重复；字符串类型，最长32个字符。只允许字符0-9及字母a-zA-Z。如果不填，系统会随机生成群id
+}
+
+// 创建群聊会话的回包
+type AppChatCreateRsp struct {
+	CommonRsp
+	ChatId string `json:"chatid"`
+}
+
+// 修改群聊会话的请求
+type AppChatUpdateReq struct {
+	ChatId      string   `json:"chatid"`                  // 群聊id
+	Name        string   `json:"name,omitempty"`          // 新的群聊名。若不需更新，请忽略此参数
+	Owner       string   `json:"owner,omitempty"`         // 新群主的id。若不需更新，请忽略此参数
+	AddUserList []string `json:"add_user_list,omitempty"` // 添加成员的id列表
+	DelUserList []string `json:"del_user_list,omitempty"` // 踢出成员的id列表
+}
+
+// 群聊会话信息
+type AppChatInfo struct {
+	ChatId   string   `json:"chatid"`
+	Name     string   `json:"name"`
+	Owner    string   `json:"owner"`
+	UserList []string `json:"userlist"`
+	ChatType int      `json:"chat_type"` // 群聊类型，0-普通群，1-家校群
+}
+
+// 获取群聊会话的回包
+type AppChatGetRsp struct {
+	CommonRsp
+	ChatInfo AppChatInfo `json:"chat_info"`
+}
+
+// 应用推送消息到群聊会话的基本结构
+type AppChatPushMessage struct {
+	ChatId  string      `json:"chatid"`         // 群聊id
+	MsgType MessageType `json:"msgtype"`        // 消息类型
+	Safe    int         `json:"safe,omitempty"` // 表示是否是保密消息，0表示否，1表示是，默认0
+}
+
+// 群聊文本消息
+type AppChatTextPushMessage struct {
+	AppChatPushMessage
+	Text struct {
+		Content string `json:"content"` // 文本消息内容
+	} `json:"text"`
+}
+
+// 群聊Markdown消息
+type AppChatMarkdownPushMessage struct {
+	AppChatPushMessage
+	Markdown struct {
+		Content string `json:"content"` // Markdown内容
+	} `json:"markdown"`
+}
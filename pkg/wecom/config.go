@@ -1,10 +1,51 @@
 package wecom
 
+import "time"
+
 // 企业微信一个Agent的配置
 type AgentConfig struct {
-	CorpID              string `json:"corp_id"`
-	AgentID             int    `json:"agent_id"`
-	AgentSecret         string `json:"agent_secret"`
-	AgentToken          string `json:"agent_token"`
-	AgentEncodingAESKey string `json:"agent_encoding_aes_key"`
+	CorpID              string      `json:"corp_id"`
+	AgentID             int         `json:"agent_id"`
+	AgentSecret         string      `json:"agent_secret"`
+	AgentToken          string      `json:"agent_token"`
+	AgentEncodingAESKey string      `json:"agent_encoding_aes_key"`
+	Media               MediaConfig `json:"media"`
+	DedupTTL            int64       `json:"dedup_ttl"`   // 回调消息排重的有效时长，单位秒
+	ReplyMode           string      `json:"reply_mode"`  // 回复模式，sync、async或者hybrid，默认sync
+	ProfileTTL          int64       `json:"profile_ttl"` // 通讯录用户资料的缓存时长，单位秒，默认1h
+}
+
+// 通讯录用户资料的缓存时长
+func (c *AgentConfig) GetProfileTTL() time.Duration {
+	if c.ProfileTTL <= 0 {
+		return defaultProfileTTL * time.Second
+	}
+
+	return time.Duration(c.ProfileTTL) * time.Second
+}
+
+// 回调消息排重的有效时长
+func (c *AgentConfig) GetDedupTTL() time.Duration {
+	if c.DedupTTL <= 0 {
+		return defaultIdempotencyTTL * time.Second
+	}
+
+	return time.Duration(c.DedupTTL) * time.Second
+}
+
+// 素材下载的配置
+type MediaConfig struct {
+	CacheType string `json:"cache_type"` // 素材缓存类型，disk或者redis，为空不缓存
+	CacheDir  string `json:"cache_dir"`  // disk缓存的目录
+	CacheTTL  int64  `json:"cache_ttl"`  // 缓存的有效时长，单位秒，默认3天，和临时素材的有效期一致
+	MaxSize   int64  `json:"max_size"`   // 下载素材的最大字节数，默认20MB
+}
+
+// 素材缓存的有效时长
+func (c *MediaConfig) GetCacheTTL() time.Duration {
+	if c.CacheTTL <= 0 {
+		return defaultMediaCacheTTL * time.Second
+	}
+
+	return time.Duration(c.CacheTTL) * time.Second
 }
@@ -0,0 +1,69 @@
+// 通讯录管理的接口，需要应用有通讯录的读取权限
+// https://developer.work.weixin.qq.com/document/path/90193
+
+package wecom
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// GetUser 读取成员详情
+func (w *WeCom) GetUser(userID string) (*ContactUser, error) {
+	var rsp UserGetRsp
+	if err := w.callAPI("user/get", url.Values{"userid": {userID}}, nil, &rsp); err != nil {
+		return nil, err
+	}
+
+	return &rsp.ContactUser, nil
+}
+
+// ListDepartments 获取部门及其下的子部门列表，departmentId为0时获取全量组织架构
+func (w *WeCom) ListDepartments(departmentId int) ([]Department, error) {
+	query := url.Values{}
+	if departmentId > 0 {
+		query.Set("id", strconv.Itoa(departmentId))
+	}
+
+	var rsp DepartmentListRsp
+	if err := w.callAPI("department/list", query, nil, &rsp); err != nil {
+		return nil, err
+	}
+
+	return rsp.Department, nil
+}
+
+// ListDepartmentUsers 获取部门成员，fetchChild为true时递归获取子部门的成员
+func (w *WeCom) ListDepartmentUsers(departmentId int, fetchChild bool) ([]SimpleUser, error) {
+	query := url.Values{"department_id": {strconv.Itoa(departmentId)}}
+	if fetchChild {
+		query.Set("fetch_child", "1")
+	}
+
+	var rsp UserSimpleListRsp
+	if err := w.callAPI("user/simplelist", query, nil, &rsp); err != nil {
+		return nil, err
+	}
+
+	return rsp.UserList, nil
+}
+
+// ListTags 获取标签列表
+func (w *WeCom) ListTags() ([]Tag, error) {
+	var rsp TagListRsp
+	if err := w.callAPI("tag/list", nil, nil, &rsp); err != nil {
+		return nil, err
+	}
+
+	return rsp.TagList, nil
+}
+
+// GetTag 获取标签的成员和部门
+func (w *WeCom) GetTag(tagId int) (*TagGetRsp, error) {
+	var rsp TagGetRsp
+	if err := w.callAPI("tag/get", url.Values{"tagid": {strconv.Itoa(tagId)}}, nil, &rsp); err != nil {
+		return nil, err
+	}
+
+	return &rsp, nil
+}
@@ -0,0 +1,66 @@
+package wecom
+
+// 通讯录成员详情
+type ContactUser struct {
+	UserId         string `json:"userid"`
+	Name           string `json:"name"`
+	Department     []int  `json:"department"`      // 成员所属部门id列表
+	MainDepartment int    `json:"main_department"` // 主部门
+	Position       string `json:"position"`        // 职务信息
+	Gender         string `json:"gender"`          // 性别，0表示未定义，1表示男性，2表示女性
+	Email          string `json:"email"`
+	Status         int    `json:"status"` // 激活状态: 1=已激活，2=已禁用，4=未激活，5=退出企业
+}
+
+// 读取成员的回包
+type UserGetRsp struct {
+	CommonRsp
+	ContactUser
+}
+
+// 部门信息
+type Department struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentId int    `json:"parentid"`
+	Order    int    `json:"order"`
+}
+
+// 获取部门列表的回包
+type DepartmentListRsp struct {
+	CommonRsp
+	Department []Department `json:"department"`
+}
+
+// 部门成员的简要信息
+type SimpleUser struct {
+	UserId     string `json:"userid"`
+	Name       string `json:"name"`
+	Department []int  `json:"department"`
+}
+
+// 获取部门成员的回包
+type UserSimpleListRsp struct {
+	CommonRsp
+	UserList []SimpleUser `json:"userlist"`
+}
+
+// 标签信息
+type Tag struct {
+	TagId   int    `json:"tagid"`
+	TagName string `json:"tagname"`
+}
+
+// 获取标签列表的回包
+type TagListRsp struct {
+	CommonRsp
+	TagList []Tag `json:"taglist"`
+}
+
+// 获取标签成员的回包
+type TagGetRsp struct {
+	CommonRsp
+	TagName   string       `json:"tagname"`
+	UserList  []SimpleUser `json:"userlist"`  // 标签中包含的成员列表
+	PartyList []int        `json:"partylist"` // 标签中包含的部门id列表
+}
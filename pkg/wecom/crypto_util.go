@@ -10,10 +10,12 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -39,7 +41,8 @@ const (
 type ProtocolType int
 
 const (
-	XmlType ProtocolType = 1
+	XmlType  ProtocolType = 1
+	JsonType ProtocolType = 2 // 智能机器人的回调使用JSON格式
 )
 
 type CryptError struct {
@@ -51,6 +54,17 @@ func NewCryptError(err_code int, err_msg string) *CryptError {
 	return &CryptError{ErrCode: err_code, ErrMsg: err_msg}
 }
 
+type WXBizJsonMsg4Recv struct {
+	Encrypt string `json:"encrypt"`
+}
+
+type WXBizJsonMsg4Send struct {
+	Encrypt   string `json:"encrypt"`
+	Signature string `json:"msgsignature"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+}
+
 type WXBizMsg4Recv struct {
 	Tousername string `xml:"ToUserName"`
 	Encrypt    string `xml:"Encrypt"`
@@ -105,12 +119,41 @@ func (self *XmlProcessor) serialize(msg4_send *WXBizMsg4Send) ([]byte, *CryptErr
 	return xml_msg, nil
 }
 
+type JsonProcessor struct {
+}
+
+func (self *JsonProcessor) parse(src_data []byte) (*WXBizMsg4Recv, *CryptError) {
+	var msg4_recv WXBizJsonMsg4Recv
+	err := json.Unmarshal(src_data, &msg4_recv)
+	if nil != err {
+		return nil, NewCryptError(ParseJsonError, "json to msg fail")
+	}
+	return &WXBizMsg4Recv{Encrypt: msg4_recv.Encrypt}, nil
+}
+
+func (self *JsonProcessor) serialize(msg4_send *WXBizMsg4Send) ([]byte, *CryptError) {
+	timestamp, _ := strconv.ParseInt(msg4_send.Timestamp, 10, 64)
+	json_msg, err := json.Marshal(&WXBizJsonMsg4Send{
+		Encrypt:   msg4_send.Encrypt.Value,
+		Signature: msg4_send.Signature.Value,
+		Timestamp: timestamp,
+		Nonce:     msg4_send.Nonce.Value,
+	})
+	if nil != err {
+		return nil, NewCryptError(GenJsonError, err.Error())
+	}
+	return json_msg, nil
+}
+
 func NewWXBizMsgCrypt(token, encoding_aeskey, receiver_id string, protocol_type ProtocolType) *WXBizMsgCrypt {
 	var protocol_processor ProtocolProcessor
-	if protocol_type != XmlType {
-		panic("unsupport protocal")
-	} else {
+	switch protocol_type {
+	case XmlType:
 		protocol_processor = new(XmlProcessor)
+	case JsonType:
+		protocol_processor = new(JsonProcessor)
+	default:
+		panic("unsupport protocal")
 	}
 
 	return &WXBizMsgCrypt{token: token, encoding_aeskey: (encoding_aeskey + "="), receiver_id: receiver_id, protocol_processor: protocol_processor}
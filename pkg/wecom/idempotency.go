@@ -0,0 +1,188 @@
+package wecom
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultIdempotencyTTL = 300 // 消息排重的有效时长，企业微信5s超时后最多重试3次，默认保留5min
+
+	idempotencyKeyPrefix  = "wecom-dedup-"
+	idempotencyProcessing = "-" // Redis中处理中的标记
+	idempotencyDone       = "+" // Redis中处理完成的标记，后面跟随加密后的回包
+
+	idempotencyWaitTimeout  = 4 * time.Second // 重试请求等待首次请求处理完成的最长时间，需要小于企业微信的5s超时
+	idempotencyWaitInterval = 200 * time.Millisecond
+)
+
+// IdempotencyStore 按照MsgId或者事件指纹对回调消息排重，缓存处理完成的回包，企业微信重试时直接返回
+type IdempotencyStore interface {
+	// Begin 开始处理消息，返回false表示消息已经在处理中或者处理完成, 处理完成时返回缓存的回包
+	Begin(key string) (reply []byte, done bool, ok bool)
+	// Done 消息处理完成，缓存回包
+	Done(key string, reply []byte)
+	// Release 消息处理失败，释放排重，允许企业微信重试
+	Release(key string)
+}
+
+// 回调消息中用于排重的字段，普通消息按照MsgId排重，事件消息没有MsgId，按照FromUserName + CreateTime + Event排重
+type messageFingerprint struct {
+	FromUserName string `xml:"FromUserName"`
+	CreateTime   int64  `xml:"CreateTime"`
+	MsgType      string `xml:"MsgType"`
+	MsgId        int64  `xml:"MsgId"`
+	Event        string `xml:"Event"`
+	EventKey     string `xml:"EventKey"`
+}
+
+func (m *messageFingerprint) Key() string {
+	if m.MsgId != 0 {
+		return fmt.Sprintf("msg-%d", m.MsgId)
+	}
+
+	return fmt.Sprintf("event-%s-%d-%s-%s", m.FromUserName, m.CreateTime, m.Event, m.EventKey)
+}
+
+type idempotencyEntry struct {
+	reply    []byte
+	done     bool
+	expireAt int64
+}
+
+type memoryIdempotencyStore struct {
+	ttl       int64
+	entries   map[string]*idempotencyEntry
+	lastSweep int64
+	mu        sync.Mutex
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) IdempotencyStore {
+	return &memoryIdempotencyStore{
+		ttl:     int64(ttl / time.Second),
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// 定期清理过期的记录
+func (m *memoryIdempotencyStore) sweep(now int64) {
+	if now-m.lastSweep < m.ttl {
+		return
+	}
+
+	for key, entry := range m.entries {
+		if entry.expireAt < now {
+			delete(m.entries, key)
+		}
+	}
+
+	m.lastSweep = now
+}
+
+func (m *memoryIdempotencyStore) Begin(key string) ([]byte, bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	m.sweep(now)
+
+	if entry, exist := m.entries[key]; exist && entry.expireAt >= now {
+		return entry.reply, entry.done, false
+	}
+
+	m.entries[key] = &idempotencyEntry{
+		expireAt: now + m.ttl,
+	}
+
+	return nil, false, true
+}
+
+func (m *memoryIdempotencyStore) Done(key string, reply []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = &idempotencyEntry{
+		reply:    reply,
+		done:     true,
+		expireAt: time.Now().Unix() + m.ttl,
+	}
+}
+
+func (m *memoryIdempotencyStore) Release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+}
+
+// Redis排重，多实例部署时共享排重状态，进程重启后依然有效
+type redisIdempotencyStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisIdempotencyStore(client *redis.Client, ttl time.Duration) IdempotencyStore {
+	return &redisIdempotencyStore{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func (r *redisIdempotencyStore) Begin(key string) ([]byte, bool, bool) {
+	ctx := context.Background()
+	key = idempotencyKeyPrefix + key
+
+	ok, err := r.client.SetNX(ctx, key, idempotencyProcessing, r.ttl).Result()
+	if err != nil {
+		// Redis异常时不排重，保证消息可以正常处理
+		return nil, false, true
+	} else if ok {
+		return nil, false, true
+	}
+
+	value, err := r.client.Get(ctx, key).Result()
+	if err != nil || !strings.HasPrefix(value, idempotencyDone) {
+		return nil, false, false
+	}
+
+	return []byte(strings.TrimPrefix(value, idempotencyDone)), true, false
+}
+
+func (r *redisIdempotencyStore) Done(key string, reply []byte) {
+	r.client.Set(context.Background(), idempotencyKeyPrefix+key, idempotencyDone+string(reply), r.ttl)
+}
+
+func (r *redisIdempotencyStore) Release(key string) {
+	r.client.Del(context.Background(), idempotencyKeyPrefix+key)
+}
+
+// 记录Handler写入的回包，用于缓存
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newResponseRecorder(wr http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriter: wr,
+		statusCode:     http.StatusOK,
+	}
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
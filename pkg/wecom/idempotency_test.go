@@ -0,0 +1,61 @@
+package wecom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        func(store *memoryIdempotencyStore)
+		wantReply string
+		wantDone  bool
+		wantOk    bool
+	}{
+		{"processing", func(store *memoryIdempotencyStore) {}, "", false, false},
+		{"done", func(store *memoryIdempotencyStore) { store.Done("msg-1", []byte("reply")) }, "reply", true, false},
+		{"released", func(store *memoryIdempotencyStore) { store.Release("msg-1") }, "", false, true},
+		{"expired", func(store *memoryIdempotencyStore) { store.entries["msg-1"].expireAt = time.Now().Unix() - 1 }, "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryIdempotencyStore(time.Minute).(*memoryIdempotencyStore)
+			if _, _, ok := store.Begin("msg-1"); !ok {
+				t.Fatal("first Begin should succeed")
+			}
+
+			tt.op(store)
+
+			reply, done, ok := store.Begin("msg-1")
+			if string(reply) != tt.wantReply || done != tt.wantDone || ok != tt.wantOk {
+				t.Fatalf("Begin = (%q, %v, %v), want (%q, %v, %v)", reply, done, ok, tt.wantReply, tt.wantDone, tt.wantOk)
+			}
+
+			// 其他消息不受影响
+			if _, _, ok := store.Begin("msg-2"); !ok {
+				t.Fatal("Begin other key should succeed")
+			}
+		})
+	}
+}
+
+func TestMessageFingerprintKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint messageFingerprint
+		want        string
+	}{
+		{"message", messageFingerprint{FromUserName: "alice", CreateTime: 1, MsgType: "text", MsgId: 123}, "msg-123"},
+		{"event", messageFingerprint{FromUserName: "alice", CreateTime: 1, MsgType: "event", Event: "click", EventKey: "menu"}, "event-alice-1-click-menu"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fingerprint.Key(); got != tt.want {
+				t.Fatalf("Key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package wecom
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	MediaCacheTypeDisk  = "disk"
+	MediaCacheTypeRedis = "redis"
+
+	defaultMediaCacheTTL = 3 * 24 * 3600      // 临时素材的有效期为3天
+	defaultMediaMaxSize  = 20 * 1024 * 1024   // 临时素材的最大为20MB
+	mediaCacheKeyPrefix  = "wecom-media-"     // 素材缓存的key前缀
+	mediaCacheDirMode    = os.FileMode(0o755) // 素材缓存目录权限
+	mediaCacheFileMode   = os.FileMode(0o644) // 素材缓存文件权限
+)
+
+// MediaCache 缓存下载的素材，key由接口名和media_id组成，不同接口下载的同一个media_id内容不同
+type MediaCache interface {
+	Get(key string) (*Media, bool)
+	Set(key string, media *Media)
+	Delete(key string)
+}
+
+// 本地磁盘缓存，素材内容和元数据分两个文件存储，按照文件修改时间判断过期
+type diskMediaCache struct {
+	dir string
+	ttl time.Duration
+	mu  sync.Mutex
+}
+
+func NewDiskMediaCache(dir string, ttl time.Duration) MediaCache {
+	if err := os.MkdirAll(dir, mediaCacheDirMode); err != nil {
+		log.Printf("[ERROR]NewDiskMediaCache|MkdirAll failed, dir:%s, err:%s", dir, err)
+	}
+
+	return &diskMediaCache{
+		dir: dir,
+		ttl: ttl,
+	}
+}
+
+// media_id由企业微信生成，这里防御一下路径穿越
+func (d *diskMediaCache) path(key string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(key)
+	return filepath.Join(d.dir, mediaCacheKeyPrefix+name)
+}
+
+func (d *diskMediaCache) Get(key string) (*Media, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := d.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+
+	if time.Since(info.ModTime()) > d.ttl {
+		os.Remove(path)
+		os.Remove(path + ".json")
+		return nil, false
+	}
+
+	meta, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, false
+	}
+
+	var media Media
+	if err := json.Unmarshal(meta, &media); err != nil {
+		log.Printf("[ERROR]diskMediaCache|json Unmarshal failed, key:%s, err:%s", key, err)
+		return nil, false
+	}
+
+	if media.Data, err = os.ReadFile(path); err != nil {
+		return nil, false
+	}
+
+	return &media, true
+}
+
+func (d *diskMediaCache) Set(key string, media *Media) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	meta, err := json.Marshal(media)
+	if err != nil {
+		log.Printf("[ERROR]diskMediaCache|json Marshal failed, mediaId:%s, err:%s", media.MediaId, err)
+		return
+	}
+
+	path := d.path(key)
+	if err := os.WriteFile(path, media.Data, mediaCacheFileMode); err != nil {
+		log.Printf("[ERROR]diskMediaCache|WriteFile failed, path:%s, err:%s", path, err)
+		return
+	}
+
+	if err := os.WriteFile(path+".json", meta, mediaCacheFileMode); err != nil {
+		log.Printf("[ERROR]diskMediaCache|WriteFile failed, path:%s, err:%s", path, err)
+	}
+}
+
+func (d *diskMediaCache) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := d.path(key)
+	os.Remove(path)
+	os.Remove(path + ".json")
+}
+
+// Redis缓存，素材按照hash存储，过期由Redis的Expire保证
+type redisMediaCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisMediaCache(client *redis.Client, ttl time.Duration) MediaCache {
+	return &redisMediaCache{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func (r *redisMediaCache) Get(key string) (*Media, bool) {
+	ctx := context.Background()
+
+	result, err := r.client.HGetAll(ctx, mediaCacheKeyPrefix+key).Result()
+	if err != nil || len(result) == 0 {
+		return nil, false
+	}
+
+	return &Media{
+		MediaId:     result["media_id"],
+		FileName:    result["file_name"],
+		ContentType: result["content_type"],
+		Data:        []byte(result["data"]),
+	}, true
+}
+
+func (r *redisMediaCache) Set(key string, media *Media) {
+	ctx := context.Background()
+	key = mediaCacheKeyPrefix + key
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "media_id", media.MediaId, "file_name", media.FileName, "content_type", media.ContentType, "data", media.Data)
+		pipe.Expire(ctx, key, r.ttl)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR]redisMediaCache|redis HSet failed, mediaId:%s, err:%s", media.MediaId, err)
+	}
+}
+
+func (r *redisMediaCache) Delete(key string) {
+	if err := r.client.Del(context.Background(), mediaCacheKeyPrefix+key).Err(); err != nil {
+		log.Printf("[ERROR]redisMediaCache|redis Del failed, key:%s, err:%s", key, err)
+	}
+}
+
+// 素材缓存的key，普通素材和高清语音素材的media_id可能相同，需要区分接口
+func mediaCacheKey(api, mediaId string) string {
+	return strings.ReplaceAll(api, "/", "_") + "_" + mediaId
+}
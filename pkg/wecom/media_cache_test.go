@@ -0,0 +1,87 @@
+package wecom
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskMediaCache(t *testing.T) {
+	media := &Media{MediaId: "m1", FileName: "a.txt", ContentType: "text/plain", Data: []byte("hello")}
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		key     string
+		op      func(cache MediaCache, key string)
+		wantHit bool
+	}{
+		{"hit", time.Hour, mediaCacheKey("media/get", "m1"), func(cache MediaCache, key string) {}, true},
+		{"miss other api", time.Hour, mediaCacheKey("media/get/jssdk", "m1"), func(cache MediaCache, key string) {}, false},
+		{"deleted", time.Hour, mediaCacheKey("media/get", "m1"), func(cache MediaCache, key string) { cache.Delete(key) }, false},
+		{"expired", time.Nanosecond, mediaCacheKey("media/get", "m1"), func(cache MediaCache, key string) { time.Sleep(time.Millisecond) }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewDiskMediaCache(t.TempDir(), tt.ttl)
+			cache.Set(mediaCacheKey("media/get", "m1"), media)
+
+			tt.op(cache, tt.key)
+
+			got, ok := cache.Get(tt.key)
+			if ok != tt.wantHit {
+				t.Fatalf("hit = %v, want %v", ok, tt.wantHit)
+			}
+
+			if ok && (got.MediaId != media.MediaId || got.FileName != media.FileName || got.ContentType != media.ContentType || !bytes.Equal(got.Data, media.Data)) {
+				t.Fatalf("media = %+v, want %+v", got, media)
+			}
+		})
+	}
+}
+
+// media_id中的路径分隔符不会写到缓存目录之外
+func TestDiskMediaCachePath(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewDiskMediaCache(dir, time.Hour)
+	cache.Set(mediaCacheKey("media/get", "../../escape"), &Media{MediaId: "escape", Data: []byte("x")})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed, err=%s", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("cache dir has %d entries, want 2", len(entries))
+	}
+
+	if _, ok := cache.Get(mediaCacheKey("media/get", "../../escape")); !ok {
+		t.Fatal("cached media not found")
+	}
+}
+
+func TestMediaErrorResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		data        string
+		wantErr     bool
+	}{
+		{"json error", "application/json; charset=UTF-8", `{"errcode":40007,"errmsg":"invalid media_id"}`, true},
+		{"invalid json", "application/json", `not json`, true},
+		{"text error", "text/plain", `{"errcode":40007,"errmsg":"invalid media_id"}`, true},
+		{"text file", "text/plain; charset=utf-8", "meeting notes", false},
+		{"text json file", "text/plain", `{"name":"config"}`, false},
+		{"image", "image/jpeg", `{"errcode":40007}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := mediaErrorResponse(tt.contentType, []byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -8,3 +8,24 @@ type UploadTemporaryMediaMessageRsp struct {
 	MediaId   string      `json:"media_id,omitempty"`
 	CreatedAt string      `json:"created_at,omitempty"`
 }
+
+// 上传图片的回包，得到的图片URL永久有效
+type UploadImageMessageRsp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+	Url     string `json:"url,omitempty"`
+}
+
+// 获取素材失败时的回包，成功时直接返回素材的二进制内容
+type GetMediaMessageRsp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// 下载的素材
+type Media struct {
+	MediaId     string `json:"media_id"`
+	FileName    string `json:"file_name"`    // 文件名，从Content-Disposition中解析，解析失败按media_id和类型生成
+	ContentType string `json:"content_type"` // 素材类型，从Content-Type中解析，解析失败按内容探测
+	Data        []byte `json:"-"`
+}
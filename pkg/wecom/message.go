@@ -18,6 +18,8 @@ const (
 	MessageTypeEvent    MessageType = "event"    // 表示事件消息类型
 	MessageTypeNews     MessageType = "news"     // 表示图文消息类型
 	MessageTypeMarkdown MessageType = "markdown" // 表示Markdown消息类型，目前只限推送消息
+
+	MessageTypeTemplateCard MessageType = "template_card" // 表示模版卡片消息类型，目前只限推送消息
 )
 
 type MessageIF interface {
@@ -37,6 +39,10 @@ func (m *MessageReq) GetMessageType() MessageType {
 	return m.MsgType
 }
 
+func (m *MessageReq) GetFromUserName() string {
+	return m.FromUserName
+}
+
 // 文本请求消息
 type TextMessageReq struct {
 	MessageReq
@@ -88,6 +94,21 @@ type LinktMessageReq struct {
 	MsgId       int64  `xml:"MsgId"`       // 消息id，64位整型
 }
 
+// 事件类型
+const (
+	EventTypeTemplateCard = "template_card_event" // 模版卡片的按钮点击事件
+)
+
+// 事件请求消息
+type EventMessageReq struct {
+	MessageReq
+	Event        string `xml:"Event"`        // 事件类型，如template_card_event
+	EventKey     string `xml:"EventKey"`     // 事件KEY值，模版卡片事件为点击的按钮key
+	TaskId       string `xml:"TaskId"`       // 模版卡片的任务id
+	CardType     string `xml:"CardType"`     // 模版卡片的类型
+	ResponseCode string `xml:"ResponseCode"` // 用于更新卡片的code，24小时内有效，只能使用一次
+}
+
 // -----------------------------------------
 // 企业微信所有被动回复的消息结构
 // -----------------------------------------
@@ -120,7 +141,8 @@ func (m *MessageRsp) GetMessageType() MessageType {
 // 文本回复消息
 type TextMessageRsp struct {
 	MessageRsp
-	Content string `xml:"Content"` // 回复的消息内容（换行：在content中能够换行，微信客户端就支持换行显示）
+	Content     string `xml:"Content"` // 回复的消息内容（换行：在content中能够换行，微信客户端就支持换行显示）
+	Placeholder bool   `xml:"-"`       // 占位回复，最终的回包由业务逻辑自行推送，通过推送接口回复时不再推送
 }
 
 // 图片回复消息
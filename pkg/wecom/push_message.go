@@ -25,6 +25,17 @@ type PushMessageRsp struct {
 	ResponseCode   string `json:"response_code"`
 }
 
+// 撤回应用消息的请求结构
+type RecallMessageReq struct {
+	MsgId string `json:"msgid"` // 推送消息时返回的msgid
+}
+
+// 撤回应用消息的回包结构
+type RecallMessageRsp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
 // 文本消息
 type TextPushMessage struct {
 	PushMessage
@@ -129,3 +140,63 @@ type MiniProgramNoticePushMessage struct {
 		} `json:"content_item"`
 	} `json:"miniprogram_notice"`
 }
+
+// 模版卡片消息
+type TemplateCardPushMessage struct {
+	PushMessage
+	TemplateCard *TemplateCard `json:"template_card"`
+}
+
+// 更新模版卡片按钮的请求，用户点击按钮后将按钮替换为不可点击的状态
+type UpdateTemplateCardButtonReq struct {
+	UserIds      []string `json:"userids,omitempty"` // 需要更新卡片的成员，为空时更新所有收到卡片的成员
+	AgentId      int      `json:"agentid"`
+	ResponseCode string   `json:"response_code"` // 按钮点击事件中的ResponseCode
+	Button       struct {
+		ReplaceName string `json:"replace_name"` // 替换按钮的文案
+	} `json:"button"`
+}
+
+// 模版卡片消息的卡片结构，应用消息和群机器人消息通用
+// https://developer.work.weixin.qq.com/document/path/90236#%E6%A8%A1%E6%9D%BF%E5%8D%A1%E7%89%87%E6%B6%88%E6%81%AF
+type TemplateCard struct {
+	CardType string `json:"card_type"` // 模版卡片的类型，文本通知型为text_notice，按钮交互型为button_interaction
+	Source   *struct {
+		IconUrl string `json:"icon_url,omitempty"` // 来源图片的url
+		Desc    string `json:"desc,omitempty"`     // 来源图片的描述
+	} `json:"source,omitempty"` // 卡片来源样式信息
+	MainTitle struct {
+		Title string `json:"title,omitempty"` // 一级标题，建议不超过36个字
+		Desc  string `json:"desc,omitempty"`  // 标题辅助信息，建议不超过44个字
+	} `json:"main_title"` // 模版卡片的主要内容，包括一级标题和标题辅助信息
+	SubTitleText          string                          `json:"sub_title_text,omitempty"`          // 二级普通文本，建议不超过160个字
+	HorizontalContentList []TemplateCardHorizontalContent `json:"horizontal_content_list,omitempty"` // 二级标题+文本列表，列表长度不超过6
+	JumpList              []TemplateCardJump              `json:"jump_list,omitempty"`               // 跳转指引样式的列表，列表长度不超过3
+	CardAction            *TemplateCardAction             `json:"card_action,omitempty"`             // 整体卡片的点击跳转事件，text_notice必填
+	TaskId                string                          `json:"task_id,omitempty"`                 // 任务id，同一个应用任务id不能重复，只能由数字、字母和"_-@"组成，最长128字节，button_interaction必填
+	ButtonList            []TemplateCardButton            `json:"button_list,omitempty"`             // 按钮列表，列表长度不超过6，button_interaction必填
+}
+
+type TemplateCardHorizontalContent struct {
+	KeyName string `json:"keyname"`         // 二级标题，建议不超过5个字
+	Value   string `json:"value,omitempty"` // 二级文本，建议不超过30个字
+	Type    int    `json:"type,omitempty"`  // 链接类型，0或不填代表不是链接，1代表跳转url
+	Url     string `json:"url,omitempty"`   // 链接跳转的url，type是1时必填
+}
+
+type TemplateCardJump struct {
+	Type  int    `json:"type,omitempty"` // 跳转链接类型，0或不填代表不是链接，1代表跳转url
+	Title string `json:"title"`          // 跳转链接样式的文案内容，建议不超过18个字
+	Url   string `json:"url,omitempty"`  // 跳转链接的url，type是1时必填
+}
+
+type TemplateCardAction struct {
+	Type int    `json:"type"`          // 跳转事件类型，1代表跳转url
+	Url  string `json:"url,omitempty"` // 跳转事件的url，type是1时必填
+}
+
+type TemplateCardButton struct {
+	Text  string `json:"text"`            // 按钮文案，建议不超过10个字
+	Style int    `json:"style,omitempty"` // 按钮样式，目前可填1~4，不填或错填默认1
+	Key   string `json:"key"`             // 按钮key值，用户点击后，会产生回调事件将本参数作为EventKey返回，最长支持1024字节，不可重复
+}
@@ -0,0 +1,23 @@
+// 日程的接口，需要应用有日程的使用权限
+// https://developer.work.weixin.qq.com/document/path/93648
+
+package wecom
+
+import "log"
+
+// AddSchedule 创建日程，返回日程id，组织者和参与者会收到日程通知
+func (w *WeCom) AddSchedule(schedule *Schedule) (string, error) {
+	req := &ScheduleAddReq{
+		Schedule: schedule,
+		AgentId:  w.agentID,
+	}
+
+	var rsp ScheduleAddRsp
+	if err := w.callAPI("oa/schedule/add", nil, req, &rsp); err != nil {
+		return "", err
+	}
+
+	log.Printf("[INFO]AddSchedule|add schedule success, scheduleId:%s, organizer:%s", rsp.ScheduleId, schedule.Organizer)
+
+	return rsp.ScheduleId, nil
+}
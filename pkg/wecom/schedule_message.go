@@ -0,0 +1,37 @@
+package wecom
+
+// 日程的参与者
+type ScheduleAttendee struct {
+	UserId string `json:"userid"`
+}
+
+// 日程的提醒
+type ScheduleReminders struct {
+	IsRemind              int `json:"is_remind"`                          // 是否提醒，0否，1是
+	RemindBeforeEventSecs int `json:"remind_before_event_secs,omitempty"` // 开始前多久提醒，单位秒，支持0、300、900、3600、86400等
+}
+
+// 日程
+type Schedule struct {
+	Organizer   string             `json:"organizer"`              // 组织者的userid
+	StartTime   int64              `json:"start_time"`             // 开始时间，unix时间戳
+	EndTime     int64              `json:"end_time"`               // 结束时间，unix时间戳
+	IsWholeDay  int                `json:"is_whole_day,omitempty"` // 是否全天日程，0否，1是
+	Attendees   []ScheduleAttendee `json:"attendees,omitempty"`    // 参与者，不包含组织者
+	Summary     string             `json:"summary,omitempty"`      // 日程标题，最多128个字符
+	Description string             `json:"description,omitempty"`  // 日程描述，最多1000个字符
+	Location    string             `json:"location,omitempty"`     // 日程地址，最多128个字符
+	Reminders   *ScheduleReminders `json:"reminders,omitempty"`
+}
+
+// 创建日程的请求
+type ScheduleAddReq struct {
+	Schedule *Schedule `json:"schedule"`
+	AgentId  int       `json:"agentid,omitempty"` // 授权访问的应用id，不填时日程不关联应用
+}
+
+// 创建日程的回包
+type ScheduleAddRsp struct {
+	CommonRsp
+	ScheduleId string `json:"schedule_id"`
+}
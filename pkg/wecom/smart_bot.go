@@ -0,0 +1,273 @@
+// 智能机器人的回调，消息为加密的JSON格式，使用流式消息回复
+// 企业微信收到流式回复后，会携带流式消息id不断回调拉取最新的内容，直到回复finish为true
+// https://developer.work.weixin.qq.com/document/path/100719
+
+package wecom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	smartBotStreamTTL = 10 * 60 // 流式消息的有效时长，超时后不再返回内容，单位秒
+)
+
+// 处理智能机器人收到的文本消息，返回当前的回复内容，finish为true表示回复已经完成
+type SmartBotMessageHandler func(userID, chatID, content string) (reply string, finish bool, err error)
+
+// 拉取流式消息的最新内容，finish为true表示回复已经完成
+type SmartBotStreamHandler func(userID, chatID string) (content string, finish bool)
+
+type SmartBot struct {
+	cryptoHelper *WXBizMsgCrypt
+
+	msgHandler    SmartBotMessageHandler
+	streamHandler SmartBotStreamHandler
+
+	streams   map[string]*smartBotStream // 流式消息id -> 流式消息
+	msgStream map[string]string          // 消息id -> 流式消息id，企业微信重试时返回同一个流式消息
+	lastSweep int64
+	mu        sync.Mutex
+}
+
+type smartBotStream struct {
+	id       string
+	msgId    string
+	userID   string
+	chatID   string
+	expireAt int64
+}
+
+// NewSmartBot 返回一个新的智能机器人实例，智能机器人的ReceiveId为空
+func NewSmartBot(config *SmartBotConfig) *SmartBot {
+	return &SmartBot{
+		cryptoHelper: NewWXBizMsgCrypt(config.Token, config.EncodingAESKey, "", JsonType),
+		streams:      make(map[string]*smartBotStream),
+		msgStream:    make(map[string]string),
+	}
+}
+
+// RegisterHandler 注册文本消息和流式消息的处理器
+func (b *SmartBot) RegisterHandler(msgHandler SmartBotMessageHandler, streamHandler SmartBotStreamHandler) {
+	b.msgHandler = msgHandler
+	b.streamHandler = streamHandler
+}
+
+// ServeHTTP 实现http.Handler接口
+func (b *SmartBot) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	log.Printf("[DEBUG]SmartBot|recv request URL:%s, Method:%s", req.URL, req.Method)
+
+	query := req.URL.Query()
+	signature := query.Get("msg_signature")
+	timestamp := query.Get("timestamp")
+	nonce := query.Get("nonce")
+
+	if req.Method == http.MethodGet {
+		// 处理企业微信的验证请求, 返回echostr
+		msg, cryptoErr := b.cryptoHelper.VerifyURL(signature, timestamp, nonce, query.Get("echostr"))
+		if cryptoErr != nil {
+			fmt.Fprint(wr, cryptoErr.ErrMsg)
+		} else {
+			fmt.Fprint(wr, string(msg))
+		}
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(wr, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf("[ERROR]SmartBot|Failed to read request Body:%s", err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msgBody, cryptoErr := b.cryptoHelper.DecryptMsg(signature, timestamp, nonce, body)
+	if cryptoErr != nil {
+		log.Printf("[ERROR]SmartBot|DecryptMsg failed:%s", cryptoErr.ErrMsg)
+		http.Error(wr, cryptoErr.ErrMsg, http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[DEBUG]SmartBot|recv msg:%s", msgBody)
+
+	msg := &SmartBotMessageReq{}
+	if err := json.Unmarshal(msgBody, msg); err != nil {
+		log.Printf("[ERROR]SmartBot|json Unmarshal failed:%s", err)
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var stream *smartBotStream
+	var content string
+	var finish bool
+
+	switch msg.MsgType {
+	case MessageTypeText:
+		stream, content, finish = b.handleTextMessage(msg)
+	case MessageTypeStream:
+		stream, content, finish = b.handleStreamMessage(msg)
+	default:
+		// 其他消息类型暂不处理，返回空包
+		log.Printf("[WARN]SmartBot|unsupported msgtype:%s", msg.MsgType)
+		return
+	}
+
+	if stream == nil {
+		return
+	}
+
+	if finish {
+		b.removeStream(stream)
+	}
+
+	b.reply(wr, stream.id, content, finish)
+}
+
+// handleTextMessage 处理文本消息，创建新的流式消息
+func (b *SmartBot) handleTextMessage(msg *SmartBotMessageReq) (*smartBotStream, string, bool) {
+	// 企业微信重试时返回已经创建的流式消息
+	if stream := b.getStreamByMsgId(msg.MsgId); stream != nil {
+		return b.refreshStream(stream)
+	}
+
+	if b.msgHandler == nil {
+		return nil, "", true
+	}
+
+	stream := b.newStream(msg)
+
+	content, finish, err := b.msgHandler(stream.userID, stream.chatID, msg.Text.Content)
+	if err != nil {
+		log.Printf("[ERROR]SmartBot|handle text message failed, userID:%s, err:%s", stream.userID, err)
+		return stream, err.Error(), true
+	}
+
+	return stream, content, finish
+}
+
+// handleStreamMessage 处理流式消息的刷新，返回最新的内容
+func (b *SmartBot) handleStreamMessage(msg *SmartBotMessageReq) (*smartBotStream, string, bool) {
+	b.mu.Lock()
+	stream, ok := b.streams[msg.Stream.Id]
+	b.mu.Unlock()
+
+	if !ok {
+		// 流式消息已经结束或者过期，直接结束
+		log.Printf("[WARN]SmartBot|stream not found, streamId:%s", msg.Stream.Id)
+		return &smartBotStream{id: msg.Stream.Id}, "", true
+	}
+
+	return b.refreshStream(stream)
+}
+
+func (b *SmartBot) refreshStream(stream *smartBotStream) (*smartBotStream, string, bool) {
+	if b.streamHandler == nil {
+		return stream, "", true
+	}
+
+	if stream.expireAt < time.Now().Unix() {
+		return stream, "回复超时，请重新提问", true
+	}
+
+	content, finish := b.streamHandler(stream.userID, stream.chatID)
+	return stream, content, finish
+}
+
+// reply 加密回复流式消息
+func (b *SmartBot) reply(wr http.ResponseWriter, streamId, content string, finish bool) {
+	rsp := &SmartBotStreamRsp{MsgType: MessageTypeStream}
+	rsp.Stream.Id = streamId
+	rsp.Stream.Finish = finish
+	rsp.Stream.Content = content
+
+	rspBytes, err := json.Marshal(rsp)
+	if err != nil {
+		log.Printf("[ERROR]SmartBot|json Marshal failed:%s", err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	encryptMsg, cryptErr := b.cryptoHelper.EncryptMsg(string(rspBytes), timestamp, b.cryptoHelper.randString(16))
+	if cryptErr != nil {
+		log.Printf("[ERROR]SmartBot|EncryptMsg failed:%s", cryptErr.ErrMsg)
+		http.Error(wr, cryptErr.ErrMsg, http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Write(encryptMsg)
+}
+
+func (b *SmartBot) newStream(msg *SmartBotMessageReq) *smartBotStream {
+	stream := &smartBotStream{
+		id:       b.cryptoHelper.randString(16),
+		msgId:    msg.MsgId,
+		userID:   msg.From.UserId,
+		expireAt: time.Now().Unix() + smartBotStreamTTL,
+	}
+
+	// 群聊使用群聊的上下文
+	if msg.ChatType == SmartBotChatTypeGroup {
+		stream.chatID = msg.ChatId
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sweep()
+
+	b.streams[stream.id] = stream
+	if stream.msgId != "" {
+		b.msgStream[stream.msgId] = stream.id
+	}
+
+	return stream
+}
+
+func (b *SmartBot) getStreamByMsgId(msgId string) *smartBotStream {
+	if msgId == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.streams[b.msgStream[msgId]]
+}
+
+func (b *SmartBot) removeStream(stream *smartBotStream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.streams, stream.id)
+	delete(b.msgStream, stream.msgId)
+}
+
+// 定期清理过期的流式消息，调用方需要持有锁
+func (b *SmartBot) sweep() {
+	now := time.Now().Unix()
+	if now-b.lastSweep < smartBotStreamTTL {
+		return
+	}
+
+	for id, stream := range b.streams {
+		if stream.expireAt < now {
+			delete(b.streams, id)
+			delete(b.msgStream, stream.msgId)
+		}
+	}
+
+	b.lastSweep = now
+}
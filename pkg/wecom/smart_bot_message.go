@@ -0,0 +1,44 @@
+package wecom
+
+// 智能机器人的配置
+type SmartBotConfig struct {
+	Token          string `json:"token"`            // 接收消息的Token
+	EncodingAESKey string `json:"encoding_aes_key"` // 接收消息的EncodingAESKey
+	Enable         bool   `json:"enable"`
+}
+
+const (
+	SmartBotChatTypeSingle = "single" // 单聊
+	SmartBotChatTypeGroup  = "group"  // 群聊
+
+	MessageTypeStream MessageType = "stream" // 表示智能机器人的流式消息类型
+)
+
+// 智能机器人回调的请求消息，解密后为JSON格式
+// https://developer.work.weixin.qq.com/document/path/100719
+type SmartBotMessageReq struct {
+	MsgId    string `json:"msgid"`    // 消息id，用于排重
+	AiBotId  string `json:"aibotid"`  // 智能机器人id
+	ChatId   string `json:"chatid"`   // 群聊id，单聊时为空
+	ChatType string `json:"chattype"` // 会话类型，single或者group
+	From     struct {
+		UserId string `json:"userid"` // 发送者的userid
+	} `json:"from"`
+	MsgType MessageType `json:"msgtype"` // 消息类型，text或者stream
+	Text    struct {
+		Content string `json:"content"` // 文本消息内容，群聊中包含@机器人的内容
+	} `json:"text"`
+	Stream struct {
+		Id string `json:"id"` // 流式消息的id，企业微信拉取流式消息的最新内容时携带
+	} `json:"stream"`
+}
+
+// 智能机器人的流式回复消息，加密前为JSON格式
+type SmartBotStreamRsp struct {
+	MsgType MessageType `json:"msgtype"`
+	Stream  struct {
+		Id      string `json:"id"`      // 流式消息的id，由回复方生成
+		Finish  bool   `json:"finish"`  // 是否结束，结束后企业微信不再拉取
+		Content string `json:"content"` // 当前完整的回复内容，支持Markdown
+	} `json:"stream"`
+}
@@ -0,0 +1,44 @@
+// 模版卡片的推送和更新
+// https://developer.work.weixin.qq.com/document/path/94888
+
+package wecom
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// 推送模版卡片消息的pusher，按钮交互型的卡片点击后会回调template_card_event事件
+func (w *WeCom) PushTemplateCardMessage(userID string, card *TemplateCard) (string, error) {
+	pushMsg := &TemplateCardPushMessage{
+		PushMessage: PushMessage{
+			ToUser:  userID,
+			MsgType: MessageTypeTemplateCard,
+			AgentID: w.agentID,
+		},
+		TemplateCard: card,
+	}
+
+	msgBytes, err := json.Marshal(pushMsg)
+	if err != nil {
+		log.Printf("[ERROR]PushTemplateCardMessage|json Marshal failed, err:%s", err)
+		return "", err
+	}
+
+	log.Printf("[DEBUG]|PushTemplateCardMessage|ready to push message :%s", string(msgBytes))
+
+	return w.pushMessage(msgBytes)
+}
+
+// UpdateTemplateCardButton 将用户点击过的卡片按钮替换为不可点击的状态，responseCode只能使用一次
+func (w *WeCom) UpdateTemplateCardButton(userID, responseCode, replaceName string) error {
+	req := &UpdateTemplateCardButtonReq{
+		UserIds:      []string{userID},
+		AgentId:      w.agentID,
+		ResponseCode: responseCode,
+	}
+	req.Button.ReplaceName = replaceName
+
+	var rsp CommonRsp
+	return w.callAPI("message/update_template_card", nil, req, &rsp)
+}
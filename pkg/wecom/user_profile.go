@@ -0,0 +1,299 @@
+package wecom
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProfileTTL = 3600 // 用户资料缓存的有效时长，单位秒
+	orgRetryInterval  = 60   // 部门、标签和成员列表刷新失败后重试的间隔，单位秒
+)
+
+// 用户资料，由通讯录的成员、部门和标签信息组合而成
+type UserProfile struct {
+	UserId         string
+	Name           string
+	Position       string
+	DepartmentIds  []int
+	Departments    []string // 部门名称，和DepartmentIds一一对应
+	MainDepartment int
+	TagIds         []int
+	Tags           []string // 标签名称，和TagIds一一对应
+
+	expireAt int64
+}
+
+// 标签的成员和部门
+type tagMembers struct {
+	name    string
+	users   []string
+	parties []int
+}
+
+// 用户资料的缓存，部门和标签整体缓存，按照相同的时效刷新
+type userProfileStore struct {
+	w   *WeCom
+	ttl int64
+
+	profiles       map[string]*UserProfile
+	departments    map[int]string
+	parents        map[int]int // 部门的上级部门id，用于标签按照部门匹配时包含子部门
+	tags           map[int]*tagMembers
+	users          []SimpleUser // 可见范围内的所有成员，用于按照姓名搜索
+	orgExpireAt    int64        // 部门、标签和成员列表缓存的过期时间
+	profileSweepAt int64
+	mu             sync.Mutex
+}
+
+func newUserProfileStore(w *WeCom, ttl time.Duration) *userProfileStore {
+	return &userProfileStore{
+		w:        w,
+		ttl:      int64(ttl / time.Second),
+		profiles: make(map[string]*UserProfile),
+	}
+}
+
+// GetUserProfile 获取用户资料，优先从缓存读取
+func (w *WeCom) GetUserProfile(userID string) (*UserProfile, error) {
+	return w.profileStore.get(userID)
+}
+
+func (s *userProfileStore) get(userID string) (*UserProfile, error) {
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	if profile, exist := s.profiles[userID]; exist && profile.expireAt >= now {
+		s.mu.Unlock()
+		return profile, nil
+	}
+	s.mu.Unlock()
+
+	user, err := s.w.GetUser(userID)
+	if err != nil {
+		log.Printf("[ERROR]userProfileStore|GetUser failed, userID:%s, err:%s", userID, err)
+		return nil, err
+	}
+
+	s.refreshOrg(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	profile := &UserProfile{
+		UserId:         user.UserId,
+		Name:           user.Name,
+		Position:       user.Position,
+		DepartmentIds:  user.Department,
+		MainDepartment: user.MainDepartment,
+		expireAt:       now + s.ttl,
+	}
+
+	for _, id := range user.Department {
+		profile.Departments = append(profile.Departments, s.departments[id])
+	}
+
+	// 标签的部门包含其子部门的成员
+	departments := s.ancestors(user.Department)
+	for id, tag := range s.tags {
+		if slices.Contains(tag.users, userID) || slices.ContainsFunc(tag.parties, func(party int) bool {
+			return slices.Contains(departments, party)
+		}) {
+			profile.TagIds = append(profile.TagIds, id)
+			profile.Tags = append(profile.Tags, tag.name)
+		}
+	}
+
+	// 定期清理过期的用户资料
+	if now-s.profileSweepAt >= s.ttl {
+		for id, p := range s.profiles {
+			if p.expireAt < now {
+				delete(s.profiles, id)
+			}
+		}
+		s.profileSweepAt = now
+	}
+
+	s.profiles[userID] = profile
+
+	return profile, nil
+}
+
+func (s *userProfileStore) forget(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.profiles, userID)
+}
+
+// SearchUsers 按照姓名或者userid搜索可见范围内的成员，姓名支持模糊匹配，最多返回limit个
+func (w *WeCom) SearchUsers(keyword string, limit int) ([]SimpleUser, error) {
+	return w.profileStore.search(keyword, limit)
+}
+
+func (s *userProfileStore) search(keyword string, limit int) ([]SimpleUser, error) {
+	keyword = strings.TrimSpace(keyword)
+	if keyword == "" {
+		return nil, nil
+	}
+
+	s.refreshOrg(time.Now().Unix())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return nil, errors.New("user list is unavailable")
+	}
+
+	// userid精确匹配的排在前面
+	matched := []SimpleUser{}
+	for _, user := range s.users {
+		if strings.EqualFold(user.UserId, keyword) {
+			matched = append([]SimpleUser{user}, matched...)
+		} else if strings.Contains(user.Name, keyword) {
+			matched = append(matched, user)
+		}
+	}
+
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+
+	return matched, nil
+}
+
+// ancestors 返回部门及其所有上级部门的id，调用方需要持有mu
+func (s *userProfileStore) ancestors(ids []int) []int {
+	result := []int{}
+	for _, id := range ids {
+		// 限制层级，避免部门数据异常时出现环
+		for depth := 0; depth < 32 && !slices.Contains(result, id); depth++ {
+			result = append(result, id)
+
+			parent, exist := s.parents[id]
+			if !exist || parent == 0 {
+				break
+			}
+			id = parent
+		}
+	}
+
+	return result
+}
+
+// refreshOrg 刷新部门、标签和成员列表的缓存，失败时保留旧的缓存，并在orgRetryInterval后重试
+func (s *userProfileStore) refreshOrg(now int64) {
+	s.mu.Lock()
+	if s.orgExpireAt >= now {
+		s.mu.Unlock()
+		return
+	}
+	// 先更新过期时间，避免并发重复拉取，全部拉取成功后再延长到ttl
+	s.orgExpireAt = now + orgRetryInterval
+	s.mu.Unlock()
+
+	failed := false
+
+	departments := make(map[int]string)
+	parents := make(map[int]int)
+	var users []SimpleUser
+	if list, err := s.w.ListDepartments(0); err != nil {
+		log.Printf("[WARN]userProfileStore|ListDepartments failed, err:%s", err)
+		departments, parents = nil, nil
+		failed = true
+	} else {
+		for _, department := range list {
+			departments[department.Id] = department.Name
+			parents[department.Id] = department.ParentId
+		}
+
+		users = s.listUsers(list, departments)
+		if users == nil {
+			failed = true
+		}
+	}
+
+	tags := make(map[int]*tagMembers)
+	var failedTags []int // 获取成员失败的标签，保留旧的缓存
+	if list, err := s.w.ListTags(); err != nil {
+		log.Printf("[WARN]userProfileStore|ListTags failed, err:%s", err)
+		tags = nil
+		failed = true
+	} else {
+		for _, tag := range list {
+			rsp, err := s.w.GetTag(tag.TagId)
+			if err != nil {
+				log.Printf("[WARN]userProfileStore|GetTag failed, tagId:%d, err:%s", tag.TagId, err)
+				failedTags = append(failedTags, tag.TagId)
+				failed = true
+				continue
+			}
+
+			members := &tagMembers{
+				name:    tag.TagName,
+				parties: rsp.PartyList,
+			}
+			for _, user := range rsp.UserList {
+				members.users = append(members.users, user.UserId)
+			}
+
+			tags[tag.TagId] = members
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if departments != nil {
+		s.departments = departments
+		s.parents = parents
+	}
+	if users != nil {
+		s.users = users
+	}
+	if tags != nil {
+		for _, id := range failedTags {
+			if old, exist := s.tags[id]; exist {
+				tags[id] = old
+			}
+		}
+		s.tags = tags
+	}
+
+	if !failed {
+		s.orgExpireAt = now + s.ttl
+	}
+}
+
+// listUsers 递归获取可见范围内顶层部门的成员，按照userid去重，失败时返回nil
+func (s *userProfileStore) listUsers(list []Department, departments map[int]string) []SimpleUser {
+	users := []SimpleUser{}
+	seen := make(map[string]bool)
+
+	for _, department := range list {
+		// 上级部门不可见的部门为顶层部门
+		if _, exist := departments[department.ParentId]; exist {
+			continue
+		}
+
+		members, err := s.w.ListDepartmentUsers(department.Id, true)
+		if err != nil {
+			log.Printf("[WARN]userProfileStore|ListDepartmentUsers failed, departmentId:%d, err:%s", department.Id, err)
+			return nil
+		}
+
+		for _, member := range members {
+			if !seen[member.UserId] {
+				seen[member.UserId] = true
+				users = append(users, member)
+			}
+		}
+	}
+
+	return users
+}
@@ -0,0 +1,230 @@
+// 群机器人的消息推送，不需要access token，每个机器人发送的消息不能超过20条/分钟
+// https://developer.work.weixin.qq.com/document/path/91770
+
+package wecom
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	webhookTextMaxBytes     = 2048 // 文本消息内容的最大字节数
+	webhookMarkdownMaxBytes = 4096 // Markdown消息内容的最大字节数
+	webhookMaxSplitMessages = 5    // 超长内容最多拆分的消息数，群机器人每分钟最多发送20条消息
+	webhookTruncatedHint    = "\n……内容过长已截断"
+)
+
+// 群机器人，消息推送到机器人所在的群，消息没有msgid不支持撤回，不能用于单聊回复
+type WebhookBot struct {
+	key string
+}
+
+// NewWebhookBot 返回一个新的群机器人实例
+func NewWebhookBot(config *WebhookBotConfig) *WebhookBot {
+	return &WebhookBot{
+		key: config.Key,
+	}
+}
+
+// post 发送群机器人的请求
+func (b *WebhookBot) post(api string, query url.Values, contentType string, body []byte, rsp commonRspIF) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("key", b.key)
+	apiURL := apiBaseURL + api + "?" + query.Encode()
+
+	res, err := http.Post(apiURL, contentType, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[ERROR]WebhookBot|http Post failed, api:%s, err:%s", api, err)
+		return err
+	}
+	defer res.Body.Close()
+
+	rspBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("[ERROR]WebhookBot|ReadAll failed, api:%s, err:%s", api, err)
+		return err
+	}
+
+	if err := json.Unmarshal(rspBody, rsp); err != nil {
+		log.Printf("[ERROR]WebhookBot|json Unmarshal failed, api:%s, err:%s", api, err)
+		return err
+	}
+
+	if commonRsp := rsp.getCommonRsp(); commonRsp.ErrCode != 0 {
+		err := fmt.Errorf("WebhookBot|%s return error, errcode: %d, errmsg: %s", api, commonRsp.ErrCode, commonRsp.ErrMsg)
+		log.Printf("[ERROR]|:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+// pushMessage 推送群机器人消息
+func (b *WebhookBot) pushMessage(pushMsg interface{}) error {
+	msgBytes, err := json.Marshal(pushMsg)
+	if err != nil {
+		log.Printf("[ERROR]WebhookBot|json Marshal failed, err:%s", err)
+		return err
+	}
+
+	log.Printf("[DEBUG]WebhookBot|ready to push message :%s", string(msgBytes))
+
+	var rsp CommonRsp
+	return b.post("webhook/send", nil, "application/json", msgBytes, &rsp)
+}
+
+// 推送文本消息，和WeCom.PushTextMessage的签名一致，userID不为空时在群中@该成员
+// 超过2048字节时拆分为多条消息，只在第一条@成员，群机器人消息没有msgid，不支持撤回
+func (b *WebhookBot) PushTextMessage(userID, content string) (string, error) {
+	for i, part := range splitWebhookContent(content, webhookTextMaxBytes) {
+		pushMsg := &WebhookTextMessage{
+			WebhookMessage: WebhookMessage{MsgType: MessageTypeText},
+		}
+		pushMsg.Text.Content = part
+		if userID != "" && i == 0 {
+			pushMsg.Text.MentionedList = []string{userID}
+		}
+
+		if err := b.pushMessage(pushMsg); err != nil {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// 推送Markdown消息，Markdown消息不支持@成员，userID不为空时在内容中<@userid>提醒，超过4096字节时拆分为多条消息
+func (b *WebhookBot) PushMarkdownMessage(userID, content string) (string, error) {
+	if userID != "" {
+		content = fmt.Sprintf("<@%s>\n%s", userID, content)
+	}
+
+	for _, part := range splitWebhookContent(content, webhookMarkdownMaxBytes) {
+		pushMsg := &WebhookMarkdownMessage{
+			WebhookMessage: WebhookMessage{MsgType: MessageTypeMarkdown},
+		}
+		pushMsg.Markdown.Content = part
+
+		if err := b.pushMessage(pushMsg); err != nil {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// splitWebhookContent 按照字节数拆分内容，优先在换行处拆分，不会拆开utf8字符，超过webhookMaxSplitMessages条时截断
+func splitWebhookContent(content string, maxBytes int) []string {
+	var parts []string
+	for len(content) > maxBytes {
+		if len(parts) == webhookMaxSplitMessages-1 {
+			cut := utf8Boundary(content, maxBytes-len(webhookTruncatedHint))
+			log.Printf("[WARN]WebhookBot|content too long, truncated, dropped:%d bytes", len(content)-cut)
+			return append(parts, content[:cut]+webhookTruncatedHint)
+		}
+
+		cut := utf8Boundary(content, maxBytes)
+		if i := strings.LastIndexByte(content[:cut], '\n'); i > 0 {
+			cut = i + 1
+		}
+
+		parts = append(parts, content[:cut])
+		content = content[cut:]
+	}
+
+	return append(parts, content)
+}
+
+// utf8Boundary 返回不超过maxBytes的最大的utf8字符边界
+func utf8Boundary(content string, maxBytes int) int {
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+
+	return cut
+}
+
+// 推送图片消息，图片最大不能超过2M，支持JPG,PNG格式
+func (b *WebhookBot) PushImageMessage(imageData []byte) error {
+	sum := md5.Sum(imageData)
+
+	pushMsg := &WebhookImageMessage{
+		WebhookMessage: WebhookMessage{MsgType: MessageTypeImage},
+	}
+	pushMsg.Image.Base64 = base64.StdEncoding.EncodeToString(imageData)
+	pushMsg.Image.Md5 = hex.EncodeToString(sum[:])
+
+	return b.pushMessage(pushMsg)
+}
+
+// 推送图文消息
+func (b *WebhookBot) PushNewsMessage(articles []WebhookNewsArticle) error {
+	pushMsg := &WebhookNewsMessage{
+		WebhookMessage: WebhookMessage{MsgType: MessageTypeNews},
+	}
+	pushMsg.News.Articles = articles
+
+	return b.pushMessage(pushMsg)
+}
+
+// 推送文件消息的pusher，和WeCom.PushFileMessage的签名一致，群机器人文件消息不支持@成员
+func (b *WebhookBot) PushFileMessage(userID, mediaId string) (string, error) {
+	pushMsg := &WebhookFileMessage{
+		WebhookMessage: WebhookMessage{MsgType: MessageTypeFile},
+	}
+	pushMsg.File.MediaId = mediaId
+
+	return "", b.pushMessage(pushMsg)
+}
+
+// 推送模版卡片消息
+func (b *WebhookBot) PushTemplateCardMessage(card *TemplateCard) error {
+	pushMsg := &WebhookTemplateCardMessage{
+		WebhookMessage: WebhookMessage{MsgType: MessageTypeTemplateCard},
+		TemplateCard:   card,
+	}
+
+	return b.pushMessage(pushMsg)
+}
+
+// 上传文件，支持普通文件（file）和语音（voice），得到的media_id仅三天内有效，且只能对应上传文件的机器人可以使用
+func (b *WebhookBot) UploadMedia(mediaType MessageType, mediaName string, mediaData []byte) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("media", mediaName)
+	if err != nil {
+		log.Printf("[ERROR]WebhookBot|CreateFormFile failed, err=%s", err)
+		return "", err
+	}
+
+	if _, err = part.Write(mediaData); err != nil {
+		log.Printf("[ERROR]WebhookBot|Write failed, err=%s", err)
+		return "", err
+	}
+
+	writer.Close()
+
+	var rsp WebhookUploadMediaRsp
+	query := url.Values{"type": {string(mediaType)}}
+	if err := b.post("webhook/upload_media", query, writer.FormDataContentType(), body.Bytes(), &rsp); err != nil {
+		return "", err
+	}
+
+	return rsp.MediaId, nil
+}
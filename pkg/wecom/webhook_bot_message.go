@@ -0,0 +1,78 @@
+package wecom
+
+// 群机器人的配置
+type WebhookBotConfig struct {
+	Key     string `json:"key"` // webhook地址中的key
+	Enable  bool   `json:"enable"`
+	Publish bool   `json:"publish"` // 聊天回复推送到群机器人所在的群，代替应用消息，群机器人消息没有msgid，回复不支持撤回
+}
+
+// 群机器人消息的基本结构
+type WebhookMessage struct {
+	MsgType MessageType `json:"msgtype"`
+}
+
+// 群机器人文本消息
+type WebhookTextMessage struct {
+	WebhookMessage
+	Text struct {
+		Content             string   `json:"content"`                         // 文本内容，最长不超过2048个字节，必须是utf8编码
+		MentionedList       []string `json:"mentioned_list,omitempty"`        // userid的列表，提醒群中的指定成员(@某个成员)，@all表示提醒所有人
+		MentionedMobileList []string `json:"mentioned_mobile_list,omitempty"` // 手机号列表，提醒手机号对应的群成员(@某个成员)，@all表示提醒所有人
+	} `json:"text"`
+}
+
+// 群机器人Markdown消息
+type WebhookMarkdownMessage struct {
+	WebhookMessage
+	Markdown struct {
+		Content string `json:"content"` // markdown内容，最长不超过4096个字节，必须是utf8编码
+	} `json:"markdown"`
+}
+
+// 群机器人图片消息
+type WebhookImageMessage struct {
+	WebhookMessage
+	Image struct {
+		Base64 string `json:"base64"` // 图片内容的base64编码，图片（base64编码前）最大不能超过2M，支持JPG,PNG格式
+		Md5    string `json:"md5"`    // 图片内容（base64编码前）的md5值
+	} `json:"image"`
+}
+
+// 群机器人图文消息的文章
+type WebhookNewsArticle struct {
+	Title       string `json:"title"`                 // 标题，不超过128个字节，超过会自动截断
+	Description string `json:"description,omitempty"` // 描述，不超过512个字节，超过会自动截断
+	Url         string `json:"url"`                   // 点击后跳转的链接
+	PicUrl      string `json:"picurl,omitempty"`      // 图文消息的图片链接，支持JPG、PNG格式，较好的效果为大图 1068*455，小图150*150
+}
+
+// 群机器人图文消息
+type WebhookNewsMessage struct {
+	WebhookMessage
+	News struct {
+		Articles []WebhookNewsArticle `json:"articles"` // 图文消息，一个图文消息支持1到8条图文
+	} `json:"news"`
+}
+
+// 群机器人文件消息
+type WebhookFileMessage struct {
+	WebhookMessage
+	File struct {
+		MediaId string `json:"media_id"` // 文件id，通过webhook/upload_media接口上传获得
+	} `json:"file"`
+}
+
+// 群机器人模版卡片消息
+type WebhookTemplateCardMessage struct {
+	WebhookMessage
+	TemplateCard *TemplateCard `json:"template_card"`
+}
+
+// 群机器人上传文件的回包
+type WebhookUploadMediaRsp struct {
+	CommonRsp
+	Type      MessageType `json:"type,omitempty"`
+	MediaId   string      `json:"media_id,omitempty"`
+	CreatedAt string      `json:"created_at,omitempty"`
+}
@@ -0,0 +1,51 @@
+package wecom
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitWebhookContent(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		maxBytes  int
+		wantParts int
+		truncated bool
+	}{
+		{"short", "hello", webhookTextMaxBytes, 1, false},
+		{"exact", strings.Repeat("a", webhookTextMaxBytes), webhookTextMaxBytes, 1, false},
+		{"utf8", strings.Repeat("中", 700), webhookTextMaxBytes, 2, false},
+		{"lines", strings.Repeat("第一行内容\n", 300), webhookTextMaxBytes, 3, false},
+		{"markdown", strings.Repeat("中", 2000), webhookMarkdownMaxBytes, 2, false},
+		{"truncated", strings.Repeat("中文abc\n", 2000), webhookTextMaxBytes, webhookMaxSplitMessages, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitWebhookContent(tt.content, tt.maxBytes)
+			if len(parts) != tt.wantParts {
+				t.Fatalf("got %d parts, want %d", len(parts), tt.wantParts)
+			}
+
+			for i, part := range parts {
+				if len(part) > tt.maxBytes {
+					t.Errorf("part %d has %d bytes, max %d", i, len(part), tt.maxBytes)
+				}
+				if !utf8.ValidString(part) {
+					t.Errorf("part %d is not valid utf8", i)
+				}
+			}
+
+			last := parts[len(parts)-1]
+			if got := strings.HasSuffix(last, webhookTruncatedHint); got != tt.truncated {
+				t.Fatalf("truncated hint = %v, want %v", got, tt.truncated)
+			}
+
+			if !tt.truncated && strings.Join(parts, "") != tt.content {
+				t.Fatal("joined parts differ from content")
+			}
+		})
+	}
+}
@@ -9,13 +9,26 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	neturl "net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	ReplyModeSync   = "sync"   // 同步被动回复，默认模式
+	ReplyModeAsync  = "async"  // 立即回复空包，通过推送接口回复
+	ReplyModeHybrid = "hybrid" // 超时前处理完成则被动回复，否则通过推送接口回复
+
+	PassiveReplyTimeout = 5 * time.Second // 企业微信被动回复的超时时间，超时后会重试
+	hybridReplyMargin   = time.Second     // hybrid模式预留的网络耗时
+)
+
 type WeCom struct {
 	corpID              string
 	agentID             int
@@ -26,13 +39,20 @@ type WeCom struct {
 	msgHandlerMap      map[MessageType]MessageHandler      // 注册各个消息类型对应的逻辑处理Handler
 	logicMsgHandlerMap map[MessageType]LogicMessageHandler // 注册各个消息类型对应的业务逻辑处理Handler
 
-	concurrencyMsgMap map[int64]struct{} // 按照MsgId防并发
-	mu                sync.Mutex
+	idempotencyStore IdempotencyStore // 按照MsgId或者事件指纹排重，缓存企业微信重试时的回包
+	replyMode        string           // 回复模式，参考ReplyModeSync等定义
 
 	accessToken      string
 	tokenExpiredTime int64
+	tokenFetcher     func() (string, int64, error) // 获取access token和有效时长，单位秒
+	tokenMu          sync.Mutex                    // 推送队列、异步回包和通讯录刷新会并发获取access token
 
 	cryptoHelper *WXBizMsgCrypt // 消息加解密工具类
+
+	mediaCache   MediaCache // 下载素材的缓存
+	mediaMaxSize int64      // 下载素材的最大字节数
+
+	profileStore *userProfileStore // 通讯录用户资料的缓存
 }
 
 type MessageHandler func(wr http.ResponseWriter, req *http.Request, body []byte, msg MessageIF)
@@ -50,16 +70,40 @@ func NewWeCom(config *AgentConfig) *WeCom {
 
 		msgHandlerMap:      make(map[MessageType]MessageHandler),
 		logicMsgHandlerMap: make(map[MessageType]LogicMessageHandler),
-		concurrencyMsgMap:  make(map[int64]struct{}),
+		idempotencyStore:   NewMemoryIdempotencyStore(config.GetDedupTTL()),
+		replyMode:          config.ReplyMode,
 	}
 
+	w.tokenFetcher = w.fetchAccessToken
+
 	w.cryptoHelper = NewWXBizMsgCrypt(config.AgentToken, config.AgentEncodingAESKey, config.CorpID, XmlType)
 
+	w.mediaMaxSize = config.Media.MaxSize
+	if w.mediaMaxSize <= 0 {
+		w.mediaMaxSize = defaultMediaMaxSize
+	}
+
+	if config.Media.CacheType == MediaCacheTypeDisk {
+		w.mediaCache = NewDiskMediaCache(config.Media.CacheDir, config.Media.GetCacheTTL())
+	}
+
+	w.profileStore = newUserProfileStore(w, config.GetProfileTTL())
+
 	w.registerMsgHandler()
 
 	return w
 }
 
+// SetMediaCache 设置下载素材的缓存，Redis缓存需要外部创建好客户端后设置
+func (w *WeCom) SetMediaCache(cache MediaCache) {
+	w.mediaCache = cache
+}
+
+// SetIdempotencyStore 设置回调消息排重的存储，默认是内存存储，Redis存储需要外部创建好客户端后设置
+func (w *WeCom) SetIdempotencyStore(store IdempotencyStore) {
+	w.idempotencyStore = store
+}
+
 func (w *WeCom) RegisterLogicMsgHandler(msgType MessageType, handler LogicMessageHandler) {
 	w.logicMsgHandlerMap[msgType] = handler
 }
@@ -134,56 +178,69 @@ func (w *WeCom) handleMessageRequest(wr http.ResponseWriter, req *http.Request,
 	log.Printf("[DEBUG]handleMessageRequest|Unmarshal message:%v", msg)
 
 	// 处理不同类型的消息
-
-	if handler, ok := w.msgHandlerMap[MessageType(msg.MsgType)]; !ok {
+	handler, ok := w.msgHandlerMap[MessageType(msg.MsgType)]
+	if !ok {
 		http.Error(wr, "Unsupported message type", http.StatusBadRequest)
 		return
-	} else {
-		handler(wr, req, msgBody, &msg)
-		return
 	}
-}
 
-// handleTextMessage 处理文本消息
-func (w *WeCom) handleTextMessage(wr http.ResponseWriter, req *http.Request, body []byte, msg MessageIF) {
-	// 解析文本消息
-	var textMsg TextMessageReq
-	err := xml.Unmarshal(body, &textMsg)
-	if err != nil {
-		http.Error(wr, "Failed to parse text message", http.StatusBadRequest)
+	// 按照MsgId或者事件指纹排重，企业微信超时重试时直接返回缓存的回包
+	var fingerprint messageFingerprint
+	xml.Unmarshal(msgBody, &fingerprint)
+	key := fingerprint.Key()
+
+	if !w.beginMessage(wr, key) {
 		return
 	}
 
-	log.Printf("[DEBUG]handleTextMessage|Unmarshal message:%v", textMsg)
+	recorder := newResponseRecorder(wr)
+	handler(recorder, req, msgBody, &msg)
 
-	// 并发检测，封装在一个闭包中，保证异常锁可以正常释放
-	concurrency_check_lmd := func() bool {
-		w.mu.Lock()
-		defer w.mu.Unlock()
+	if recorder.statusCode == http.StatusOK {
+		w.idempotencyStore.Done(key, recorder.body.Bytes())
+	} else {
+		w.idempotencyStore.Release(key)
+	}
+}
 
-		if _, exist := w.concurrencyMsgMap[textMsg.MsgId]; exist {
-			err := fmt.Sprintf("message is processing now, please wait a moment, MsgId=%d, FromUserName=%s", textMsg.MsgId, textMsg.FromUserName)
-			log.Printf("[ERROR][handleTextMessage]%s", err)
+// beginMessage 消息排重，返回false表示消息重复
+// 重复的消息如果首次请求已经处理完成，直接返回缓存的回包，如果还在处理中，等待处理完成
+// 等待超时后返回空包，企业微信收到空包后不会再重试，最终的回复通过异步推送
+func (w *WeCom) beginMessage(wr http.ResponseWriter, key string) bool {
+	deadline := time.Now().Add(idempotencyWaitTimeout)
 
-			http.Error(wr, err, http.StatusInternalServerError)
+	for {
+		reply, done, ok := w.idempotencyStore.Begin(key)
+		if ok {
+			return true
+		}
+
+		if done {
+			log.Printf("[INFO]beginMessage|duplicate message, reply with cache, key=%s", key)
+			wr.Write(reply)
 			return false
 		}
 
-		w.concurrencyMsgMap[textMsg.MsgId] = struct{}{}
-		return true
+		if time.Now().After(deadline) {
+			log.Printf("[WARN]beginMessage|duplicate message is processing now, reply empty, key=%s", key)
+			return false
+		}
+
+		time.Sleep(idempotencyWaitInterval)
 	}
+}
 
-	// 并发则返回
-	if !concurrency_check_lmd() {
+// handleTextMessage 处理文本消息
+func (w *WeCom) handleTextMessage(wr http.ResponseWriter, req *http.Request, body []byte, msg MessageIF) {
+	// 解析文本消息
+	var textMsg TextMessageReq
+	err := xml.Unmarshal(body, &textMsg)
+	if err != nil {
+		http.Error(wr, "Failed to parse text message", http.StatusBadRequest)
 		return
 	}
 
-	// 保证处理完释放并发控制
-	defer func() {
-		w.mu.Lock()
-		defer w.mu.Unlock()
-		delete(w.concurrencyMsgMap, textMsg.MsgId)
-	}()
+	log.Printf("[DEBUG]handleTextMessage|Unmarshal message:%v", textMsg)
 
 	// 调用处理器处理消息
 	handler, ok := w.logicMsgHandlerMap[MessageTypeText]
@@ -192,20 +249,86 @@ func (w *WeCom) handleTextMessage(wr http.ResponseWriter, req *http.Request, bod
 		return
 	}
 
-	//response, err := handler((*Message)(unsafe.Pointer(&textMsg)))
-	responseIF, err := handler(&textMsg)
+	w.dispatchLogicMessage(wr, &textMsg.MessageReq, func() (MessageIF, error) {
+		return handler(&textMsg)
+	})
+}
+
+// 业务逻辑的处理结果
+type logicResult struct {
+	rsp MessageIF
+	err error
+}
+
+// dispatchLogicMessage 按照回复模式调用业务逻辑处理消息
+// sync: 同步处理，被动回复处理结果
+// async: 立即回复空包，异步处理后通过推送接口发送处理结果，业务逻辑自行推送最终回包的占位回复不推送
+// hybrid: 在企业微信的超时时间内处理完成则被动回复，否则回复空包，处理完成后通过推送接口发送
+func (w *WeCom) dispatchLogicMessage(wr http.ResponseWriter, reqMsg *MessageReq, handle func() (MessageIF, error)) {
+	switch w.replyMode {
+	case ReplyModeAsync:
+		go func() {
+			rsp, err := handle()
+			w.pushLogicResponse(reqMsg.FromUserName, rsp, err)
+		}()
+
+	case ReplyModeHybrid:
+		resultChan := make(chan logicResult, 1)
+		go func() {
+			rsp, err := handle()
+			resultChan <- logicResult{rsp: rsp, err: err}
+		}()
+
+		select {
+		case result := <-resultChan:
+			w.replyLogicResponse(wr, reqMsg, result.rsp, result.err)
+		case <-time.After(PassiveReplyTimeout - hybridReplyMargin):
+			log.Printf("[INFO]dispatchLogicMessage|passive reply timeout, reply by push, FromUserName:%s", reqMsg.FromUserName)
+			go func() {
+				result := <-resultChan
+				w.pushLogicResponse(reqMsg.FromUserName, result.rsp, result.err)
+			}()
+		}
+
+	default:
+		rsp, err := handle()
+		w.replyLogicResponse(wr, reqMsg, rsp, err)
+	}
+}
+
+// replyLogicResponse 被动回复业务逻辑的处理结果
+func (w *WeCom) replyLogicResponse(wr http.ResponseWriter, reqMsg *MessageReq, responseIF MessageIF, err error) {
 	if err != nil {
-		http.Error(wr, "Failed to handle text message", http.StatusInternalServerError)
+		http.Error(wr, "Failed to handle message", http.StatusInternalServerError)
+		return
+	}
+
+	var response *MessageRsp
+	switch rsp := responseIF.(type) {
+	case *TextMessageRsp:
+		// 没有需要回复的内容，回复空包
+		if rsp.Content == "" {
+			return
+		}
+		response = &rsp.MessageRsp
+		response.MsgType = MessageTypeText
+	case *ImageMessageRsp:
+		response = &rsp.MessageRsp
+		response.MsgType = MessageTypeImage
+	case *VoiceMessageRsp:
+		response = &rsp.MessageRsp
+		response.MsgType = MessageTypeVoice
+	default:
+		log.Printf("[ERROR]replyLogicResponse|unsupported response:%v", responseIF)
+		http.Error(wr, "Unsupported response message type", http.StatusInternalServerError)
 		return
 	}
-	response, _ := responseIF.(*TextMessageRsp)
 
 	// 返回响应消息
-	response.ToUserName = textMsg.FromUserName
-	response.FromUserName = textMsg.ToUserName
+	response.ToUserName = reqMsg.FromUserName
+	response.FromUserName = reqMsg.ToUserName
 	response.CreateTime = time.Now().Unix()
-	response.MsgType = MessageTypeText
-	xmlResponse, err := xml.Marshal(response)
+	xmlResponse, err := xml.Marshal(responseIF)
 	if err != nil {
 		err = fmt.Errorf("Failed to marshal XML response:%s", err)
 		log.Printf("[ERROR]%s", err)
@@ -217,20 +340,88 @@ func (w *WeCom) handleTextMessage(wr http.ResponseWriter, req *http.Request, bod
 	// 构建加密消息体
 	encryptMsg, cryptErr := w.cryptoHelper.EncryptMsg(string(xmlResponse), strconv.Itoa(int(response.CreateTime)), w.cryptoHelper.randString(16))
 	if cryptErr != nil {
-		log.Printf("[ERROR]handleTextMessage|EncryptMsg failed%s", cryptErr.ErrMsg)
+		log.Printf("[ERROR]replyLogicResponse|EncryptMsg failed%s", cryptErr.ErrMsg)
 		http.Error(wr, cryptErr.ErrMsg, http.StatusInternalServerError)
+		return
 	}
 
-	log.Printf("[DEBUG]handleTextMessage|reponse:%s", encryptMsg)
+	log.Printf("[DEBUG]replyLogicResponse|reponse:%s", encryptMsg)
 	fmt.Fprintf(wr, string(encryptMsg))
 }
 
+// pushLogicResponse 通过推送接口发送业务逻辑的处理结果
+func (w *WeCom) pushLogicResponse(userID string, responseIF MessageIF, err error) {
+	if err != nil {
+		log.Printf("[ERROR]pushLogicResponse|handle message failed, userID:%s, err:%s", userID, err)
+		return
+	}
+
+	if err := w.pushResponse(userID, responseIF); err != nil {
+		log.Printf("[ERROR]pushLogicResponse|push response failed, userID:%s, err:%s", userID, err)
+	}
+}
+
+// pushResponse 按照回包的类型推送，占位回复和空回复不推送
+func (w *WeCom) pushResponse(userID string, responseIF MessageIF) error {
+	var err error
+
+	switch rsp := responseIF.(type) {
+	case *TextMessageRsp:
+		if rsp.Content == "" || rsp.Placeholder {
+			return nil
+		}
+		_, err = w.PushTextMessage(userID, rsp.Content)
+	case *ImageMessageRsp:
+		_, err = w.PushImageMessage(userID, rsp.Image.MediaId)
+	case *VoiceMessageRsp:
+		_, err = w.PushVoiceMessage(userID, rsp.Voice.MediaId)
+	default:
+		err = fmt.Errorf("unsupported response type %T", responseIF)
+	}
+
+	return err
+}
+
+// handleImageMessage 处理图片消息，没有注册图片处理器时回复空包
 func (w *WeCom) handleImageMessage(wr http.ResponseWriter, req *http.Request, body []byte, msg MessageIF) {
-	// 处理图片消息
+	var imageMsg ImageMessageReq
+	err := xml.Unmarshal(body, &imageMsg)
+	if err != nil {
+		http.Error(wr, "Failed to parse image message", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[DEBUG]handleImageMessage|Unmarshal message:%v", imageMsg)
+
+	handler, ok := w.logicMsgHandlerMap[MessageTypeImage]
+	if !ok {
+		return
+	}
+
+	w.dispatchLogicMessage(wr, &imageMsg.MessageReq, func() (MessageIF, error) {
+		return handler(&imageMsg)
+	})
 }
 
+// handleVoiceMessage 处理语音消息，没有注册语音处理器时回复空包
 func (w *WeCom) handleVoiceMessage(wr http.ResponseWriter, req *http.Request, body []byte, msg MessageIF) {
-	// 处理语音消息
+	var voiceMsg VoiceMessageReq
+	err := xml.Unmarshal(body, &voiceMsg)
+	if err != nil {
+		http.Error(wr, "Failed to parse voice message", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[DEBUG]handleVoiceMessage|Unmarshal message:%v", voiceMsg)
+
+	handler, ok := w.logicMsgHandlerMap[MessageTypeVoice]
+	if !ok {
+		return
+	}
+
+	w.dispatchLogicMessage(wr, &voiceMsg.MessageReq, func() (MessageIF, error) {
+		return handler(&voiceMsg)
+	})
 }
 
 func (w *WeCom) handleVideoMessage(wr http.ResponseWriter, req *http.Request, body []byte, msg MessageIF) {
@@ -249,12 +440,50 @@ func (w *WeCom) handleLinkMessage(wr http.ResponseWriter, req *http.Request, bod
 	// 处理链接消息
 }
 
+// handleEventMessage 处理事件消息，没有注册事件处理器时回复空包
 func (w *WeCom) handleEventMessage(wr http.ResponseWriter, req *http.Request, body []byte, msg MessageIF) {
-	// 处理事件消息
+	var eventMsg EventMessageReq
+	err := xml.Unmarshal(body, &eventMsg)
+	if err != nil {
+		http.Error(wr, "Failed to parse event message", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[DEBUG]handleEventMessage|Unmarshal message:%v", eventMsg)
+
+	handler, ok := w.logicMsgHandlerMap[MessageTypeEvent]
+	if !ok {
+		return
+	}
+
+	w.dispatchLogicMessage(wr, &eventMsg.MessageReq, func() (MessageIF, error) {
+		return handler(&eventMsg)
+	})
 }
 
-// 获取Access Token信息
+// 获取Access Token信息，过期时重新获取，获取期间并发的调用等待同一次获取的结果
 func (w *WeCom) getAccessToken() string {
+	w.tokenMu.Lock()
+	defer w.tokenMu.Unlock()
+
+	if w.tokenExpiredTime > time.Now().Unix() {
+		return w.accessToken
+	}
+
+	accessToken, expiresIn, err := w.tokenFetcher()
+	if err != nil {
+		log.Printf("[ERROR]getAccessToken|fetch access token failed, err:%s", err)
+		return ""
+	}
+
+	w.accessToken = accessToken
+	w.tokenExpiredTime = time.Now().Unix() + expiresIn
+
+	return w.accessToken
+}
+
+// 调用gettoken接口获取access token
+func (w *WeCom) fetchAccessToken() (string, int64, error) {
 	type AccessToken struct {
 		AccessToken string `json:"access_token"`
 		ExpiresIn   int64  `json:"expires_in"`
@@ -262,26 +491,20 @@ func (w *WeCom) getAccessToken() string {
 		ErrMsg      string `json:"errmsg,omitempty"`
 	}
 
-	if w.tokenExpiredTime > time.Now().Unix() {
-		return w.accessToken
-	}
-
 	// 请求获取 access token 的 API 地址及参数
 	url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=%s&corpsecret=%s", w.corpID, w.agentSecret)
 
 	// 发送 GET 请求获取 access token
 	res, err := http.Get(url)
 	if err != nil {
-		log.Printf("[ERROR]getAccessToken|http Get failed, err:%s", err)
-		return ""
+		return "", 0, err
 	}
 	defer res.Body.Close()
 
 	// 读取返回结果中的信息
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("[ERROR]getAccessToken|ReadAll failed, err:%s", err)
-		return ""
+		return "", 0, err
 	}
 
 	log.Printf("[INFO]getAccessToken|res Body:%s", body)
@@ -289,29 +512,24 @@ func (w *WeCom) getAccessToken() string {
 	// 将返回结果中的 JSON 数据解析到 AccessToken 结构体中
 	var accessToken AccessToken
 	if err := json.Unmarshal(body, &accessToken); err != nil {
-		log.Printf("[ERROR]getAccessToken|json Unmarshal failed, err:%s", err)
-		return ""
+		return "", 0, err
 	}
 
 	// 判断是否获取 access token 成功
 	if accessToken.ErrCode != 0 {
-		log.Printf("[ERROR]getAccessToken|Failed to get access token, errcode: %d, errmsg: %s", accessToken.ErrCode, accessToken.ErrMsg)
-		return ""
+		return "", 0, fmt.Errorf("errcode: %d, errmsg: %s", accessToken.ErrCode, accessToken.ErrMsg)
 	}
 
-	w.accessToken = accessToken.AccessToken
-	w.tokenExpiredTime = time.Now().Unix() + accessToken.ExpiresIn
-
-	return w.accessToken
+	return accessToken.AccessToken, accessToken.ExpiresIn, nil
 }
 
-// pushMessage 推送应用消息
-func (w *WeCom) pushMessage(msgBytes []byte) error {
+// pushMessage 推送应用消息，返回消息的msgid，可用于撤回消息
+func (w *WeCom) pushMessage(msgBytes []byte) (string, error) {
 	accessToken := w.getAccessToken()
 	if accessToken == "" {
 		err := errors.New("access token is invalid")
 		log.Printf("[ERROR]pushMessage|getAccessToken failed, err:%s", err)
-		return err
+		return "", err
 	}
 
 	// 消息发送接口的 API 地址
@@ -321,7 +539,7 @@ func (w *WeCom) pushMessage(msgBytes []byte) error {
 	res, err := http.Post(url, "application/json", bytes.NewReader(msgBytes))
 	if err != nil {
 		log.Printf("[ERROR]pushMessage|http Post failed, err:%s", err)
-		return err
+		return "", err
 	}
 	defer res.Body.Close()
 
@@ -329,28 +547,28 @@ func (w *WeCom) pushMessage(msgBytes []byte) error {
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		log.Printf("[ERROR]pushMessage|ReadAll failed, err:%s", err)
-		return err
+		return "", err
 	}
 
 	// 解析返回结果中的 JSON 数据
 	var msgRsp PushMessageRsp
 	if err := json.Unmarshal(body, &msgRsp); err != nil {
 		log.Printf("[ERROR]pushMessage|json Unmarshal failed, err:%s", err)
-		return err
+		return "", err
 	}
 
 	// 判断是否推送消息成功
 	if msgRsp.ErrCode != 0 {
 		err := fmt.Errorf("pushMessage|return error, errcode: %d, errmsg: %s", msgRsp.ErrCode, msgRsp.ErrMsg)
 		log.Printf("[ERROR]|:%s", err)
-		return err
+		return "", err
 	}
 
-	return nil
+	return msgRsp.MsgId, nil
 }
 
 // 推送文本消息的pusher，外部可以以方法表达式的方式进行注册和调用
-func (w *WeCom) PushTextMessage(userID, content string) error {
+func (w *WeCom) PushTextMessage(userID, content string) (string, error) {
 	pushMsg := &TextPushMessage{
 		PushMessage: PushMessage{
 			ToUser:  userID,
@@ -368,7 +586,7 @@ func (w *WeCom) PushTextMessage(userID, content string) error {
 	msgBytes, err := json.Marshal(pushMsg)
 	if err != nil {
 		log.Printf("[ERROR]PushTextMessage|json Marshal failed, err:%s", err)
-		return err
+		return "", err
 	}
 
 	log.Printf("[DEBUG]|PushTextMessage|ready to push text message :%s", string(msgBytes))
@@ -377,7 +595,7 @@ func (w *WeCom) PushTextMessage(userID, content string) error {
 }
 
 // 推送Markdown文本消息的pusher，外部可以以方法表达式的方式进行注册和调用
-func (w *WeCom) PushMarkdowntMessage(userID, content string) error {
+func (w *WeCom) PushMarkdowntMessage(userID, content string) (string, error) {
 	pushMsg := &MarkdownPushMessage{
 		PushMessage: PushMessage{
 			ToUser:  userID,
@@ -395,7 +613,7 @@ func (w *WeCom) PushMarkdowntMessage(userID, content string) error {
 	msgBytes, err := json.Marshal(pushMsg)
 	if err != nil {
 		log.Printf("[ERROR]PushMarkdowntMessage|json Marshal failed, err:%s", err)
-		return err
+		return "", err
 	}
 
 	log.Printf("[DEBUG]|PushMarkdowntMessage|ready to push markdown message :%s", string(msgBytes))
@@ -404,7 +622,7 @@ func (w *WeCom) PushMarkdowntMessage(userID, content string) error {
 }
 
 // 推送文件消息的pusher，外部可以以方法表达式的方式进行注册和调用
-func (w *WeCom) PushFileMessage(userID, mediaId string) error {
+func (w *WeCom) PushFileMessage(userID, mediaId string) (string, error) {
 	pushMsg := &FilePushMessage{
 		PushMessage: PushMessage{
 			ToUser:  userID,
@@ -422,7 +640,7 @@ func (w *WeCom) PushFileMessage(userID, mediaId string) error {
 	msgBytes, err := json.Marshal(pushMsg)
 	if err != nil {
 		log.Printf("[ERROR]PushFileMessage|json Marshal failed, err:%s", err)
-		return err
+		return "", err
 	}
 
 	log.Printf("[DEBUG]|PushFileMessage|ready to push message :%s", string(msgBytes))
@@ -430,6 +648,98 @@ func (w *WeCom) PushFileMessage(userID, mediaId string) error {
 	return w.pushMessage(msgBytes)
 }
 
+// 推送图片消息的pusher，mediaId为上传图片临时素材得到的media_id
+func (w *WeCom) PushImageMessage(userID, mediaId string) (string, error) {
+	pushMsg := &ImagePushMessage{
+		PushMessage: PushMessage{
+			ToUser:  userID,
+			MsgType: MessageTypeImage,
+			AgentID: w.agentID,
+		},
+	}
+	pushMsg.Image.MediaId = mediaId
+
+	msgBytes, err := json.Marshal(pushMsg)
+	if err != nil {
+		log.Printf("[ERROR]PushImageMessage|json Marshal failed, err:%s", err)
+		return "", err
+	}
+
+	log.Printf("[DEBUG]|PushImageMessage|ready to push message :%s", string(msgBytes))
+
+	return w.pushMessage(msgBytes)
+}
+
+// 推送语音消息的pusher，mediaId为上传语音临时素材得到的media_id，语音仅支持amr格式
+func (w *WeCom) PushVoiceMessage(userID, mediaId string) (string, error) {
+	pushMsg := &VoicePushMessage{
+		PushMessage: PushMessage{
+			ToUser:  userID,
+			MsgType: MessageTypeVoice,
+			AgentID: w.agentID,
+		},
+	}
+	pushMsg.Voice.MediaId = mediaId
+
+	msgBytes, err := json.Marshal(pushMsg)
+	if err != nil {
+		log.Printf("[ERROR]PushVoiceMessage|json Marshal failed, err:%s", err)
+		return "", err
+	}
+
+	log.Printf("[DEBUG]|PushVoiceMessage|ready to push message :%s", string(msgBytes))
+
+	return w.pushMessage(msgBytes)
+}
+
+// 撤回应用消息，msgId为推送消息时返回的msgid，仅支持撤回24小时内的消息
+func (w *WeCom) RecallMessage(msgId string) error {
+	accessToken := w.getAccessToken()
+	if accessToken == "" {
+		err := errors.New("access token is invalid")
+		log.Printf("[ERROR]RecallMessage|getAccessToken failed, err:%s", err)
+		return err
+	}
+
+	msgBytes, err := json.Marshal(&RecallMessageReq{MsgId: msgId})
+	if err != nil {
+		log.Printf("[ERROR]RecallMessage|json Marshal failed, err:%s", err)
+		return err
+	}
+
+	// 消息撤回接口的 API 地址
+	url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/message/recall?access_token=%s", accessToken)
+
+	res, err := http.Post(url, "application/json", bytes.NewReader(msgBytes))
+	if err != nil {
+		log.Printf("[ERROR]RecallMessage|http Post failed, err:%s", err)
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("[ERROR]RecallMessage|ReadAll failed, err:%s", err)
+		return err
+	}
+
+	var msgRsp RecallMessageRsp
+	if err := json.Unmarshal(body, &msgRsp); err != nil {
+		log.Printf("[ERROR]RecallMessage|json Unmarshal failed, err:%s", err)
+		return err
+	}
+
+	if msgRsp.ErrCode != 0 {
+		err := fmt.Errorf("RecallMessage|return error, errcode: %d, errmsg: %s", msgRsp.ErrCode, msgRsp.ErrMsg)
+		log.Printf("[ERROR]|:%s", err)
+		return err
+	}
+
+	log.Printf("[INFO]RecallMessage|recall message success, msgId:%s", msgId)
+
+	return nil
+}
+
 // 上传临时素材，支持媒体文件类型，分别有图片（image）、语音（voice）、视频（video），普通文件（file）
 // 素材上传得到media_id，该media_id仅三天内有效
 func (w *WeCom) UploadTemporaryMedia(mediaType MessageType, mediaName string, mediaData []byte) (string, error) {
@@ -442,7 +752,7 @@ func (w *WeCom) UploadTemporaryMedia(mediaType MessageType, mediaName string, me
 
 	// 消息发送接口的 API 地址
 	//url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/message/send?access_token=%s", accessToken)
-	url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/upload?access_token=%s&type=%s", accessToken, "file")
+	url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/upload?access_token=%s&type=%s", accessToken, mediaType)
 
 	// 创建一个新的表单数据
 	body := &bytes.Buffer{}
@@ -507,3 +817,185 @@ func (w *WeCom) UploadTemporaryMedia(mediaType MessageType, mediaName string, me
 
 	return msgRsp.MediaId, nil
 }
+
+// 上传图片得到图片URL，该URL永久有效，图片仅支持jpg/png格式，大小2B~2MB
+// 返回的URL可以用于图文消息中的图片链接
+func (w *WeCom) UploadImage(imageName string, imageData []byte) (string, error) {
+	accessToken := w.getAccessToken()
+	if accessToken == "" {
+		err := errors.New("access token is invalid")
+		log.Printf("[ERROR]UploadImage|getAccessToken failed, err:%s", err)
+		return "", err
+	}
+
+	url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/media/uploadimg?access_token=%s", accessToken)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("media", imageName)
+	if err != nil {
+		log.Printf("[ERROR]UploadImage|CreateFormFile failed, err=%s", err)
+		return "", err
+	}
+
+	if _, err = part.Write(imageData); err != nil {
+		log.Printf("[ERROR]UploadImage|Write failed, err=%s", err)
+		return "", err
+	}
+
+	writer.Close()
+
+	res, err := http.Post(url, writer.FormDataContentType(), body)
+	if err != nil {
+		log.Printf("[ERROR]UploadImage|http Post failed, err=%s", err)
+		return "", err
+	}
+	defer res.Body.Close()
+
+	rspBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("[ERROR]UploadImage|ReadAll failed, err:%s", err)
+		return "", err
+	}
+
+	var msgRsp UploadImageMessageRsp
+	if err := json.Unmarshal(rspBody, &msgRsp); err != nil {
+		log.Printf("[ERROR]UploadImage|json Unmarshal failed, err:%s", err)
+		return "", err
+	}
+
+	if msgRsp.ErrCode != 0 {
+		err := fmt.Errorf("UploadImage|return error, errcode: %d, errmsg: %s", msgRsp.ErrCode, msgRsp.ErrMsg)
+		log.Printf("[ERROR]|:%s", err)
+		return "", err
+	}
+
+	return msgRsp.Url, nil
+}
+
+// 获取临时素材，优先从缓存中读取
+func (w *WeCom) GetTemporaryMedia(mediaId string) (*Media, error) {
+	return w.getMedia("media/get", mediaId)
+}
+
+// 获取高清语音素材，可以获取通过JSSDK上传的高清语音，格式为speex，16K采样率
+func (w *WeCom) GetHDVoiceMedia(mediaId string) (*Media, error) {
+	return w.getMedia("media/get/jssdk", mediaId)
+}
+
+// ForgetUser 删除用户资料的缓存和用户发送的素材的缓存，mediaIds为用户发送过的素材
+func (w *WeCom) ForgetUser(userID string, mediaIds []string) {
+	w.profileStore.forget(userID)
+
+	if w.mediaCache == nil {
+		return
+	}
+
+	for _, mediaId := range mediaIds {
+		w.mediaCache.Delete(mediaCacheKey("media/get", mediaId))
+		w.mediaCache.Delete(mediaCacheKey("media/get/jssdk", mediaId))
+	}
+}
+
+func (w *WeCom) getMedia(api string, mediaId string) (*Media, error) {
+	cacheKey := mediaCacheKey(api, mediaId)
+
+	if w.mediaCache != nil {
+		if media, ok := w.mediaCache.Get(cacheKey); ok {
+			log.Printf("[DEBUG]getMedia|hit media cache, api:%s, mediaId:%s", api, mediaId)
+			return media, nil
+		}
+	}
+
+	accessToken := w.getAccessToken()
+	if accessToken == "" {
+		err := errors.New("access token is invalid")
+		log.Printf("[ERROR]getMedia|getAccessToken failed, err:%s", err)
+		return nil, err
+	}
+
+	url := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/%s?access_token=%s&media_id=%s", api, accessToken, neturl.QueryEscape(mediaId))
+
+	res, err := http.Get(url)
+	if err != nil {
+		log.Printf("[ERROR]getMedia|http Get failed, err:%s", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.ContentLength > w.mediaMaxSize {
+		err := fmt.Errorf("getMedia|media too large, mediaId:%s, size:%d, max:%d", mediaId, res.ContentLength, w.mediaMaxSize)
+		log.Printf("[ERROR]%s", err)
+		return nil, err
+	}
+
+	// Content-Length可能不存在，读取时也需要限制大小
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, w.mediaMaxSize+1))
+	if err != nil {
+		log.Printf("[ERROR]getMedia|ReadAll failed, err:%s", err)
+		return nil, err
+	}
+
+	if int64(len(data)) > w.mediaMaxSize {
+		err := fmt.Errorf("getMedia|media too large, mediaId:%s, max:%d", mediaId, w.mediaMaxSize)
+		log.Printf("[ERROR]%s", err)
+		return nil, err
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if err := mediaErrorResponse(contentType, data); err != nil {
+		log.Printf("[ERROR]%s", err)
+		return nil, err
+	}
+
+	media := &Media{
+		MediaId:     mediaId,
+		ContentType: contentType,
+		Data:        data,
+	}
+
+	if media.ContentType == "" || media.ContentType == "application/octet-stream" {
+		media.ContentType = http.DetectContentType(data)
+	}
+
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		media.FileName = filepath.Base(params["filename"])
+	}
+
+	if media.FileName == "" || media.FileName == "." {
+		media.FileName = mediaId
+		if exts, _ := mime.ExtensionsByType(media.ContentType); len(exts) > 0 {
+			media.FileName += exts[0]
+		}
+	}
+
+	log.Printf("[INFO]getMedia|download media success, mediaId:%s, fileName:%s, contentType:%s, size:%d", mediaId, media.FileName, media.ContentType, len(data))
+
+	if w.mediaCache != nil {
+		w.mediaCache.Set(cacheKey, media)
+	}
+
+	return media, nil
+}
+
+// 失败时返回的是JSON格式的错误信息，部分情况下Content-Type为text/plain，
+// 但text/plain也可能是真实的文本文件，只有能解析出非0的errcode时才认为失败
+func mediaErrorResponse(contentType string, data []byte) error {
+	var msgRsp GetMediaMessageRsp
+
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		if err := json.Unmarshal(data, &msgRsp); err != nil {
+			return fmt.Errorf("getMedia|json Unmarshal failed, err:%s", err)
+		}
+	case strings.HasPrefix(contentType, "text/plain"):
+		if err := json.Unmarshal(data, &msgRsp); err != nil || msgRsp.ErrCode == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	return fmt.Errorf("getMedia|return error, errcode: %d, errmsg: %s", msgRsp.ErrCode, msgRsp.ErrMsg)
+}
@@ -0,0 +1,105 @@
+package wecom
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 并发获取access token时只请求一次，过期后重新获取
+func TestGetAccessTokenConcurrent(t *testing.T) {
+	w := &WeCom{}
+
+	var fetches atomic.Int32
+	w.tokenFetcher = func() (string, int64, error) {
+		fetches.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return "token", 7200, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token := w.getAccessToken(); token != "token" {
+				t.Errorf("getAccessToken = %q, want token", token)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want 1", n)
+	}
+
+	w.tokenMu.Lock()
+	w.tokenExpiredTime = time.Now().Unix() - 1
+	w.tokenMu.Unlock()
+
+	w.getAccessToken()
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("fetched %d times after expired, want 2", n)
+	}
+}
+
+// 获取失败时返回空，之后的调用重新获取
+func TestGetAccessTokenFetchFailed(t *testing.T) {
+	w := &WeCom{}
+
+	fail := true
+	w.tokenFetcher = func() (string, int64, error) {
+		if fail {
+			return "", 0, errors.New("fetch failed")
+		}
+		return "token", 7200, nil
+	}
+
+	if token := w.getAccessToken(); token != "" {
+		t.Fatalf("getAccessToken = %q, want empty", token)
+	}
+
+	fail = false
+	if token := w.getAccessToken(); token != "token" {
+		t.Fatalf("getAccessToken = %q, want token", token)
+	}
+}
+
+// 占位回复和空回复不推送，不支持的回包类型返回错误
+func TestPushResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		rsp       MessageIF
+		wantPush  bool
+		wantError bool
+	}{
+		{"placeholder", &TextMessageRsp{Content: "生成中...", Placeholder: true}, false, false},
+		{"empty", &TextMessageRsp{}, false, false},
+		{"text", &TextMessageRsp{Content: "hello"}, true, true},
+		{"image", &ImageMessageRsp{}, true, true},
+		{"voice", &VoiceMessageRsp{}, true, true},
+		{"unsupported", &VideoMessageRsp{}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 获取access token失败时推送失败，用是否获取token判断是否推送
+			var pushed bool
+			w := &WeCom{}
+			w.tokenFetcher = func() (string, int64, error) {
+				pushed = true
+				return "", 0, errors.New("fetch failed")
+			}
+
+			err := w.pushResponse("alice", tt.rsp)
+			if pushed != tt.wantPush {
+				t.Fatalf("pushed = %v, want %v", pushed, tt.wantPush)
+			}
+			if (err != nil) != tt.wantError {
+				t.Fatalf("err = %v, want error %v", err, tt.wantError)
+			}
+		})
+	}
+}